@@ -0,0 +1,171 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Account deletion. delete-account asks for the password again, and a code if
+2FA is on (see totp.go), and for the account's name to confirm. Then every
+session of the account is disconnected, its login tokens, API keys, trusted
+devices and role revoked, what the server keeps for it (scheduled commands,
+reminders to and from it, feeds, webhooks, read markers, login history,
+mutes, and its place as owner, operator or guest on the invite list of
+rooms) dropped, and its files removed. Messages it sent to rooms stay,
+they're part of their conversations. Its direct conversations go, or
+whoever registers the name next would read them.
+
+Accounts live in index paths (see indexPath), so the directories of names
+that start with this one's are inside its directory; those single character
+branches are left alone.
+*/
+
+//
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// removeUserFiles removes the files of the account name and the directories
+// of its index path left empty.
+func removeUserFiles(name string) error {
+	dir := userDir(name)
+	infos, e := ioutil.ReadDir(dir)
+	if e != nil {
+		return e
+	}
+	for _, fi := range infos {
+		if fi.IsDir() && len(fi.Name()) == 1 {
+			continue
+		}
+		if e := os.RemoveAll(dir + SEP + fi.Name()); e != nil {
+			return e
+		}
+	}
+	for d := dir; d != filepath.Clean(*users) && len(d) > len(*users); d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// forgetUser drops what the server keeps for the account name.
+func forgetUser(name string) {
+	revokeSessions(name, "")
+	revokeAPIKeys(name)
+	revokeDevices(name, "")
+	forgetLogins(name)
+	if grantedRole(name) > roleUser {
+		if e := setRole(name, roleUser); e != nil {
+			log.Println(e)
+		}
+	}
+	crons.Lock()
+	for id, j := range crons.list {
+		if strings.EqualFold(j.Owner, name) {
+			sched.cancel("cron:" + id)
+			delete(crons.list, id)
+		}
+	}
+	if e := saveCrons(); e != nil {
+		log.Println(e)
+	}
+	crons.Unlock()
+	reminders.Lock()
+	for id, r := range reminders.list {
+		if strings.EqualFold(r.From, name) || strings.EqualFold(r.To, name) {
+			sched.cancel("remind:" + id)
+			delete(reminders.list, id)
+		}
+	}
+	if e := saveReminders(); e != nil {
+		log.Println(e)
+	}
+	reminders.Unlock()
+	feeds.Lock()
+	for id, f := range feeds.list {
+		if strings.EqualFold(f.Owner, name) {
+			delete(feeds.list, id)
+		}
+	}
+	if e := saveFeeds(); e != nil {
+		log.Println(e)
+	}
+	feeds.Unlock()
+	hooks.Lock()
+	for token, h := range hooks.list {
+		if strings.EqualFold(h.Owner, name) {
+			delete(hooks.list, token)
+		}
+	}
+	if e := saveHooks(); e != nil {
+		log.Println(e)
+	}
+	hooks.Unlock()
+	reads.Lock()
+	delete(reads.list, strings.ToLower(name))
+	if e := saveJSON(reads.list, readsPath()); e != nil {
+		log.Println(e)
+	}
+	reads.Unlock()
+	forgetConversations(name)
+	forgetRoomUser(name)
+	forgetMutes(name)
+}
+
+// deleteAccount deletes the account c is logged in to.
+func deleteAccount(c *client) error {
+	name := c.user.Name
+	kickClients(&ban{Target: name, User: true}, "Your account was deleted")
+	// Nothing may be saved for the account any more.
+	c.user = newGuest()
+	c.sessionID = ""
+	forgetUser(name)
+	if e := removeUserFiles(name); e != nil {
+		log.Println("deleting account", name+":", e)
+		return e
+	}
+	log.Println(c.address, "deleted the account", name)
+	emit("user.deleted", map[string]string{"user": name})
+	return nil
+}
+
+func init() {
+	cmdMap["delete-account"] = command{
+		Desc:     "Deletes your account and everything stored for it, for good.",
+		Usage:    "delete-account",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			pass, e := c.promptSecure("#msg-txt", "Please enter your password")
+			if e != nil {
+				return e
+			}
+			if !c.passwordOK(pass) {
+				securityLoginFailed(c.address, c.user.Name)
+				return c.appendMsg("#msg-list", "Wrong password")
+			}
+			if c.user.TOTP != "" {
+				ok, e := c.checkTOTP(&c.user)
+				if e != nil || !ok {
+					if e == nil {
+						e = c.appendMsg("#msg-list", "Wrong code")
+					}
+					return e
+				}
+			}
+			confirm, e := c.prompt(c.trf("This can't be undone. Type %s to delete your account", c.user.Name))
+			if e != nil {
+				return e
+			}
+			if !strings.EqualFold(strings.TrimSpace(confirm), c.user.Name) {
+				return c.appendMsg("#msg-list", "Account not deleted")
+			}
+			return deleteAccount(c)
+		},
+	}
+}
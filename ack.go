@@ -0,0 +1,120 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Guaranteed delivery for important packets: moderation notices, prompts and
+announcements. sendImportant numbers a packet with a Seq and keeps it until
+the browser acknowledges it with an "ack" packet holding the highest Seq it
+got. The welcome packet gives the browser a resume token; when a connection
+drops, its unacknowledged packets are kept for resumeWait, and a page that
+reconnects with the token in its hello gets them again with the same Seqs, so
+it can skip any it already showed. Clients older than protocol version 3 (see
+caps.go) don't acknowledge and get plain sends.
+*/
+
+//
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	resumeWait = 2 * time.Minute
+	outboxMax  = 100 // unacknowledged packets kept per client
+)
+
+// outbox holds a client's important packets until they're acknowledged.
+type outbox struct {
+	sync.Mutex
+	token   string // resume token, empty until the welcome
+	seq     uint64 // Seq of the last packet numbered
+	unacked []packet
+	expires time.Time // when a parked outbox is dropped
+}
+
+var parked = struct {
+	sync.Mutex
+	m map[string]*outbox // resume token -> outbox of a closed connection
+}{m: make(map[string]*outbox)}
+
+// sendImportant sends p and keeps it until c acknowledges it.
+func (c *client) sendImportant(p packet) error {
+	if c.ws == nil || c.protocol() < 3 {
+		return c.send(p)
+	}
+	c.outbox.Lock()
+	c.outbox.seq++
+	p.Seq = strconv.FormatUint(c.outbox.seq, 10)
+	if len(c.outbox.unacked) == outboxMax {
+		c.outbox.unacked = c.outbox.unacked[1:]
+	}
+	c.outbox.unacked = append(c.outbox.unacked, p)
+	c.outbox.Unlock()
+	return c.send(p.Clone())
+}
+
+// resume gives c the outbox parked under token, or a new token if there is
+// none. It returns c's token and the packets to send again.
+func (c *client) resume(token string) (string, []packet) {
+	parked.Lock()
+	now := time.Now()
+	for t, o := range parked.m {
+		if now.After(o.expires) {
+			delete(parked.m, t)
+		}
+	}
+	o, ok := parked.m[token]
+	delete(parked.m, token)
+	parked.Unlock()
+	c.outbox.Lock()
+	defer c.outbox.Unlock()
+	if !ok {
+		c.outbox.token = randomToken(16)
+		return c.outbox.token, nil
+	}
+	c.outbox.token, c.outbox.seq, c.outbox.unacked = o.token, o.seq, o.unacked
+	resend := make([]packet, len(o.unacked))
+	for i, p := range o.unacked {
+		resend[i] = p.Clone()
+	}
+	return o.token, resend
+}
+
+// parkOutbox keeps c's unacknowledged packets for a reconnect. It is
+// deferred by serveWs.
+func parkOutbox(c *client) {
+	c.outbox.Lock()
+	defer c.outbox.Unlock()
+	if c.outbox.token == "" || len(c.outbox.unacked) == 0 {
+		return
+	}
+	o := &outbox{token: c.outbox.token, seq: c.outbox.seq, unacked: c.outbox.unacked, expires: time.Now().Add(resumeWait)}
+	parked.Lock()
+	parked.m[o.token] = o
+	parked.Unlock()
+}
+
+func init() {
+	packetMap["ack"] = func(c *client, p packet) error {
+		seq, err := strconv.ParseUint(p.Data["Seq"], 10, 64)
+		if err != nil {
+			securitySuspicious(c.address, "malformed ack packet")
+			return nil
+		}
+		c.outbox.Lock()
+		defer c.outbox.Unlock()
+		i := 0
+		for i < len(c.outbox.unacked) {
+			if n, _ := strconv.ParseUint(c.outbox.unacked[i].Seq, 10, 64); n > seq {
+				break
+			}
+			i++
+		}
+		c.outbox.unacked = c.outbox.unacked[i:]
+		return nil
+	}
+}
@@ -0,0 +1,112 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Aliases are shortcuts for commands, e.g. alias ll="list -l". The listener
+replaces an alias typed as the first word of a line with its definition
+before dispatching; the rest of the line is kept. Aliases are saved in the
+account of logged in users and last for the session for guests.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const aliasMax = 50
+
+// expandAlias replaces a leading alias in line with its definition. Aliases
+// aren't expanded recursively.
+func (c *client) expandAlias(line []byte) []byte {
+	if len(c.user.Aliases) == 0 {
+		return line
+	}
+	s := strings.TrimLeft(string(line), " \t")
+	name, rest := s, ""
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		name, rest = s[:i], s[i:]
+	}
+	if def, ok := c.user.Aliases[strings.ToLower(name)]; ok {
+		return []byte(def + rest)
+	}
+	return line
+}
+
+func init() {
+	cmdMap["alias"] = command{
+		Desc:     "Lists your aliases or defines one.",
+		Usage:    `alias [<name>="<command>"]`,
+		Examples: []string{`alias ll="list -l"`, "alias w='weather berlin'"},
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) == 1 {
+				if len(c.user.Aliases) == 0 {
+					return c.appendMsg("#msg-list", "No aliases")
+				}
+				var names []string
+				for name := range c.user.Aliases {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				rows := [][]string{{"Alias", "Command"}}
+				for _, name := range names {
+					rows = append(rows, []string{name, c.user.Aliases[name]})
+				}
+				return c.appendPre("#msg-list", formatTable(rows, true))
+			}
+			def := strings.Join(args[1:], " ")
+			var name, value string
+			if i := strings.Index(def, "="); i >= 0 {
+				name, value = def[:i], def[i+1:]
+			} else if len(args) > 2 {
+				name, value = args[1], strings.Join(args[2:], " ")
+			} else {
+				return c.appendMsg("#msg-list", `Usage: alias <name>="<command>"`)
+			}
+			name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+			switch {
+			case name == "" || !isName(name):
+				return c.appendMsg("#msg-list", "alias: invalid name: "+name)
+			case value == "":
+				return c.appendMsg("#msg-list", "alias: empty command")
+			}
+			if _, exists := lookupCommand(name); exists {
+				return c.appendMsg("#msg-list", "alias: "+name+" is a command")
+			}
+			if _, exists := c.user.Aliases[name]; !exists && len(c.user.Aliases) >= aliasMax {
+				return c.appendMsg("#msg-list", "alias: too many aliases")
+			}
+			if c.user.Aliases == nil {
+				c.user.Aliases = make(map[string]string)
+			}
+			c.user.Aliases[name] = value
+			if e = c.user.commit(); e != nil {
+				return
+			}
+			return c.appendMsg("#msg-list", "alias "+name+"=\""+value+"\"")
+		},
+	}
+	cmdMap["unalias"] = command{
+		Desc:     "Removes an alias.",
+		Usage:    "unalias <name>",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: unalias <name>")
+			}
+			name := strings.ToLower(args[1])
+			if _, exists := c.user.Aliases[name]; !exists {
+				return c.appendMsg("#msg-list", "unalias: no such alias: "+name)
+			}
+			delete(c.user.Aliases, name)
+			if e = c.user.commit(); e != nil {
+				return
+			}
+			return c.appendMsg("#msg-list", "Alias "+name+" removed")
+		},
+	}
+}
@@ -0,0 +1,216 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The api system is a small JSON REST API so scripts can post and read messages
+without speaking the websocket protocol. Requests authenticate with HTTP basic
+auth using a registered account, or with an API key of the account as a bearer
+token (see apikey.go); keys only get to use the endpoints their scopes allow.
+
+	GET  /api/me
+	POST /api/rooms/{room}/messages   {"text": "..."}
+	GET  /api/rooms/{room}/messages?before=<id>&limit=<n>
+	POST /api/users/{name}/messages   {"text": "..."}
+	GET  /api/users/{name}/messages?before=<id>&limit=<n>
+	GET|POST /api/graphql (see graphql.go)
+*/
+
+//
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var apiLimit = newRateLimiter(60, time.Minute)
+
+// apiHandler is an API endpoint called with the authenticated user.
+type apiHandler func(w http.ResponseWriter, r *http.Request, u *user)
+
+// apiError writes a JSON error response.
+func apiError(w http.ResponseWriter, status int, msg string) {
+	apiJSON(w, status, map[string]string{"error": msg})
+}
+
+// apiJSON writes v as a JSON response.
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiAuth wraps an API endpoint with authentication and rate limiting. API
+// keys need the scope read to GET it and write for other methods; an empty
+// scope lets any key in.
+func apiAuth(read, write string, h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			apiError(w, 403, "https required")
+			return
+		}
+		if isBanned(r.RemoteAddr) {
+			apiError(w, 403, "address banned")
+			return
+		}
+		if token := bearerToken(r); token != "" {
+			k, u, e := openAPIKey(token, r.RemoteAddr)
+			if e != nil {
+				securitySuspicious(r.RemoteAddr, "bad API key for "+r.URL.Path)
+				apiError(w, 401, e.Error())
+				return
+			}
+			scope := write
+			if r.Method == "GET" || r.Method == "HEAD" {
+				scope = read
+			}
+			switch {
+			case userBanned(u.Name):
+				apiError(w, 403, "account banned")
+			case scope != "" && !k.allows(scope):
+				apiError(w, 403, "API key lacks the "+scope+" scope")
+			case !apiLimit.allow(strings.ToLower(u.Name)):
+				apiError(w, 429, "too many requests")
+			default:
+				h(w, r, u)
+			}
+			return
+		}
+		name, pass, ok := r.BasicAuth()
+		if !ok || !userExists(name) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="soshell"`)
+			apiError(w, 401, "authentication required")
+			return
+		}
+		if userBanned(name) {
+			apiError(w, 403, "account banned")
+			return
+		}
+		if !apiLimit.allow(strings.ToLower(name)) {
+			apiError(w, 429, "too many requests")
+			return
+		}
+		var u user
+		if u.load(name, pass) != nil {
+			securityLoginFailed(r.RemoteAddr, name)
+			w.Header().Set("WWW-Authenticate", `Basic realm="soshell"`)
+			apiError(w, 401, "authentication failed")
+			return
+		}
+		if u.TOTP != "" {
+			// Passwords alone don't do for accounts with 2FA, see totp.go.
+			apiError(w, 403, "two-factor authentication enabled")
+			return
+		}
+		h(w, r, &u)
+	}
+}
+
+// apiText reads the text of a message posted to the API.
+func apiText(r *http.Request) (string, bool) {
+	var body struct{ Text string }
+	if json.NewDecoder(io.LimitReader(r.Body, 16<<10)).Decode(&body) != nil {
+		return "", false
+	}
+	body.Text = strings.TrimSpace(body.Text)
+	return body.Text, body.Text != ""
+}
+
+// apiPage writes a page of a conversation's history.
+func apiPage(w http.ResponseWriter, r *http.Request, key string) {
+	before, _ := strconv.Atoi(r.FormValue("before"))
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	msgs, err := pageHistory(key, before, limit)
+	if err != nil {
+		apiError(w, 500, "could not read history")
+		return
+	}
+	if msgs == nil {
+		msgs = []message{}
+	}
+	apiJSON(w, 200, map[string]interface{}{"messages": msgs})
+}
+
+// apiRoomMessages posts to or reads the history of a room.
+func apiRoomMessages(w http.ResponseWriter, r *http.Request, u *user) {
+	room := strings.ToLower(mux.Vars(r)["room"])
+	if _, ok := findRoom(room); !ok {
+		apiError(w, 404, "no such room")
+		return
+	}
+	if !mayEnter(u, room) {
+		apiError(w, 403, "not in this room")
+		return
+	}
+	if r.Method == "GET" {
+		apiPage(w, r, roomKey(room))
+		return
+	}
+	text, ok := apiText(r)
+	if !ok {
+		apiError(w, 400, "missing text")
+		return
+	}
+	if flooding(u, room, clientsByName(u.Name)) {
+		apiError(w, 429, "talking too fast in this room")
+		return
+	}
+	m, err := postRoom(room, u.Name, text)
+	if err == errMuted {
+		apiError(w, 403, "muted in this room")
+		return
+	}
+	if err != nil {
+		apiError(w, 500, "could not store message")
+		return
+	}
+	markRead(u.Name, room, m.Id)
+	apiJSON(w, 201, m)
+}
+
+// apiUserMessages sends a direct message to, or reads the conversation
+// with, another user.
+func apiUserMessages(w http.ResponseWriter, r *http.Request, u *user) {
+	to := mux.Vars(r)["name"]
+	if !userExists(to) {
+		apiError(w, 404, "no such user")
+		return
+	}
+	if r.Method == "GET" {
+		apiPage(w, r, dmKey(u.Name, to))
+		return
+	}
+	text, ok := apiText(r)
+	if !ok {
+		apiError(w, 400, "missing text")
+		return
+	}
+	m, err := sendDirect(u.Name, to, text)
+	if err != nil {
+		apiError(w, 500, "could not store message")
+		return
+	}
+	apiJSON(w, 201, m)
+}
+
+// apiMe describes the authenticated user.
+func apiMe(w http.ResponseWriter, r *http.Request, u *user) {
+	apiJSON(w, 200, map[string]string{"name": u.Name, "role": u.role().String()})
+}
+
+// routeAPI registers the API endpoints on r.
+func routeAPI(r *mux.Router) {
+	r.HandleFunc("/api/me", apiAuth("", "", apiMe)).Methods("GET")
+	r.HandleFunc("/api/rooms/{room}/messages", csrfProtect(apiAuth("read:message", "post:message", apiRoomMessages))).Methods("GET", "POST")
+	r.HandleFunc("/api/users/{name}/messages", csrfProtect(apiAuth("read:message", "post:message", apiUserMessages))).Methods("GET", "POST")
+	r.HandleFunc("/api/graphql", csrfProtect(apiAuth("graphql", "graphql", apiGraphQL))).Methods("GET", "POST")
+}
@@ -0,0 +1,373 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+API keys let scripts and bots use an account without its password. A user
+makes one with apikey create, giving the scopes it's good for, and passes it
+as a bearer token:
+
+	Authorization: Bearer <key>
+
+to the REST API (see api.go) or, with the connect scope, when opening a
+websocket from outside a browser, which logs the connection in. Keys are sealed
+like login tokens (see token.go) and hold the user's file key; the server
+keeps the rest, without the file key, in work/apikeys.json, along with when
+and from where each was last used. A key it no longer has is refused, so
+apikey revoke, deleting the account or changing its password (which changes
+the file key) revokes keys.
+*/
+
+//
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "ssk_"
+	apiKeysMax   = 20 // per user
+)
+
+var errBadAPIKey = errors.New("invalid or revoked API key")
+
+// apiScopes are the scopes a key may have, with what they allow.
+var apiScopes = map[string]string{
+	"read:message": "read room and direct message history",
+	"post:message": "post to rooms and send direct messages",
+	"graphql":      "use /api/graphql",
+	"connect":      "connect to the websocket and run commands",
+}
+
+// apiKey is a key issued to a user.
+type apiKey struct {
+	Id       string
+	User     string
+	Name     string `json:",omitempty"`
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time `json:",omitempty"`
+	LastFrom string    `json:",omitempty"`
+}
+
+// apiKeyClaims are what a key holds.
+type apiKeyClaims struct {
+	Id   string
+	User string
+	Key  []byte
+}
+
+var apiKeys = struct {
+	sync.Mutex
+	list map[string]*apiKey // Id -> key
+}{list: make(map[string]*apiKey)}
+
+// allows reports whether k has scope.
+func (k *apiKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeysPath is the file issued keys are persisted in.
+func apiKeysPath() string {
+	return *work + SEP + "apikeys.json"
+}
+
+// saveAPIKeys writes the keys to disk. Callers must hold the lock.
+func saveAPIKeys() error {
+	var list []*apiKey
+	for _, k := range apiKeys.list {
+		list = append(list, k)
+	}
+	return saveJSON(list, apiKeysPath())
+}
+
+// loadAPIKeys reads the issued keys. It is called once from main, after
+// loadSessions.
+func loadAPIKeys() {
+	var list []*apiKey
+	if e := loadJSON(&list, apiKeysPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	for _, k := range list {
+		apiKeys.list[k.Id] = k
+	}
+}
+
+// parseScopes splits a comma separated list of scopes, returning the first
+// unknown one if there is one.
+func parseScopes(s string) (scopes []string, bad string) {
+	seen := make(map[string]bool)
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if _, ok := apiScopes[scope]; !ok {
+			return nil, scope
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes, ""
+}
+
+// createAPIKey returns a new key for u with scopes.
+func createAPIKey(u *user, name string, scopes []string) (string, *apiKey, error) {
+	k := &apiKey{Id: randomToken(8), User: u.Name, Name: name, Scopes: scopes, Created: time.Now()}
+	b, _ := json.Marshal(apiKeyClaims{Id: k.Id, User: k.User, Key: u.key})
+	b, e := seal(b)
+	if e != nil {
+		return "", nil, e
+	}
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	apiKeys.list[k.Id] = k
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), k, saveAPIKeys()
+}
+
+// openAPIKey returns the key token is and its user, noting it was used from
+// addr, or errBadAPIKey if it isn't one the server has.
+func openAPIKey(token, addr string) (apiKey, *user, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return apiKey{}, nil, errBadAPIKey
+	}
+	b, e := base64.RawURLEncoding.DecodeString(token[len(apiKeyPrefix):])
+	if e == nil {
+		b, e = unseal(b)
+	}
+	var cl apiKeyClaims
+	if e != nil || json.Unmarshal(b, &cl) != nil {
+		return apiKey{}, nil, errBadAPIKey
+	}
+	apiKeys.Lock()
+	k, ok := apiKeys.list[cl.Id]
+	if !ok || k.User != cl.User {
+		apiKeys.Unlock()
+		return apiKey{}, nil, errBadAPIKey
+	}
+	// Saved at most once a minute, scripts may use a key a lot.
+	now := time.Now()
+	changed := now.Sub(k.LastUsed) > time.Minute || k.LastFrom != hostOf(addr)
+	k.LastUsed, k.LastFrom = now, hostOf(addr)
+	if changed {
+		if e := saveAPIKeys(); e != nil {
+			log.Println(e)
+		}
+	}
+	key := *k
+	apiKeys.Unlock()
+	var u user
+	if e := u.loadKey(cl.User, cl.Key); e != nil {
+		log.Println(addr, "opening API key of", cl.User+":", e)
+		return apiKey{}, nil, errBadAPIKey
+	}
+	return key, &u, nil
+}
+
+// revokeAPIKey forgets the key id of user name, reporting whether there was
+// one, and disconnects the websockets using it.
+func revokeAPIKey(name, id string) bool {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	k, ok := apiKeys.list[id]
+	if !ok || !strings.EqualFold(k.User, name) {
+		return false
+	}
+	delete(apiKeys.list, id)
+	if e := saveAPIKeys(); e != nil {
+		log.Println(e)
+	}
+	dropAPIKey(id)
+	return true
+}
+
+// revokeAPIKeys forgets the keys of user name, returning how many there
+// were.
+func revokeAPIKeys(name string) int {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	n := 0
+	for id, k := range apiKeys.list {
+		if strings.EqualFold(k.User, name) {
+			delete(apiKeys.list, id)
+			dropAPIKey(id)
+			n++
+		}
+	}
+	if n > 0 {
+		if e := saveAPIKeys(); e != nil {
+			log.Println(e)
+		}
+	}
+	return n
+}
+
+// dropAPIKey disconnects the clients logged in with the key id.
+func dropAPIKey(id string) {
+	for _, c := range onlineClients() {
+		if c.apiKeyID == id {
+			c.disconnect("Your API key was revoked")
+		}
+	}
+}
+
+// userAPIKeys returns the keys of user name, oldest first.
+func userAPIKeys(name string) (list []apiKey) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	for _, k := range apiKeys.list {
+		if strings.EqualFold(k.User, name) {
+			list = append(list, *k)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return
+}
+
+// bearerToken returns the bearer token r was sent with, if any.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// listAPIKeys shows c the keys of its user.
+func listAPIKeys(c *client) error {
+	loc := c.user.location()
+	rows := [][]string{{"Id", "Name", "Scopes", "Created", "Last used", "From"}}
+	for _, k := range userAPIKeys(c.user.Name) {
+		used := c.tr("never")
+		if !k.LastUsed.IsZero() {
+			used = k.LastUsed.In(loc).Format("2006-01-02 15:04")
+		}
+		rows = append(rows, []string{k.Id, k.Name, strings.Join(k.Scopes, ","),
+			k.Created.In(loc).Format("2006-01-02 15:04"), used, k.LastFrom})
+	}
+	if len(rows) == 1 {
+		return c.appendMsg("#msg-list", "No API keys")
+	}
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+// scopeList returns the scopes and what they allow, one per line.
+func scopeList() string {
+	var names []string
+	for name := range apiScopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rows := make([][]string, len(names))
+	for i, name := range names {
+		rows[i] = []string{name, apiScopes[name]}
+	}
+	return formatTable(rows, false)
+}
+
+func init() {
+	cmdMap["apikey"] = command{
+		Desc:     "Lists your API keys.",
+		Usage:    "apikey",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return listAPIKeys(c)
+			}
+			return c.usage("apikey", commandNamed("apikey"))
+		},
+		Sub: map[string]command{
+			"create": {
+				Desc:  "Makes a key for scripts to use your account with.",
+				Usage: "apikey create --scope <scope,...> [--name <name>]",
+				Flags: []flagDoc{
+					{"scope", "scope,...", "what the key may do: connect, graphql, post:message, read:message"},
+					{"name", "name", "what the key is for"},
+				},
+				Examples: []string{"apikey create --scope post:message --name deploy-bot"},
+				Sudo:     true,
+				Handler: func(c *client, args []string) error {
+					opts, rest, err := parseFlags(args[1:], commandNamed("apikey").Sub["create"].flagSpec())
+					if err != nil || len(rest) != 0 || opts["scope"] == "" {
+						return c.usage("apikey", commandNamed("apikey"))
+					}
+					scopes, bad := parseScopes(opts["scope"])
+					if bad != "" {
+						if e := c.appendMsg("#msg-list", c.trf("Unknown scope: %s", bad)); e != nil {
+							return e
+						}
+						return c.appendPre("#msg-list", scopeList())
+					}
+					if len(userAPIKeys(c.user.Name)) >= apiKeysMax {
+						return c.appendMsg("#msg-list", c.trf("You can have at most %d API keys", apiKeysMax))
+					}
+					token, k, e := createAPIKey(&c.user, opts["name"], scopes)
+					if e != nil {
+						return e
+					}
+					log.Println(c.user.Name, "created the API key", k.Id, k.Scopes)
+					return c.offRecord(func() error {
+						if e := c.appendMsg("#msg-list", "Copy your API key now, it won't be shown again:"); e != nil {
+							return e
+						}
+						return c.appendPre("#msg-list", token)
+					})
+				},
+				Complete: func(c *client, words []string) []string {
+					if len(words) > 3 && words[len(words)-2] == "--scope" {
+						var names []string
+						for name := range apiScopes {
+							names = append(names, name)
+						}
+						return names
+					}
+					return []string{"--scope", "--name"}
+				},
+			},
+			"revoke": {
+				Desc:  "Revokes an API key, or all of them.",
+				Usage: "apikey revoke <id|all>",
+				Handler: func(c *client, args []string) error {
+					if len(args) != 3 {
+						return c.usage("apikey", commandNamed("apikey"))
+					}
+					if args[2] == "all" {
+						return c.appendMsg("#msg-list", c.trf("Revoked %d API keys", revokeAPIKeys(c.user.Name)))
+					}
+					if !revokeAPIKey(c.user.Name, args[2]) {
+						return c.appendMsg("#msg-list", c.trf("No such API key: %s", args[2]))
+					}
+					return c.appendMsg("#msg-list", c.trf("Revoked %d API keys", 1))
+				},
+				Complete: func(c *client, words []string) []string {
+					var ids []string
+					for _, k := range userAPIKeys(c.user.Name) {
+						ids = append(ids, k.Id)
+					}
+					return append(ids, "all")
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,135 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Argument parsing. A command line is split into words on white space, like a
+shell does:
+
+	'single quotes'  keep everything literally
+	"double quotes"  keep everything but \" and \\, which are escapes
+	`back quotes`    keep everything literally, including new lines
+	\ outside quotes escapes a following space, quote or backslash
+
+Quoted parts join with the text around them, so ll="list -l" is the single
+word ll=list -l. Other backslashes are kept, so regular expressions such as
+\d+ can be typed without quoting.
+
+Commands with options use parseFlags to pick -name value style options out of
+their arguments.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// tokenize splits a command line into words.
+func tokenize(line string) ([]string, error) {
+	var (
+		words []string
+		word  strings.Builder
+		in    bool // inside a word
+	)
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			if in {
+				words = append(words, word.String())
+				word.Reset()
+				in = false
+			}
+		case ch == '\\' && i+1 < len(line) && strings.IndexByte(" \t'\"`\\", line[i+1]) >= 0:
+			i++
+			word.WriteByte(line[i])
+			in = true
+		case ch == '\'' || ch == '`':
+			end := strings.IndexByte(line[i+1:], ch)
+			if end < 0 {
+				return nil, errors.New("unterminated " + string(ch) + " quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			in = true
+		case ch == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errors.New(`unterminated " quote`)
+			}
+			in = true
+		default:
+			word.WriteByte(ch)
+			in = true
+		}
+	}
+	if in {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// joinArgs joins words into a command line tokenize splits back into the same
+// words, quoting where needed.
+func joinArgs(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		if w != "" && !strings.ContainsAny(w, " \t\n\r'\"`\\") {
+			quoted[i] = w
+		} else {
+			quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(w) + `"`
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseFlags separates the options in args from the other arguments. spec
+// lists the option names a command accepts, true for options that take a
+// value. Options are written -name value, -name=value or with two dashes and
+// may appear anywhere; -- ends the options. Options without a value are set
+// to "true". args[0], the command name, is not included in rest.
+func parseFlags(args []string, spec map[string]bool) (opts map[string]string, rest []string, err error) {
+	opts = make(map[string]string)
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' || (arg[1] >= '0' && arg[1] <= '9') {
+			rest = append(rest, arg)
+			continue
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		value, hasValue := "", false
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		takesValue, known := spec[name]
+		switch {
+		case !known:
+			return nil, nil, errors.New("unknown option -" + name)
+		case takesValue && !hasValue:
+			if i+1 >= len(args) {
+				return nil, nil, errors.New("option -" + name + " needs a value")
+			}
+			i++
+			value = args[i]
+		case !takesValue && hasValue:
+			return nil, nil, errors.New("option -" + name + " takes no value")
+		case !takesValue:
+			value = "true"
+		}
+		opts[name] = value
+	}
+	return
+}
@@ -0,0 +1,292 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Admin moderation. kick disconnects a user's sessions; ban keeps a user or an
+address out, for a while or for good. Bans set by admins are kept in
+work/bans.json, unlike the short automatic bans of the security system, and
+are checked before a websocket is accepted, on login and by the API.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ban keeps a user or an address out.
+type ban struct {
+	Target string    // user name or address
+	User   bool      // Target is a user name
+	Until  time.Time `json:",omitempty"` // zero for bans without an end
+	By     string
+	Reason string `json:",omitempty"`
+}
+
+// active reports whether the ban is in force.
+func (b *ban) active() bool {
+	return b.Until.IsZero() || time.Now().Before(b.Until)
+}
+
+// eventData returns the data of the events about b: its target under "user"
+// or "ip", like the other user events, and who set or lifted it.
+func (b *ban) eventData(by string) map[string]string {
+	data := map[string]string{"by": by}
+	if b.User {
+		data["user"] = b.Target
+	} else {
+		data["ip"] = b.Target
+	}
+	return data
+}
+
+var bans = struct {
+	sync.Mutex
+	list map[string]*ban // banKey -> ban
+}{list: make(map[string]*ban)}
+
+// banKey returns the key of a ban on target.
+func banKey(target string, isUser bool) string {
+	if isUser {
+		return "user:" + strings.ToLower(target)
+	}
+	return "addr:" + target
+}
+
+// bansPath is the file bans are persisted in.
+func bansPath() string {
+	return *work + SEP + "bans.json"
+}
+
+// saveBans writes the bans to disk. Callers must hold the lock.
+func saveBans() error {
+	var list []*ban
+	for _, b := range bans.list {
+		list = append(list, b)
+	}
+	return saveJSON(list, bansPath())
+}
+
+// loadBans reads the persisted bans. It is called once from main.
+func loadBans() {
+	var list []*ban
+	if e := loadJSON(&list, bansPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	bans.Lock()
+	defer bans.Unlock()
+	for _, b := range list {
+		if b.active() {
+			bans.list[banKey(b.Target, b.User)] = b
+		}
+	}
+}
+
+// findBan returns the active ban on target, if any.
+func findBan(target string, isUser bool) *ban {
+	bans.Lock()
+	defer bans.Unlock()
+	key := banKey(target, isUser)
+	b, ok := bans.list[key]
+	if !ok {
+		return nil
+	}
+	if !b.active() {
+		delete(bans.list, key)
+		return nil
+	}
+	return b
+}
+
+// userBanned reports whether the account name is banned or disabled (see
+// useradmin.go).
+func userBanned(name string) bool {
+	return findBan(name, true) != nil || accountDisabled(name) != nil
+}
+
+// addrBanned reports whether an admin banned addr.
+func addrBanned(addr string) bool {
+	return findBan(hostOf(addr), false) != nil
+}
+
+// disconnect tells c why and closes its connection; the listener then
+// returns and the client is cleaned up as usual.
+func (c *client) disconnect(reason string) {
+	c.appendNotice("#msg-list", reason)
+	if c.ws != nil {
+		c.closeAfterWrite()
+	}
+}
+
+// kickClients disconnects the clients matching b.
+func kickClients(b *ban, reason string) int {
+	n := 0
+	for _, c := range onlineClients() {
+		if b.User && c.user.key != nil && strings.EqualFold(c.user.Name, b.Target) ||
+			!b.User && hostOf(c.address) == b.Target {
+			c.disconnect(reason)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	cmdMap["kick"] = command{
+		Desc:     "Disconnects all sessions of a user.",
+		Usage:    "kick <user> [reason]",
+		Category: "Admin",
+		Role:     roleModerator,
+		Sudo:     true,
+		Handler: func(c *client, args []string) error {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: kick <user> [reason]")
+			}
+			if userRole(args[1]) > c.user.role() {
+				return c.appendMsg("#msg-list", c.trf("You can't kick %s", args[1]))
+			}
+			reason := strings.Join(args[2:], " ")
+			msg := "You have been kicked by " + c.user.Name
+			if reason != "" {
+				msg += ": " + reason
+			}
+			n := kickClients(&ban{Target: args[1], User: true}, msg)
+			if n == 0 {
+				return c.appendMsg("#msg-list", c.trf("%s is not online", args[1]))
+			}
+			log.Println(c.user.Name, "kicked", args[1], reason)
+			emit("user.kicked", map[string]string{"user": args[1], "by": c.user.Name, "reason": reason})
+			return c.appendMsg("#msg-list", c.trf("Kicked %s (%d sessions)", args[1], n))
+		},
+		Complete: func(c *client, words []string) []string {
+			return onlineNames()
+		},
+	}
+	cmdMap["ban"] = command{
+		Desc:     "Bans a user or an address, for a while or until unbanned, and disconnects them; without arguments lists the bans.",
+		Usage:    "ban [<user|address> [duration] [reason]]",
+		Examples: []string{"ban spammer 7d flooding", "ban 203.0.113.7 2h"},
+		Category: "Admin",
+		Role:     roleAdmin,
+		Sudo:     true,
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) == 1 {
+				bans.Lock()
+				rows := [][]string{{"Target", "Until", "By", "Reason"}}
+				for _, b := range bans.list {
+					if !b.active() {
+						continue
+					}
+					target, until := b.Target, "-"
+					if b.User {
+						target = "@" + target
+					}
+					if !b.Until.IsZero() {
+						until = b.Until.In(c.user.location()).Format("2006-01-02 15:04")
+					}
+					rows = append(rows, []string{target, until, b.By, b.Reason})
+				}
+				bans.Unlock()
+				if len(rows) == 1 {
+					return c.appendMsg("#msg-list", "No bans")
+				}
+				sort.Slice(rows[1:], func(i, j int) bool { return rows[i+1][0] < rows[j+1][0] })
+				return c.appendPre("#msg-list", formatTable(rows, true))
+			}
+			b := &ban{Target: args[1], By: c.user.Name}
+			if ip := net.ParseIP(args[1]); ip != nil {
+				b.Target = ip.String()
+			} else if userExists(args[1]) {
+				b.User = true
+			} else {
+				return c.appendMsg("#msg-list", c.trf("No such user or address: %s", args[1]))
+			}
+			if b.User && strings.EqualFold(b.Target, c.user.Name) || !b.User && b.Target == hostOf(c.address) {
+				return c.appendMsg("#msg-list", "You can't ban yourself")
+			}
+			rest := args[2:]
+			if len(rest) > 0 {
+				if until, _, err := parseWhen("in", rest[:1], time.Now()); err == nil {
+					b.Until, rest = until, rest[1:]
+				}
+			}
+			b.Reason = strings.Join(rest, " ")
+			bans.Lock()
+			bans.list[banKey(b.Target, b.User)] = b
+			e = saveBans()
+			bans.Unlock()
+			if e != nil {
+				return
+			}
+			msg := "You have been banned by " + c.user.Name
+			if b.Reason != "" {
+				msg += ": " + b.Reason
+			}
+			n := kickClients(b, msg)
+			if b.User {
+				revokeSessions(b.Target, "")
+			}
+			until := ""
+			if !b.Until.IsZero() {
+				until = b.Until.UTC().Format(time.RFC3339)
+			}
+			log.Println(c.user.Name, "banned", b.Target, until, b.Reason)
+			data := b.eventData(c.user.Name)
+			data["until"], data["reason"] = until, b.Reason
+			emit("user.banned", data)
+			return c.appendMsg("#msg-list", c.trf("Banned %s, %d sessions disconnected", b.Target, n))
+		},
+	}
+	cmdMap["unban"] = command{
+		Desc:     "Lifts a ban, whether set with ban or by the security system.",
+		Usage:    "unban <user|address>",
+		Category: "Admin",
+		Role:     roleAdmin,
+		Sudo:     true,
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: unban <user|address>")
+			}
+			target := args[1]
+			if ip := net.ParseIP(target); ip != nil {
+				target = ip.String()
+			}
+			bans.Lock()
+			defer bans.Unlock()
+			key := banKey(target, true)
+			if _, ok := bans.list[key]; !ok {
+				key = banKey(target, false)
+			}
+			if _, ok := bans.list[key]; !ok {
+				// Maybe one of the security system's automatic bans.
+				security.Lock()
+				_, ok := security.bans[target]
+				delete(security.bans, target)
+				security.Unlock()
+				if !ok {
+					return c.appendMsg("#msg-list", c.trf("Not banned: %s", target))
+				}
+				emit("user.unbanned", (&ban{Target: target}).eventData(c.user.Name))
+				return c.appendMsg("#msg-list", c.trf("Ban lifted for %s", target))
+			}
+			b := bans.list[key]
+			delete(bans.list, key)
+			if e = saveBans(); e != nil {
+				return
+			}
+			emit("user.unbanned", b.eventData(c.user.Name))
+			return c.appendMsg("#msg-list", c.trf("Ban lifted for %s", target))
+		},
+	}
+}
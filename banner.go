@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The banner is shown to every client when it connects, in place of any fixed
+greeting. It's a text/template read from the banner config file given with
+-banner, bannerDefault without one, and admins can replace it at runtime with
+the motd command (the replacement is kept in the work directory). The
+template can use:
+
+	{{.Server}} {{.Version}} {{.Users}} {{.Clients}} {{.Tip}} {{.Time}}
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	bannerFile = flag.String("banner", "", "connect banner template file")
+	banner     = struct {
+		sync.Mutex
+		templ *template.Template
+		src   string
+	}{}
+	bannerDefault = "Welcome to {{.Server}} (soshell {{.Version}}), {{.Users}} online.\nTip: {{.Tip}}"
+	bannerTips    = []string{
+		"type help to list all commands",
+		"register <name> <email> creates an account",
+		"remind me in 10m to stretch sets a reminder",
+		"calc 10 km to mi converts units",
+		"stats shows how the server is doing",
+	}
+)
+
+// bannerPath is the file a banner set with motd is kept in.
+func bannerPath() string {
+	return *work + SEP + "motd.txt"
+}
+
+// setBanner parses src as the banner template.
+func setBanner(src string) error {
+	t, err := template.New("banner").Parse(src)
+	if err != nil {
+		return err
+	}
+	banner.Lock()
+	banner.templ, banner.src = t, src
+	banner.Unlock()
+	return nil
+}
+
+// loadBanner reads the banner set with motd, or the -banner file. It is
+// called once from main.
+func loadBanner() {
+	src := bannerDefault
+	if b, err := ioutil.ReadFile(bannerPath()); err == nil {
+		src = string(b)
+	} else if *bannerFile != "" {
+		if b, err = ioutil.ReadFile(*bannerFile); err != nil {
+			log.Fatal(err)
+		}
+		src = string(b)
+	}
+	if err := setBanner(src); err != nil {
+		log.Fatal("banner: ", err)
+	}
+}
+
+// renderBanner executes the banner template.
+func renderBanner() (string, error) {
+	s := readStats()
+	data := map[string]interface{}{
+		"Server":  *hostname,
+		"Version": version,
+		"Users":   s.Users,
+		"Clients": s.Clients,
+		"Tip":     bannerTips[rand.Intn(len(bannerTips))],
+		"Time":    time.Now().Format("2006-01-02 15:04"),
+	}
+	banner.Lock()
+	t := banner.templ
+	banner.Unlock()
+	if t == nil {
+		return "", nil
+	}
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	return strings.TrimSpace(b.String()), err
+}
+
+// showBanner sends the banner to c.
+func showBanner(c *client) error {
+	text, err := renderBanner()
+	if err != nil {
+		log.Println("banner:", err)
+	}
+	if text == "" {
+		return err
+	}
+	return c.appendPre("#msg-list", text)
+}
+
+func init() {
+	cmdMap["motd"] = command{
+		Desc:     "Shows the connect banner; admins can change it.",
+		Usage:    "motd [set <template>|reset]",
+		Category: "Rooms",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) == 1 {
+				return showBanner(c)
+			}
+			if !isAdmin(&c.user) {
+				return c.appendMsg("#msg-list", "motd: only admins can change the banner")
+			}
+			switch {
+			case args[1] == "set" && len(args) > 2:
+				src := strings.Replace(strings.Join(args[2:], " "), `\n`, "\n", -1)
+				if e = setBanner(src); e != nil {
+					return c.appendMsg("#msg-list", "motd: "+e.Error())
+				}
+				if e = ioutil.WriteFile(bannerPath(), []byte(src), 0600); e != nil {
+					return
+				}
+			case args[1] == "reset" && len(args) == 2:
+				if err := os.Remove(bannerPath()); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				loadBanner()
+			default:
+				return c.appendMsg("#msg-list", "Usage: motd | motd set <template> | motd reset")
+			}
+			c.appendMsg("#msg-list", "Banner updated:")
+			return showBanner(c)
+		},
+	}
+}
@@ -0,0 +1,415 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The calc system is a small recursive-descent expression evaluator used by the
+calc command. Expressions support the usual arithmetic operators, parentheses,
+variables, common math functions and simple unit conversions such as
+"10 km to mi" or "98.6 F in C".
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// calcFuncs contains the functions that can be called from an expression.
+var calcFuncs = map[string]func([]float64) (float64, error){
+	"sqrt":  calcFunc1(math.Sqrt),
+	"abs":   calcFunc1(math.Abs),
+	"sin":   calcFunc1(math.Sin),
+	"cos":   calcFunc1(math.Cos),
+	"tan":   calcFunc1(math.Tan),
+	"asin":  calcFunc1(math.Asin),
+	"acos":  calcFunc1(math.Acos),
+	"atan":  calcFunc1(math.Atan),
+	"ln":    calcFunc1(math.Log),
+	"log":   calcFunc1(math.Log10),
+	"exp":   calcFunc1(math.Exp),
+	"floor": calcFunc1(math.Floor),
+	"ceil":  calcFunc1(math.Ceil),
+	"round": calcFunc1(math.Round),
+	"pow": func(a []float64) (float64, error) {
+		if len(a) != 2 {
+			return 0, errors.New("pow takes 2 arguments")
+		}
+		return math.Pow(a[0], a[1]), nil
+	},
+	"min": func(a []float64) (float64, error) {
+		if len(a) == 0 {
+			return 0, errors.New("min needs at least 1 argument")
+		}
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Min(m, v)
+		}
+		return m, nil
+	},
+	"max": func(a []float64) (float64, error) {
+		if len(a) == 0 {
+			return 0, errors.New("max needs at least 1 argument")
+		}
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Max(m, v)
+		}
+		return m, nil
+	},
+}
+
+// calcConsts contains the read-only constants available to expressions.
+var calcConsts = map[string]float64{"pi": math.Pi, "e": math.E}
+
+// calcFunc1 wraps a single argument math function.
+func calcFunc1(f func(float64) float64) func([]float64) (float64, error) {
+	return func(a []float64) (float64, error) {
+		if len(a) != 1 {
+			return 0, errors.New("function takes 1 argument")
+		}
+		return f(a[0]), nil
+	}
+}
+
+// calcUnit describes a unit as a factor of its kind's base unit.
+type calcUnit struct {
+	kind   string
+	factor float64
+}
+
+// calcUnits maps unit names to their kind and base factor. Temperatures are
+// handled separately by toBase/fromBase.
+var calcUnits = map[string]calcUnit{
+	"mm": {"length", 0.001}, "cm": {"length", 0.01}, "m": {"length", 1},
+	"km": {"length", 1000}, "in": {"length", 0.0254}, "ft": {"length", 0.3048},
+	"yd": {"length", 0.9144}, "mi": {"length", 1609.344},
+	"mg": {"mass", 0.000001}, "g": {"mass", 0.001}, "kg": {"mass", 1},
+	"oz": {"mass", 0.028349523125}, "lb": {"mass", 0.45359237},
+	"ml": {"volume", 0.001}, "l": {"volume", 1}, "gal": {"volume", 3.785411784},
+	"ms": {"time", 0.001}, "s": {"time", 1}, "min": {"time", 60},
+	"h": {"time", 3600}, "day": {"time", 86400},
+	"b": {"data", 1}, "kb": {"data", 1024}, "mb": {"data", 1 << 20},
+	"gb": {"data", 1 << 30}, "tb": {"data", 1 << 40},
+	"c": {"temp", 1}, "f": {"temp", 1}, "k": {"temp", 1},
+}
+
+// toBase converts v in unit u to the base unit of its kind.
+func (u calcUnit) toBase(name string, v float64) float64 {
+	switch name {
+	case "f":
+		return (v - 32) * 5 / 9
+	case "k":
+		return v - 273.15
+	}
+	return v * u.factor
+}
+
+// fromBase converts v from the base unit of its kind to unit u.
+func (u calcUnit) fromBase(name string, v float64) float64 {
+	switch name {
+	case "f":
+		return v*9/5 + 32
+	case "k":
+		return v + 273.15
+	}
+	return v / u.factor
+}
+
+// calcToken is a single lexical token of an expression.
+type calcToken struct {
+	kind byte // 'n'umber, 'i'dent or the operator character itself
+	text string
+	num  float64
+}
+
+// calcLex splits an expression into tokens.
+func calcLex(s string) (toks []calcToken, e error) {
+	r := []rune(s)
+	for i := 0; i < len(r); {
+		ch := r[i]
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case unicode.IsDigit(ch) || ch == '.':
+			j := i
+			for j < len(r) && (unicode.IsDigit(r[j]) || r[j] == '.') {
+				j++
+			}
+			if j < len(r) && (r[j] == 'e' || r[j] == 'E') && j+1 < len(r) &&
+				(unicode.IsDigit(r[j+1]) || ((r[j+1] == '-' || r[j+1] == '+') && j+2 < len(r) && unicode.IsDigit(r[j+2]))) {
+				j += 2
+				for j < len(r) && unicode.IsDigit(r[j]) {
+					j++
+				}
+			}
+			n, err := strconv.ParseFloat(string(r[i:j]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number %q", string(r[i:j]))
+			}
+			toks = append(toks, calcToken{kind: 'n', text: string(r[i:j]), num: n})
+			i = j
+		case unicode.IsLetter(ch) || ch == '_':
+			j := i
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_') {
+				j++
+			}
+			toks = append(toks, calcToken{kind: 'i', text: strings.ToLower(string(r[i:j]))})
+			i = j
+		case strings.ContainsRune("+-*/%^(),=", ch):
+			toks = append(toks, calcToken{kind: byte(ch), text: string(ch)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q", ch)
+		}
+	}
+	return
+}
+
+// calcParser evaluates tokens as it parses them.
+type calcParser struct {
+	toks []calcToken
+	pos  int
+	vars map[string]float64
+}
+
+func (p *calcParser) peek() (t calcToken) {
+	if p.pos < len(p.toks) {
+		t = p.toks[p.pos]
+	}
+	return
+}
+
+func (p *calcParser) next() (t calcToken) {
+	t = p.peek()
+	p.pos++
+	return
+}
+
+// expr := term (('+'|'-') term)*
+func (p *calcParser) expr() (v float64, e error) {
+	if v, e = p.term(); e != nil {
+		return
+	}
+	for k := p.peek().kind; k == '+' || k == '-'; k = p.peek().kind {
+		p.next()
+		r, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if k == '+' {
+			v += r
+		} else {
+			v -= r
+		}
+	}
+	return
+}
+
+// term := unary (('*'|'/'|'%') unary)*
+func (p *calcParser) term() (v float64, e error) {
+	if v, e = p.unary(); e != nil {
+		return
+	}
+	for k := p.peek().kind; k == '*' || k == '/' || k == '%'; k = p.peek().kind {
+		p.next()
+		r, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch k {
+		case '*':
+			v *= r
+		case '/':
+			if r == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v /= r
+		case '%':
+			if r == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v = math.Mod(v, r)
+		}
+	}
+	return
+}
+
+// unary := ('+'|'-') unary | power
+func (p *calcParser) unary() (float64, error) {
+	switch p.peek().kind {
+	case '-':
+		p.next()
+		v, e := p.unary()
+		return -v, e
+	case '+':
+		p.next()
+		return p.unary()
+	}
+	return p.power()
+}
+
+// power := primary ('^' unary)?
+func (p *calcParser) power() (v float64, e error) {
+	if v, e = p.primary(); e != nil {
+		return
+	}
+	if p.peek().kind == '^' {
+		p.next()
+		r, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		v = math.Pow(v, r)
+	}
+	return
+}
+
+// primary := number | ident | ident '(' args ')' | '(' expr ')'
+func (p *calcParser) primary() (v float64, e error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		return t.num, nil
+	case '(':
+		if v, e = p.expr(); e != nil {
+			return
+		}
+		if p.next().kind != ')' {
+			return 0, errors.New("missing )")
+		}
+		return
+	case 'i':
+		if p.peek().kind == '(' {
+			f, ok := calcFuncs[t.text]
+			if !ok {
+				return 0, errors.New("unknown function: " + t.text)
+			}
+			p.next()
+			var args []float64
+			if p.peek().kind != ')' {
+				for {
+					a, err := p.expr()
+					if err != nil {
+						return 0, err
+					}
+					args = append(args, a)
+					if p.peek().kind != ',' {
+						break
+					}
+					p.next()
+				}
+			}
+			if p.next().kind != ')' {
+				return 0, errors.New("missing )")
+			}
+			return f(args)
+		}
+		if c, ok := calcConsts[t.text]; ok {
+			return c, nil
+		}
+		if val, ok := p.vars[t.text]; ok {
+			return val, nil
+		}
+		return 0, errors.New("unknown variable: " + t.text)
+	case 0:
+		return 0, errors.New("unexpected end of expression")
+	}
+	return 0, errors.New("unexpected " + t.text)
+}
+
+// calcEval evaluates a full calc statement using vars for variable storage.
+// A statement is either an assignment "name = expr", an expression, or a unit
+// conversion "expr unit (to|in) unit". The result is stored in vars["ans"].
+func calcEval(s string, vars map[string]float64) (string, error) {
+	toks, e := calcLex(s)
+	if e != nil {
+		return "", e
+	}
+	if len(toks) == 0 {
+		return "", errors.New("empty expression")
+	}
+	assign := ""
+	if len(toks) > 2 && toks[0].kind == 'i' && toks[1].kind == '=' {
+		assign = toks[0].text
+		if _, ok := calcConsts[assign]; ok {
+			return "", errors.New("cannot assign to constant " + assign)
+		}
+		if _, ok := calcFuncs[assign]; ok {
+			return "", errors.New("cannot assign to function " + assign)
+		}
+		toks = toks[2:]
+	}
+	// Peel off a trailing "<unit> to <unit>" conversion before parsing.
+	from, to := "", ""
+	if n := len(toks); n >= 4 && toks[n-1].kind == 'i' && toks[n-3].kind == 'i' &&
+		(toks[n-2].text == "to" || toks[n-2].text == "in") && toks[n-2].kind == 'i' {
+		if _, ok := calcUnits[toks[n-3].text]; ok {
+			from, to = toks[n-3].text, toks[n-1].text
+			toks = toks[:n-3]
+		}
+	}
+	p := &calcParser{toks: toks, vars: vars}
+	v, e := p.expr()
+	if e != nil {
+		return "", e
+	}
+	if p.pos < len(p.toks) {
+		return "", errors.New("unexpected " + p.peek().text)
+	}
+	if from != "" {
+		fu := calcUnits[from]
+		tu, ok := calcUnits[to]
+		if !ok {
+			return "", errors.New("unknown unit: " + to)
+		}
+		if fu.kind != tu.kind {
+			return "", fmt.Errorf("cannot convert %s to %s", fu.kind, tu.kind)
+		}
+		v = tu.fromBase(to, fu.toBase(from, v))
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "", errors.New("result is not a finite number")
+	}
+	vars["ans"] = v
+	if assign != "" {
+		vars[assign] = v
+	}
+	out := strconv.FormatFloat(v, 'g', 12, 64)
+	if to != "" {
+		out += " " + to
+	}
+	if assign != "" {
+		out = assign + " = " + out
+	}
+	return out, nil
+}
+
+func init() {
+	cmdMap["calc"] = command{
+		Desc:     "Evaluates an expression or converts units.",
+		Usage:    "calc <expression>",
+		Examples: []string{"calc 2*(3+4)", "calc x = sqrt(2)", "calc 5 km to mi"},
+		Category: "Tools",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: calc <expression>")
+			}
+			if c.calcVars == nil {
+				c.calcVars = make(map[string]float64)
+			}
+			res, err := calcEval(strings.Join(args[1:], " "), c.calcVars)
+			if err != nil {
+				return c.appendMsg("#msg-list", "calc: "+err.Error())
+			}
+			return c.appendMsg("#msg-list", res)
+		},
+		Background: true,
+	}
+}
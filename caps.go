@@ -0,0 +1,127 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Capability negotiation: right after connecting, the browser sends a "hello"
+packet describing what it supports. The capabilities are kept on the client so
+features degrade gracefully, e.g. notifications fall back to toasts and
+downloads to a message, instead of sending ops the client can't handle.
+Until the hello arrives every capability is assumed present, which matches
+what older clients could do.
+
+The hello also carries the client's protocol version. The server answers with
+a "welcome" packet holding the version both speak, the lower of the two, and
+keeps to it for the connection, so a page loaded from an older server, or
+cached from before an upgrade, keeps working. Clients older than
+minProtocol are told to reload and disconnected. The versions are:
+
+	1  the first with hello; queries are answered by the next frame
+	2  queries carry an Id and are answered with reply packets
+	3  important packets carry a Seq and are acknowledged, see ack.go
+	4  large packets may be streamed in chunks, see stream.go
+	5  failures are sent as error packets, see fail.go
+	6  logins are kept with tokens, see token.go
+	7  browsers may be trusted to skip 2FA, see device.go
+*/
+
+//
+package main
+
+import (
+	"strconv"
+)
+
+// protocolVersion is the newest packet protocol version spoken by the server
+// and minProtocol the oldest it still accepts.
+const (
+	protocolVersion = 7
+	minProtocol     = 1
+)
+
+// clientCaps are the capabilities announced by a client.
+type clientCaps struct {
+	Known         bool // a hello packet was received
+	Protocol      int
+	Notifications bool
+	Clipboard     bool
+	Touch         bool
+	Compression   bool
+	Download      bool
+}
+
+// capabilities returns what c announced in its hello packet.
+func (c *client) capabilities() clientCaps {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	return c.caps
+}
+
+// protocol returns the protocol version spoken with c. Clients that haven't
+// said hello, or didn't say which version they speak, get version 1.
+func (c *client) protocol() int {
+	caps := c.capabilities()
+	switch {
+	case !caps.Known || caps.Protocol <= 0:
+		return 1
+	case caps.Protocol > protocolVersion:
+		return protocolVersion
+	}
+	return caps.Protocol
+}
+
+// can reports whether c supports a feature checked with f. Clients that
+// haven't said hello are assumed to support everything.
+func (c *client) can(f func(clientCaps) bool) bool {
+	caps := c.capabilities()
+	return !caps.Known || f(caps)
+}
+
+func init() {
+	packetMap["hello"] = func(c *client, p packet) error {
+		caps := clientCaps{Known: true}
+		caps.Protocol, _ = strconv.Atoi(p.Data["Protocol"])
+		caps.Notifications = p.Data["Notifications"] == "true"
+		caps.Clipboard = p.Data["Clipboard"] == "true"
+		caps.Touch = p.Data["Touch"] == "true"
+		caps.Compression = p.Data["Compression"] == "true"
+		caps.Download = p.Data["Download"] == "true"
+		c.lmu.Lock()
+		c.caps = caps
+		c.lmu.Unlock()
+		// The browser's own list beats Accept-Language, which proxies may
+		// rewrite, unless the user picked a language.
+		if langs := p.Data["Languages"]; langs != "" && c.user.Locale == "" {
+			c.setLocale(negotiateLocale(langs))
+		}
+		if caps.Protocol > 0 && caps.Protocol < minProtocol {
+			c.disconnect("Your client is too old for this server, please reload the page")
+			return nil
+		}
+		w := Welcome{Protocol: strconv.Itoa(c.protocol())}
+		var resend []packet
+		if c.protocol() >= 3 {
+			w.Resume, resend = c.resume(p.Data["Resume"])
+		}
+		if e := c.sendOn(chanCtl, w.packet()); e != nil {
+			return e
+		}
+		for _, r := range resend {
+			if e := c.send(r); e != nil {
+				return e
+			}
+		}
+		if c.protocol() >= 7 {
+			c.device = p.Data["Device"]
+		}
+		if token := p.Data["Session"]; token != "" && c.protocol() >= 6 && c.user.key == nil {
+			if e := c.resumeSession(token); e != nil {
+				return e
+			}
+		}
+		if caps.Touch {
+			return startMobile(c)
+		}
+		return nil
+	}
+}
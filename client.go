@@ -6,39 +6,108 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
+	"github.com/jmptrader/soshell/protocol"
+	"log"
 	"strings"
+	"sync"
 	"time"
 )
 
-// packet is an extensible object type transmitted via websocket as JSON.
-type packet struct {
-	Type string
-	Data map[string]string
-}
+//go:generate go run genpackets.go
 
-// newPacket returns an initialized packet with Type set to t
-func newPacket(t string) (pack packet) {
-	pack.Data = make(map[string]string)
-	pack.Type = t
-	return
-}
+// packet is a message to or from the page, see the protocol package. The
+// packets sent to the page are described in packets.schema, from which go
+// generate makes a struct for each, e.g. AppendElement; send those rather
+// than building packets by hand. Queries, packets the client answers, carry
+// an Id that the client copies into its reply packet, see query; Seq is set
+// by sendImportant, see ack.go, and Chan is the channel, see mux.go.
+type packet = protocol.Packet
+
+// packetMap holds the handlers for packets sent by client-side scripts, keyed
+// by packet Type.
+var packetMap = make(map[string]func(*client, packet) error)
 
 // client is an extensible type representing a single websocket client.
 type client struct {
 	ws            *websocket.Conn
+	binary        bool // packets are sent as MessagePack, see wire.go
+	compressMin   int  // smallest message compressed, 0 for none; see compress.go
 	user          user
 	path, address string
+	room          string          // current room, guarded by the lock of rooms
+	replayed      map[string]bool // rooms whose messages were replayed, see scrollback.go
+	calcVars      map[string]float64
+	history       []string   // commands entered, see cmdhistory.go
+	recall        int        // position in history of the arrow keys
+	jobs          jobTable   // background commands, see jobs.go
+	limits        callLog    // calls of commands with cooldowns
+	macro         macroState // macro being recorded or played
+	pager         pager      // output waiting for --more--, see pager.go
+	sess          session    // connection info, see session.go
+	sudoUntil     time.Time  // end of sudo elevation, see sudo.go
+	sessionID     string     // login token in use, see token.go
+	apiKeyID      string     // API key the connection logged in with, see apikey.go
+	device        string     // device token from the hello packet, see device.go
+	locked        int32      // set while the terminal is locked, see idle.go
+	unlockFails   int        // wrong passwords typed since it was locked
+	typingAt      time.Time  // last typing notice sent to the room, see typing.go
+	wmu           sync.Mutex // serializes sends from other goroutines
+	wq            writeQueue // output waiting to be written, see writer.go
+	rec           *recorder  // session recording, guarded by wmu
+	offRec        int        // offRecord calls running, guarded by wmu
+	output        []packet   // output of a headless client, guarded by wmu
+	panes         panes
+	locale        string        // message catalog used by tr
+	caps          clientCaps    // announced in the hello packet
+	theme, css    string        // current theme and custom CSS
+	lmu           sync.Mutex    // guards locale and caps
+	inbox         chan []byte   // input for the listener, see reader.go
+	gone          chan struct{} // closed when the reader stops
+	readErr       error         // why the reader stopped, set before gone is closed
+	rmu           sync.Mutex    // guards the fields below
+	lastID        uint64
+	pending       map[string]chan string // query Id -> waiting caller
+	waiting       []chan []byte          // prompts waiting for input, oldest first
+	outbox        outbox                 // unacknowledged packets, see ack.go
+	streams       uint64                 // last stream Id, see stream.go
+	subs          subscriptions          // pushed server events, see subscribe.go
 }
 
-// recieve reads a single message and returns it.
-func (c *client) recieve() (b []byte, e error) {
-	t, m, e := c.ws.ReadMessage()
-	if t == 1 {
-		b = m
+// send queues v to be written to the websocket as JSON, see writer.go. It is
+// safe to call from goroutines other than the client's listener. Packets for
+// #msg-list go to the focused pane.
+func (c *client) send(v interface{}) error {
+	if p, ok := v.(packet); ok && p.Data["Selector"] == "#msg-list" {
+		if out := c.out(); out != "#msg-list" {
+			p.Data["Selector"] = out
+		}
 	}
-	return
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.rec != nil && c.offRec == 0 && recordable(v) {
+		c.rec.write("out", v)
+	}
+	if c.ws == nil {
+		// Headless clients (see cron.go) keep their output.
+		if p, ok := v.(packet); ok {
+			c.output = append(c.output, p)
+		}
+		return nil
+	}
+	count(&c.sess.packetsOut)
+	typ, data := websocket.TextMessage, []byte(nil)
+	if p, ok := v.(packet); ok && c.binary {
+		typ, data = websocket.BinaryMessage, protocol.MarshalMsgpack(p)
+	} else if b, err := json.Marshal(v); err != nil {
+		return err
+	} else {
+		data = b
+	}
+	return c.enqueue(newFrame(typ, data, v))
 }
 
 // listener listens for incoming packets and passes them to the respective handlers.
@@ -48,99 +117,208 @@ func (c *client) listener() (e error) {
 		if e != nil {
 			return e
 		}
-		args := getArgs(b)
-		if len(args) > 0 && len(args[0]) > 0 {
-			if cmd, exists := cmdMap[strings.ToLower(args[0])]; exists {
-				e = cmd.Handler(c, args)
-			} else {
-				e = c.appendMsg("#msg-list", args[0]+": command not found ")
+		c.sess.touch()
+		if c.isLocked() {
+			e = c.lockedInput(b)
+			continue
+		}
+		// JSON packets from client-side scripts skip the command throttle.
+		if len(b) > 0 && b[0] == '{' {
+			if p, err := protocol.Unmarshal(b); err == nil {
+				if bad := validatePacket(p); bad != nil {
+					e = c.reject(bad, p.Id)
+				} else {
+					_, e = c.demux(p)
+				}
+				continue
+			}
+			securitySuspicious(c.address, "malformed packet")
+		}
+		typed := string(b)
+		if bad := c.validateLine(typed); bad != nil {
+			e = c.reject(bad, "")
+			continue
+		}
+		if strings.TrimSpace(typed) != "" {
+			if err := c.addHistory(typed); err != nil {
+				log.Println(err)
 			}
+			recordCommand(c, typed)
+			c.recordMacro(typed)
 		}
+		// A new command drops output still waiting for --more--.
+		if err := c.quitPage(); err != nil {
+			log.Println(err)
+		}
+		e = c.dispatch(typed)
 		time.Sleep(time.Second)
 	}
 	return
 }
 
-// appendMsg appends a msg (div.msg) element to selector.
+// dispatch runs a command line: aliases are expanded, then the command is
+// run, in the background if the line ends with &, or else a macro is played.
+// Lines that aren't commands are said in the current room, see rooms.go.
+func (c *client) dispatch(line string) error {
+	if strings.HasPrefix(line, "/") {
+		line = line[1:]
+	} else if c.isChat(line) {
+		return c.say(line)
+	}
+	args, err := getArgs(c.expandAlias([]byte(line)))
+	if err != nil {
+		return c.appendMsg("#msg-list", err.Error())
+	}
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil
+	}
+	if bad := c.validateArgs(args); bad != nil {
+		return c.reject(bad, "")
+	}
+	name := strings.ToLower(args[0])
+	if cmd, exists := lookupCommand(name); exists {
+		if n := len(args); n > 1 && args[n-1] == "&" {
+			return c.startJob(line, cmd, args[:n-1])
+		}
+		return c.run(cmd, args)
+	}
+	if steps, exists := c.user.Macros[name]; exists {
+		return c.playMacro(name, steps)
+	}
+	return c.fail(codeNotFound, "", c.trf("%s: command not found", args[0]))
+}
+
+// appendMsg appends a msg (div.msg) element to selector, translating text
+// into the client's language.
 func (c *client) appendMsg(selector, text string) (e error) {
-	p := newPacket("appendElement")
-	p.Data["Element"] = "div"
-	p.Data["Selector"] = selector
-	p.Data["Class"] = "msg"
-	p.Data["Text"] = text
-	p.Data["Scroll"] = "true"
-	e = c.ws.WriteJSON(p)
+	return c.send(c.msgPacket(selector, text))
+}
+
+// appendNotice is appendMsg for text that must not get lost, see ack.go.
+func (c *client) appendNotice(selector, text string) (e error) {
+	return c.sendImportant(c.msgPacket(selector, text))
+}
+
+// msgPacket returns the packet appending a msg element with text.
+func (c *client) msgPacket(selector, text string) packet {
+	return AppendElement{Selector: selector, Element: "div", Class: "msg", Text: c.tr(text), Scroll: true}.packet()
+}
+
+// appendPre appends preformatted text (div.msg.pre) to selector, preserving
+// whitespace so tables and other aligned output render correctly.
+func (c *client) appendPre(selector, text string) (e error) {
+	p := AppendElement{Selector: selector, Element: "div", Class: "msg pre", Text: text, Scroll: true}
+	e = c.sendStreamed(chanTerm, p.packet(), "Text")
+	return
+}
+
+// appendHTML appends a msg (div.msg) element containing html to selector. The
+// html must already be safe, e.g. built with markdownHTML.
+func (c *client) appendHTML(selector, html string) (e error) {
+	p := AppendElement{Selector: selector, Element: "div", Class: "msg", HTML: html, Scroll: true}
+	e = c.sendStreamed(chanTerm, p.packet(), "HTML")
+	return
+}
+
+// appendImage appends an image (img.msg-img) to selector. src is usually a
+// data URI generated server side.
+func (c *client) appendImage(selector, src, alt string) (e error) {
+	p := AppendElement{Selector: selector, Element: "img", Class: "msg-img", Attribute: "src", Value: src, Alt: alt, Scroll: true}
+	e = c.send(p.packet())
 	return
 }
 
 func (c *client) appendLink(selector, url, text string) (e error) {
-	p := newPacket("appendElement")
-	p.Data["Element"] = "a"
-	p.Data["Selector"] = selector
-	p.Data["Id"] = text
-	p.Data["Class"] = "ip-link"
-	p.Data["Href"] = url
-	p.Data["Text"] = text
-	p.Data["Target"] = "_blank"
-	p.Data["Scroll"] = "true"
-	p.Data["OnClick"] = "removeDecoration"
-	e = c.ws.WriteJSON(p)
+	p := AppendElement{Selector: selector, Element: "a", Id: text, Class: "ip-link", Href: url, Text: text,
+		Target: "_blank", Scroll: true, OnClick: "removeDecoration"}
+	e = c.send(p.packet())
 	return
 }
 
 func (c *client) appendBreak(selector string) (e error) {
-	p := newPacket("appendElement")
-	p.Data["Element"] = "br"
-	p.Data["Selector"] = selector
-	p.Data["Scroll"] = "true"
-	e = c.ws.WriteJSON(p)
+	e = c.send(AppendElement{Selector: selector, Element: "br", Scroll: true}.packet())
+	return
+}
+
+// toast shows text in a transient popup on the client.
+func (c *client) toast(text string) (e error) {
+	e = c.send(Toast{Text: text}.packet())
+	return
+}
+
+// notify shows a browser (push) notification, falling back to a toast when
+// the user hasn't granted notification permission or prefers toasts (see
+// prefs.go). Users who turned notifications off get none.
+func (c *client) notify(title, text string) (e error) {
+	switch c.user.Notify {
+	case "off":
+		return nil
+	case "toast":
+		return c.toast(title + ": " + text)
+	}
+	if !c.can(func(caps clientCaps) bool { return caps.Notifications }) {
+		return c.toast(title + ": " + text)
+	}
+	e = c.send(Notify{Title: title, Text: text}.packet())
+	return
+}
+
+// announce reads text out to screen reader users. Urgent announcements
+// interrupt whatever is being read.
+func (c *client) announce(text string, urgent bool) (e error) {
+	e = c.send(Announce{Text: c.tr(text), Urgent: urgent}.packet())
+	return
+}
+
+// setAria sets the ARIA role (if not empty) and aria-* attributes of
+// selector, e.g.
+//
+//	setAria("#board", "grid", map[string]string{"aria-label": "Board"})
+func (c *client) setAria(selector, role string, attrs map[string]string) (e error) {
+	e = c.send(SetAria{Selector: selector, Role: role, Aria: attrs}.packet())
+	return
+}
+
+// download makes the client save content as a file called name.
+func (c *client) download(name, mime string, content []byte) (e error) {
+	if !c.can(func(caps clientCaps) bool { return caps.Download }) {
+		return c.appendMsg("#msg-list", "Your browser can't download files")
+	}
+	p := Download{Name: name, Mime: mime, Content: base64.StdEncoding.EncodeToString(content)}
+	e = c.sendStreamed(chanFile, p.packet(), "Content")
+	return
+}
+
+// setTheme switches the client to the named color theme, which it remembers.
+func (c *client) setTheme(name string) (e error) {
+	if e = c.send(Theme{Value: name}.packet()); e == nil {
+		c.theme = name
+	}
 	return
 }
 
 // focus will set the window focus on selector
 func (c *client) focus(selector, value string) (e error) {
-	p := newPacket("focus")
-	p.Data["Selector"] = selector
-	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(Focus{Selector: selector, Value: value}.packet())
 	return
 }
 
 // exists will check if selector exists
 func (c *client) exists(selector string) (bl bool) {
-	p := newPacket("exists")
-	p.Data["Selector"] = selector
-	e := c.ws.WriteJSON(p)
-	if e == nil {
-		b, e := c.recieve()
-		if e == nil && string(b) == "true" {
-			return true
-		}
-	}
-	return false
+	s, e := c.query(Exists{Selector: selector}.packet())
+	return e == nil && s == "true"
 }
 
 // innerHTML will set the html content of selector
 func (c *client) innerHTML(selector, value string) (e error) {
-	p := newPacket("innerHTML")
-	p.Data["Selector"] = selector
-	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.sendStreamed(chanTerm, InnerHTML{Selector: selector, Value: value}.packet(), "Value")
 	return
 }
 
 // getHTML returns the innerHTML of selector
 func (c *client) getHTML(selector string) (s string, e error) {
 	if c.exists(selector) {
-		p := newPacket("getHTML")
-		p.Data["Selector"] = selector
-		e = c.ws.WriteJSON(p)
-		if e == nil {
-			b, e := c.recieve()
-			if e == nil {
-				s = string(b)
-			}
-		}
+		s, e = c.query(GetHTML{Selector: selector}.packet())
 	} else {
 		e = errors.New("element does not exist")
 	}
@@ -149,70 +327,57 @@ func (c *client) getHTML(selector string) (s string, e error) {
 
 // setAttribute sets the specified attribute for selector.
 func (c *client) setAttribute(selector, attribute, value string) (e error) {
-	p := newPacket("setAttribute")
-	p.Data["Selector"] = selector
-	p.Data["Attribute"] = attribute
-	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(SetAttribute{Selector: selector, Attribute: attribute, Value: value}.packet())
 	return
 }
 
 // getAttribute returns the current value of an attribute of selector.
 func (c *client) getAttribute(selector, attribute string) (s string, e error) {
-	p := newPacket("getAttribute")
-	p.Data["Selector"] = selector
-	p.Data["Attribute"] = attribute
-	e = c.ws.WriteJSON(p)
-	if e == nil {
-		b, e := c.recieve()
-		if e == nil {
-			s = string(b)
-		}
-	}
-	return
+	return c.query(GetAttribute{Selector: selector, Attribute: attribute}.packet())
 }
 
-// setProperty sets the specified CSS property of selector.
+// setProperty sets the specified CSS property of selector, one of background,
+// background-color, border, border-color and color.
 func (c *client) setProperty(selector, property, value string) (e error) {
-	p := newPacket(property)
-	p.Data["Selector"] = selector
-	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	var p packet
+	switch property {
+	case "background":
+		p = Background{Selector: selector, Value: value}.packet()
+	case "background-color":
+		p = BackgroundColor{Selector: selector, Value: value}.packet()
+	case "border":
+		p = Border{Selector: selector, Value: value}.packet()
+	case "border-color":
+		p = BorderColor{Selector: selector, Value: value}.packet()
+	case "color":
+		p = Color{Selector: selector, Value: value}.packet()
+	default:
+		return errors.New("unknown property " + property)
+	}
+	e = c.send(p)
 	return
 }
 
 // getProperty returns the current (computed) value for the specified CSS property of selector.
 func (c *client) getProperty(selector, property string) (s string, e error) {
-	p := newPacket("getProperty")
-	p.Data["Selector"] = selector
-	p.Data["Property"] = property
-	e = c.ws.WriteJSON(p)
-	if e == nil {
-		b, e := c.recieve()
-		if e == nil {
-			s = string(b)
-		}
-	}
-	return
+	return c.query(GetProperty{Selector: selector, Property: property}.packet())
 }
 
 // editable sets the editable property of the element
 func (c *client) editable(selector, value string) (e error) {
-	p := newPacket("editable")
-	p.Data["Selector"] = selector
-	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(Editable{Selector: selector, Value: value}.packet())
 	return
 }
 
 // prompt sends the specified text as a msg and returns user input as a string.
 func (c *client) prompt(text string) (s string, e error) {
 	if len(text) > 0 {
-		e = c.appendMsg("#msg-list", text)
+		e = c.appendNotice("#msg-list", text)
 	} else {
-		e = c.appendMsg("#msg-list", "Enter some input:")
+		e = c.appendNotice("#msg-list", "Enter some input:")
 	}
-	b, e := c.recieve()
+	c.inputHint("text")
+	b, e := c.input()
 	if e == nil {
 		s = string(b)
 	}
@@ -11,37 +11,163 @@ interacting with the client HTML/CSS.
 //
 package main
 
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// role is a permission level. Each level may do everything the levels below
+// it can.
+type role int
+
+const (
+	roleGuest     role = iota // anyone, logged in or not
+	roleUser                  // logged in users
+	roleModerator             // users granted it, see roles.go
+	roleAdmin                 // users named in -admins or granted it
+)
+
+// roleNames are the names of the roles, by role.
+var roleNames = []string{"guest", "user", "moderator", "admin"}
+
+// String returns the name of r.
+func (r role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return "guest"
+	}
+	return roleNames[r]
+}
+
+// parseRole returns the role called name.
+func parseRole(name string) (role, bool) {
+	for r, n := range roleNames {
+		if strings.EqualFold(n, name) {
+			return role(r), true
+		}
+	}
+	return roleGuest, false
+}
+
+// role returns the permission level of u.
+func (u *user) role() role {
+	if u.key == nil {
+		return roleGuest
+	}
+	return userRole(u.Name)
+}
+
 type command struct {
-	Desc    string
-	Handler func(*client, []string) error
+	Desc    string // what the command does
+	Role    role   // the lowest role allowed to run the command
+	Handler Handler
+	// Usage shows how to call the command, e.g. "weather <location>", Flags
+	// documents its options and Examples are lines to try. Category groups
+	// the command in help, see help.go.
+	Usage    string
+	Flags    []flagDoc
+	Examples []string
+	Category string
+	// Background commands may run as jobs (see jobs.go); they must not
+	// prompt or query the page.
+	Background bool
+	// Sudo commands need the password typed recently, see sudo.go.
+	Sudo bool
+	// Cooldown is the time between two calls and PerMinute the most calls
+	// a minute allowed per client, see cooldown.go. Zero means no limit.
+	Cooldown  time.Duration
+	PerMinute int
+	// Complete optionally returns the candidates for the last of the words
+	// typed so far; only those starting with it are offered.
+	Complete func(c *client, words []string) []string
+	// Sub holds the sub-commands, keyed by name, see subcmd.go.
+	Sub map[string]command
 }
 
-var cmdMap = make(map[string]command)
+// allowed reports whether c may run cmd, telling c why not if it may not.
+func (c *client) allowed(name string, cmd command) bool {
+	switch {
+	case c.user.role() >= cmd.Role:
+		return true
+	case cmd.Role == roleUser:
+		c.fail(codeLogin, "", c.trf("%s: you must be logged in", name))
+	default:
+		c.fail(codeForbidden, "", c.trf("%s: permission denied", name))
+	}
+	return false
+}
 
-func init() {
-	cmdMap["help"] = command{
-		Desc: "help returns help information about available commands.",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 0 {
-				if len(args) == 1 {
-					cmds := ""
-					for k, _ := range cmdMap {
-						cmds += " " + k
-					}
-					e = c.appendMsg("#msg-list", "Available commands:"+cmds)
-				} else {
-					if cmd, ok := cmdMap[args[1]]; ok {
-						e = c.appendMsg("#msg-list", cmd.Desc)
-					} else {
-						e = c.appendMsg("#msg-list", "Command not available: "+args[1])
-					}
-				}
-			}
-			return
-		},
+// cmdMap holds the commands by name. It is filled from init and main before
+// clients connect; after that only reloading (see reload.go) changes it, with
+// cmdMu held, so code running for clients reads it with lookupCommand and
+// commandList.
+var (
+	cmdMap = make(map[string]command)
+	cmdMu  sync.RWMutex
+)
+
+// lookupCommand returns the command called name.
+func lookupCommand(name string) (command, bool) {
+	cmdMu.RLock()
+	defer cmdMu.RUnlock()
+	cmd, ok := cmdMap[name]
+	return cmd, ok
+}
+
+// commandNamed returns the command called name, the zero command if there is
+// none.
+func commandNamed(name string) command {
+	cmd, _ := lookupCommand(name)
+	return cmd
+}
+
+// commandList returns a copy of cmdMap.
+func commandList() map[string]command {
+	cmdMu.RLock()
+	defer cmdMu.RUnlock()
+	m := make(map[string]command, len(cmdMap))
+	for name, cmd := range cmdMap {
+		m[name] = cmd
 	}
+	return m
+}
+
+// loggedIn sets c up for the user just logged in, with the password or a
+// token (see token.go), or registered.
+func (c *client) loggedIn() (e error) {
+	e = c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+	if c.user.Locale != "" && hasLocale(c.user.Locale) {
+		c.setLocale(c.user.Locale)
+	}
+	if err := c.restoreRooms(); err != nil {
+		return err
+	}
+	applyPrefs(c)
+	if err := c.loadHistory(); err != nil {
+		log.Println(err)
+	}
+	if isAdmin(&c.user) {
+		if _, err := startRecording(c); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := c.recordLoggedIn(); err != nil {
+		return err
+	}
+	deliverDueReminders(c)
+	deliverDueCrons(c)
+	deliverInbox(c)
+	emit("user.login", map[string]string{"user": c.user.Name, "address": c.address})
+	emit("user.join", map[string]string{"user": c.user.Name, "room": c.currentRoom()})
+	return
+}
+
+func init() {
 	cmdMap["clear"] = command{
-		Desc: "clear the current terminal's content",
+		Desc:     "Clears the current terminal's content.",
+		Usage:    "clear",
+		Category: "Shell",
 		Handler: func(c *client, args []string) (e error) {
 			if len(args) > 0 {
 				c.innerHTML("#msg-list", " ")
@@ -50,25 +176,52 @@ func init() {
 		},
 	}
 	cmdMap["login"] = command{
-		Desc: "login lets you log into a registered user account.",
+		Desc:     "Logs you into a registered user account.",
+		Usage:    "login",
+		Category: "Account",
 		Handler: func(c *client, args []string) (e error) {
+			if isBanned(c.address) {
+				return c.appendMsg("#msg-list", "Login is blocked from your address for a while")
+			}
 			if len(args) > 0 {
 				if len(args) == 1 {
 					e = c.appendMsg("#msg-list", "Usage: login <name>")
 				} else {
 					name := args[1]
 					if isName(name) {
-						path := *users + SEP + indexPath([]byte(name))
-						if pathExists(path) {
+						if accountDisabled(name) != nil {
+							e = c.appendMsg("#msg-list", "This account is disabled")
+						} else if userBanned(name) {
+							e = c.appendMsg("#msg-list", "This account is banned")
+						} else if userExists(name) {
 							pass, e := c.promptSecure("#msg-txt", "Please enter your password")
 							if e == nil && len(pass) > 0 {
-								e = c.user.load(name, pass)
-								if e != nil {
+								var u user
+								ok := u.load(name, pass) == nil
+								// Two-factor authentication, see totp.go and
+								// device.go.
+								coded := false
+								if ok && u.TOTP != "" && !deviceTrusted(c.device, name) {
+									if ok, e = c.checkTOTP(&u); e != nil {
+										return e
+									}
+									coded = ok
+								}
+								if !ok {
+									securityLoginFailed(c.address, name)
+									loginFailed(c, name)
 									e = c.appendMsg("#msg-list", "Login failed")
 								} else {
-									e = c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+									c.become(u)
+									e = c.appendMsg("#msg-list", c.trf("Welcome back, %s", c.user.Name))
+									if e == nil {
+										e = c.loggedIn()
+									}
 									if e == nil {
-										e = c.appendMsg("#msg-list", "Welcome back, "+c.user.Name)
+										e = c.startSession()
+									}
+									if e == nil && coded {
+										e = c.offerTrust()
 									}
 								}
 							}
@@ -84,22 +237,44 @@ func init() {
 		},
 	}
 	cmdMap["register"] = command{
-		Desc: "register a user account",
+		Desc:     "Registers a user account.",
+		Usage:    "register",
+		Category: "Account",
 		Handler: func(c *client, args []string) (e error) {
+			if isBanned(c.address) {
+				return c.appendMsg("#msg-list", "Registration is blocked from your address for a while")
+			}
 			if len(args) > 1 {
 				name := args[1]
-				if isName(name) {
-					email, e := c.prompt("Enter your email address")
+				if userExists(name) {
+					e = c.appendMsg("#msg-list", "That name is taken")
+				} else if isName(name) {
+					email, e := c.promptAs("Enter your email address", "email")
 					if e == nil && isEmail(email) {
 						pass1, e1 := c.promptSecure("#msg-txt", "Enter a good password")
 						if e1 == nil {
 							pass2, e2 := c.promptSecure("#msg-txt", "Re-enter your password")
 							if e2 == nil && pass1 == pass2 {
-								c.user.Email = email
-								c.user.Name = name
-								e = c.user.save(name, pass1)
+								// The account keeps what was set up as a
+								// guest, see guest.go.
+								u := c.user
+								u.Email = email
+								u.Name = name
+								c.lmu.Lock()
+								u.Locale = c.locale
+								c.lmu.Unlock()
+								e = u.save(name, pass1)
 								if e == nil {
+									securityRegistered(c.address)
+									emit("user.registered", map[string]string{"user": name, "email": email})
+									c.become(u)
 									e = c.appendMsg("#msg-list", "User account created (don't forget your password!)")
+									if e == nil {
+										e = c.loggedIn()
+									}
+									if e == nil {
+										e = c.startSession()
+									}
 								} else {
 									e = c.appendMsg("#msg-list", e.Error())
 								}
@@ -0,0 +1,132 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Command history. Every command typed is kept in the session's history and,
+for logged in users, saved (encrypted like the rest of the account) so it
+survives reconnects and follows the user to other devices. The up and down
+arrow keys in the command box send "recall" packets and the server answers
+with the previous or next command. Like shells do, commands typed with a
+leading space aren't kept.
+*/
+
+//
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const historyMax = 500
+
+// commandsPath is the file a user's command history is saved in.
+func commandsPath(name string) string {
+	return userDir(name) + SEP + "history"
+}
+
+// addHistory adds a typed command to c's history.
+func (c *client) addHistory(line string) error {
+	if strings.TrimSpace(line) == "" || strings.HasPrefix(line, " ") {
+		return nil
+	}
+	c.history = append(c.history, line)
+	if len(c.history) > historyMax {
+		c.history = c.history[len(c.history)-historyMax:]
+	}
+	c.recall = len(c.history)
+	return c.saveHistory()
+}
+
+// saveHistory saves c's history if c is logged in.
+func (c *client) saveHistory() error {
+	if c.user.key == nil {
+		return nil
+	}
+	return saveObjectKey(c.history, commandsPath(c.user.Name), c.user.key)
+}
+
+// loadHistory puts the saved history of the user who just logged in before
+// the commands of this session. It is called on login.
+func (c *client) loadHistory() error {
+	var saved []string
+	if pathExists(commandsPath(c.user.Name)) {
+		if err := loadObjectKey(&saved, commandsPath(c.user.Name), c.user.key); err != nil {
+			return err
+		}
+	}
+	c.history = append(saved, c.history...)
+	if len(c.history) > historyMax {
+		c.history = c.history[len(c.history)-historyMax:]
+	}
+	c.recall = len(c.history)
+	return c.saveHistory()
+}
+
+func init() {
+	cmdMap["history"] = command{
+		Desc:  "Shows your last n commands (20 by default), or forgets them; with a #room, @user or --before, pages back through messages.",
+		Usage: "history [n|clear] | history [#room|@user] [--before <time>]",
+		Flags: []flagDoc{
+			{"before", "time", "show the messages sent before this time, e.g. 2026-10-01T18:30, 2026-10-01 or 18:30"},
+		},
+		Examples: []string{"history 50", "history --before 18:30", "history #dev --before 2026-10-01"},
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			if target, before, chat, err := historyArgs(args); err != nil {
+				return c.appendMsg("#msg-list", "Usage: history [n] | history clear | history [#room|@user] [--before <time>]")
+			} else if chat {
+				return scrollback(c, target, before)
+			}
+			if len(args) == 2 && args[1] == "clear" {
+				c.history, c.recall = nil, 0
+				if e = c.saveHistory(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "History cleared")
+			}
+			n := 20
+			if len(args) == 2 {
+				var err error
+				if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+					return c.appendMsg("#msg-list", "Usage: history [n] | history clear")
+				}
+			}
+			start := len(c.history) - n
+			if start < 0 {
+				start = 0
+			}
+			var lines []string
+			for i := start; i < len(c.history); i++ {
+				lines = append(lines, strconv.Itoa(i+1)+"  "+c.history[i])
+			}
+			return c.pageLines(lines, false)
+		},
+		Complete: func(c *client, words []string) []string {
+			return []string{"clear"}
+		},
+	}
+	packetMap["recall"] = func(c *client, p packet) error {
+		switch p.Data["Dir"] {
+		case "up":
+			if c.recall > 0 {
+				c.recall--
+			}
+		case "down":
+			if c.recall < len(c.history) {
+				c.recall++
+			}
+		default:
+			return nil
+		}
+		if c.recall > len(c.history) {
+			c.recall = len(c.history)
+		}
+		value := ""
+		if c.recall < len(c.history) {
+			value = c.history[c.recall]
+		}
+		return c.send(InputValue{Value: value}.packet())
+	}
+}
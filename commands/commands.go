@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Package commands is the public registry of soshell commands. Packages that
+add commands register them from init:
+
+	func init() {
+		commands.Register("hello", commands.Command{
+			Desc:  "Greets you.",
+			Usage: "hello",
+			Run: func(s commands.Session, args []string) error {
+				return s.Print("Hello, " + s.User())
+			},
+		})
+	}
+
+and are linked into the server with a blank import in a file of their own,
+e.g. commands_local.go:
+
+	package main
+
+	import _ "example.com/mycommands"
+
+The server adds every registered command when it starts. A command can't
+replace a built-in one.
+*/
+package commands
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+)
+
+// Role is the lowest permission level allowed to run a command.
+type Role int
+
+const (
+	Guest Role = iota // anyone, logged in or not
+	User              // logged in users
+	Admin             // server admins
+)
+
+// Session is the terminal a command runs in.
+type Session interface {
+	// User returns the name of the user, Guest if not logged in.
+	User() string
+	LoggedIn() bool
+	// Print shows a line of text, Preformatted a block of preformatted text.
+	Print(text string) error
+	Preformatted(text string) error
+	// Prompt asks the user for a line of input, PromptSecret for a password
+	// or other input that isn't echoed.
+	Prompt(text string) (string, error)
+	PromptSecret(text string) (string, error)
+}
+
+// Command is a command that can be typed in the terminal.
+type Command struct {
+	Desc string // what the command does, shown by help
+	Role Role
+	Run  func(s Session, args []string) error // args[0] is the command name
+	// Usage shows how to call the command, e.g. "hello [name]", and Examples
+	// are lines to try. Category groups the command in help: Shell,
+	// Account, Rooms, Files, Tools or Admin; Other if empty.
+	Usage    string
+	Examples []string
+	Category string
+	// Complete optionally returns the candidates for the last of the words
+	// typed so far.
+	Complete func(s Session, words []string) []string
+}
+
+var (
+	validName = regexp.MustCompile(`^[a-z0-9_]+$`)
+	registry  = struct {
+		sync.Mutex
+		m map[string]Command
+	}{m: make(map[string]Command)}
+)
+
+// Register adds a command. Names are lower case words. It fails if the name is
+// invalid or already registered, or the command has no Run function.
+func Register(name string, cmd Command) error {
+	if !validName.MatchString(name) {
+		return errors.New("commands: invalid command name: " + name)
+	}
+	if cmd.Run == nil {
+		return errors.New("commands: command has no Run function: " + name)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, exists := registry.m[name]; exists {
+		return errors.New("commands: command already registered: " + name)
+	}
+	registry.m[name] = cmd
+	return nil
+}
+
+// All returns the registered commands by name.
+func All() map[string]Command {
+	registry.Lock()
+	defer registry.Unlock()
+	m := make(map[string]Command, len(registry.m))
+	for name, cmd := range registry.m {
+		m[name] = cmd
+	}
+	return m
+}
@@ -0,0 +1,119 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Tab completion. Pressing tab in the command box sends the line typed so far
+in a "complete" packet. The server completes the last word: the first word
+from the commands, aliases and macros the user may run, words starting with @
+from the names of users online, and other words from the command's own
+Complete function, if it has one, or from its sub-commands. The word is
+extended as far as the candidates agree; if more than one remains they are
+listed.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// onlineNames returns the names of the logged in users online.
+func onlineNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, c := range onlineClients() {
+		if c.user.key != nil && !seen[c.user.Name] {
+			seen[c.user.Name] = true
+			names = append(names, c.user.Name)
+		}
+	}
+	return names
+}
+
+// candidates returns the possible completions of the last word of words.
+func (c *client) candidates(words []string) []string {
+	prefix := words[len(words)-1]
+	var list []string
+	switch {
+	case len(words) == 1:
+		for name, cmd := range commandList() {
+			if c.user.role() >= cmd.Role {
+				list = append(list, name)
+			}
+		}
+		for name := range c.user.Aliases {
+			list = append(list, name)
+		}
+		for name := range c.user.Macros {
+			list = append(list, name)
+		}
+	case strings.HasPrefix(prefix, "@"):
+		for _, name := range onlineNames() {
+			list = append(list, "@"+name)
+		}
+	default:
+		if cmd, ok := lookupCommand(strings.ToLower(words[0])); ok {
+			cmd, n := cmd.find(words[:len(words)-1])
+			switch {
+			case c.user.role() < cmd.Role:
+			case cmd.Complete != nil:
+				list = cmd.Complete(c, words)
+			case n == len(words)-1:
+				list = c.subNames(cmd)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	var matches []string
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) && !seen[s] {
+			seen[s] = true
+			matches = append(matches, s)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// commonPrefix returns the longest prefix shared by all of list.
+func commonPrefix(list []string) string {
+	prefix := list[0]
+	for _, s := range list[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// complete returns line with its last word completed and the candidates.
+func (c *client) complete(line string) (string, []string) {
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") {
+		words = append(words, "")
+	}
+	matches := c.candidates(words)
+	if len(matches) == 0 {
+		return line, nil
+	}
+	line = line[:len(line)-len(words[len(words)-1])] + commonPrefix(matches)
+	if len(matches) == 1 {
+		line += " "
+	}
+	return line, matches
+}
+
+func init() {
+	packetMap["complete"] = func(c *client, p packet) error {
+		line, matches := c.complete(p.Data["Line"])
+		if len(matches) > 1 {
+			if e := c.appendMsg("#msg-list", strings.Join(matches, "  ")); e != nil {
+				return e
+			}
+		}
+		return c.send(InputValue{Value: line}.packet())
+	}
+}
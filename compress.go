@@ -0,0 +1,57 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Websocket compression. Browsers offering permessage-deflate get messages of
+at least a threshold size compressed, so large innerHTML payloads and history
+dumps don't cost much bandwidth while the many small DOM updates skip the CPU
+cost. The threshold is set per listener with -compress-http and
+-compress-https; 0 turns compression off for that listener.
+*/
+
+//
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	compressHTTP  = flag.Int("compress-http", 1024, "smallest websocket message in bytes compressed on the http listener, 0 for none")
+	compressHTTPS = flag.Int("compress-https", 1024, "smallest websocket message in bytes compressed on the https listener, 0 for none")
+)
+
+// compressMin returns the compression threshold of the listener r came in
+// on, 0 if the browser didn't offer compression or the listener has none.
+func compressMin(r *http.Request) int {
+	if !strings.Contains(r.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		return 0
+	}
+	min := *compressHTTP
+	if r.TLS != nil {
+		min = *compressHTTPS
+	}
+	if min < 0 {
+		return 0
+	}
+	return min
+}
+
+// upgrader returns the websocket upgrader for r's listener. Origins are
+// checked by serveWs.
+func upgrader(r *http.Request) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: compressMin(r) > 0,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			http.Error(w, "Not a websocket handshake", status)
+		},
+	}
+}
@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Command cooldowns. Expensive commands declare a Cooldown (the time that must
+pass between two calls) and/or PerMinute (the most calls in any minute) in
+their definition. The throttle middleware keeps the calls of each client and
+asks users going faster to slow down.
+*/
+
+//
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// callLog holds a client's recent calls of limited commands.
+type callLog struct {
+	sync.Mutex
+	calls map[string][]time.Time
+}
+
+// wait records a call of the command name if cmd's limits allow it, and
+// otherwise returns how long to wait.
+func (l *callLog) wait(name string, cmd command) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range l.calls[name] {
+		if now.Sub(t) < time.Minute || now.Sub(t) < cmd.Cooldown {
+			recent = append(recent, t)
+		}
+	}
+	var wait time.Duration
+	if n := len(recent); n > 0 && now.Sub(recent[n-1]) < cmd.Cooldown {
+		wait = cmd.Cooldown - now.Sub(recent[n-1])
+	}
+	if cmd.PerMinute > 0 {
+		var count int
+		for _, t := range recent {
+			if now.Sub(t) < time.Minute {
+				count++
+			}
+		}
+		if count >= cmd.PerMinute {
+			if w := time.Minute - now.Sub(recent[len(recent)-count]); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait == 0 {
+		recent = append(recent, now)
+	}
+	if l.calls == nil {
+		l.calls = make(map[string][]time.Time)
+	}
+	l.calls[name] = recent
+	return wait
+}
+
+// throttle enforces the Cooldown and PerMinute limits of commands.
+func throttle(next Handler) Handler {
+	return func(c *client, args []string) error {
+		name := strings.ToLower(args[0])
+		cmd, ok := lookupCommand(name)
+		if !ok || (cmd.Cooldown == 0 && cmd.PerMinute == 0) {
+			return next(c, args)
+		}
+		if wait := c.limits.wait(name, cmd); wait > 0 {
+			if wait < time.Second {
+				wait = time.Second
+			}
+			return c.fail(codeRateLimited, "", c.trf("Slow down! %s can be used again in %s", name, wait.Round(time.Second)))
+		}
+		return next(c, args)
+	}
+}
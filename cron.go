@@ -0,0 +1,372 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Scheduled commands. cron add runs a command once (in 20m, at 15:00) or
+repeatedly (every 2h, daily 07:30). Jobs are kept in work/cron.json, so admins
+can also set them up there, and scheduled with the scheduler.
+
+A scheduled command runs on a headless client of its own, not on one of the
+owner's sessions, and its output is sent to the owner's sessions, or posted to
+a room for jobs with one (admins only). Output for owners who are offline is
+kept and delivered when they log in. Only commands that can run in the
+background and don't need a login can be scheduled, since the owner's account
+can't be opened without their password.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cronMax        = 10 // jobs per user
+	cronMinEvery   = 5 * time.Minute
+	cronPendingMax = 100 // packets kept for an offline owner
+)
+
+// cronJob is a scheduled command.
+type cronJob struct {
+	Id      string
+	Owner   string
+	Line    string
+	Every   time.Duration // 0 for jobs that run once
+	Next    time.Time
+	Room    string   `json:",omitempty"` // post the output to a room
+	Pending []packet `json:",omitempty"` // output waiting for the owner
+}
+
+var crons = struct {
+	sync.Mutex
+	list   map[string]*cronJob
+	nextId int
+}{list: make(map[string]*cronJob)}
+
+// cronPath is the file scheduled commands are persisted in.
+func cronPath() string {
+	return *work + SEP + "cron.json"
+}
+
+// saveCrons writes all jobs to disk. Callers must hold the lock.
+func saveCrons() error {
+	var list []*cronJob
+	for _, j := range crons.list {
+		list = append(list, j)
+	}
+	return saveJSON(list, cronPath())
+}
+
+// loadCrons reads persisted jobs and schedules them. Runs missed while the
+// server was down are skipped. It is called once from main.
+func loadCrons() {
+	var list []*cronJob
+	if e := loadJSON(&list, cronPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	crons.Lock()
+	defer crons.Unlock()
+	now := time.Now()
+	for _, j := range list {
+		if j.Id == "" {
+			crons.nextId++
+			j.Id = strconv.Itoa(crons.nextId)
+		}
+		crons.list[j.Id] = j
+		if n, _ := strconv.Atoi(j.Id); n > crons.nextId {
+			crons.nextId = n
+		}
+		switch {
+		case j.Every > 0:
+			for !j.Next.After(now) {
+				j.Next = j.Next.Add(j.Every)
+			}
+			scheduleCron(j)
+		case j.Next.After(now):
+			scheduleCron(j)
+		case len(j.Pending) == 0:
+			delete(crons.list, j.Id)
+		}
+	}
+}
+
+// scheduleCron arranges for j to run at j.Next.
+func scheduleCron(j *cronJob) {
+	id := j.Id
+	sched.at("cron:"+id, j.Next, func() { fireCron(id) })
+}
+
+// checkCron reports why line can't be scheduled, if it can't.
+func checkCron(line string) error {
+	args, err := getArgs([]byte(line))
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("missing command")
+	}
+	cmd, ok := lookupCommand(strings.ToLower(args[0]))
+	switch {
+	case !ok:
+		return errors.New(args[0] + ": command not found")
+	case !cmd.Background || cmd.Role != roleGuest:
+		return errors.New(args[0] + " can't be scheduled")
+	}
+	return nil
+}
+
+// runCron runs a job's command on a headless client and returns its output.
+func runCron(j *cronJob) []packet {
+	hc := &client{user: user{Name: j.Owner}, address: "cron", room: defaultRoom}
+	if err := checkCron(j.Line); err != nil {
+		hc.appendMsg("#msg-list", err.Error())
+	} else {
+		args, _ := getArgs([]byte(j.Line))
+		cmd, _ := lookupCommand(strings.ToLower(args[0]))
+		if err := hc.run(cmd, args); err != nil {
+			hc.appendMsg("#msg-list", err.Error())
+		}
+	}
+	hc.wmu.Lock()
+	defer hc.wmu.Unlock()
+	return hc.output
+}
+
+// fireCron runs a job and delivers its output.
+func fireCron(id string) {
+	crons.Lock()
+	j, ok := crons.list[id]
+	crons.Unlock()
+	if !ok {
+		return
+	}
+	out := runCron(j)
+	header := AppendElement{Selector: "#msg-list", Element: "div", Class: "msg cron", Text: "[cron " + j.Id + "] " + j.Line, Scroll: true}
+	out = append([]packet{header.packet()}, out...)
+
+	crons.Lock()
+	defer crons.Unlock()
+	if j.Room != "" {
+		for _, c := range roomClients(j.Room) {
+			deliverCron(c, out)
+		}
+	} else if cs := clientsByName(j.Owner); len(cs) > 0 {
+		for _, c := range cs {
+			deliverCron(c, out)
+		}
+	} else {
+		j.Pending = append(j.Pending, out...)
+		if n := len(j.Pending); n > cronPendingMax {
+			j.Pending = j.Pending[n-cronPendingMax:]
+		}
+	}
+	if _, ok := crons.list[id]; !ok {
+		return // removed while running
+	}
+	if j.Every > 0 {
+		for now := time.Now(); !j.Next.After(now); {
+			j.Next = j.Next.Add(j.Every)
+		}
+		scheduleCron(j)
+	} else if len(j.Pending) == 0 {
+		delete(crons.list, id)
+	}
+	if e := saveCrons(); e != nil {
+		log.Println(e)
+	}
+}
+
+// deliverCron sends the output of a job to c.
+func deliverCron(c *client, out []packet) {
+	for _, p := range out {
+		if e := c.send(p.Clone()); e != nil {
+			log.Println(c.address, e)
+			return
+		}
+	}
+}
+
+// deliverDueCrons sends c the output of jobs that ran while it was offline.
+func deliverDueCrons(c *client) {
+	crons.Lock()
+	defer crons.Unlock()
+	changed := false
+	for id, j := range crons.list {
+		if len(j.Pending) > 0 && strings.EqualFold(j.Owner, c.user.Name) {
+			deliverCron(c, j.Pending)
+			j.Pending = nil
+			if j.Every == 0 && !j.Next.After(time.Now()) {
+				delete(crons.list, id)
+			}
+			changed = true
+		}
+	}
+	if changed {
+		if e := saveCrons(); e != nil {
+			log.Println(e)
+		}
+	}
+}
+
+// parseCronWhen parses the schedule of cron add: every <duration>,
+// daily <HH:MM> or the in/at forms of remind. It returns the first run, the
+// interval and the number of arguments used.
+func parseCronWhen(args []string, now time.Time) (next time.Time, every time.Duration, used int, e error) {
+	if len(args) < 2 {
+		return next, 0, 0, errors.New("missing schedule")
+	}
+	switch args[0] {
+	case "every":
+		if next, _, e = parseWhen("in", args[1:2], now); e != nil {
+			return
+		}
+		every = next.Sub(now)
+		if every < cronMinEvery {
+			return next, 0, 0, errors.New("the shortest interval is " + cronMinEvery.String())
+		}
+		return next, every, 2, nil
+	case "daily":
+		if next, _, e = parseWhen("at", args[1:2], now); e != nil {
+			return
+		}
+		return next, 24 * time.Hour, 2, nil
+	}
+	next, used, e = parseWhen(args[0], args[1:], now)
+	return next, 0, used + 1, e
+}
+
+// listCrons shows c's jobs, or all jobs to admins.
+func listCrons(c *client) error {
+	crons.Lock()
+	var list []*cronJob
+	for _, j := range crons.list {
+		if strings.EqualFold(j.Owner, c.user.Name) || isAdmin(&c.user) {
+			list = append(list, j)
+		}
+	}
+	crons.Unlock()
+	if len(list) == 0 {
+		return c.appendMsg("#msg-list", "No scheduled commands")
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Next.Before(list[b].Next) })
+	loc := c.user.location()
+	rows := [][]string{{"Id", "Owner", "Next", "Every", "Command"}}
+	for _, j := range list {
+		every := "once"
+		if j.Every > 0 {
+			every = j.Every.String()
+		}
+		line := j.Line
+		if j.Room != "" {
+			line += " > #" + j.Room
+		}
+		rows = append(rows, []string{j.Id, j.Owner, j.Next.In(loc).Format("2006-01-02 15:04"), every, line})
+	}
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+func init() {
+	cmdMap["cron"] = command{
+		Desc:     "Schedules commands to run later or repeatedly.",
+		Category: "Shell",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return listCrons(c)
+			}
+			return c.usage("cron", commandNamed("cron"))
+		},
+		Sub: map[string]command{
+			"add": {
+				Desc:     "Schedules a command; admins can post its output to a room.",
+				Usage:    "cron add <every 2h|daily 07:30|in 20m|at 15:00> <command> [> #room]",
+				Examples: []string{"cron add daily 07:30 weather berlin", "cron add in 20m define serendipity"},
+				Handler: func(c *client, args []string) (e error) {
+					if len(args) < 4 {
+						return c.usage("cron", commandNamed("cron"))
+					}
+					next, every, used, err := parseCronWhen(args[2:], time.Now().In(c.user.location()))
+					if err != nil {
+						return c.appendMsg("#msg-list", "cron: "+err.Error())
+					}
+					rest := args[2+used:]
+					room := ""
+					if n := len(rest); n > 2 && rest[n-2] == ">" && strings.HasPrefix(rest[n-1], "#") {
+						if !isAdmin(&c.user) {
+							return c.appendMsg("#msg-list", "cron: only admins can post to rooms")
+						}
+						room, rest = strings.ToLower(rest[n-1][1:]), rest[:n-2]
+						if !isName(room) {
+							return c.appendMsg("#msg-list", "cron: invalid room")
+						}
+					}
+					if len(rest) == 0 {
+						return c.usage("cron", commandNamed("cron"))
+					}
+					line := joinArgs(rest)
+					if err := checkCron(line); err != nil {
+						return c.appendMsg("#msg-list", "cron: "+err.Error())
+					}
+					crons.Lock()
+					defer crons.Unlock()
+					count := 0
+					for _, j := range crons.list {
+						if strings.EqualFold(j.Owner, c.user.Name) {
+							count++
+						}
+					}
+					if count >= cronMax && !isAdmin(&c.user) {
+						return c.appendMsg("#msg-list", "cron: you can have at most "+strconv.Itoa(cronMax)+" scheduled commands")
+					}
+					crons.nextId++
+					j := &cronJob{Id: strconv.Itoa(crons.nextId), Owner: c.user.Name, Line: line, Every: every, Next: next, Room: room}
+					crons.list[j.Id] = j
+					if e = saveCrons(); e != nil {
+						return
+					}
+					scheduleCron(j)
+					return c.appendMsg("#msg-list", "Scheduled command "+j.Id+", next run "+next.Format("2006-01-02 15:04"))
+				},
+			},
+			"list": {
+				Desc: "Shows your scheduled commands.",
+				Handler: func(c *client, args []string) error {
+					return listCrons(c)
+				},
+			},
+			"rm": {
+				Desc:  "Removes a scheduled command.",
+				Usage: "cron rm <id>",
+				Handler: func(c *client, args []string) (e error) {
+					if len(args) != 3 {
+						return c.usage("cron", commandNamed("cron"))
+					}
+					crons.Lock()
+					defer crons.Unlock()
+					j, ok := crons.list[args[2]]
+					if !ok || (!strings.EqualFold(j.Owner, c.user.Name) && !isAdmin(&c.user)) {
+						return c.appendMsg("#msg-list", "cron: no such job: "+args[2])
+					}
+					sched.cancel("cron:" + j.Id)
+					delete(crons.list, j.Id)
+					if e = saveCrons(); e != nil {
+						return
+					}
+					return c.appendMsg("#msg-list", "Removed scheduled command "+j.Id)
+				},
+			},
+		},
+	}
+}
@@ -25,17 +25,31 @@ import (
 // saveObject converts a data object to json and writes it to a file encrypted
 // with specified password.
 func saveObject(obj interface{}, path, password string) (e error) {
+	return saveObjectKey(obj, path, passKey(password))
+}
+
+// loadObject reads json data from password encrypted file into a data object.
+func loadObject(obj interface{}, path, password string) (e error) {
+	return loadObjectKey(obj, path, passKey(password))
+}
+
+// passKey derives a file encryption key from a password the way accounts did
+// before passwords were hashed, see passwd.go.
+func passKey(password string) []byte {
+	return []byte(fmt.Sprintf("%x", sha256.Sum256([]byte(password)))[:32])
+}
+
+// saveObjectKey is saveObject with an already derived key.
+func saveObjectKey(obj interface{}, path string, key []byte) (e error) {
 	b, e := json.Marshal(obj)
 	if e == nil {
-		key := []byte(fmt.Sprintf("%x", sha256.Sum256([]byte(password)))[:32])
 		e = writeFile(key, path, b)
 	}
 	return
 }
 
-// loadObject reads json data from password encrypted file into a data object.
-func loadObject(obj interface{}, path, password string) (e error) {
-	key := []byte(fmt.Sprintf("%x", sha256.Sum256([]byte(password)))[:32])
+// loadObjectKey is loadObject with an already derived key.
+func loadObjectKey(obj interface{}, path string, key []byte) (e error) {
 	b, e := readFile(key, path)
 	if e == nil {
 		e = json.Unmarshal(b, &obj)
@@ -43,6 +57,25 @@ func loadObject(obj interface{}, path, password string) (e error) {
 	return
 }
 
+// saveJSON writes obj as plain (unencrypted) json, used for server owned
+// data that isn't tied to a single user's password.
+func saveJSON(obj interface{}, path string) (e error) {
+	b, e := json.Marshal(obj)
+	if e == nil {
+		e = ioutil.WriteFile(path, b, 0600)
+	}
+	return
+}
+
+// loadJSON reads plain json written by saveJSON into obj.
+func loadJSON(obj interface{}, path string) (e error) {
+	b, e := ioutil.ReadFile(path)
+	if e == nil {
+		e = json.Unmarshal(b, obj)
+	}
+	return
+}
+
 // getStream gets a new cipher stream for key.
 func getStream(key []byte) cipher.Stream {
 	block, err := aes.NewCipher(key)
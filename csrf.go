@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+CSRF protection for the HTTP endpoints. serveClient issues every browser a
+random token, both in the soshell_csrf cookie and in the page (the csrf-token
+meta tag), so scripts on the page can send it back. Requests changing state
+must come from the same origin and, if the browser carries the cookie, repeat
+the token in the X-CSRF-Token header or the csrf form field. Another site can
+make the browser send the cookie but can't read the token.
+
+Clients that aren't browsers (no Origin header and no cookie) are unaffected,
+they authenticate every request themselves.
+*/
+
+//
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+)
+
+const csrfCookie = "soshell_csrf"
+
+// csrfToken returns the CSRF token of the browser making r, issuing a new one
+// if it has none.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if ck, err := r.Cookie(csrfCookie); err == nil && len(ck.Value) == 32 {
+		return ck.Value
+	}
+	token := randomToken(16)
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: token, Path: "/",
+		Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	return token
+}
+
+// sameOrigin reports whether r comes from a page served by this host. The
+// Referer is checked when the browser sends no Origin; requests with neither
+// aren't from a browser page and pass.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		ref := r.Referer()
+		if ref == "" {
+			return true
+		}
+		u, err := url.Parse(ref)
+		if err != nil {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	return origin == "https://"+r.Host
+}
+
+// csrfProtect wraps a handler so requests that change state are only accepted
+// from this origin with a valid token.
+func csrfProtect(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h(w, r)
+			return
+		}
+		if !sameOrigin(r) {
+			securitySuspicious(r.RemoteAddr, "cross-origin "+r.Method+" "+r.URL.Path)
+			http.Error(w, "Origin not allowed", 403)
+			return
+		}
+		if ck, err := r.Cookie(csrfCookie); err == nil {
+			token := r.Header.Get("X-CSRF-Token")
+			if token == "" {
+				token = r.FormValue("csrf")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(ck.Value)) != 1 {
+				securitySuspicious(r.RemoteAddr, "bad CSRF token for "+r.URL.Path)
+				http.Error(w, "Invalid CSRF token", 403)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
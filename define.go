@@ -0,0 +1,219 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The define system looks up word definitions either from a dictionary web API
+(dictionaryapi.dev compatible) or, when a WordNet database directory is
+configured, from the bundled WordNet data files without any network access.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	dictURL = flag.String("dict", "https://api.dictionaryapi.dev/api/v2/entries/en/", "dictionary API URL")
+	wordnet = flag.String("wordnet", "", "WordNet dict directory (used instead of the dictionary API)")
+)
+
+// definition is a dictionary entry for a single word.
+type definition struct {
+	Word     string
+	Phonetic []string
+	Meanings []meaning
+}
+
+// meaning is one part of speech and its senses.
+type meaning struct {
+	Part     string
+	Senses   []string
+	Examples []string
+}
+
+// lookupAPI looks up word in the configured dictionary API.
+func lookupAPI(word string) (d definition, e error) {
+	var r []struct {
+		Word      string
+		Phonetic  string
+		Phonetics []struct{ Text string }
+		Meanings  []struct {
+			PartOfSpeech string
+			Definitions  []struct{ Definition, Example string }
+		}
+	}
+	if e = getJSON(*dictURL+url.PathEscape(word), &r); e != nil {
+		if strings.Contains(e.Error(), "404") {
+			e = errors.New("no definitions found")
+		}
+		return
+	}
+	if len(r) == 0 {
+		return d, errors.New("no definitions found")
+	}
+	d.Word = r[0].Word
+	seen := make(map[string]bool)
+	for _, entry := range r {
+		for _, p := range append([]struct{ Text string }{{entry.Phonetic}}, entry.Phonetics...) {
+			if p.Text != "" && !seen[p.Text] {
+				seen[p.Text] = true
+				d.Phonetic = append(d.Phonetic, p.Text)
+			}
+		}
+		for _, m := range entry.Meanings {
+			var mn meaning
+			mn.Part = m.PartOfSpeech
+			for _, def := range m.Definitions {
+				mn.Senses = append(mn.Senses, def.Definition)
+				if def.Example != "" {
+					mn.Examples = append(mn.Examples, def.Example)
+				}
+			}
+			d.Meanings = append(d.Meanings, mn)
+		}
+	}
+	return
+}
+
+// wordnetParts maps WordNet file suffixes to parts of speech.
+var wordnetParts = [][2]string{{"noun", "noun"}, {"verb", "verb"}, {"adj", "adjective"}, {"adv", "adverb"}}
+
+// lookupWordNet looks up word in the WordNet index.* and data.* files.
+func lookupWordNet(word string) (d definition, e error) {
+	lemma := strings.ToLower(strings.Replace(word, " ", "_", -1))
+	d.Word = word
+	for _, part := range wordnetParts {
+		offsets, err := wordnetIndex(*wordnet+SEP+"index."+part[0], lemma)
+		if err != nil {
+			return d, err
+		}
+		if len(offsets) == 0 {
+			continue
+		}
+		mn := meaning{Part: part[1]}
+		data, err := os.Open(*wordnet + SEP + "data." + part[0])
+		if err != nil {
+			return d, err
+		}
+		for _, off := range offsets {
+			gloss, err := wordnetGloss(data, off)
+			if err != nil {
+				continue
+			}
+			// Glosses are "definition; \"example\"; \"example\"".
+			parts := strings.Split(gloss, "; \"")
+			mn.Senses = append(mn.Senses, strings.TrimSpace(parts[0]))
+			for _, ex := range parts[1:] {
+				mn.Examples = append(mn.Examples, strings.Trim(ex, "\" "))
+			}
+		}
+		data.Close()
+		d.Meanings = append(d.Meanings, mn)
+	}
+	if len(d.Meanings) == 0 {
+		e = errors.New("no definitions found")
+	}
+	return
+}
+
+// wordnetIndex returns the synset offsets listed for lemma in an index file.
+func wordnetIndex(path, lemma string) (offsets []int64, e error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, lemma+" ") {
+			continue
+		}
+		// lemma pos synset_cnt p_cnt [ptr_symbol...] sense_cnt tagsense_cnt offsets...
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			break
+		}
+		synsets, err := strconv.Atoi(fields[2])
+		if err != nil || synsets < 0 || synsets > len(fields)-4 {
+			break // a malformed or truncated line
+		}
+		for _, f := range fields[len(fields)-synsets:] {
+			if off, err := strconv.ParseInt(f, 10, 64); err == nil {
+				offsets = append(offsets, off)
+			}
+		}
+		break
+	}
+	return offsets, s.Err()
+}
+
+// wordnetGloss reads the gloss of the synset at off in a data file.
+func wordnetGloss(data *os.File, off int64) (string, error) {
+	if _, e := data.Seek(off, io.SeekStart); e != nil {
+		return "", e
+	}
+	line, e := bufio.NewReader(data).ReadString('\n')
+	if e != nil && e != io.EOF {
+		return "", e
+	}
+	i := strings.Index(line, " | ")
+	if i < 0 {
+		return "", errors.New("malformed synset")
+	}
+	return strings.TrimSpace(line[i+3:]), nil
+}
+
+// markdown renders the definition for the client.
+func (d definition) markdown() string {
+	md := "## " + d.Word + "\n"
+	if len(d.Phonetic) > 0 {
+		md += "*" + strings.Join(d.Phonetic, ", ") + "*\n"
+	}
+	for _, m := range d.Meanings {
+		md += "\n**" + m.Part + "**\n"
+		for i, s := range m.Senses {
+			md += strconv.Itoa(i+1) + ". " + s + "\n"
+		}
+		for _, ex := range m.Examples {
+			md += "- *\"" + ex + "\"*\n"
+		}
+	}
+	return md
+}
+
+func init() {
+	cmdMap["define"] = command{
+		Desc:     "Shows the pronunciation and definitions of a word.",
+		Usage:    "define <word>",
+		Category: "Tools",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: define <word>")
+			}
+			word := strings.Join(args[1:], " ")
+			lookup := lookupAPI
+			if *wordnet != "" {
+				lookup = lookupWordNet
+			}
+			d, err := lookup(word)
+			if err != nil {
+				return c.appendMsg("#msg-list", "define: "+err.Error())
+			}
+			return c.appendHTML("#msg-list", markdownHTML(d.markdown()))
+		},
+		Background: true,
+		PerMinute:  10,
+	}
+}
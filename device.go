@@ -0,0 +1,254 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Trusted devices. After typing a 2FA code (see totp.go) at login, the user may
+choose to trust the browser: it is sent a "device" packet with a token it
+keeps and presents in its hello packet, and logging in to the account from it
+then asks for the password only. Other browsers still need a code.
+
+Device tokens are sealed like login tokens (see token.go) but hold no file
+key, they only stand in for the code. The server keeps the devices it trusts
+in work/devices.json, a token it no longer has is refused; devices revoke
+forgets them, and turning 2FA on or off forgets them all. They last
+-device-ttl.
+*/
+
+//
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var deviceTTL = flag.Duration("device-ttl", 90*24*time.Hour, "how long a browser trusted at login may skip 2FA")
+
+// trustedDevice is a browser a user said to trust.
+type trustedDevice struct {
+	Id       string
+	User     string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+	Address  string // where it was trusted
+	Agent    string // User-Agent of the browser
+}
+
+// deviceClaims are what a device token holds.
+type deviceClaims struct {
+	Id      string
+	User    string
+	Expires int64
+}
+
+var devices = struct {
+	sync.Mutex
+	list map[string]*trustedDevice // Id -> device
+}{list: make(map[string]*trustedDevice)}
+
+// devicesPath is the file trusted devices are persisted in.
+func devicesPath() string {
+	return *work + SEP + "devices.json"
+}
+
+// saveDevices writes the devices to disk. Callers must hold the lock.
+func saveDevices() error {
+	var list []*trustedDevice
+	for _, d := range devices.list {
+		list = append(list, d)
+	}
+	return saveJSON(list, devicesPath())
+}
+
+// loadDevices reads the devices still trusted. It is called once from main.
+func loadDevices() {
+	var list []*trustedDevice
+	if e := loadJSON(&list, devicesPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	devices.Lock()
+	defer devices.Unlock()
+	for _, d := range list {
+		if time.Now().Before(d.Expires) {
+			devices.list[d.Id] = d
+		}
+	}
+}
+
+// trustDevice returns a new token trusting c's browser for its user.
+func trustDevice(c *client) (string, *trustedDevice, error) {
+	now := time.Now()
+	d := &trustedDevice{Id: randomToken(8), User: c.user.Name, Created: now, Expires: now.Add(*deviceTTL),
+		LastUsed: now, Address: hostOf(c.address), Agent: c.sess.agent}
+	b, _ := json.Marshal(deviceClaims{Id: d.Id, User: d.User, Expires: d.Expires.Unix()})
+	b, e := seal(b)
+	if e != nil {
+		return "", nil, e
+	}
+	devices.Lock()
+	defer devices.Unlock()
+	for id, old := range devices.list {
+		if !now.Before(old.Expires) {
+			delete(devices.list, id)
+		}
+	}
+	devices.list[d.Id] = d
+	return base64.RawURLEncoding.EncodeToString(b), d, saveDevices()
+}
+
+// deviceTrusted reports whether token trusts the browser presenting it for
+// the user name.
+func deviceTrusted(token, name string) bool {
+	if token == "" {
+		return false
+	}
+	b, e := base64.RawURLEncoding.DecodeString(token)
+	if e == nil {
+		b, e = unseal(b)
+	}
+	var cl deviceClaims
+	if e != nil || json.Unmarshal(b, &cl) != nil || !strings.EqualFold(cl.User, name) {
+		return false
+	}
+	devices.Lock()
+	defer devices.Unlock()
+	d, ok := devices.list[cl.Id]
+	if !ok || d.User != cl.User || !time.Now().Before(d.Expires) || time.Now().Unix() >= cl.Expires {
+		return false
+	}
+	d.LastUsed = time.Now()
+	if e := saveDevices(); e != nil {
+		log.Println(e)
+	}
+	return true
+}
+
+// revokeDevices forgets the devices of user name with the id, or all of
+// them if id is empty, returning how many there were.
+func revokeDevices(name, id string) int {
+	devices.Lock()
+	defer devices.Unlock()
+	n := 0
+	for i, d := range devices.list {
+		if (id == "" || i == id) && strings.EqualFold(d.User, name) {
+			delete(devices.list, i)
+			n++
+		}
+	}
+	if n > 0 {
+		if e := saveDevices(); e != nil {
+			log.Println(e)
+		}
+	}
+	return n
+}
+
+// userDevices returns the devices of user name, oldest first.
+func userDevices(name string) (list []trustedDevice) {
+	devices.Lock()
+	defer devices.Unlock()
+	for _, d := range devices.list {
+		if strings.EqualFold(d.User, name) && time.Now().Before(d.Expires) {
+			list = append(list, *d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return
+}
+
+// offerTrust asks c, which just typed a 2FA code, whether to trust its
+// browser, and does if the user says so.
+func (c *client) offerTrust() error {
+	if c.protocol() < 7 {
+		return nil
+	}
+	days := int(deviceTTL.Hours() / 24)
+	answer, e := c.prompt(c.trf("Trust this browser for %d days, so it doesn't ask for a code? [no/yes]", days))
+	if e != nil || !strings.EqualFold(strings.TrimSpace(answer), "yes") {
+		return e
+	}
+	token, d, e := trustDevice(c)
+	if e != nil {
+		log.Println(e)
+		return nil
+	}
+	c.device = token
+	if e := c.sendOn(chanCtl, Device{Token: token}.packet()); e != nil {
+		return e
+	}
+	log.Println(c.address, "trusted device", d.Id, "for", c.user.Name)
+	return c.appendMsg("#msg-list", "This browser is trusted")
+}
+
+// listDevices shows c the trusted devices of its user.
+func listDevices(c *client) error {
+	loc := c.user.location()
+	rows := [][]string{{"Id", "Trusted", "Last used", "Expires", "Address", "Browser"}}
+	for _, d := range userDevices(c.user.Name) {
+		agent := d.Agent
+		if len(agent) > 40 {
+			agent = agent[:40] + "..."
+		}
+		rows = append(rows, []string{d.Id, d.Created.In(loc).Format("2006-01-02 15:04"),
+			d.LastUsed.In(loc).Format("2006-01-02 15:04"), d.Expires.In(loc).Format("2006-01-02"), d.Address, agent})
+	}
+	if len(rows) == 1 {
+		return c.appendMsg("#msg-list", "No trusted devices")
+	}
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+func init() {
+	cmdMap["devices"] = command{
+		Desc:     "Lists the browsers trusted to log in to your account without a 2FA code.",
+		Usage:    "devices",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return listDevices(c)
+			}
+			return c.usage("devices", commandNamed("devices"))
+		},
+		Sub: map[string]command{
+			"revoke": {
+				Desc:     "Stops trusting a browser, or all of them.",
+				Usage:    "devices revoke <id|all>",
+				Examples: []string{"devices revoke all"},
+				Handler: func(c *client, args []string) error {
+					if len(args) != 3 {
+						return c.usage("devices", commandNamed("devices"))
+					}
+					id := args[2]
+					if id == "all" {
+						id = ""
+					}
+					n := revokeDevices(c.user.Name, id)
+					if n == 0 && id != "" {
+						return c.appendMsg("#msg-list", c.trf("No such device: %s", id))
+					}
+					return c.appendMsg("#msg-list", c.trf("Revoked %d devices", n))
+				},
+				Complete: func(c *client, words []string) []string {
+					var ids []string
+					for _, d := range userDevices(c.user.Name) {
+						ids = append(ids, d.Id)
+					}
+					return append(ids, "all")
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,289 @@
+//go:build e2e
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+End to end tests: the server is built and started on ephemeral ports with a
+throwaway work directory and self-signed certificate, then client.html is
+driven in headless Chrome via chromedp, exactly as a user would. They catch
+protocol and DOM op changes that break the real client.
+
+The tests need Chrome or Chromium and are only built with the e2e tag:
+
+	go test -tags e2e ./e2e
+*/
+
+//
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/chromedp/chromedp"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const password = "correct horse battery"
+
+// server is a running soshell instance.
+type server struct {
+	url   string // https base URL
+	https string // https address
+	cmd   *exec.Cmd
+}
+
+// freePort returns a port nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// writeCert writes a self-signed certificate for localhost to dir.
+func writeCert(t *testing.T, dir string) (cert, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// startServer builds the server and starts it in a temporary directory.
+func startServer(t *testing.T) *server {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "soshell")
+	build := exec.Command("go", "build", "-o", bin, "..")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+	public, err := filepath.Abs("../public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key := writeCert(t, dir)
+	s := &server{https: ":" + strconv.Itoa(freePort(t))}
+	s.url = "https://localhost" + s.https
+	s.cmd = exec.Command(bin,
+		"-http", "127.0.0.1:"+strconv.Itoa(freePort(t)),
+		"-https", s.https,
+		"-host", "localhost",
+		"-work", filepath.Join(dir, "work"),
+		"-users", filepath.Join(dir, "users"),
+		"-public", public,
+		"-cert", cert,
+		"-key", key)
+	s.cmd.Dir = dir
+	var log bytes.Buffer
+	s.cmd.Stdout, s.cmd.Stderr = &log, &log
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+		if t.Failed() {
+			t.Logf("server log:\n%s", log.String())
+		}
+	})
+	for i := 0; i < 100; i++ {
+		conn, err := tls.Dial("tcp", "localhost"+s.https, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			return s
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return nil
+}
+
+// browser starts headless Chrome, skipping the test if it isn't installed.
+func browser(t *testing.T) context.Context {
+	found := false
+	for _, name := range []string{"google-chrome", "chromium", "chromium-browser", "headless-shell", "chrome"} {
+		if _, err := exec.LookPath(name); err == nil {
+			found = true
+		}
+	}
+	if !found {
+		t.Skip("Chrome is not installed")
+	}
+	opts := append(chromedp.DefaultExecAllocatorOptions[:], chromedp.Flag("ignore-certificate-errors", true))
+	actx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
+	t.Cleanup(cancel)
+	ctx, cancel := chromedp.NewContext(actx)
+	t.Cleanup(cancel)
+	ctx, cancel = context.WithTimeout(ctx, time.Minute)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// open loads the client and waits for the websocket to connect. The first
+// visit tour is marked as seen so it doesn't prompt.
+func open(url string) chromedp.Action {
+	return chromedp.Tasks{
+		chromedp.Navigate(url),
+		chromedp.Evaluate(`localStorage.setItem("soshell.visited", "1")`, nil),
+		chromedp.Reload(),
+		chromedp.Poll(`typeof ws !== "undefined" && ws.readyState === WebSocket.OPEN`, nil),
+	}
+}
+
+// send types a line into the command box and submits it.
+func send(text string) chromedp.Action {
+	return chromedp.Tasks{
+		chromedp.SetValue("#msg-txt", text, chromedp.ByID),
+		chromedp.Submit("#msg-txt", chromedp.ByID),
+	}
+}
+
+// waitFor waits until the message list shows text.
+func waitFor(text string) chromedp.Action {
+	return chromedp.Poll(`document.getElementById("msg-list").textContent.includes(`+strconv.Quote(text)+`)`,
+		nil, chromedp.WithPollingTimeout(10*time.Second))
+}
+
+// inputType waits until the command box has type typ.
+func inputType(typ string) chromedp.Action {
+	return chromedp.Poll(`document.getElementById("msg-txt").type === `+strconv.Quote(typ),
+		nil, chromedp.WithPollingTimeout(10*time.Second))
+}
+
+func TestUnknownCommand(t *testing.T) {
+	s := startServer(t)
+	ctx := browser(t)
+	if err := chromedp.Run(ctx, open(s.url),
+		send("/nosuchcmd"),
+		waitFor("nosuchcmd: command not found"),
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterLoginChat(t *testing.T) {
+	s := startServer(t)
+	ctx := browser(t)
+
+	// register prompts for an email and the password twice; the password
+	// prompts switch the command box to a password field and back.
+	if err := chromedp.Run(ctx, open(s.url),
+		send("register alice"),
+		waitFor("Enter your email address"),
+		send("alice@example.com"),
+		waitFor("Enter a good password"),
+		inputType("password"),
+		send(password),
+		waitFor("Re-enter your password"),
+		send(password),
+		waitFor("User account created"),
+		inputType("text"),
+	); err != nil {
+		t.Fatal("register: ", err)
+	}
+
+	var status string
+	if err := chromedp.Run(ctx, open(s.url),
+		send("login alice"),
+		waitFor("Please enter your password"),
+		inputType("password"),
+		send(password),
+		waitFor("Welcome back, alice"),
+		inputType("text"),
+		chromedp.Text("#status-box", &status, chromedp.ByID),
+	); err != nil {
+		t.Fatal("login: ", err)
+	}
+	if status != "alice" {
+		t.Errorf("status box shows %q, want alice", status)
+	}
+
+	// A message posted to the lobby through the API reaches the browser.
+	req, err := http.NewRequest("POST", s.url+"/api/rooms/lobby/messages",
+		bytes.NewBufferString(`{"Text": "hello from the API"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", password)
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("posting a message: status %d", resp.StatusCode)
+	}
+	if err := chromedp.Run(ctx, waitFor("hello from the API")); err != nil {
+		t.Fatal("chat: ", err)
+	}
+
+	// A line that isn't a command is said in the current room.
+	if err := chromedp.Run(ctx, send("hello everyone"), waitFor("[alice] hello everyone")); err != nil {
+		t.Fatal("say: ", err)
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	s := startServer(t)
+	ctx := browser(t)
+	if err := chromedp.Run(ctx, open(s.url),
+		send("login bob"),
+		waitFor("User does not exist"),
+		send("register bob"),
+		waitFor("Enter your email address"),
+		send("bob@example.com"),
+		waitFor("Enter a good password"),
+		send(password),
+		waitFor("Re-enter your password"),
+		send("something else"),
+		waitFor("Passwords did not match"),
+		inputType("text"),
+	); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,284 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The edit system lets several users edit a virtual file at the same time. Each
+open file has a server side edit session holding the authoritative text and
+revision number. Clients send single replace operations (position, deleted
+length, inserted text) based on the last revision they saw; the server
+transforms them against anything applied since (operational transform),
+applies them and fans the result out to every participant. Positions are in
+UTF-16 code units to match JavaScript strings.
+*/
+
+//
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// editOp replaces Del code units at Pos with Ins.
+type editOp struct {
+	Pos, Del int
+	Ins      []uint16
+}
+
+// transform returns a adjusted to apply after b. When both ops insert at the
+// same position, or replace the same range, the op with priority (aFirst)
+// goes first. A range deleted by one op swallows any op inside it.
+func (a editOp) transform(b editOp, aFirst bool) editOp {
+	as, ae := a.Pos, a.Pos+a.Del
+	bs, be, bl := b.Pos, b.Pos+b.Del, len(b.Ins)
+	switch {
+	case as == bs && a.Del == 0 && b.Del == 0:
+		if !aFirst {
+			a.Pos += bl
+		}
+		return a
+	case ae <= bs:
+		return a
+	case as >= be:
+		a.Pos += bl - b.Del
+		return a
+	case as == bs && ae == be:
+		if aFirst {
+			a.Del = bl
+			return a
+		}
+		return editOp{Pos: bs + bl}
+	case as <= bs && be <= ae:
+		a.Del += bl - b.Del
+		return a
+	case bs <= as && ae <= be:
+		return editOp{Pos: bs + bl}
+	case as < bs:
+		a.Del = bs - as
+		return a
+	}
+	return editOp{Pos: bs + bl, Del: ae - be, Ins: a.Ins}
+}
+
+// editSession is a file being edited.
+type editSession struct {
+	sync.Mutex
+	id, owner, path string
+	text            []uint16
+	history         []editOp           // history[i] produced revision i+1
+	members         map[*client]string // client -> author tag sent with ops
+	invited         map[string]bool
+	dirty           bool
+}
+
+var edits = struct {
+	sync.Mutex
+	list   map[string]*editSession
+	nextId int
+}{list: make(map[string]*editSession)}
+
+// sendAll sends p to every member of the session.
+func (s *editSession) sendAll(p packet) {
+	for c := range s.members {
+		c.send(p)
+	}
+}
+
+// open adds c to the session and sends it the editor pane.
+func (s *editSession) open(c *client) error {
+	s.members[c] = c.address
+	p := Editor{Id: s.id, Title: s.owner + ":" + s.path, Text: string(utf16.Decode(s.text)),
+		Rev: len(s.history), Author: s.members[c]}
+	return c.send(p.packet())
+}
+
+// save writes the text back to the owner's filesystem.
+func (s *editSession) save() error {
+	if err := writeVFile(s.owner, s.path, []byte(string(utf16.Decode(s.text)))); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// close removes c from the session, saving and ending it when the last
+// member leaves.
+func (s *editSession) close(c *client) {
+	s.Lock()
+	if _, ok := s.members[c]; !ok {
+		s.Unlock()
+		return
+	}
+	delete(s.members, c)
+	c.send(EditClose{Id: s.id}.packet())
+	empty := len(s.members) == 0
+	if empty && s.dirty {
+		if err := s.save(); err != nil {
+			log.Println(s.owner, s.path, err)
+		}
+	}
+	s.Unlock()
+	if empty {
+		edits.Lock()
+		delete(edits.list, s.id)
+		edits.Unlock()
+	}
+}
+
+// closeEdits removes a disconnecting client from all edit sessions.
+func closeEdits(c *client) {
+	edits.Lock()
+	var list []*editSession
+	for _, s := range edits.list {
+		list = append(list, s)
+	}
+	edits.Unlock()
+	for _, s := range list {
+		s.close(c)
+	}
+}
+
+// findEdit returns the session with id if c is a member of it.
+func findEdit(c *client, id string) *editSession {
+	edits.Lock()
+	s := edits.list[id]
+	edits.Unlock()
+	if s != nil {
+		s.Lock()
+		_, ok := s.members[c]
+		s.Unlock()
+		if ok {
+			return s
+		}
+	}
+	return nil
+}
+
+func init() {
+	cmdMap["edit"] = command{
+		Desc:     "Opens a file in a shared editor; invite others to edit it with you.",
+		Usage:    "edit <file> | edit invite <id> <user> | edit join <id>",
+		Category: "Files",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) == 4 && args[1] == "invite" {
+				edits.Lock()
+				s := edits.list[args[2]]
+				edits.Unlock()
+				if s == nil || s.owner != c.user.Name {
+					return c.appendMsg("#msg-list", "No such edit session: "+args[2])
+				}
+				s.Lock()
+				s.invited[strings.ToLower(args[3])] = true
+				s.Unlock()
+				for _, other := range clientsByName(args[3]) {
+					other.appendMsg("#msg-list", c.user.Name+" invited you to edit "+s.path+", type: edit join "+s.id)
+				}
+				return c.appendMsg("#msg-list", "Invited "+args[3])
+			}
+			if len(args) == 3 && args[1] == "join" {
+				edits.Lock()
+				s := edits.list[args[2]]
+				edits.Unlock()
+				if s == nil {
+					return c.appendMsg("#msg-list", "No such edit session: "+args[2])
+				}
+				s.Lock()
+				defer s.Unlock()
+				if s.owner != c.user.Name && !s.invited[strings.ToLower(c.user.Name)] {
+					return c.appendMsg("#msg-list", "You haven't been invited to edit "+s.path)
+				}
+				return s.open(c)
+			}
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: edit <file> | edit invite <id> <user> | edit join <id>")
+			}
+			_, virtual := vfsPath(c.user.Name, args[1])
+			edits.Lock()
+			var s *editSession
+			for _, open := range edits.list {
+				if open.owner == c.user.Name && open.path == virtual {
+					s = open
+				}
+			}
+			if s == nil {
+				real, _ := vfsPath(c.user.Name, virtual)
+				b, err := ioutil.ReadFile(real)
+				if err != nil && !os.IsNotExist(err) {
+					edits.Unlock()
+					return c.appendMsg("#msg-list", "edit: "+err.Error())
+				}
+				s = &editSession{id: strconv.Itoa(edits.nextId), owner: c.user.Name, path: virtual,
+					text: utf16.Encode([]rune(string(b))), members: make(map[*client]string), invited: make(map[string]bool)}
+				edits.nextId++
+				edits.list[s.id] = s
+			}
+			edits.Unlock()
+			s.Lock()
+			defer s.Unlock()
+			if e = s.open(c); e == nil {
+				e = c.appendMsg("#msg-list", "Editing "+virtual+" (session "+s.id+")")
+			}
+			return
+		},
+	}
+	packetMap["editOp"] = func(c *client, p packet) error {
+		s := findEdit(c, p.Data["Id"])
+		if s == nil {
+			return nil
+		}
+		s.Lock()
+		defer s.Unlock()
+		base, e1 := strconv.Atoi(p.Data["Base"])
+		pos, e2 := strconv.Atoi(p.Data["Pos"])
+		del, e3 := strconv.Atoi(p.Data["Del"])
+		op := editOp{Pos: pos, Del: del, Ins: utf16.Encode([]rune(p.Data["Ins"]))}
+		if e1 != nil || e2 != nil || e3 != nil || base < 0 || base > len(s.history) {
+			return s.open(c) // out of sync, resend the document
+		}
+		for _, h := range s.history[base:] {
+			op = op.transform(h, false)
+		}
+		if op.Pos < 0 || op.Del < 0 || op.Pos+op.Del > len(s.text) {
+			return s.open(c)
+		}
+		if err := checkQuota(s.owner, int64(len(op.Ins)-op.Del)); err != nil {
+			c.appendMsg("#msg-list", "edit: "+err.Error())
+			return s.open(c)
+		}
+		text := append([]uint16{}, s.text[:op.Pos]...)
+		text = append(text, op.Ins...)
+		s.text = append(text, s.text[op.Pos+op.Del:]...)
+		s.history = append(s.history, op)
+		s.dirty = true
+		out := EditOp{Id: s.id, Rev: len(s.history), Pos: op.Pos, Del: op.Del, Ins: string(utf16.Decode(op.Ins)),
+			Len: len(s.text), Author: s.members[c]}
+		s.sendAll(out.packet())
+		return nil
+	}
+	packetMap["editSave"] = func(c *client, p packet) error {
+		s := findEdit(c, p.Data["Id"])
+		if s == nil {
+			return nil
+		}
+		s.Lock()
+		err := s.save()
+		s.Unlock()
+		if err != nil {
+			return c.appendMsg("#msg-list", "edit: "+err.Error())
+		}
+		return c.appendMsg("#msg-list", "Saved "+s.path)
+	}
+	packetMap["editClose"] = func(c *client, p packet) error {
+		if s := findEdit(c, p.Data["Id"]); s != nil {
+			s.close(c)
+		}
+		return nil
+	}
+}
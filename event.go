@@ -0,0 +1,277 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The event system is a shared calendar of room scoped events. Times are entered
+and shown in each user's own time zone but stored in UTC. Attendees are
+reminded shortly before an event starts, and every room's calendar can be
+subscribed to over HTTP as an iCal feed at /cal/<room>.ics.
+*/
+
+//
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventWarn is how long before an event starts attendees are reminded.
+const eventWarn = 15 * time.Minute
+
+// event is a single calendar entry.
+type event struct {
+	Id, Room, Title, Owner string
+	At                     time.Time
+	RSVP                   map[string]string // user name -> yes, no or maybe
+}
+
+var events = struct {
+	sync.Mutex
+	list   map[string]*event
+	nextId int
+}{list: make(map[string]*event)}
+
+// eventsPath is the file events are persisted in.
+func eventsPath() string {
+	return *work + SEP + "events.json"
+}
+
+// saveEvents writes all events to disk. Callers must hold the lock.
+func saveEvents() error {
+	var list []*event
+	for _, ev := range events.list {
+		list = append(list, ev)
+	}
+	return saveJSON(list, eventsPath())
+}
+
+// loadEvents reads persisted events and schedules their reminders. It is
+// called once from main.
+func loadEvents() {
+	var list []*event
+	if e := loadJSON(&list, eventsPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	events.Lock()
+	defer events.Unlock()
+	for _, ev := range list {
+		events.list[ev.Id] = ev
+		if n, _ := strconv.Atoi(ev.Id); n >= events.nextId {
+			events.nextId = n + 1
+		}
+		scheduleEvent(ev)
+	}
+}
+
+// scheduleEvent arranges for attendees of ev to be reminded before it starts.
+func scheduleEvent(ev *event) {
+	if at := ev.At.Add(-eventWarn); at.After(time.Now()) {
+		sched.at("event:"+ev.Id, at, func() { warnEvent(ev.Id) })
+	}
+}
+
+// warnEvent notifies the owner and everyone who hasn't declined ev.
+func warnEvent(id string) {
+	events.Lock()
+	ev, ok := events.list[id]
+	if !ok {
+		events.Unlock()
+		return
+	}
+	names := []string{ev.Owner}
+	for name, answer := range ev.RSVP {
+		if answer != "no" && !strings.EqualFold(name, ev.Owner) {
+			names = append(names, name)
+		}
+	}
+	title, room, at := ev.Title, ev.Room, ev.At
+	events.Unlock()
+	for _, name := range names {
+		for _, c := range clientsByName(name) {
+			text := fmt.Sprintf("Event starting at %s in #%s: %s",
+				at.In(c.user.location()).Format("15:04"), room, title)
+			if e := c.toast(text); e == nil {
+				c.appendMsg("#msg-list", text)
+			}
+		}
+	}
+}
+
+// roomEvents returns the events of room sorted by start time.
+func roomEvents(room string) (list []*event) {
+	for _, ev := range events.list {
+		if ev.Room == room {
+			list = append(list, ev)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return
+}
+
+// icalEscape escapes text for use in an iCal property value.
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// serveCal serves a room's events as an iCal calendar.
+func serveCal(w http.ResponseWriter, r *http.Request) {
+	room := strings.ToLower(mux.Vars(r)["room"])
+	if !isName(room) || isPrivate(room) {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	events.Lock()
+	list := roomEvents(room)
+	var b strings.Builder
+	b.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//soshell//events//EN\r\n")
+	b.WriteString("X-WR-CALNAME:#" + room + "\r\n")
+	for _, ev := range list {
+		b.WriteString("BEGIN:VEVENT\r\n")
+		b.WriteString("UID:" + ev.Id + "@" + *hostname + "\r\n")
+		b.WriteString("DTSTAMP:" + time.Now().UTC().Format("20060102T150405Z") + "\r\n")
+		b.WriteString("DTSTART:" + ev.At.UTC().Format("20060102T150405Z") + "\r\n")
+		b.WriteString("SUMMARY:" + icalEscape(ev.Title) + "\r\n")
+		b.WriteString("ORGANIZER;CN=" + ev.Owner + ":noreply@" + *hostname + "\r\n")
+		b.WriteString("END:VEVENT\r\n")
+	}
+	events.Unlock()
+	b.WriteString("END:VCALENDAR\r\n")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+func init() {
+	cmdMap["event"] = command{
+		Desc:     "Manages room calendars.",
+		Usage:    "event add [#room] <YYYY-MM-DD HH:MM> <title> | event list [#room] | event rsvp <id> <yes|no|maybe> | event rm <id> | event tz <zone>",
+		Examples: []string{"event add #dev 2026-11-02 18:00 Release party", "event rsvp 3 yes"},
+		Category: "Rooms",
+		Handler: func(c *client, args []string) (e error) {
+			usage := "Usage: event add|list|rsvp|rm|tz ..."
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", usage)
+			}
+			loc := c.user.location()
+			switch args[1] {
+			case "list":
+				room, _ := roomArg(args[2:])
+				if !c.reachRoom("event", room) {
+					return nil
+				}
+				events.Lock()
+				rows := [][]string{{"Id", "When (" + loc.String() + ")", "Title", "Owner", "Going"}}
+				for _, ev := range roomEvents(room) {
+					if ev.At.Before(time.Now()) {
+						continue
+					}
+					going := 0
+					for _, a := range ev.RSVP {
+						if a == "yes" {
+							going++
+						}
+					}
+					rows = append(rows, []string{ev.Id, ev.At.In(loc).Format("Mon 2006-01-02 15:04"),
+						ev.Title, ev.Owner, strconv.Itoa(going)})
+				}
+				events.Unlock()
+				if len(rows) == 1 {
+					return c.appendMsg("#msg-list", "No upcoming events in #"+room)
+				}
+				e = c.appendPre("#msg-list", formatTable(rows, true))
+				if e == nil {
+					e = c.appendMsg("#msg-list", "Subscribe: https://"+*hostname+*httpsAddr+"/cal/"+room+".ics")
+				}
+				return
+			case "tz":
+				if len(args) != 3 {
+					return c.appendMsg("#msg-list", "Your time zone is "+loc.String())
+				}
+				if _, err := time.LoadLocation(args[2]); err != nil {
+					return c.appendMsg("#msg-list", "Unknown time zone: "+args[2])
+				}
+				c.user.TZ = args[2]
+				if e = c.user.commit(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "Time zone set to "+args[2])
+			}
+			if c.user.key == nil {
+				return c.appendMsg("#msg-list", "You must be logged in to manage events")
+			}
+			switch args[1] {
+			case "add":
+				room, rest := roomArg(args[2:])
+				if len(rest) < 3 {
+					return c.appendMsg("#msg-list", "Usage: event add [#room] <YYYY-MM-DD HH:MM> <title>")
+				}
+				if !c.reachRoom("event", room) {
+					return nil
+				}
+				at, err := time.ParseInLocation("2006-01-02 15:04", rest[0]+" "+rest[1], loc)
+				if err != nil {
+					return c.appendMsg("#msg-list", "Bad date, use YYYY-MM-DD HH:MM")
+				}
+				if at.Before(time.Now()) {
+					return c.appendMsg("#msg-list", "That time has already passed")
+				}
+				events.Lock()
+				ev := &event{Id: strconv.Itoa(events.nextId), Room: room, Title: strings.Join(rest[2:], " "),
+					Owner: c.user.Name, At: at.UTC(), RSVP: map[string]string{c.user.Name: "yes"}}
+				events.nextId++
+				events.list[ev.Id] = ev
+				e = saveEvents()
+				events.Unlock()
+				if e != nil {
+					return
+				}
+				scheduleEvent(ev)
+				return c.appendMsg("#msg-list", "Event "+ev.Id+" added to #"+room)
+			case "rsvp":
+				if len(args) != 4 || (args[3] != "yes" && args[3] != "no" && args[3] != "maybe") {
+					return c.appendMsg("#msg-list", "Usage: event rsvp <id> <yes|no|maybe>")
+				}
+				events.Lock()
+				defer events.Unlock()
+				ev, ok := events.list[args[2]]
+				if !ok || !mayEnter(&c.user, ev.Room) {
+					return c.appendMsg("#msg-list", "No such event: "+args[2])
+				}
+				ev.RSVP[c.user.Name] = args[3]
+				if e = saveEvents(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "RSVP "+args[3]+" to "+ev.Title)
+			case "rm":
+				if len(args) != 3 {
+					return c.appendMsg("#msg-list", "Usage: event rm <id>")
+				}
+				events.Lock()
+				defer events.Unlock()
+				ev, ok := events.list[args[2]]
+				if !ok || !strings.EqualFold(ev.Owner, c.user.Name) {
+					return c.appendMsg("#msg-list", "No such event: "+args[2])
+				}
+				sched.cancel("event:" + ev.Id)
+				delete(events.list, ev.Id)
+				if e = saveEvents(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "Event removed")
+			}
+			return c.appendMsg("#msg-list", usage)
+		},
+	}
+}
@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The exportlog command exports a room's (or a direct conversation's) message
+history as JSON, CSV or HTML and sends it to the client as a file download.
+Private rooms are only exported for the users who may join them, see
+roomperm.go.
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	exportMax   = 50000 // messages per export
+	exportLimit = newRateLimiter(5, time.Hour)
+)
+
+// exportMessages renders msgs of conversation title in format.
+func exportMessages(title, format string, msgs []message, loc *time.Location) ([]byte, string) {
+	var b bytes.Buffer
+	switch format {
+	case "csv":
+		w := csv.NewWriter(&b)
+		w.Write([]string{"id", "time", "from", "text"})
+		for _, m := range msgs {
+			w.Write([]string{strconv.Itoa(m.Id), m.Time.In(loc).Format(time.RFC3339), m.From, m.Text})
+		}
+		w.Flush()
+		return b.Bytes(), "text/csv"
+	case "html":
+		b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>" + html.EscapeString(title) +
+			"</title></head><body>\n<h1>" + html.EscapeString(title) + "</h1>\n<table>\n")
+		for _, m := range msgs {
+			b.WriteString("<tr><td>" + m.Time.In(loc).Format("2006-01-02 15:04") + "</td><td><b>" +
+				html.EscapeString(m.From) + "</b></td><td>" + html.EscapeString(m.Text) + "</td></tr>\n")
+		}
+		b.WriteString("</table>\n</body></html>\n")
+		return b.Bytes(), "text/html"
+	}
+	if msgs == nil {
+		msgs = []message{}
+	}
+	out, _ := json.MarshalIndent(msgs, "", "\t")
+	return out, "application/json"
+}
+
+// parseDay parses a date (2006-01-02) or RFC 3339 time in loc.
+func parseDay(s string, loc *time.Location) (time.Time, bool) {
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+func init() {
+	cmdMap["exportlog"] = command{
+		Desc:  "Downloads the message history of a room or conversation.",
+		Usage: "exportlog #room|@user [options]",
+		Flags: []flagDoc{
+			{"from", "2006-01-02", "first day to export"},
+			{"to", "2006-01-02", "last day to export"},
+			{"format", "json|csv|html", "file format, json by default"},
+		},
+		Examples: []string{"exportlog #dev --from 2026-10-01 --format csv"},
+		Category: "Files",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			usage := "Usage: exportlog #room|@user [--from 2006-01-02] [--to 2006-01-02] [--format json|csv|html]"
+			opts, rest, err := parseFlags(args, commandNamed("exportlog").flagSpec())
+			if err != nil || len(rest) != 1 {
+				return c.appendMsg("#msg-list", usage)
+			}
+			var key, title string
+			switch target := rest[0]; {
+			case strings.HasPrefix(target, "#") && isName(target[1:]) && len(target) > 1:
+				room := strings.ToLower(target[1:])
+				if !c.reachRoom("exportlog", room) {
+					return nil
+				}
+				key, title = roomKey(room), "#"+room
+			case strings.HasPrefix(target, "@") && userExists(target[1:]):
+				key, title = dmKey(c.user.Name, target[1:]), c.user.Name+" and "+target[1:]
+			default:
+				return c.appendMsg("#msg-list", usage)
+			}
+			loc := c.user.location()
+			var from, to time.Time
+			ok := true
+			if val, set := opts["from"]; set {
+				from, ok = parseDay(val, loc)
+			}
+			if val, set := opts["to"]; set && ok {
+				// A bare date includes the whole day.
+				if to, ok = parseDay(val, loc); ok && !strings.Contains(val, "T") {
+					to = to.AddDate(0, 0, 1)
+				}
+			}
+			format := strings.ToLower(opts["format"])
+			switch format {
+			case "":
+				format = "json"
+			case "json", "csv", "html":
+			default:
+				ok = false
+			}
+			if !ok {
+				return c.appendMsg("#msg-list", usage)
+			}
+			if !exportLimit.allow(c.user.Name) {
+				return c.appendMsg("#msg-list", "exportlog: rate limit reached, try again later")
+			}
+			history.Lock()
+			all, err := readHistory(key)
+			history.Unlock()
+			if err != nil {
+				return c.appendMsg("#msg-list", "exportlog: "+err.Error())
+			}
+			var msgs []message
+			for _, m := range all {
+				if (from.IsZero() || !m.Time.Before(from)) && (to.IsZero() || m.Time.Before(to)) {
+					msgs = append(msgs, m)
+				}
+			}
+			if len(msgs) > exportMax {
+				msgs = msgs[len(msgs)-exportMax:]
+			}
+			if len(msgs) == 0 {
+				return c.appendMsg("#msg-list", "exportlog: no messages in that range")
+			}
+			b, mime := exportMessages(title, format, msgs, loc)
+			name := strings.NewReplacer("#", "", "@", "", " and ", "-").Replace(title) + "-" +
+				time.Now().In(loc).Format("20060102") + "." + format
+			if e = c.download(name, mime, b); e == nil {
+				e = c.appendMsg("#msg-list", "Exported "+strconv.Itoa(len(msgs))+" messages to "+name)
+			}
+			return
+		},
+		Background: true,
+	}
+}
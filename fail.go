@@ -0,0 +1,46 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Failures, a command that doesn't exist or that the user may not run, input
+that fails validation (see validate.go), ..., are sent as "error" packets
+instead of plain messages, so the page can show them apart from normal output
+and scripts can act on them. An error packet holds:
+
+	Code     what went wrong, one of the codes below, for machines
+	Message  what went wrong, in the user's language, for people
+	Request  the Id of the packet from the page that failed, if it had one
+
+Pages older than protocol version 5 (see caps.go) get the message as a
+normal one.
+*/
+
+//
+package main
+
+// Error codes.
+const (
+	codeMalformed   = "malformed-packet"
+	codeTooMany     = "too-many-fields"
+	codeSelector    = "selector-not-allowed"
+	codeUnknown     = "unknown-packet"
+	codeChannel     = "unknown-channel"
+	codeLineLong    = "line-too-long"
+	codeArgs        = "too-many-args"
+	codeNotFound    = "command-not-found"
+	codeLogin       = "login-required"
+	codeForbidden   = "permission-denied"
+	codeRateLimited = "rate-limited"
+	codeSession     = "session-expired"
+)
+
+// fail tells c that the request with Id request, empty for typed lines,
+// failed with code; text is translated.
+func (c *client) fail(code, request, text string) error {
+	text = c.tr(text)
+	if c.protocol() < 5 {
+		return c.send(AppendElement{Selector: "#msg-list", Element: "div", Class: "msg", Text: text, Scroll: true}.packet())
+	}
+	return c.send(Error{Selector: "#msg-list", Code: code, Message: text, Request: request}.packet())
+}
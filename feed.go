@@ -0,0 +1,322 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The feed system polls RSS and Atom feeds in the background and posts new items
+into a room or directly to the user who subscribed. Items already seen are
+remembered per feed so restarts don't repost them, and each poll delivers at
+most feedBurst items per feed. Like webhooks, feeds only post into a room
+while their owner may enter it, see hook.go.
+*/
+
+//
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	feedInterval = flag.Duration("feed-interval", 10*time.Minute, "how often subscribed feeds are polled")
+	feedBurst    = 5   // maximum items posted per feed per poll
+	feedSeenMax  = 500 // item ids remembered per feed
+	feedMax      = 20  // subscriptions per user
+)
+
+// feed is a single subscription.
+type feed struct {
+	Id, URL, Owner, Room, Title string
+	Seen                        []string
+}
+
+var feeds = struct {
+	sync.Mutex
+	list   map[string]*feed
+	nextId int
+}{list: make(map[string]*feed)}
+
+// feedItem is an entry of either an RSS or an Atom feed.
+type feedItem struct {
+	Id, Title, Link string
+}
+
+// feedsPath is the file subscriptions are persisted in.
+func feedsPath() string {
+	return *work + SEP + "feeds.json"
+}
+
+// saveFeeds writes all subscriptions to disk. Callers must hold the lock.
+func saveFeeds() error {
+	var list []*feed
+	for _, f := range feeds.list {
+		list = append(list, f)
+	}
+	return saveJSON(list, feedsPath())
+}
+
+// parseFeed parses an RSS 2.0 or Atom document.
+func parseFeed(b []byte) (title string, items []feedItem, e error) {
+	var doc struct {
+		XMLName xml.Name
+		Title   string `xml:"title"`
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title string `xml:"title"`
+				Link  string `xml:"link"`
+				Guid  string `xml:"guid"`
+			} `xml:"item"`
+		} `xml:"channel"`
+		Entries []struct {
+			Title string `xml:"title"`
+			Id    string `xml:"id"`
+			Links []struct {
+				Href string `xml:"href,attr"`
+				Rel  string `xml:"rel,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	if e = xml.Unmarshal(b, &doc); e != nil {
+		return
+	}
+	switch doc.XMLName.Local {
+	case "rss":
+		title = doc.Channel.Title
+		for _, it := range doc.Channel.Items {
+			id := it.Guid
+			if id == "" {
+				id = it.Link
+			}
+			items = append(items, feedItem{id, strings.TrimSpace(it.Title), strings.TrimSpace(it.Link)})
+		}
+	case "feed":
+		title = doc.Title
+		for _, en := range doc.Entries {
+			link := ""
+			for _, l := range en.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = l.Href
+					break
+				}
+			}
+			id := en.Id
+			if id == "" {
+				id = link
+			}
+			items = append(items, feedItem{id, strings.TrimSpace(en.Title), link})
+		}
+	default:
+		e = errors.New("not an RSS or Atom feed")
+	}
+	return
+}
+
+// fetchFeed downloads and parses the feed at u.
+func fetchFeed(u string) (string, []feedItem, error) {
+	req, e := http.NewRequest("GET", u, nil)
+	if e != nil {
+		return "", nil, e
+	}
+	req.Header.Set("User-Agent", "soshell/1.0 (https://"+*hostname+")")
+	res, e := publicClient.Do(req)
+	if e != nil {
+		return "", nil, e
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", nil, errors.New("feed returned " + res.Status)
+	}
+	b, e := ioutil.ReadAll(io.LimitReader(res.Body, 4<<20))
+	if e != nil {
+		return "", nil, e
+	}
+	return parseFeed(b)
+}
+
+// pollFeed fetches f and delivers unseen items.
+func pollFeed(f *feed) {
+	_, items, err := fetchFeed(f.URL)
+	if err != nil {
+		log.Println("feed", f.URL, err)
+		return
+	}
+	feeds.Lock()
+	seen := make(map[string]bool)
+	for _, id := range f.Seen {
+		seen[id] = true
+	}
+	var fresh []feedItem
+	for _, it := range items {
+		if !seen[it.Id] {
+			fresh = append(fresh, it)
+			f.Seen = append(f.Seen, it.Id)
+		}
+	}
+	if n := len(f.Seen); n > feedSeenMax {
+		f.Seen = f.Seen[n-feedSeenMax:]
+	}
+	if len(fresh) > 0 {
+		if e := saveFeeds(); e != nil {
+			log.Println(e)
+		}
+	}
+	room, owner, title := f.Room, f.Owner, f.Title
+	feeds.Unlock()
+	// Feeds list newest first; post the oldest of the burst first.
+	if len(fresh) > feedBurst {
+		fresh = fresh[:feedBurst]
+	}
+	for i := len(fresh) - 1; i >= 0; i-- {
+		text := fresh[i].Title + " " + fresh[i].Link
+		if room != "" {
+			if !mayEnterAs(owner, room) {
+				return // see hook.go
+			}
+			postRoom(room, title, text)
+		} else {
+			for _, c := range clientsByName(owner) {
+				c.appendMsg("#msg-list", "["+title+"] "+text)
+			}
+		}
+	}
+}
+
+// startFeeds loads subscriptions and starts the background poller. It is
+// called once from main.
+func startFeeds() {
+	var list []*feed
+	if e := loadJSON(&list, feedsPath()); e != nil && !os.IsNotExist(e) {
+		log.Println(e)
+	}
+	feeds.Lock()
+	for _, f := range list {
+		feeds.list[f.Id] = f
+		if n, _ := strconv.Atoi(f.Id); n >= feeds.nextId {
+			feeds.nextId = n + 1
+		}
+	}
+	feeds.Unlock()
+	go func() {
+		for range time.Tick(*feedInterval) {
+			feeds.Lock()
+			var list []*feed
+			for _, f := range feeds.list {
+				list = append(list, f)
+			}
+			feeds.Unlock()
+			for _, f := range list {
+				pollFeed(f)
+			}
+		}
+	}()
+}
+
+func init() {
+	cmdMap["feed"] = command{
+		Desc:     "Manages RSS/Atom subscriptions.",
+		Usage:    "feed add <url> [#room] | feed list | feed rm <id>",
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			switch {
+			case len(args) >= 3 && args[1] == "add":
+				u, err := url.Parse(args[2])
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					return c.appendMsg("#msg-list", "feed: not a valid http(s) URL")
+				}
+				room := ""
+				if len(args) > 3 {
+					if room, _ = roomArg(args[3:4]); !strings.HasPrefix(args[3], "#") {
+						return c.appendMsg("#msg-list", "Usage: feed add <url> [#room]")
+					}
+					if !c.reachRoom("feed", room) {
+						return nil
+					}
+					if !mayEnterAs(c.user.Name, room) {
+						return c.fail(codeForbidden, "", c.trf("%s: permission denied", "feed"))
+					}
+				}
+				feeds.Lock()
+				n := 0
+				for _, f := range feeds.list {
+					if f.Owner == c.user.Name {
+						n++
+					}
+				}
+				feeds.Unlock()
+				if n >= feedMax {
+					return c.appendMsg("#msg-list", "feed: subscription limit reached")
+				}
+				title, items, err := fetchFeed(u.String())
+				if err != nil {
+					return c.appendMsg("#msg-list", "feed: "+err.Error())
+				}
+				if title == "" {
+					title = u.Host
+				}
+				// Existing items count as seen so subscribing doesn't flood.
+				f := &feed{URL: u.String(), Owner: c.user.Name, Room: room, Title: title}
+				for _, it := range items {
+					f.Seen = append(f.Seen, it.Id)
+				}
+				feeds.Lock()
+				f.Id = strconv.Itoa(feeds.nextId)
+				feeds.nextId++
+				feeds.list[f.Id] = f
+				e = saveFeeds()
+				feeds.Unlock()
+				if e != nil {
+					return
+				}
+				dest := "you"
+				if room != "" {
+					dest = "#" + room
+				}
+				return c.appendMsg("#msg-list", "Subscribed to "+title+" (feed "+f.Id+"), new items go to "+dest)
+			case len(args) == 2 && args[1] == "list":
+				feeds.Lock()
+				rows := [][]string{{"Id", "Title", "To", "URL"}}
+				for _, f := range feeds.list {
+					if f.Owner == c.user.Name {
+						to := "you"
+						if f.Room != "" {
+							to = "#" + f.Room
+						}
+						rows = append(rows, []string{f.Id, f.Title, to, f.URL})
+					}
+				}
+				feeds.Unlock()
+				if len(rows) == 1 {
+					return c.appendMsg("#msg-list", "No feeds")
+				}
+				return c.appendPre("#msg-list", formatTable(rows, true))
+			case len(args) == 3 && args[1] == "rm":
+				feeds.Lock()
+				defer feeds.Unlock()
+				f, ok := feeds.list[args[2]]
+				if !ok || f.Owner != c.user.Name {
+					return c.appendMsg("#msg-list", "No such feed: "+args[2])
+				}
+				delete(feeds.list, f.Id)
+				if e = saveFeeds(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "Unsubscribed from "+f.Title)
+			}
+			return c.appendMsg("#msg-list", "Usage: feed add <url> [#room] | feed list | feed rm <id>")
+		},
+	}
+}
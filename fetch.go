@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the helpers used by commands that call out to external
+HTTP APIs (weather, translation, etc). URLs that users give, like feeds, are
+fetched with publicClient, which only connects to public addresses so users
+can't reach the server's own network through it.
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+var publicClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublic}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// sharedNet is the shared address space of carrier-grade NAT, RFC 6598.
+var sharedNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublic reports whether ip is a public unicast address.
+func isPublic(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedNet.Contains(ip)
+}
+
+// dialPublic refuses connections to addresses that aren't public. It is
+// called with the address the host name resolved to, so names resolving to
+// private addresses are refused too.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+		return errors.New("refusing to connect to non-public address " + host)
+	}
+	return nil
+}
+
+// doJSON sends req and decodes the JSON response into obj.
+func doJSON(req *http.Request, obj interface{}) error {
+	// met.no and nominatim both require an identifying user agent.
+	req.Header.Set("User-Agent", "soshell/1.0 (https://"+*hostname+")")
+	res, e := httpClient.Do(req)
+	if e != nil {
+		return e
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return errors.New("upstream returned " + res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(obj)
+}
+
+// getJSON performs a GET request and decodes the JSON response into obj.
+func getJSON(u string, obj interface{}) error {
+	req, e := http.NewRequest("GET", u, nil)
+	if e != nil {
+		return e
+	}
+	return doJSON(req, obj)
+}
+
+// postJSON POSTs body as JSON and decodes the JSON response into obj.
+func postJSON(u string, body, obj interface{}) error {
+	b, e := json.Marshal(body)
+	if e != nil {
+		return e
+	}
+	req, e := http.NewRequest("POST", u, bytes.NewReader(b))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(req, obj)
+}
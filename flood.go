@@ -0,0 +1,170 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Flood protection. Each user may say -flood messages per period in a room,
+5/10s by default, typed or sent through the API, GraphQL or gRPC, from a
+token bucket per room (see ratelimit.go); operators change it for their room
+with mode +f 10/30s, and +f 0 turns it off there. A user talking faster has
+the message dropped and is struck: the first strike is a warning, the second
+mutes it in the room for -flood-mute (see mute.go) and the third disconnects
+its clients. Strikes are forgotten floodForgive after the last one. The
+room's operators and moderators aren't limited.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	floodLimit = flag.String("flood", "5/10s", "messages a user may say in a room per period, 0 for no limit; rooms override it with mode +f")
+	floodMute  = flag.Duration("flood-mute", 5*time.Minute, "how long a user flooding a room after a warning is muted in it")
+)
+
+const floodForgive = 10 * time.Minute
+
+// floodState is the message rates and strikes of a user.
+type floodState struct {
+	buckets map[string]*bucket // room -> messages said in it
+	strikes int
+	last    time.Time // of the last strike
+}
+
+var floods = struct {
+	sync.Mutex
+	list   map[string]*floodState // lower case name -> rates and strikes
+	pruned time.Time              // when quiet users were last dropped
+}{list: make(map[string]*floodState)}
+
+// parseFlood parses a flood limit, n messages per period like "5/10s", or
+// "0" for none.
+func parseFlood(s string) (n int, per time.Duration, err error) {
+	if s == "0" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 {
+		n, err = strconv.Atoi(parts[0])
+		if err == nil {
+			per, err = time.ParseDuration(parts[1])
+		}
+		if err == nil && n > 0 && per > 0 {
+			return n, per, nil
+		}
+	}
+	return 0, 0, errors.New("flood limits look like 5/10s, or 0 for none")
+}
+
+// floodRate returns the flood limit of room, n 0 for none.
+func floodRate(room string) (n int, per time.Duration) {
+	limit := *floodLimit
+	if r, ok := findRoom(room); ok && r.Flood != "" {
+		limit = r.Flood
+	}
+	n, per, err := parseFlood(limit)
+	if err != nil {
+		log.Println("flood limit of #"+room+":", err)
+	}
+	return n, per
+}
+
+// floodStrike takes a message of name from its bucket for room, which holds n
+// messages per period. It returns 0 if there was one, the strikes against
+// name otherwise.
+func floodStrike(name, room string, n int, per time.Duration) int {
+	floods.Lock()
+	defer floods.Unlock()
+	now := time.Now()
+	if now.Sub(floods.pruned) > prunePeriod {
+		pruneFloods(now)
+	}
+	key := strings.ToLower(name)
+	f, ok := floods.list[key]
+	if !ok {
+		f = &floodState{buckets: make(map[string]*bucket)}
+		floods.list[key] = f
+	}
+	b, ok := f.buckets[room]
+	if !ok {
+		b = &bucket{tokens: float64(n), last: now}
+		f.buckets[room] = b
+	}
+	if b.take(now, float64(n)/per.Seconds(), float64(n)) {
+		return 0
+	}
+	if now.Sub(f.last) > floodForgive {
+		f.strikes = 0
+	}
+	f.strikes++
+	f.last = now
+	strikes := f.strikes
+	if strikes >= 3 {
+		f.strikes = 0
+	}
+	return strikes
+}
+
+// pruneFloods drops the states of the users quiet for floodForgive. Callers
+// must hold the lock.
+func pruneFloods(now time.Time) {
+	for key, f := range floods.list {
+		quiet := now.Sub(f.last) > floodForgive
+		for _, b := range f.buckets {
+			quiet = quiet && now.Sub(b.last) > floodForgive
+		}
+		if quiet {
+			delete(floods.list, key)
+		}
+	}
+	floods.pruned = now
+}
+
+// flooding reports whether u is saying too much in room, in which case the
+// message is dropped and u struck. clients are the clients of u told about
+// it, and disconnected on the last strike.
+func flooding(u *user, room string, clients []*client) bool {
+	n, per := floodRate(room)
+	if n == 0 || mayModerate(u, room) {
+		return false
+	}
+	if _, muted := findMute(u.Name, room); muted {
+		return false // postRoom refuses it
+	}
+	strikes := floodStrike(u.Name, room, n, per)
+	if strikes == 0 {
+		return false
+	}
+	log.Println(u.Name, "is flooding #"+room+", strike", strikes)
+	switch strikes {
+	case 1:
+		for _, c := range clients {
+			c.appendMsg("#msg-list", c.trf("You're talking too fast in #%s, slow down or you will be muted", room))
+		}
+	case 2:
+		until := time.Now().Add(*floodMute)
+		if e := addMute(&mute{User: strings.ToLower(u.Name), Room: room, Until: until, By: "flood protection", Reason: "flooding"}); e != nil {
+			log.Println(e)
+			break
+		}
+		emit("user.muted", map[string]string{"user": u.Name, "room": room, "by": "flood protection", "until": until.UTC().Format(time.RFC3339), "reason": "flooding"})
+		for _, c := range clients {
+			c.appendMsg("#msg-list", c.trf("You have been muted in #%s for %s for flooding", room, floodMute.String()))
+		}
+	default:
+		emit("user.kicked", map[string]string{"user": u.Name, "by": "flood protection", "reason": "flooding #" + room})
+		for _, c := range clients {
+			c.disconnect(c.tr("You have been disconnected for flooding"))
+		}
+	}
+	return true
+}
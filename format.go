@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains text formatting helpers used by commands to build console
+friendly output, such as aligned tables and a small markdown renderer, before
+it is sent to the client.
+*/
+
+//
+package main
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatTable aligns rows into space padded columns. The first row is treated
+// as a header when header is true and is underlined with dashes.
+func formatTable(rows [][]string, header bool) string {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	var b strings.Builder
+	line := func(row []string) {
+		for i, cell := range row {
+			b.WriteString(cell)
+			if i < len(row)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2))
+			}
+		}
+		b.WriteString("\n")
+	}
+	for i, row := range rows {
+		line(row)
+		if i == 0 && header {
+			var dashes []string
+			for _, w := range widths {
+				dashes = append(dashes, strings.Repeat("-", w))
+			}
+			line(dashes)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// formatSize formats a byte count using binary units, e.g. 1.5 MB.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "B"
+}
+
+// formatPercent formats a 0-1 ratio as a percentage.
+func formatPercent(f float64) string {
+	return strconv.FormatFloat(f*100, 'f', 1, 64) + "%"
+}
+
+var (
+	mdBold   = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	mdItalic = regexp.MustCompile(`\*(.+?)\*`)
+	mdCode   = regexp.MustCompile("`(.+?)`")
+)
+
+// markdownHTML renders a small, safe subset of markdown as HTML: headings,
+// bullet and numbered lists, **bold**, *italic* and `code`. All text is
+// escaped first so the result can be used with appendHTML.
+func markdownHTML(md string) string {
+	var b strings.Builder
+	list := ""
+	closeList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			b.WriteString("<" + tag + ">")
+			list = tag
+		}
+	}
+	for _, line := range strings.Split(md, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trim := strings.TrimLeft(line, " ")
+		switch {
+		case strings.HasPrefix(trim, "#"):
+			closeList()
+			n := len(trim) - len(strings.TrimLeft(trim, "#"))
+			if n > 6 {
+				n = 6
+			}
+			h := string(rune('0' + n))
+			b.WriteString("<h" + h + ">" + mdInline(strings.TrimSpace(trim[n:])) + "</h" + h + ">")
+		case strings.HasPrefix(trim, "- "), strings.HasPrefix(trim, "* "):
+			openList("ul")
+			b.WriteString("<li>" + mdInline(trim[2:]) + "</li>")
+		case mdNumbered(trim) > 0:
+			openList("ol")
+			b.WriteString("<li>" + mdInline(trim[mdNumbered(trim):]) + "</li>")
+		case trim == "":
+			closeList()
+		default:
+			closeList()
+			b.WriteString("<div>" + mdInline(line) + "</div>")
+		}
+	}
+	closeList()
+	return b.String()
+}
+
+// mdNumbered returns the length of a "1. " style prefix or 0 if there is none.
+func mdNumbered(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i > 0 && strings.HasPrefix(s[i:], ". ") {
+		return i + 2
+	}
+	return 0
+}
+
+// mdInline escapes s and applies inline markdown styles.
+func mdInline(s string) string {
+	s = html.EscapeString(s)
+	s = mdCode.ReplaceAllString(s, "<code>$1</code>")
+	s = mdBold.ReplaceAllString(s, "<b>$1</b>")
+	return mdItalic.ReplaceAllString(s, "<i>$1</i>")
+}
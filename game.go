@@ -0,0 +1,326 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The game system hosts turn based multiplayer text games. A game session tracks
+its players and whose turn it is, while the rules of each kind of game live
+behind the gameRules interface. Every player and spectator gets a live board
+element that is redrawn in place after each move.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gameRules is implemented by each kind of game. Players are identified by
+// their index in the session's player list.
+type gameRules interface {
+	// start sets up a new game for n players.
+	start(n int)
+	// move applies player's move or returns why it isn't allowed.
+	move(player int, arg string) error
+	// board renders the current state as plain text.
+	board(names []string) string
+	// result reports whether the game is over and how it ended.
+	result(names []string) (bool, string)
+}
+
+// gameKind describes a kind of game that can be created.
+type gameKind struct {
+	desc     string
+	min, max int
+	new      func() gameRules
+}
+
+var gameKinds = map[string]gameKind{}
+
+// gameSession is a single game being set up or played.
+type gameSession struct {
+	sync.Mutex
+	id, kind, room string
+	players        []*client
+	watchers       []*client
+	boards         map[*client]bool // clients that have a board element
+	rules          gameRules
+	turn           int
+	started, done  bool
+}
+
+var games = struct {
+	sync.Mutex
+	list   map[string]*gameSession
+	nextId int
+}{list: make(map[string]*gameSession)}
+
+// names returns the display names of the players.
+func (g *gameSession) names() (n []string) {
+	for _, c := range g.players {
+		n = append(n, c.user.Name)
+	}
+	return
+}
+
+// index returns c's player index or -1 if c isn't playing.
+func (g *gameSession) index(c *client) int {
+	for i, p := range g.players {
+		if p == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// render draws the board for every player and watcher, creating the board
+// element the first time and updating it in place afterwards.
+func (g *gameSession) render(status string) {
+	text := "[" + g.kind + " #" + g.id + " in #" + g.room + "]\n"
+	if g.rules != nil {
+		text += g.rules.board(g.names()) + "\n"
+	}
+	text += status
+	for _, c := range append(append([]*client{}, g.players...), g.watchers...) {
+		if g.boards[c] {
+			// Boards are updated in place, which screen readers don't
+			// notice, so the status is announced as well.
+			c.innerHTML("#game-"+g.id, html.EscapeString(text))
+			c.announce(status, false)
+			continue
+		}
+		p := AppendElement{Selector: "#msg-list", Element: "div", Id: "game-" + g.id, Class: "msg pre game", Text: text,
+			Role: "region", Aria: map[string]string{"label": g.kind + " game " + g.id}, Scroll: true}
+		if c.send(p.packet()) == nil {
+			g.boards[c] = true
+		}
+	}
+}
+
+// status describes whose turn it is or the final result.
+func (g *gameSession) status() string {
+	if !g.started {
+		return "Waiting for players: " + strings.Join(g.names(), ", ") + " (game start " + g.id + " to begin)"
+	}
+	if done, res := g.rules.result(g.names()); done {
+		g.done = true
+		return "Game over: " + res
+	}
+	return g.players[g.turn].user.Name + "'s turn (play " + g.id + " <move>)"
+}
+
+// endGame removes a finished game from the registry.
+func endGame(g *gameSession) {
+	games.Lock()
+	delete(games.list, g.id)
+	games.Unlock()
+}
+
+// findGame returns the game with id.
+func findGame(id string) (*gameSession, error) {
+	games.Lock()
+	defer games.Unlock()
+	if g, ok := games.list[strings.TrimPrefix(id, "#")]; ok {
+		return g, nil
+	}
+	return nil, errors.New("no such game: " + id)
+}
+
+// leave removes c from g as a player or watcher, ending the game if it no
+// longer has enough players.
+func (g *gameSession) leave(c *client) {
+	g.Lock()
+	for i, w := range g.watchers {
+		if w == c {
+			g.watchers = append(g.watchers[:i], g.watchers[i+1:]...)
+			break
+		}
+	}
+	delete(g.boards, c)
+	if i := g.index(c); i >= 0 {
+		g.players = append(g.players[:i], g.players[i+1:]...)
+		if len(g.players) == 0 || (g.started && len(g.players) < gameKinds[g.kind].min) {
+			g.done = true
+			g.render(c.user.Name + " left, game abandoned")
+		} else {
+			if g.turn >= len(g.players) {
+				g.turn = 0
+			}
+			if g.started {
+				// Restart rather than guess how to drop a player's pieces.
+				g.rules.start(len(g.players))
+				g.turn = 0
+			}
+			g.render(c.user.Name + " left. " + g.status())
+		}
+	}
+	done := g.done
+	g.Unlock()
+	if done {
+		endGame(g)
+	}
+}
+
+// leaveGames removes a disconnecting client from every game it's in.
+func leaveGames(c *client) {
+	games.Lock()
+	var list []*gameSession
+	for _, g := range games.list {
+		list = append(list, g)
+	}
+	games.Unlock()
+	for _, g := range list {
+		g.leave(c)
+	}
+}
+
+func init() {
+	cmdMap["game"] = command{
+		Desc:     "Manages multiplayer games; use play to take a turn.",
+		Usage:    "game new <kind> [#room] | game join|watch|start|quit <id> | game list",
+		Examples: []string{"game new tictactoe", "game join 2"},
+		Category: "Rooms",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: game new|list|join|watch|start|quit ...")
+			}
+			switch args[1] {
+			case "new":
+				if len(args) < 3 {
+					var kinds []string
+					for k, kind := range gameKinds {
+						kinds = append(kinds, k+" - "+kind.desc)
+					}
+					sort.Strings(kinds)
+					return c.appendMsg("#msg-list", "Usage: game new <kind> [#room]. Kinds: "+strings.Join(kinds, "; "))
+				}
+				kind, ok := gameKinds[args[2]]
+				if !ok {
+					return c.appendMsg("#msg-list", "Unknown game: "+args[2])
+				}
+				room, _ := roomArg(args[3:])
+				games.Lock()
+				g := &gameSession{id: strconv.Itoa(games.nextId), kind: args[2], room: room,
+					players: []*client{c}, boards: make(map[*client]bool), rules: kind.new()}
+				games.nextId++
+				games.list[g.id] = g
+				games.Unlock()
+				g.Lock()
+				defer g.Unlock()
+				if kind.max == 1 {
+					g.rules.start(1)
+					g.started = true
+				}
+				g.render(g.status())
+				return
+			case "list":
+				games.Lock()
+				rows := [][]string{{"Id", "Game", "Room", "Players", "State"}}
+				for _, g := range games.list {
+					g.Lock()
+					state := "waiting"
+					if g.started {
+						state = "playing"
+					}
+					rows = append(rows, []string{g.id, g.kind, "#" + g.room, strings.Join(g.names(), ","), state})
+					g.Unlock()
+				}
+				games.Unlock()
+				if len(rows) == 1 {
+					return c.appendMsg("#msg-list", "No games, start one with game new <kind>")
+				}
+				return c.appendPre("#msg-list", formatTable(rows, true))
+			}
+			if len(args) != 3 {
+				return c.appendMsg("#msg-list", "Usage: game "+args[1]+" <id>")
+			}
+			g, err := findGame(args[2])
+			if err != nil {
+				return c.appendMsg("#msg-list", err.Error())
+			}
+			if args[1] == "quit" {
+				g.leave(c)
+				return c.appendMsg("#msg-list", "You left game "+g.id)
+			}
+			g.Lock()
+			defer g.Unlock()
+			switch args[1] {
+			case "join":
+				if g.index(c) >= 0 {
+					return c.appendMsg("#msg-list", "You are already in this game")
+				}
+				if g.started || len(g.players) >= gameKinds[g.kind].max {
+					return c.appendMsg("#msg-list", "Game is full or already started, try game watch "+g.id)
+				}
+				g.players = append(g.players, c)
+				g.render(c.user.Name + " joined. " + g.status())
+			case "watch":
+				if g.index(c) < 0 {
+					g.watchers = append(g.watchers, c)
+				}
+				g.render(g.status())
+			case "start":
+				if g.index(c) != 0 {
+					return c.appendMsg("#msg-list", "Only the player who created the game can start it")
+				}
+				if g.started {
+					return c.appendMsg("#msg-list", "Game already started")
+				}
+				if len(g.players) < gameKinds[g.kind].min {
+					return c.appendMsg("#msg-list", "Not enough players yet")
+				}
+				g.rules.start(len(g.players))
+				g.started = true
+				g.render(g.status())
+			default:
+				return c.appendMsg("#msg-list", "Usage: game new|list|join|watch|start|quit ...")
+			}
+			return
+		},
+	}
+	cmdMap["play"] = command{
+		Desc:     "Takes your turn in a game.",
+		Usage:    "play <id> <move>",
+		Category: "Rooms",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) < 3 {
+				return c.appendMsg("#msg-list", "Usage: play <id> <move>")
+			}
+			g, err := findGame(args[1])
+			if err != nil {
+				return c.appendMsg("#msg-list", err.Error())
+			}
+			g.Lock()
+			i := g.index(c)
+			switch {
+			case i < 0:
+				g.Unlock()
+				return c.appendMsg("#msg-list", "You are not playing in game "+g.id)
+			case !g.started || g.done:
+				g.Unlock()
+				return c.appendMsg("#msg-list", "Game "+g.id+" is not in progress")
+			case i != g.turn:
+				g.Unlock()
+				return c.appendMsg("#msg-list", "It's not your turn")
+			}
+			if err := g.rules.move(i, strings.Join(args[2:], " ")); err != nil {
+				g.Unlock()
+				return c.appendMsg("#msg-list", err.Error())
+			}
+			g.turn = (g.turn + 1) % len(g.players)
+			g.render(g.status())
+			done := g.done
+			g.Unlock()
+			if done {
+				endGame(g)
+			}
+			return
+		},
+	}
+}
@@ -0,0 +1,206 @@
+//go:build ignore
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+genpackets generates packets_gen.go and public/packets.js from
+packets.schema. It is run by go generate, see client.go.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+)
+
+// field is a field of a packet.
+type field struct {
+	name     string
+	kind     string // "string", "bool", "int" or "aria"
+	optional bool
+}
+
+// packetType is a packet described in the schema.
+type packetType struct {
+	name     string
+	selector string // fixed selector, "-" for none, "" for a Selector field
+	fields   []field
+	open     bool // may have other fields
+}
+
+// goName returns the name of the struct for packets of type t.
+func (t packetType) goName() string {
+	var b strings.Builder
+	for _, part := range strings.Split(t.name, "-") {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func parseSchema(path string) (types []packetType, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		words := strings.Fields(s.Text())
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		t := packetType{name: words[0]}
+		for _, w := range words[1:] {
+			switch {
+			case w == "...":
+				t.open = true
+			case strings.HasPrefix(w, "@"):
+				t.selector = w[1:]
+			default:
+				fl := field{kind: "string"}
+				if strings.HasSuffix(w, "?") {
+					fl.optional, w = true, strings.TrimSuffix(w, "?")
+				}
+				if i := strings.IndexByte(w, ':'); i >= 0 {
+					w, fl.kind = w[:i], w[i+1:]
+				}
+				switch fl.kind {
+				case "string", "bool", "int", "aria":
+				default:
+					return nil, fmt.Errorf("%s:%d: unknown kind %s", path, n, fl.kind)
+				}
+				fl.name = w
+				t.fields = append(t.fields, fl)
+			}
+		}
+		if t.selector == "" {
+			t.fields = append([]field{{name: "Selector", kind: "string"}}, t.fields...)
+		}
+		types = append(types, t)
+	}
+	return types, s.Err()
+}
+
+func genGo(types []packetType) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "// Code generated by genpackets.go from packets.schema. DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "package main")
+	fmt.Fprintln(&b)
+	imports := map[string]string{"int": "strconv", "aria": "strings"}
+	used := make(map[string]bool)
+	for _, t := range types {
+		for _, f := range t.fields {
+			if pkg, ok := imports[f.kind]; ok {
+				used[pkg] = true
+			}
+		}
+	}
+	fmt.Fprintln(&b, "import (")
+	for _, pkg := range []string{"strconv", "strings"} {
+		if used[pkg] {
+			fmt.Fprintf(&b, "%q\n", pkg)
+		}
+	}
+	fmt.Fprintln(&b, "\n\"github.com/jmptrader/soshell/protocol\"\n)")
+	for _, t := range types {
+		fmt.Fprintf(&b, "\n// %s is the %s packet.\ntype %s struct {\n", t.goName(), t.name, t.goName())
+		for _, f := range t.fields {
+			switch f.kind {
+			case "aria":
+				fmt.Fprintf(&b, "%s map[string]string\n", f.name)
+			default:
+				fmt.Fprintf(&b, "%s %s\n", f.name, f.kind)
+			}
+		}
+		if t.open {
+			fmt.Fprintln(&b, "Extra map[string]string")
+		}
+		fmt.Fprintln(&b, "}")
+		fmt.Fprintf(&b, "\n// packet returns p as a packet.\nfunc (p %s) packet() packet {\n", t.goName())
+		fmt.Fprintf(&b, "pack := protocol.New(%q)\n", t.name)
+		if t.open {
+			fmt.Fprintln(&b, "for k, v := range p.Extra {\npack.Data[k] = v\n}")
+		}
+		if t.selector != "" && t.selector != "-" {
+			fmt.Fprintf(&b, "pack.Data[\"Selector\"] = %q\n", t.selector)
+		}
+		for _, f := range t.fields {
+			switch {
+			case f.kind == "aria":
+				fmt.Fprintf(&b, "for k, v := range p.%s {\npack.Data[\"aria-\"+strings.TrimPrefix(k, \"aria-\")] = v\n}\n", f.name)
+			case f.kind == "bool":
+				fmt.Fprintf(&b, "if p.%s {\npack.Data[%q] = \"true\"\n}\n", f.name, f.name)
+			case f.kind == "int":
+				fmt.Fprintf(&b, "pack.Data[%q] = strconv.Itoa(p.%s)\n", f.name, f.name)
+			case f.optional:
+				fmt.Fprintf(&b, "if p.%s != \"\" {\npack.Data[%q] = p.%s\n}\n", f.name, f.name, f.name)
+			default:
+				fmt.Fprintf(&b, "pack.Data[%q] = p.%s\n", f.name, f.name)
+			}
+		}
+		fmt.Fprintln(&b, "return pack\n}")
+	}
+	return format.Source(b.Bytes())
+}
+
+func genJS(types []packetType) []byte {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "// Code generated by genpackets.go from packets.schema. DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "// PacketSchema describes the packets the server sends: the fields each always")
+	fmt.Fprintln(&b, "// has, those it may have, whether it may have aria-* or any other fields and")
+	fmt.Fprintln(&b, "// whether it is a DOM op, run by DomMap.")
+	fmt.Fprintln(&b, "var PacketSchema = {")
+	for i, t := range types {
+		var required, optional []string
+		aria := false
+		for _, f := range t.fields {
+			switch {
+			case f.kind == "aria":
+				aria = true
+			case f.optional || f.kind == "bool":
+				optional = append(optional, fmt.Sprintf("%q", f.name))
+			default:
+				required = append(required, fmt.Sprintf("%q", f.name))
+			}
+		}
+		if t.selector != "" && t.selector != "-" {
+			required = append([]string{`"Selector"`}, required...)
+		}
+		comma := ","
+		if i == len(types)-1 {
+			comma = ""
+		}
+		fmt.Fprintf(&b, "\t%q: {required: [%s], optional: [%s], aria: %t, open: %t, dom: %t}%s\n",
+			t.name, strings.Join(required, ", "), strings.Join(optional, ", "), aria, t.open, t.selector != "-", comma)
+	}
+	fmt.Fprintln(&b, "};")
+	return b.Bytes()
+}
+
+func main() {
+	types, err := parseSchema("packets.schema")
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := genGo(types)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("packets_gen.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("public"+string(os.PathSeparator)+"packets.js", genJS(types), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
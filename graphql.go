@@ -0,0 +1,608 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The graphql system is a read-mostly GraphQL endpoint at /api/graphql so
+dashboards can fetch nested data in one request, e.g. the rooms a user is in
+with their last message and unread count:
+
+	{ rooms { name unread lastMessage { from text time } } }
+
+It implements the subset of GraphQL needed for that: a single query or
+mutation with aliases, arguments, variables and nested selections (no
+fragments or directives). Resolvers are scoped to the authenticated user.
+
+	type Query    { me: User, user(name): User, rooms: [Room], room(name): Room }
+	type Mutation { sendMessage(room, text): Message, markRead(room): Room }
+	type User     { name, online }
+	type Room     { name, members: [User], unread, lastMessage: Message,
+	                messages(before, limit): [Message] }
+	type Message  { id, time, from, text }
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// gqlField is a field of a selection set.
+type gqlField struct {
+	alias, name string
+	args        map[string]interface{}
+	sel         []gqlField
+}
+
+// gqlResolver resolves a field from its arguments. It returns scalars,
+// gqlObjects, []gqlObject or nil.
+type gqlResolver func(args map[string]interface{}) (interface{}, error)
+
+// gqlObject is a value of an object type.
+type gqlObject struct {
+	typ    string
+	fields map[string]gqlResolver
+}
+
+// gqlEntry is a resolved field.
+type gqlEntry struct {
+	key string
+	val interface{}
+}
+
+// gqlMap is a JSON object that keeps the order of the selection set.
+type gqlMap []gqlEntry
+
+func (m gqlMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, kv := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(kv.key)
+		v, err := json.Marshal(kv.val)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlParser parses a GraphQL document.
+type gqlParser struct {
+	src  string
+	pos  int
+	vars map[string]interface{}
+}
+
+// skip moves past whitespace, commas and comments.
+func (p *gqlParser) skip() {
+	for p.pos < len(p.src) {
+		switch ch := p.src[p.pos]; {
+		case ch == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case ch == ',' || ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next character without consuming it, or 0 at the end.
+func (p *gqlParser) peek() byte {
+	p.skip()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+// expect consumes the punctuator ch.
+func (p *gqlParser) expect(ch byte) error {
+	if p.peek() != ch {
+		return p.errorf("expected " + strconv.QuoteRune(rune(ch)))
+	}
+	p.pos++
+	return nil
+}
+
+// errorf returns a syntax error at the current position.
+func (p *gqlParser) errorf(msg string) error {
+	return errors.New("syntax error at " + strconv.Itoa(p.pos) + ": " + msg)
+}
+
+// name consumes a name.
+func (p *gqlParser) name() (string, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) {
+		ch := rune(p.src[p.pos])
+		if ch != '_' && !unicode.IsLetter(ch) && !(p.pos > start && unicode.IsDigit(ch)) {
+			break
+		}
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected a name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+// value parses a literal or variable.
+func (p *gqlParser) value() (interface{}, error) {
+	switch ch := p.peek(); {
+	case ch == '$':
+		p.pos++
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		v, ok := p.vars[name]
+		if !ok {
+			return nil, errors.New("undefined variable $" + name)
+		}
+		return v, nil
+	case ch == '"':
+		start := p.pos
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != '"'; p.pos++ {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		p.pos++
+		if p.pos > len(p.src) {
+			return nil, p.errorf("unterminated string")
+		}
+		var s string
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+			return nil, p.errorf("bad string")
+		}
+		return s, nil
+	case ch == '-' || (ch >= '0' && ch <= '9'):
+		start := p.pos
+		for p.pos++; p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0; p.pos++ {
+		}
+		if n, err := strconv.Atoi(p.src[start:p.pos]); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("bad number")
+		}
+		return f, nil
+	case ch == '[':
+		p.pos++
+		list := []interface{}{}
+		for p.peek() != ']' {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.pos++
+		return list, nil
+	case ch == '{':
+		p.pos++
+		obj := make(map[string]interface{})
+		for p.peek() != '}' {
+			k, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(':'); err != nil {
+				return nil, err
+			}
+			if obj[k], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+		return obj, nil
+	}
+	name, err := p.name()
+	switch {
+	case err != nil:
+		return nil, err
+	case name == "true" || name == "false":
+		return name == "true", nil
+	case name == "null":
+		return nil, nil
+	}
+	return name, nil // enum value
+}
+
+// typeRef skips a type reference in a variable definition.
+func (p *gqlParser) typeRef() error {
+	if p.peek() == '[' {
+		p.pos++
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect(']'); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peek() == '!' {
+		p.pos++
+	}
+	return nil
+}
+
+// selection parses a selection set.
+func (p *gqlParser) selection() (sel []gqlField, err error) {
+	if err = p.expect('{'); err != nil {
+		return
+	}
+	for p.peek() != '}' {
+		if p.peek() == '.' || p.peek() == '@' {
+			return nil, errors.New("fragments and directives are not supported")
+		}
+		var f gqlField
+		if f.name, err = p.name(); err != nil {
+			return
+		}
+		f.alias = f.name
+		if p.peek() == ':' {
+			p.pos++
+			if f.name, err = p.name(); err != nil {
+				return
+			}
+		}
+		f.args = make(map[string]interface{})
+		if p.peek() == '(' {
+			p.pos++
+			for p.peek() != ')' {
+				var k string
+				if k, err = p.name(); err != nil {
+					return
+				}
+				if err = p.expect(':'); err != nil {
+					return
+				}
+				if f.args[k], err = p.value(); err != nil {
+					return
+				}
+			}
+			p.pos++
+		}
+		if p.peek() == '{' {
+			if f.sel, err = p.selection(); err != nil {
+				return
+			}
+		}
+		sel = append(sel, f)
+	}
+	p.pos++
+	return
+}
+
+// parseGraphQL parses a document holding a single operation and returns
+// its type ("query" or "mutation") and selection set.
+func parseGraphQL(src string, vars map[string]interface{}) (op string, sel []gqlField, err error) {
+	p := &gqlParser{src: src, vars: vars}
+	if p.vars == nil {
+		p.vars = make(map[string]interface{})
+	}
+	op = "query"
+	if p.peek() != '{' {
+		if op, err = p.name(); err != nil {
+			return
+		}
+		if op != "query" && op != "mutation" {
+			return "", nil, errors.New("unsupported operation: " + op)
+		}
+		if ch := p.peek(); ch != '{' && ch != '(' {
+			if _, err = p.name(); err != nil {
+				return
+			}
+		}
+		if p.peek() == '(' {
+			p.pos++
+			for p.peek() != ')' {
+				if err = p.expect('$'); err != nil {
+					return
+				}
+				var name string
+				if name, err = p.name(); err != nil {
+					return
+				}
+				if err = p.expect(':'); err != nil {
+					return
+				}
+				if err = p.typeRef(); err != nil {
+					return
+				}
+				if p.peek() == '=' {
+					p.pos++
+					var def interface{}
+					if def, err = p.value(); err != nil {
+						return
+					}
+					if _, ok := p.vars[name]; !ok {
+						p.vars[name] = def
+					}
+				}
+			}
+			p.pos++
+		}
+	}
+	if sel, err = p.selection(); err != nil {
+		return
+	}
+	if p.peek() != 0 {
+		return "", nil, errors.New("only a single operation is supported")
+	}
+	return
+}
+
+// gqlExec resolves sel against v, collecting field errors in errs.
+func gqlExec(v interface{}, sel []gqlField, path string, errs *[]string) interface{} {
+	switch v := v.(type) {
+	case gqlObject:
+		if len(sel) == 0 {
+			*errs = append(*errs, strings.TrimSuffix(path, ".")+": "+v.typ+" needs a selection")
+			return nil
+		}
+		var out gqlMap
+		for _, f := range sel {
+			var val interface{}
+			if f.name == "__typename" {
+				val = v.typ
+			} else if resolve, ok := v.fields[f.name]; !ok {
+				*errs = append(*errs, path+f.alias+": no field "+f.name+" on "+v.typ)
+			} else if res, err := resolve(f.args); err != nil {
+				*errs = append(*errs, path+f.alias+": "+err.Error())
+			} else {
+				val = gqlExec(res, f.sel, path+f.alias+".", errs)
+			}
+			out = append(out, gqlEntry{f.alias, val})
+		}
+		return out
+	case []gqlObject:
+		list := make([]interface{}, len(v))
+		for i, o := range v {
+			list[i] = gqlExec(o, sel, path+strconv.Itoa(i)+".", errs)
+		}
+		return list
+	}
+	if len(sel) > 0 {
+		*errs = append(*errs, strings.TrimSuffix(path, ".")+": scalar has no fields")
+		return nil
+	}
+	return v
+}
+
+// gqlString returns the string argument name, or an error if it's missing.
+func gqlString(args map[string]interface{}, name string) (string, error) {
+	s, ok := args[name].(string)
+	if !ok || s == "" {
+		return "", errors.New("missing argument " + name)
+	}
+	return s, nil
+}
+
+// gqlInt returns the integer argument name, or def if it's missing.
+func gqlInt(args map[string]interface{}, name string, def int) int {
+	switch n := args[name].(type) {
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	return def
+}
+
+// gqlMessage returns a message object.
+func gqlMessage(m message) gqlObject {
+	return gqlObject{"Message", map[string]gqlResolver{
+		"id":   func(map[string]interface{}) (interface{}, error) { return m.Id, nil },
+		"time": func(map[string]interface{}) (interface{}, error) { return m.Time.Format(time.RFC3339), nil },
+		"from": func(map[string]interface{}) (interface{}, error) { return m.From, nil },
+		"text": func(map[string]interface{}) (interface{}, error) { return m.Text, nil },
+	}}
+}
+
+// gqlUser returns a user object.
+func gqlUser(name string) gqlObject {
+	return gqlObject{"User", map[string]gqlResolver{
+		"name":   func(map[string]interface{}) (interface{}, error) { return name, nil },
+		"online": func(map[string]interface{}) (interface{}, error) { return len(clientsByName(name)) > 0, nil },
+	}}
+}
+
+// gqlRoom returns a room object as seen by viewer.
+func gqlRoom(viewer *user, room string) gqlObject {
+	return gqlObject{"Room", map[string]gqlResolver{
+		"name": func(map[string]interface{}) (interface{}, error) { return room, nil },
+		"members": func(map[string]interface{}) (interface{}, error) {
+			seen := make(map[string]bool)
+			list := []gqlObject{}
+			for _, c := range roomClients(room) {
+				if c.user.key != nil && !seen[c.user.Name] {
+					seen[c.user.Name] = true
+					list = append(list, gqlUser(c.user.Name))
+				}
+			}
+			return list, nil
+		},
+		"lastMessage": func(map[string]interface{}) (interface{}, error) {
+			if m, ok := lastMessage(roomKey(room)); ok {
+				return gqlMessage(m), nil
+			}
+			return nil, nil
+		},
+		"unread": func(map[string]interface{}) (interface{}, error) {
+			return unreadCount(viewer.Name, room), nil
+		},
+		"messages": func(args map[string]interface{}) (interface{}, error) {
+			limit := gqlInt(args, "limit", 50)
+			if limit <= 0 || limit > 200 {
+				limit = 50
+			}
+			msgs, err := pageHistory(roomKey(room), gqlInt(args, "before", 0), limit)
+			list := []gqlObject{}
+			for _, m := range msgs {
+				list = append(list, gqlMessage(m))
+			}
+			return list, err
+		},
+	}}
+}
+
+// gqlRoomArg returns the room named by the argument "room" or "name", one u
+// may be in.
+func gqlRoomArg(u *user, args map[string]interface{}, name string) (string, error) {
+	room, err := gqlString(args, name)
+	room = strings.ToLower(strings.TrimPrefix(room, "#"))
+	if _, ok := findRoom(room); err == nil && !ok {
+		err = errors.New("no such room")
+	}
+	if err == nil && !mayEnter(u, room) {
+		err = errors.New("not in this room")
+	}
+	return room, err
+}
+
+// gqlQuery returns the root query object for u.
+func gqlQuery(u *user) gqlObject {
+	return gqlObject{"Query", map[string]gqlResolver{
+		"me": func(map[string]interface{}) (interface{}, error) { return gqlUser(u.Name), nil },
+		"user": func(args map[string]interface{}) (interface{}, error) {
+			name, err := gqlString(args, "name")
+			if err != nil || !userExists(name) {
+				return nil, err
+			}
+			return gqlUser(name), nil
+		},
+		"room": func(args map[string]interface{}) (interface{}, error) {
+			room, err := gqlRoomArg(u, args, "name")
+			if err != nil {
+				return nil, err
+			}
+			return gqlRoom(u, room), nil
+		},
+		"rooms": func(map[string]interface{}) (interface{}, error) {
+			in := userRooms(u.Name)
+			for _, c := range clientsByName(u.Name) {
+				for _, room := range c.joinedRooms() {
+					if _, ok := in[room]; !ok {
+						in[room] = 0
+					}
+				}
+			}
+			var names []string
+			for room := range in {
+				if mayEnter(u, room) {
+					names = append(names, room)
+				}
+			}
+			sort.Strings(names)
+			list := []gqlObject{}
+			for _, room := range names {
+				list = append(list, gqlRoom(u, room))
+			}
+			return list, nil
+		},
+	}}
+}
+
+// gqlMutation returns the root mutation object for u.
+func gqlMutation(u *user) gqlObject {
+	return gqlObject{"Mutation", map[string]gqlResolver{
+		"sendMessage": func(args map[string]interface{}) (interface{}, error) {
+			room, err := gqlRoomArg(u, args, "room")
+			if err != nil {
+				return nil, err
+			}
+			text, err := gqlString(args, "text")
+			if err != nil {
+				return nil, err
+			}
+			if flooding(u, room, clientsByName(u.Name)) {
+				return nil, errors.New("talking too fast in this room")
+			}
+			m, err := postRoom(room, u.Name, strings.TrimSpace(text))
+			if err == errMuted {
+				return nil, err
+			}
+			if err != nil {
+				return nil, errors.New("could not store message")
+			}
+			markRead(u.Name, room, m.Id)
+			return gqlMessage(m), nil
+		},
+		"markRead": func(args map[string]interface{}) (interface{}, error) {
+			room, err := gqlRoomArg(u, args, "room")
+			if err != nil {
+				return nil, err
+			}
+			if m, ok := lastMessage(roomKey(room)); ok {
+				markRead(u.Name, room, m.Id)
+			}
+			return gqlRoom(u, room), nil
+		},
+	}}
+}
+
+// apiGraphQL serves GraphQL requests, as a query string for GET or a JSON
+// body for POST.
+func apiGraphQL(w http.ResponseWriter, r *http.Request, u *user) {
+	var req struct {
+		Query     string
+		Variables map[string]interface{}
+	}
+	if r.Method == "GET" {
+		req.Query = r.FormValue("query")
+		if v := r.FormValue("variables"); v != "" && json.Unmarshal([]byte(v), &req.Variables) != nil {
+			apiError(w, 400, "bad variables")
+			return
+		}
+	} else if json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req) != nil {
+		apiError(w, 400, "bad request body")
+		return
+	}
+	op, sel, err := parseGraphQL(req.Query, req.Variables)
+	if err != nil {
+		apiJSON(w, 400, map[string]interface{}{"errors": []map[string]string{{"message": err.Error()}}})
+		return
+	}
+	root := gqlQuery(u)
+	if op == "mutation" {
+		if r.Method != "POST" {
+			apiJSON(w, 405, map[string]interface{}{"errors": []map[string]string{{"message": "mutations require POST"}}})
+			return
+		}
+		root = gqlMutation(u)
+	}
+	var errs []string
+	res := map[string]interface{}{"data": gqlExec(root, sel, "", &errs)}
+	if len(errs) > 0 {
+		var list []map[string]string
+		for _, e := range errs {
+			list = append(list, map[string]string{"message": e})
+		}
+		res["errors"] = list
+	}
+	apiJSON(w, 200, res)
+}
@@ -0,0 +1,182 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the grep and find commands which search a user's virtual
+filesystem and command history. Searches stop after searchTimeout or
+searchMax results so a large home directory can't tie up the server.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"errors"
+	"html"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	searchTimeout = 2 * time.Second
+	searchMax     = 200
+)
+
+var errSearchLimit = errors.New("search limit reached")
+
+// highlight escapes line and wraps every match of re in a <mark> element.
+func highlight(re *regexp.Regexp, line string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringIndex(line, -1) {
+		b.WriteString(html.EscapeString(line[last:m[0]]))
+		b.WriteString("<mark>" + html.EscapeString(line[m[0]:m[1]]) + "</mark>")
+		last = m[1]
+	}
+	b.WriteString(html.EscapeString(line[last:]))
+	return b.String()
+}
+
+// searchResults collects matches, enforcing the search limits.
+type searchResults struct {
+	lines    []string
+	deadline time.Time
+}
+
+func (r *searchResults) add(s string) error {
+	if len(r.lines) >= searchMax || time.Now().After(r.deadline) {
+		return errSearchLimit
+	}
+	r.lines = append(r.lines, s)
+	return nil
+}
+
+// send writes the results to c, noting when the search was cut short.
+func (r *searchResults) send(c *client, err error, none string) error {
+	if len(r.lines) == 0 && err == nil {
+		return c.appendMsg("#msg-list", none)
+	}
+	lines := r.lines
+	if err == errSearchLimit {
+		lines = append(lines, "(search stopped after "+strconv.Itoa(len(r.lines))+" results)")
+	}
+	return c.pageLines(lines, true)
+}
+
+// grepFile appends the matching lines of a file to r.
+func grepFile(re *regexp.Regexp, real, virtual string, r *searchResults) error {
+	f, e := os.Open(real)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		if line := s.Text(); re.MatchString(line) {
+			prefix := html.EscapeString(virtual) + ":" + strconv.Itoa(n) + ": "
+			if e := r.add(prefix + highlight(re, line)); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	cmdMap["grep"] = command{
+		Desc:     "Searches your files or command history with a regular expression.",
+		Usage:    "grep <pattern> <file|dir|--history>",
+		Flags:    []flagDoc{{"history", "", "search your command history instead of files"}},
+		Examples: []string{`grep "todo|fixme" notes`, "grep weather --history"},
+		Category: "Files",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 3 {
+				return c.appendMsg("#msg-list", "Usage: grep <pattern> <file|dir|--history>")
+			}
+			re, err := regexp.Compile(args[1])
+			if err != nil {
+				return c.appendMsg("#msg-list", "grep: "+err.Error())
+			}
+			r := &searchResults{deadline: time.Now().Add(searchTimeout)}
+			if args[2] == "--history" {
+				for i, line := range c.history {
+					if re.MatchString(line) {
+						if err = r.add(strconv.Itoa(i+1) + ": " + highlight(re, line)); err != nil {
+							break
+						}
+					}
+				}
+				return r.send(c, err, "No matches")
+			}
+			if c.user.key == nil {
+				return c.appendMsg("#msg-list", "You must be logged in to search files")
+			}
+			real, virtual := vfsPath(c.user.Name, args[2])
+			fi, err := os.Stat(real)
+			if err != nil {
+				return c.appendMsg("#msg-list", "grep: "+virtual+": no such file or directory")
+			}
+			if !fi.IsDir() {
+				err = grepFile(re, real, virtual, r)
+			} else {
+				home := homeDir(c.user.Name)
+				err = filepath.Walk(real, func(p string, fi os.FileInfo, err error) error {
+					if err != nil || fi.IsDir() {
+						return nil
+					}
+					return grepFile(re, p, filepath.ToSlash(strings.TrimPrefix(p, home)), r)
+				})
+			}
+			if err != nil && err != errSearchLimit {
+				return c.appendMsg("#msg-list", "grep: "+err.Error())
+			}
+			return r.send(c, err, "No matches")
+		},
+		Background: true,
+		Cooldown:   3 * time.Second,
+	}
+	cmdMap["find"] = command{
+		Desc:     "Lists files in your home whose name (or path, if the glob has a /) matches.",
+		Usage:    "find <glob>",
+		Examples: []string{"find *.md", "find notes/*"},
+		Category: "Files",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: find <glob>")
+			}
+			glob := args[1]
+			if _, err := path.Match(glob, ""); err != nil {
+				return c.appendMsg("#msg-list", "find: bad pattern")
+			}
+			home := homeDir(c.user.Name)
+			r := &searchResults{deadline: time.Now().Add(searchTimeout)}
+			err := filepath.Walk(home, func(p string, fi os.FileInfo, err error) error {
+				if err != nil || p == home {
+					return nil
+				}
+				virtual := filepath.ToSlash(strings.TrimPrefix(p, home))
+				name := fi.Name()
+				if strings.Contains(glob, "/") {
+					name = virtual
+				}
+				if ok, _ := path.Match(glob, name); ok {
+					if fi.IsDir() {
+						virtual += "/"
+					}
+					return r.add("<mark>" + html.EscapeString(virtual) + "</mark>")
+				}
+				return nil
+			})
+			return r.send(c, err, "No files found")
+		},
+		Background: true,
+	}
+}
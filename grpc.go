@@ -0,0 +1,254 @@
+//go:build grpc
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The grpc service lets backend services integrate with a typed, streaming API
+instead of REST or websockets. It is only compiled in with -tags grpc so the
+default build has no grpc dependency.
+
+Messages are encoded as JSON (content subtype "json") so no generated code is
+needed on either side; the request and response types below are the schema.
+Every call authenticates with "user" and "password" metadata.
+
+	soshell.Soshell/SendMessage   grpcSendRequest -> message
+	soshell.Soshell/StreamEvents  grpcStreamRequest -> stream of serverEvent
+	soshell.Soshell/ManageUsers   grpcUsersRequest -> grpcUsersReply
+
+StreamEvents only sends the events the user could subscribe to in the
+terminal, see subscribe.go.
+*/
+
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var grpcAddr = flag.String("grpc", "", "grpc service address, empty to disable")
+
+// grpcCodec encodes grpc messages as JSON.
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error)   { return json.Marshal(v) }
+func (grpcCodec) Unmarshal(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+func (grpcCodec) Name() string                            { return "json" }
+
+// grpcSendRequest posts Text to a room, or to a user when To is set.
+type grpcSendRequest struct {
+	Room, To, Text string
+}
+
+// grpcStreamRequest selects the events to stream; empty means all. Rooms
+// limits room events to the given rooms.
+type grpcStreamRequest struct {
+	Events, Rooms []string
+}
+
+// grpcUsersRequest is a user management action: "online" lists connected
+// users, "exists" checks whether Name is registered.
+type grpcUsersRequest struct {
+	Action, Name string
+}
+
+// grpcUsersReply is the result of a ManageUsers call.
+type grpcUsersReply struct {
+	Names  []string `json:",omitempty"`
+	Exists bool
+}
+
+// grpcUser authenticates the caller from the call metadata.
+func grpcUser(ctx context.Context) (*user, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	addr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	if isBanned(addr) {
+		return nil, status.Error(codes.PermissionDenied, "address banned")
+	}
+	name, pass := md.Get("user"), md.Get("password")
+	if len(name) != 1 || len(pass) != 1 || !userExists(name[0]) {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+	if userBanned(name[0]) {
+		return nil, status.Error(codes.PermissionDenied, "account banned")
+	}
+	if !apiLimit.allow(strings.ToLower(name[0])) {
+		return nil, status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	var u user
+	if u.load(name[0], pass[0]) != nil {
+		securityLoginFailed(addr, name[0])
+		return nil, status.Error(codes.Unauthenticated, "authentication failed")
+	}
+	if u.TOTP != "" {
+		return nil, status.Error(codes.PermissionDenied, "two-factor authentication enabled")
+	}
+	return &u, nil
+}
+
+// grpcServer implements the Soshell service.
+type grpcServer struct{}
+
+func (grpcServer) sendMessage(ctx context.Context, req *grpcSendRequest) (*message, error) {
+	u, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing text")
+	}
+	var m message
+	switch {
+	case req.To != "":
+		if !userExists(req.To) {
+			return nil, status.Error(codes.NotFound, "no such user")
+		}
+		m, err = sendDirect(u.Name, req.To, req.Text)
+	case isName(req.Room) && req.Room != "":
+		if _, ok := findRoom(strings.ToLower(req.Room)); !ok {
+			return nil, status.Error(codes.NotFound, "no such room")
+		}
+		if !mayEnter(u, strings.ToLower(req.Room)) {
+			return nil, status.Error(codes.PermissionDenied, "not in this room")
+		}
+		if flooding(u, strings.ToLower(req.Room), clientsByName(u.Name)) {
+			return nil, status.Error(codes.ResourceExhausted, "talking too fast in this room")
+		}
+		m, err = postRoom(strings.ToLower(req.Room), u.Name, req.Text)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "missing room or user")
+	}
+	if err == errMuted {
+		return nil, status.Error(codes.PermissionDenied, "muted in this room")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "could not store message")
+	}
+	return &m, nil
+}
+
+func (grpcServer) streamEvents(req *grpcStreamRequest, stream grpc.ServerStream) error {
+	u, err := grpcUser(stream.Context())
+	if err != nil {
+		return err
+	}
+	ch, stop := listen()
+	defer stop()
+	wanted := func(list []string, s string) bool {
+		for _, v := range list {
+			if v == s {
+				return true
+			}
+		}
+		return len(list) == 0
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-ch:
+			if !wanted(req.Events, ev.Event) || !mayWatch(u, ev) {
+				continue
+			}
+			if room, ok := ev.Data["room"]; ok && (!wanted(req.Rooms, room) || !mayEnter(u, room)) {
+				continue
+			}
+			if err := stream.SendMsg(&ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (grpcServer) manageUsers(ctx context.Context, req *grpcUsersRequest) (*grpcUsersReply, error) {
+	if _, err := grpcUser(ctx); err != nil {
+		return nil, err
+	}
+	switch req.Action {
+	case "online":
+		seen := make(map[string]bool)
+		var reply grpcUsersReply
+		for _, c := range onlineClients() {
+			if c.user.key != nil && !seen[c.user.Name] {
+				seen[c.user.Name] = true
+				reply.Names = append(reply.Names, c.user.Name)
+			}
+		}
+		return &reply, nil
+	case "exists":
+		return &grpcUsersReply{Exists: userExists(req.Name)}, nil
+	}
+	return nil, status.Error(codes.InvalidArgument, "unknown action: "+req.Action)
+}
+
+var grpcService = grpc.ServiceDesc{
+	ServiceName: "soshell.Soshell",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "SendMessage", Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			var req grpcSendRequest
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			return srv.(grpcServer).sendMessage(ctx, &req)
+		}},
+		{MethodName: "ManageUsers", Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			var req grpcUsersRequest
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			return srv.(grpcServer).manageUsers(ctx, &req)
+		}},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "StreamEvents", ServerStreams: true, Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			var req grpcStreamRequest
+			if err := stream.RecvMsg(&req); err != nil {
+				return err
+			}
+			return srv.(grpcServer).streamEvents(&req, stream)
+		}},
+	},
+}
+
+// startGRPC serves the grpc service over TLS using the server certificate.
+func startGRPC() {
+	if *grpcAddr == "" {
+		return
+	}
+	creds, err := credentials.NewServerTLSFromFile(*certFile, *keyFile)
+	if err != nil {
+		log.Fatal("grpc: ", err)
+	}
+	l, err := net.Listen("tcp", *grpcAddr)
+	if err != nil {
+		log.Fatal("grpc: ", err)
+	}
+	s := grpc.NewServer(grpc.Creds(creds))
+	s.RegisterService(&grpcService, grpcServer{})
+	log.Fatal("grpc: ", s.Serve(l))
+}
+
+func init() {
+	encoding.RegisterCodec(grpcCodec{})
+	services = append(services, startGRPC)
+}
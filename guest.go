@@ -0,0 +1,64 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Guests. A client that isn't logged in gets a name of its own, like
+guest-1234, so it shows up in who and presence events, can talk in rooms and
+is told apart from other guests. Guest names have a '-', which isName
+refuses, so no account can be registered with one. Guests have the guest role
+(see roles.go) and nothing of theirs is saved.
+
+Registering keeps what the guest set up: the locale, theme, settings (see
+prefs.go) and command history of the session go into the new account.
+Logging in or out swaps the guest identity for the account's or for a fresh
+guest one.
+*/
+
+//
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const guestPrefix = "guest-"
+
+// newGuest returns a guest user with a name no client online has.
+func newGuest() user {
+	cs := onlineClients()
+	taken := make(map[string]bool, len(cs))
+	for _, c := range cs {
+		taken[c.user.Name] = true
+	}
+	for n := 10000; ; n *= 10 {
+		for try := 0; try < 10; try++ {
+			name := fmt.Sprintf("%s%d", guestPrefix, n/10+rand.Intn(n-n/10))
+			if !taken[name] {
+				return user{Name: name}
+			}
+		}
+	}
+}
+
+// become makes u c's identity, letting others know who c was is gone. The
+// caller announces u, see loggedIn.
+func (c *client) become(u user) {
+	noteSeen(c)
+	emit("user.leave", map[string]string{"user": c.user.Name, "room": c.currentRoom()})
+	c.user = u
+}
+
+// becomeGuest makes c a new guest in the lobby, after it logged out.
+func (c *client) becomeGuest() error {
+	old := c.user
+	c.become(newGuest())
+	announceLeave(c, &old, leaveRooms(c), false)
+	c.enterRoom(defaultRoom)
+	emit("user.join", map[string]string{"user": c.user.Name, "room": defaultRoom})
+	if e := c.showPrompt(); e != nil {
+		return e
+	}
+	return c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+}
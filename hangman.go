@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+)
+
+// hangmanWords is the word list secret words are picked from.
+var hangmanWords = []string{
+	"terminal", "websocket", "console", "gopher", "channel", "goroutine",
+	"protocol", "keyboard", "password", "compiler", "function", "variable",
+	"network", "browser", "server", "message", "cipher", "directory",
+}
+
+// hangmanStages are drawn as wrong guesses accumulate.
+var hangmanStages = []string{
+	"  +---+\n      |\n      |\n      |\n     ===",
+	"  +---+\n  O   |\n      |\n      |\n     ===",
+	"  +---+\n  O   |\n  |   |\n      |\n     ===",
+	"  +---+\n  O   |\n /|   |\n      |\n     ===",
+	"  +---+\n  O   |\n /|\\  |\n      |\n     ===",
+	"  +---+\n  O   |\n /|\\  |\n /    |\n     ===",
+	"  +---+\n  O   |\n /|\\  |\n / \\  |\n     ===",
+}
+
+// hangman is a cooperative game where players take turns guessing letters.
+type hangman struct {
+	word    string
+	guessed map[rune]bool
+	wrong   int
+}
+
+func (h *hangman) start(n int) {
+	h.word = hangmanWords[rand.Intn(len(hangmanWords))]
+	h.guessed = make(map[rune]bool)
+	h.wrong = 0
+}
+
+func (h *hangman) move(player int, arg string) error {
+	arg = strings.ToLower(strings.TrimSpace(arg))
+	if len(arg) > 1 {
+		// Guessing the whole word: right wins, wrong costs a turn.
+		if arg == h.word {
+			for _, r := range h.word {
+				h.guessed[r] = true
+			}
+		} else {
+			h.wrong++
+		}
+		return nil
+	}
+	if len(arg) != 1 || arg[0] < 'a' || arg[0] > 'z' {
+		return errors.New("guess a single letter or the whole word")
+	}
+	r := rune(arg[0])
+	if h.guessed[r] {
+		return errors.New("already guessed " + arg)
+	}
+	h.guessed[r] = true
+	if !strings.ContainsRune(h.word, r) {
+		h.wrong++
+	}
+	return nil
+}
+
+// masked returns the word with unguessed letters hidden.
+func (h *hangman) masked() string {
+	var b []string
+	for _, r := range h.word {
+		if h.guessed[r] {
+			b = append(b, string(r))
+		} else {
+			b = append(b, "_")
+		}
+	}
+	return strings.Join(b, " ")
+}
+
+func (h *hangman) board(names []string) string {
+	var used []string
+	for r := 'a'; r <= 'z'; r++ {
+		if h.guessed[r] {
+			used = append(used, string(r))
+		}
+	}
+	return hangmanStages[h.wrong] + "\n\n" + h.masked() + "\nGuessed: " + strings.Join(used, " ")
+}
+
+func (h *hangman) result(names []string) (bool, string) {
+	if !strings.Contains(h.masked(), "_") {
+		return true, "the word was " + h.word + ", everyone wins!"
+	}
+	if h.wrong >= len(hangmanStages)-1 {
+		return true, "the word was " + h.word + ", better luck next time"
+	}
+	return false, ""
+}
+
+func init() {
+	gameKinds["hangman"] = gameKind{
+		desc: "guess the word one letter at a time (1-8 players)",
+		min:  1, max: 8,
+		new: func() gameRules { return &hangman{} },
+	}
+}
@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Help is generated from the commands themselves. help lists the commands the
+user may run by category with their descriptions; help <command> [sub-command]
+shows the usage, options, examples and sub-commands of one. Commands describe
+themselves with the Desc, Usage, Flags, Examples and Category fields, so a new
+command is documented by filling them in.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// categories is the order of the categories in help. Commands without one,
+// e.g. from plugins, are listed under Other.
+var categories = []string{"Shell", "Account", "Rooms", "Files", "Tools", "Admin", "Other"}
+
+// flagDoc documents an option of a command.
+type flagDoc struct {
+	Name  string // without dashes
+	Value string // what the value is, empty for options that take none
+	Desc  string
+}
+
+// flagSpec returns the options of cmd in the form parseFlags takes.
+func (cmd command) flagSpec() map[string]bool {
+	spec := make(map[string]bool)
+	for _, f := range cmd.Flags {
+		spec[f.Name] = f.Value != ""
+	}
+	return spec
+}
+
+// usageOf returns the usage line of the command named path.
+func (c *client) usageOf(path string, cmd command) string {
+	switch {
+	case cmd.Usage != "":
+		return cmd.Usage
+	case len(cmd.Sub) > 0:
+		return path + " " + strings.Join(c.subNames(cmd), "|") + " ..."
+	}
+	return path
+}
+
+// helpIndex lists the commands c may run by category.
+func (c *client) helpIndex() error {
+	byCategory := make(map[string][]string)
+	cmds := commandList()
+	for name, cmd := range cmds {
+		if c.user.role() < cmd.Role {
+			continue
+		}
+		cat := cmd.Category
+		if cat == "" {
+			cat = "Other"
+		}
+		byCategory[cat] = append(byCategory[cat], name)
+	}
+	lines := []string{c.tr("Available commands:")}
+	for _, cat := range categories {
+		names := byCategory[cat]
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		var rows [][]string
+		for _, name := range names {
+			rows = append(rows, []string{"  " + name, c.tr(cmds[name].Desc)})
+		}
+		lines = append(lines, "", c.tr(cat))
+		lines = append(lines, strings.Split(formatTable(rows, false), "\n")...)
+	}
+	lines = append(lines, "", c.tr("Type help <command> for more about a command."))
+	return c.pageLines(lines, false)
+}
+
+// helpCommand describes the command named path.
+func (c *client) helpCommand(path string, cmd command) error {
+	lines := []string{c.tr("Usage:") + " " + c.usageOf(path, cmd)}
+	if cmd.Desc != "" {
+		lines = append(lines, c.tr(cmd.Desc))
+	}
+	if len(cmd.Flags) > 0 {
+		var rows [][]string
+		for _, f := range cmd.Flags {
+			opt := "  --" + f.Name
+			if f.Value != "" {
+				opt += " <" + f.Value + ">"
+			}
+			rows = append(rows, []string{opt, c.tr(f.Desc)})
+		}
+		lines = append(lines, "", c.tr("Options:"))
+		lines = append(lines, strings.Split(formatTable(rows, false), "\n")...)
+	}
+	if len(cmd.Sub) > 0 {
+		lines = append(lines, "", c.tr("Sub-commands:"))
+		lines = append(lines, c.subUsage(path, cmd)...)
+	}
+	if len(cmd.Examples) > 0 {
+		lines = append(lines, "", c.tr("Examples:"))
+		for _, ex := range cmd.Examples {
+			lines = append(lines, "  "+ex)
+		}
+	}
+	return c.pageLines(lines, false)
+}
+
+func init() {
+	cmdMap["help"] = command{
+		Desc:     "Shows the available commands, or how to use one.",
+		Usage:    "help [command [sub-command]]",
+		Examples: []string{"help", "help weather", "help cron add"},
+		Category: "Shell",
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return c.helpIndex()
+			}
+			cmd, ok := lookupCommand(strings.ToLower(args[1]))
+			if !ok || c.user.role() < cmd.Role {
+				return c.appendMsg("#msg-list", c.trf("Command not available: %s", args[1]))
+			}
+			cmd, n := cmd.find(args[1:])
+			return c.helpCommand(strings.ToLower(strings.Join(args[1:n+1], " ")), cmd)
+		},
+		Complete: func(c *client, words []string) []string {
+			var names []string
+			if len(words) == 2 {
+				for name, cmd := range commandList() {
+					if c.user.role() >= cmd.Role {
+						names = append(names, name)
+					}
+				}
+			} else if cmd, ok := lookupCommand(strings.ToLower(words[1])); ok {
+				if cmd, n := cmd.find(words[1 : len(words)-1]); n == len(words)-2 {
+					names = c.subNames(cmd)
+				}
+			}
+			return names
+		},
+	}
+}
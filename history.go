@@ -0,0 +1,250 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The history system stores messages per conversation, either a room ("#room")
+or a pair of users ("@alice+bob"), as append-only JSON lines files in the work
+directory. Messages are numbered from 1 within their conversation so they can
+be paged through by id.
+
+Read markers remember the last room message each user has seen, which gives
+the rooms a user is in and their unread counts.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// message is a single stored chat message.
+type message struct {
+	Id   int
+	Time time.Time
+	From string
+	Text string
+}
+
+var history = struct {
+	sync.Mutex
+	count map[string]int // messages stored per conversation
+}{count: make(map[string]int)}
+
+var reads = struct {
+	sync.Mutex
+	list map[string]map[string]int // user -> room -> last read id
+}{list: make(map[string]map[string]int)}
+
+// roomKey returns the history key of room.
+func roomKey(room string) string {
+	return "#" + room
+}
+
+// dmKey returns the history key of the conversation between two users.
+func dmKey(a, b string) string {
+	names := []string{strings.ToLower(a), strings.ToLower(b)}
+	sort.Strings(names)
+	return "@" + names[0] + "+" + names[1]
+}
+
+// historyPath returns the file the conversation key is stored in.
+func historyPath(key string) string {
+	return *work + SEP + "history" + SEP + key + ".log"
+}
+
+// forgetConversations removes the conversations of name with other users.
+func forgetConversations(name string) {
+	history.Lock()
+	defer history.Unlock()
+	paths, e := filepath.Glob(historyPath("@*"))
+	if e != nil {
+		log.Println(e)
+		return
+	}
+	for _, p := range paths {
+		key := strings.TrimSuffix(filepath.Base(p), ".log")
+		if !containsFold(strings.Split(key[1:], "+"), name) {
+			continue
+		}
+		if e := os.Remove(p); e != nil {
+			log.Println(e)
+		}
+		delete(history.count, key)
+	}
+}
+
+// readHistory returns every message of a conversation. Callers must hold
+// the lock.
+func readHistory(key string) (msgs []message, e error) {
+	f, e := os.Open(historyPath(key))
+	if os.IsNotExist(e) {
+		return nil, nil
+	} else if e != nil {
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var m message
+		if json.Unmarshal(s.Bytes(), &m) == nil {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, s.Err()
+}
+
+// storeMessage appends a message to a conversation and returns it.
+func storeMessage(key, from, text string) (m message, e error) {
+	history.Lock()
+	defer history.Unlock()
+	n, ok := history.count[key]
+	if !ok {
+		msgs, err := readHistory(key)
+		if err != nil {
+			return m, err
+		}
+		if len(msgs) > 0 {
+			n = msgs[len(msgs)-1].Id
+		}
+	}
+	m = message{Id: n + 1, Time: time.Now().UTC(), From: from, Text: text}
+	if e = os.MkdirAll(*work+SEP+"history", 0700); e != nil {
+		return
+	}
+	f, e := os.OpenFile(historyPath(key), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	b, _ := json.Marshal(m)
+	if _, e = f.Write(append(b, '\n')); e == nil {
+		history.count[key] = m.Id
+		count(&counters.messages)
+	}
+	return
+}
+
+// pageHistory returns up to limit messages of a conversation with an id
+// below before (or the latest messages when before is 0), oldest first.
+func pageHistory(key string, before, limit int) ([]message, error) {
+	history.Lock()
+	msgs, e := readHistory(key)
+	history.Unlock()
+	if e != nil {
+		return nil, e
+	}
+	end := len(msgs)
+	if before > 0 {
+		end = sort.Search(len(msgs), func(i int) bool { return msgs[i].Id >= before })
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return msgs[start:end], nil
+}
+
+// historyBefore returns up to limit messages of a conversation sent before
+// t, oldest first.
+func historyBefore(key string, t time.Time, limit int) ([]message, error) {
+	history.Lock()
+	msgs, e := readHistory(key)
+	history.Unlock()
+	if e != nil {
+		return nil, e
+	}
+	end := sort.Search(len(msgs), func(i int) bool { return !msgs[i].Time.Before(t) })
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return msgs[start:end], nil
+}
+
+// lastMessage returns the latest message of a conversation, if any.
+func lastMessage(key string) (message, bool) {
+	msgs, err := pageHistory(key, 0, 1)
+	if err != nil || len(msgs) == 0 {
+		return message{}, false
+	}
+	return msgs[0], true
+}
+
+// lastId returns the id of the latest message of a conversation, 0 if it
+// has none.
+func lastId(key string) int {
+	history.Lock()
+	defer history.Unlock()
+	if n, ok := history.count[key]; ok {
+		return n
+	}
+	msgs, err := readHistory(key)
+	if err != nil || len(msgs) == 0 {
+		return 0
+	}
+	history.count[key] = msgs[len(msgs)-1].Id
+	return history.count[key]
+}
+
+// readsPath is the file read markers are persisted in.
+func readsPath() string {
+	return *work + SEP + "reads.json"
+}
+
+// loadReads reads persisted read markers. It is called once from main.
+func loadReads() {
+	reads.Lock()
+	defer reads.Unlock()
+	if e := loadJSON(&reads.list, readsPath()); e != nil && !os.IsNotExist(e) {
+		log.Println(e)
+	}
+	if reads.list == nil {
+		reads.list = make(map[string]map[string]int)
+	}
+}
+
+// markRead records that name has read room up to message id.
+func markRead(name, room string, id int) {
+	name = strings.ToLower(name)
+	reads.Lock()
+	defer reads.Unlock()
+	if reads.list[name] == nil {
+		reads.list[name] = make(map[string]int)
+	}
+	if old, ok := reads.list[name][room]; ok && old >= id {
+		return
+	}
+	reads.list[name][room] = id
+	if e := saveJSON(reads.list, readsPath()); e != nil {
+		log.Println(e)
+	}
+}
+
+// lastRead returns the id of the last message of room name has read.
+func lastRead(name, room string) int {
+	reads.Lock()
+	defer reads.Unlock()
+	return reads.list[strings.ToLower(name)][room]
+}
+
+// userRooms returns the rooms name has read, with the last read id of each.
+func userRooms(name string) map[string]int {
+	reads.Lock()
+	defer reads.Unlock()
+	rooms := make(map[string]int)
+	for room, id := range reads.list[strings.ToLower(name)] {
+		rooms[room] = id
+	}
+	return rooms
+}
@@ -0,0 +1,202 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The hook system provides incoming webhooks: secret /hooks/<token> URLs that
+external services (CI systems, monitoring, etc) can POST to in order to post
+markdown formatted messages into a room. The request body may be JSON with a
+"text" (and optional "username") field, a form with the same fields, or plain
+text. A hook only posts while its owner may enter the room (see mayEnterAs in
+roomperm.go), so hooks into private rooms need the owner to run the room or
+be invited to it.
+*/
+
+//
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hook is an incoming webhook endpoint.
+type hook struct {
+	Token, Room, Owner, Name string
+}
+
+var (
+	hooks = struct {
+		sync.Mutex
+		list map[string]*hook
+	}{list: make(map[string]*hook)}
+	hookLimit = newRateLimiter(30, time.Minute)
+)
+
+// hooksPath is the file hooks are persisted in.
+func hooksPath() string {
+	return *work + SEP + "hooks.json"
+}
+
+// saveHooks writes all hooks to disk. Callers must hold the lock.
+func saveHooks() error {
+	var list []*hook
+	for _, h := range hooks.list {
+		list = append(list, h)
+	}
+	return saveJSON(list, hooksPath())
+}
+
+// loadHooks reads persisted hooks. It is called once from main.
+func loadHooks() {
+	var list []*hook
+	if e := loadJSON(&list, hooksPath()); e != nil && !os.IsNotExist(e) {
+		log.Println(e)
+	}
+	hooks.Lock()
+	for _, h := range list {
+		hooks.list[h.Token] = h
+	}
+	hooks.Unlock()
+}
+
+// randomToken returns n random bytes hex encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// serveHook posts the body of a webhook request into the hook's room.
+func serveHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	hooks.Lock()
+	h, ok := hooks.list[mux.Vars(r)["token"]]
+	hooks.Unlock()
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if !mayEnterAs(h.Owner, h.Room) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if !hookLimit.allow(h.Token) {
+		http.Error(w, "Too many requests", 429)
+		return
+	}
+	var msg struct{ Text, Username string }
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(ct, "application/json"):
+		if json.Unmarshal(body, &msg) != nil {
+			http.Error(w, "Bad JSON", 400)
+			return
+		}
+	case strings.HasPrefix(ct, "application/x-www-form-urlencoded"):
+		r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		r.ParseForm()
+		msg.Text, msg.Username = r.PostForm.Get("text"), r.PostForm.Get("username")
+	default:
+		msg.Text = string(body)
+	}
+	if strings.TrimSpace(msg.Text) == "" {
+		http.Error(w, "Missing text", 400)
+		return
+	}
+	from := h.Name
+	if msg.Username != "" {
+		from = msg.Username + " via " + h.Name
+	}
+	postRoomHTML(h.Room, html.EscapeString(from), markdownHTML(msg.Text))
+	emit("room.message", map[string]string{"room": h.Room, "from": from, "text": msg.Text})
+	w.WriteHeader(204)
+}
+
+func init() {
+	cmdMap["hook"] = command{
+		Desc:     "Manages webhook URLs that post into a room.",
+		Usage:    "hook create #room [name] | hook list | hook rm <token>",
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			switch {
+			case len(args) >= 3 && args[1] == "create" && strings.HasPrefix(args[2], "#"):
+				room, rest := roomArg(args[2:])
+				if !c.reachRoom("hook", room) {
+					return nil
+				}
+				if !mayEnterAs(c.user.Name, room) {
+					return c.fail(codeForbidden, "", c.trf("%s: permission denied", "hook"))
+				}
+				name := "hook"
+				if len(rest) > 0 {
+					name = strings.Join(rest, " ")
+				}
+				h := &hook{Token: randomToken(16), Room: room, Owner: c.user.Name, Name: name}
+				hooks.Lock()
+				hooks.list[h.Token] = h
+				e = saveHooks()
+				hooks.Unlock()
+				if e != nil {
+					return
+				}
+				return c.offRecord(func() error {
+					e := c.appendMsg("#msg-list", "Webhook created for #"+room+", POST messages to:")
+					if e == nil {
+						u := "https://" + *hostname + *httpsAddr + "/hooks/" + h.Token
+						e = c.appendLink("#msg-list", u, u)
+					}
+					return e
+				})
+			case len(args) == 2 && args[1] == "list":
+				hooks.Lock()
+				rows := [][]string{{"Token", "Room", "Name"}}
+				for _, h := range hooks.list {
+					if h.Owner == c.user.Name {
+						rows = append(rows, []string{h.Token, "#" + h.Room, h.Name})
+					}
+				}
+				hooks.Unlock()
+				if len(rows) == 1 {
+					return c.appendMsg("#msg-list", "No webhooks")
+				}
+				return c.appendPre("#msg-list", formatTable(rows, true))
+			case len(args) == 3 && args[1] == "rm":
+				hooks.Lock()
+				defer hooks.Unlock()
+				h, ok := hooks.list[args[2]]
+				if !ok || h.Owner != c.user.Name {
+					return c.appendMsg("#msg-list", "No such webhook")
+				}
+				delete(hooks.list, h.Token)
+				if e = saveHooks(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "Webhook removed")
+			}
+			return c.appendMsg("#msg-list", "Usage: hook create #room [name] | hook list | hook rm <token>")
+		},
+	}
+}
@@ -0,0 +1,124 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The hub is the goroutine that owns the set of connected clients. Clients are
+added and removed through its register and unregister channels, and packets
+for all of them, or the ones a filter picks, go through broadcast, so chat,
+admin commands and presence can address sockets without sharing a map and a
+lock. Lookups (onlineClients, clientsByName and the like, see online.go) are
+run by the hub too, through query. So is presence, users entering and leaving
+rooms, see presence.go.
+
+Each broadcast packet is sent from a goroutine of its own per client, so a
+slow connection doesn't hold up the hub or the other clients. Filters and
+queries run on the hub's goroutine: they must be quick and must not use the
+hub themselves.
+*/
+
+//
+package main
+
+import (
+	"log"
+)
+
+// hubCast is a broadcast: packets for the clients to picks, or all of them
+// if to is nil.
+type hubCast struct {
+	packets   []packet
+	important bool // sent with sendImportant, see ack.go
+	to        func(c *client) bool
+}
+
+// hubState is what the hub owns.
+type hubState struct {
+	clients map[*client]bool
+	leaving map[string]*pendingLeave // user#room -> leave not announced yet
+}
+
+var hub = struct {
+	register   chan *client
+	unregister chan *client
+	broadcast  chan hubCast
+	presence   chan presenceChange
+	expired    chan *pendingLeave
+	query      chan func(h *hubState)
+}{
+	register:   make(chan *client),
+	unregister: make(chan *client),
+	broadcast:  make(chan hubCast, 64),
+	presence:   make(chan presenceChange, 64),
+	expired:    make(chan *pendingLeave),
+	query:      make(chan func(h *hubState)),
+}
+
+// runHub is the hub's goroutine, started once from main.
+func runHub() {
+	h := &hubState{clients: make(map[*client]bool), leaving: make(map[string]*pendingLeave)}
+	for {
+		select {
+		case c := <-hub.register:
+			h.clients[c] = true
+		case c := <-hub.unregister:
+			delete(h.clients, c)
+		case b := <-hub.broadcast:
+			h.cast(b)
+		case p := <-hub.presence:
+			h.changePresence(p)
+		case l := <-hub.expired:
+			h.expireLeave(l)
+		case f := <-hub.query:
+			f(h)
+		}
+	}
+}
+
+// cast sends b to the clients it is for.
+func (h *hubState) cast(b hubCast) {
+	for c := range h.clients {
+		if b.to == nil || b.to(c) {
+			go deliverCast(c, b)
+		}
+	}
+}
+
+// deliverCast sends the packets of b to c.
+func deliverCast(c *client, b hubCast) {
+	for _, p := range b.packets {
+		var e error
+		if b.important {
+			e = c.sendImportant(p.Clone())
+		} else {
+			e = c.send(p.Clone())
+		}
+		if e != nil {
+			log.Println(c.address, e)
+			return
+		}
+	}
+}
+
+// hubQuery runs f on the hub's goroutine and waits for it.
+func hubQuery(f func(h *hubState)) {
+	done := make(chan struct{})
+	hub.query <- func(h *hubState) {
+		f(h)
+		close(done)
+	}
+	<-done
+}
+
+// selectClients returns the connected clients to picks, all of them if to
+// is nil.
+func selectClients(to func(c *client) bool) (cs []*client) {
+	hubQuery(func(h *hubState) {
+		for c := range h.clients {
+			if to == nil || to(c) {
+				cs = append(cs, c)
+			}
+		}
+	})
+	return
+}
@@ -0,0 +1,178 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The i18n system translates client-facing strings using message catalogs, one
+JSON file per locale in the -locales directory (e.g. locales/de.json), mapping
+the English text to its translation:
+
+	{"User does not exist": "Benutzer existiert nicht",
+	 "Welcome back, %s": "Willkommen zurück, %s"}
+
+Messages sent with appendMsg are looked up as is, so static strings need no
+changes at the call site; strings with variable parts go through trf with a
+printf style format. Usage messages ("Usage: calc <expression>") only need
+the "Usage:" label translated. Command descriptions, option descriptions and
+categories are translated by help the same way, so catalogs cover them too.
+
+A client's locale is negotiated from the browser's Accept-Language header,
+then from the languages announced in its hello packet, and can be changed with
+the lang command. Accounts keep the language they were registered with or last
+set with lang across sessions. Missing translations fall back to English.
+*/
+
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	localesDir = flag.String("locales", "locales", "directory of message catalogs")
+	locales    = struct {
+		sync.RWMutex
+		list map[string]map[string]string
+	}{list: make(map[string]map[string]string)}
+)
+
+// loadLocales reads every catalog in the locales directory. It is called
+// once from main.
+func loadLocales() {
+	files, err := filepath.Glob(filepath.Join(*localesDir, "*.json"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	locales.Lock()
+	defer locales.Unlock()
+	for _, f := range files {
+		var catalog map[string]string
+		if e := loadJSON(&catalog, f); e != nil {
+			log.Println(f, e)
+			continue
+		}
+		locales.list[strings.TrimSuffix(filepath.Base(f), ".json")] = catalog
+	}
+}
+
+// hasLocale reports whether a catalog exists for locale. English is built in.
+func hasLocale(locale string) bool {
+	locales.RLock()
+	defer locales.RUnlock()
+	_, ok := locales.list[locale]
+	return ok || locale == "en"
+}
+
+// localeNames returns the available locales.
+func localeNames() []string {
+	locales.RLock()
+	names := []string{"en"}
+	for name := range locales.list {
+		names = append(names, name)
+	}
+	locales.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// negotiateLocale picks the best available locale for an Accept-Language
+// header, e.g. "de-CH,de;q=0.9,en;q=0.8".
+func negotiateLocale(header string) string {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		p := pref{strings.ToLower(fields[0]), 1}
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(strings.TrimSpace(f), "q=") {
+				p.q, _ = strconv.ParseFloat(strings.TrimSpace(f)[2:], 64)
+			}
+		}
+		if p.tag != "" && p.q > 0 {
+			prefs = append(prefs, p)
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if hasLocale(p.tag) {
+			return p.tag
+		}
+		if i := strings.IndexByte(p.tag, '-'); i > 0 && hasLocale(p.tag[:i]) {
+			return p.tag[:i]
+		}
+	}
+	return "en"
+}
+
+// setLocale changes the client's locale.
+func (c *client) setLocale(locale string) {
+	c.lmu.Lock()
+	c.locale = locale
+	c.lmu.Unlock()
+}
+
+// tr translates s into the client's locale.
+func (c *client) tr(s string) string {
+	c.lmu.Lock()
+	locale := c.locale
+	c.lmu.Unlock()
+	if locale == "" || locale == "en" {
+		return s
+	}
+	locales.RLock()
+	defer locales.RUnlock()
+	catalog := locales.list[locale]
+	if t, ok := catalog[s]; ok && t != "" {
+		return t
+	}
+	// Usage lines are command syntax, only their label is translated.
+	if strings.HasPrefix(s, "Usage: ") && catalog["Usage:"] != "" {
+		return catalog["Usage:"] + s[len("Usage:"):]
+	}
+	return s
+}
+
+// trf translates format and formats it with args.
+func (c *client) trf(format string, args ...interface{}) string {
+	return fmt.Sprintf(c.tr(format), args...)
+}
+
+func init() {
+	cmdMap["lang"] = command{
+		Desc:     "Shows the available languages or switches to one.",
+		Usage:    "lang [code]",
+		Category: "Account",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", c.trf("Available languages: %s", strings.Join(localeNames(), " ")))
+			}
+			locale := strings.ToLower(args[1])
+			if !hasLocale(locale) {
+				return c.appendMsg("#msg-list", c.trf("No such language: %s", args[1]))
+			}
+			c.setLocale(locale)
+			if c.user.key != nil {
+				c.user.Locale = locale
+				if e = c.user.commit(); e != nil {
+					return
+				}
+			}
+			return c.appendMsg("#msg-list", c.trf("Language set to %s", locale))
+		},
+		Complete: func(c *client, words []string) []string {
+			return localeNames()
+		},
+	}
+}
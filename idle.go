@@ -0,0 +1,185 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Idle timeout. A client that sends nothing for -idle-timeout is warned
+-idle-warn before, then, with -idle-action lock, has its terminal locked: the
+messages are blurred and whatever is typed next is taken as the password,
+which unlocks it. Nothing else is run or answered until then, the prompts
+open when it locks fail, and after
+unlockTries wrong passwords the client is disconnected. With -idle-action
+disconnect idle clients are disconnected instead. lock locks the terminal
+straight away.
+
+Only logged in clients are locked, guests have nothing to protect; clients
+logged in with an API key (see apikey.go) are left alone either way.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmptrader/soshell/protocol"
+)
+
+const unlockTries = 5
+
+var (
+	idleTimeout = flag.Duration("idle-timeout", 0, "how long a client may be idle before -idle-action is taken, 0 for ever")
+	idleAction  = flag.String("idle-action", "lock", "what to do with idle clients: lock or disconnect")
+	idleWarn    = flag.Duration("idle-warn", time.Minute, "how long before -idle-timeout idle clients are warned")
+)
+
+// errLocked is what prompts return when the terminal locks.
+var errLocked = errors.New("terminal locked")
+
+// isLocked reports whether c's terminal is locked.
+func (c *client) isLocked() bool {
+	return atomic.LoadInt32(&c.locked) != 0
+}
+
+// lock locks c's terminal, telling it why, unless it's locked already.
+func (c *client) lock(why string) {
+	if !atomic.CompareAndSwapInt32(&c.locked, 0, 1) {
+		return
+	}
+	c.failPrompts()
+	c.setAttribute("#msg-list", "data-locked", "yes")
+	c.setAttribute("#msg-txt", "type", "password")
+	c.lockMsg(why)
+	c.lockMsg(c.trf("Enter the password of %s to unlock", c.user.Name))
+}
+
+// failPrompts makes the prompts waiting for c's input fail with errLocked,
+// so that the password typed to unlock it isn't taken as an answer.
+func (c *client) failPrompts() {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for _, ch := range c.waiting {
+		close(ch)
+	}
+	c.waiting = nil
+}
+
+// lockMsg appends a message about the lock to c's messages, where it isn't
+// blurred with the rest.
+func (c *client) lockMsg(text string) error {
+	return c.sendImportant(AppendElement{Selector: "#msg-list", Element: "div", Class: "msg lock-msg", Text: c.tr(text), Scroll: true}.packet())
+}
+
+// unlock takes what was typed on c's locked terminal as the password, and
+// unlocks it if it is. It is called from the listener instead of dispatch.
+func (c *client) unlock(pass string) error {
+	if !c.passwordOK(pass) {
+		securityLoginFailed(c.address, c.user.Name)
+		if c.unlockFails++; c.unlockFails >= unlockTries {
+			c.disconnect("Too many wrong passwords")
+			return nil
+		}
+		return c.lockMsg("Wrong password")
+	}
+	c.unlockFails = 0
+	c.sudoUntil = time.Time{}
+	atomic.StoreInt32(&c.locked, 0)
+	if e := c.setAttribute("#msg-txt", "type", "text"); e != nil {
+		return e
+	}
+	if e := c.setAttribute("#msg-list", "data-locked", "no"); e != nil {
+		return e
+	}
+	return c.appendMsg("#msg-list", "Unlocked")
+}
+
+// lockedInput handles input to c while it's locked: only acks and hellos
+// are let through, anything typed is a password.
+func (c *client) lockedInput(b []byte) error {
+	if len(b) > 0 && b[0] == '{' {
+		if p, err := protocol.Unmarshal(b); err == nil {
+			if p.Type == "ack" || p.Type == "hello" {
+				_, err = c.demux(p)
+			}
+			return err
+		}
+	}
+	return c.unlock(string(b))
+}
+
+// checkIdleFlags stops the server if -idle-action is not one it knows. It is
+// called once from main.
+func checkIdleFlags() {
+	if *idleAction != "lock" && *idleAction != "disconnect" {
+		log.Fatalln("-idle-action must be lock or disconnect, not", *idleAction)
+	}
+}
+
+// watchIdle warns c when it's about to time out and locks or disconnects
+// it when it does, until done is closed. It is called from serveWs.
+func (c *client) watchIdle(done <-chan struct{}) {
+	if *idleTimeout <= 0 {
+		return
+	}
+	check := *idleTimeout / 10
+	if check > 15*time.Second {
+		check = 15 * time.Second
+	} else if check < time.Second {
+		check = time.Second
+	}
+	go func() {
+		t := time.NewTicker(check)
+		defer t.Stop()
+		warned := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			idle := c.sess.idle()
+			lock := *idleAction != "disconnect"
+			switch {
+			case c.apiKeyID != "" || lock && (c.user.key == nil || c.isLocked()):
+				warned = false
+			case idle >= *idleTimeout:
+				warned = false
+				if !lock {
+					log.Println(c.address, "idle for", idle.Truncate(time.Second))
+					c.disconnect("Disconnected for being idle")
+					return
+				}
+				c.lock(c.trf("Locked after %s idle", idle.Truncate(time.Second)))
+			case idle >= *idleTimeout-*idleWarn:
+				if !warned {
+					warned = true
+					left := (*idleTimeout - idle).Truncate(time.Second)
+					if lock {
+						c.appendNotice("#msg-list", c.trf("You've been idle, your terminal locks in %s", left))
+					} else {
+						c.appendNotice("#msg-list", c.trf("You've been idle, you'll be disconnected in %s", left))
+					}
+				}
+			default:
+				warned = false
+			}
+		}
+	}()
+}
+
+func init() {
+	cmdMap["lock"] = command{
+		Desc:     "Locks your terminal until you enter your password.",
+		Usage:    "lock",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			c.lock("Locked")
+			return nil
+		},
+	}
+}
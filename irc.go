@@ -0,0 +1,450 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The IRC bridge connects rooms to channels of an IRC network, so IRC users and
+soshell users talk together. It is off unless -irc names a server, and
+-irc-rooms pairs the rooms with channels:
+
+	soshell -irc irc.libera.chat:6697 -irc-nick hawks -irc-rooms lobby=#hawks,dev=#hawks-dev
+
+Room messages are said in the channel by the bridge's nick as "<alice> text",
+and rooms are told when users join and leave them. Channel messages are posted
+in the room from "nick@irc", and the room is told when IRC users join, part,
+quit or change nick; irc lists the nicks in a bridged channel. The bridge
+reconnects with backoff when the connection drops and sends at most a line
+every ircSendEvery, so the network doesn't kick it for flooding.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ircServer   = flag.String("irc", "", "IRC server host:port to bridge rooms to, empty to disable")
+	ircTLS      = flag.Bool("irc-tls", true, "connect to the IRC server with TLS")
+	ircNick     = flag.String("irc-nick", "soshell", "nick of the IRC bridge")
+	ircPassword = flag.String("irc-password", "", "IRC server password, if it needs one")
+	ircRooms    = flag.String("irc-rooms", "", "rooms bridged to IRC channels, as room=#channel,...")
+)
+
+const (
+	ircSendEvery = 500 * time.Millisecond
+	ircLineMax   = 400 // bytes of text per PRIVMSG
+	ircSuffix    = "@irc"
+)
+
+// ircFormatting matches the bold, color, italic, underline and reset codes
+// of IRC messages.
+var ircFormatting = regexp.MustCompile("\x02|\x03(\\d{1,2}(,\\d{1,2})?)?|\x0f|\x16|\x1d|\x1f")
+
+// ircMessage is a parsed line of the IRC protocol.
+type ircMessage struct {
+	Nick    string // from the prefix, "" for the server
+	Command string
+	Params  []string
+}
+
+// ircBridge is the state of the bridge's connection.
+var ircBridge = struct {
+	sync.Mutex
+	channels map[string]string          // room -> channel
+	rooms    map[string]string          // lower case channel -> room
+	nicks    map[string]map[string]bool // room -> nicks in its channel
+	nick     string                     // current nick, -irc-nick or a variant
+	out      chan string
+	up       bool
+}{channels: make(map[string]string), rooms: make(map[string]string), nicks: make(map[string]map[string]bool)}
+
+// parseIRC parses a line of the IRC protocol.
+func parseIRC(line string) (m ircMessage) {
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return
+		}
+		m.Nick = line[1:i]
+		if j := strings.IndexByte(m.Nick, '!'); j >= 0 {
+			m.Nick = m.Nick[:j]
+		}
+		line = line[i+1:]
+	}
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			i = len(line)
+		}
+		if word := line[:i]; word != "" {
+			if m.Command == "" {
+				m.Command = strings.ToUpper(word)
+			} else {
+				m.Params = append(m.Params, word)
+			}
+		}
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	return
+}
+
+// param returns the ith parameter of m, "" if it has none.
+func (m ircMessage) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// ircSend queues line to be sent to the server, unless the bridge is down.
+func ircSend(line string) {
+	ircBridge.Lock()
+	out, up := ircBridge.out, ircBridge.up
+	ircBridge.Unlock()
+	if !up {
+		return
+	}
+	select {
+	case out <- line:
+	default:
+		log.Println("irc: send queue full, dropped", line)
+	}
+}
+
+// ircBreak reports whether r ends an IRC line, for some server or other.
+func ircBreak(r rune) bool {
+	return r == '\r' || r == '\n' || r == 0
+}
+
+// ircClean returns s without the characters that would end an IRC line.
+func ircClean(s string) string {
+	return strings.Map(func(r rune) rune {
+		if ircBreak(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// ircSay says text from in channel, a PRIVMSG per line of at most
+// ircLineMax bytes.
+func ircSay(channel, from, text string) {
+	from = ircClean(from)
+	for _, line := range strings.FieldsFunc(text, ircBreak) {
+		for line != "" {
+			n := len(line)
+			if n > ircLineMax {
+				n = ircLineMax
+				for n > 0 && line[n]&0xc0 == 0x80 {
+					n-- // don't cut a rune in two
+				}
+				if n == 0 {
+					n = ircLineMax // not UTF-8 anyway
+				}
+			}
+			ircSend("PRIVMSG " + channel + " :<" + from + "> " + line[:n])
+			line = line[n:]
+		}
+	}
+}
+
+// ircRoom returns the room bridged to channel.
+func ircRoom(channel string) (string, bool) {
+	ircBridge.Lock()
+	defer ircBridge.Unlock()
+	room, ok := ircBridge.rooms[strings.ToLower(channel)]
+	return room, ok
+}
+
+// ircChannel returns the channel bridged to room.
+func ircChannel(room string) (string, bool) {
+	ircBridge.Lock()
+	defer ircBridge.Unlock()
+	channel, ok := ircBridge.channels[room]
+	return channel, ok
+}
+
+// setNick records that nick is in the channel of room, or left it.
+func setNick(room, nick string, in bool) {
+	ircBridge.Lock()
+	defer ircBridge.Unlock()
+	if ircBridge.nicks[room] == nil {
+		ircBridge.nicks[room] = make(map[string]bool)
+	}
+	if in {
+		ircBridge.nicks[room][nick] = true
+	} else {
+		delete(ircBridge.nicks[room], nick)
+	}
+}
+
+// roomsOfNick returns the bridged rooms whose channel nick is in.
+func roomsOfNick(nick string) (list []string) {
+	ircBridge.Lock()
+	defer ircBridge.Unlock()
+	for room, nicks := range ircBridge.nicks {
+		if nicks[nick] {
+			list = append(list, room)
+		}
+	}
+	return
+}
+
+// handleIRC acts on a message from the server.
+func handleIRC(m ircMessage) {
+	ircBridge.Lock()
+	self := ircBridge.nick
+	ircBridge.Unlock()
+	switch m.Command {
+	case "PING":
+		ircSend("PONG :" + m.param(0))
+	case "001":
+		ircBridge.Lock()
+		ircBridge.nick = m.param(0)
+		var channels []string
+		for _, channel := range ircBridge.channels {
+			channels = append(channels, channel)
+		}
+		ircBridge.Unlock()
+		sort.Strings(channels)
+		for _, channel := range channels {
+			ircSend("JOIN " + channel)
+		}
+		log.Println("irc: connected to", *ircServer, "as", m.param(0))
+	case "433": // nick in use
+		ircBridge.Lock()
+		ircBridge.nick += "_"
+		nick := ircBridge.nick
+		ircBridge.Unlock()
+		ircSend("NICK " + nick)
+	case "353": // names: nick = #channel :@alice +bob carol
+		if room, ok := ircRoom(m.param(2)); ok {
+			for _, nick := range strings.Fields(m.param(3)) {
+				if nick = strings.TrimLeft(nick, "~&@%+"); nick != self {
+					setNick(room, nick, true)
+				}
+			}
+		}
+	case "PRIVMSG":
+		room, ok := ircRoom(m.param(0))
+		if !ok || m.Nick == self {
+			return
+		}
+		text := ircFormatting.ReplaceAllString(m.param(1), "")
+		if strings.HasPrefix(text, "\x01ACTION ") {
+			text = "*" + strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01") + "*"
+		} else if strings.HasPrefix(text, "\x01") {
+			return // other CTCP
+		}
+		if _, err := postRoom(room, m.Nick+ircSuffix, text); err != nil {
+			log.Println("irc:", err)
+		}
+	case "JOIN":
+		if room, ok := ircRoom(m.param(0)); ok && m.Nick != self {
+			setNick(room, m.Nick, true)
+			noticeRoom(room, m.Nick+ircSuffix, "%s joined")
+		}
+	case "PART":
+		if room, ok := ircRoom(m.param(0)); ok && m.Nick != self {
+			setNick(room, m.Nick, false)
+			noticeRoom(room, m.Nick+ircSuffix, "%s left")
+		}
+	case "KICK":
+		if room, ok := ircRoom(m.param(0)); ok {
+			if m.param(1) == self {
+				ircSend("JOIN " + m.param(0))
+				return
+			}
+			setNick(room, m.param(1), false)
+			noticeRoom(room, m.param(1)+ircSuffix, "%s left")
+		}
+	case "QUIT":
+		for _, room := range roomsOfNick(m.Nick) {
+			setNick(room, m.Nick, false)
+			noticeRoom(room, m.Nick+ircSuffix, "%s left")
+		}
+	case "NICK":
+		if m.Nick == self {
+			ircBridge.Lock()
+			ircBridge.nick = m.param(0)
+			ircBridge.Unlock()
+			return
+		}
+		for _, room := range roomsOfNick(m.Nick) {
+			setNick(room, m.Nick, false)
+			setNick(room, m.param(0), true)
+			for _, c := range roomClients(room) {
+				c.appendMsg("#msg-list", c.trf("%s is now known as %s", m.Nick+ircSuffix, m.param(0)+ircSuffix))
+			}
+		}
+	}
+}
+
+// ircSession runs one connection to the server until it drops.
+func ircSession() error {
+	var conn net.Conn
+	var err error
+	if *ircTLS {
+		host, _, _ := net.SplitHostPort(*ircServer)
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", *ircServer, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", *ircServer, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	out := make(chan string, 256)
+	done := make(chan struct{})
+	defer close(done)
+	ircBridge.Lock()
+	ircBridge.out, ircBridge.up, ircBridge.nick = out, true, *ircNick
+	ircBridge.nicks = make(map[string]map[string]bool)
+	ircBridge.Unlock()
+	defer func() {
+		ircBridge.Lock()
+		ircBridge.up = false
+		ircBridge.Unlock()
+	}()
+	go func() {
+		tick := time.NewTicker(ircSendEvery)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case line := <-out:
+				conn.SetWriteDeadline(time.Now().Add(time.Minute))
+				if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+					conn.Close()
+					return
+				}
+				<-tick.C
+			}
+		}
+	}()
+	if *ircPassword != "" {
+		ircSend("PASS " + *ircPassword)
+	}
+	ircSend("NICK " + *ircNick)
+	ircSend("USER " + *ircNick + " 0 * :" + *hostname + " bridge")
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		handleIRC(parseIRC(strings.TrimRight(line, "\r\n")))
+	}
+}
+
+// relayToIRC says the room messages of bridged rooms, and who joins and
+// leaves them, in their channels.
+func relayToIRC() {
+	ch, _ := listen()
+	for ev := range ch {
+		channel, ok := ircChannel(ev.Data["room"])
+		if !ok {
+			continue
+		}
+		switch ev.Event {
+		case "room.message":
+			if !strings.HasSuffix(ev.Data["from"], ircSuffix) {
+				ircSay(channel, ev.Data["from"], ev.Data["text"])
+			}
+		case "user.join":
+			ircSend("NOTICE " + channel + " :" + ircClean(ev.Data["user"]) + " joined")
+		case "user.leave":
+			ircSend("NOTICE " + channel + " :" + ircClean(ev.Data["user"]) + " left")
+		}
+	}
+}
+
+// startIRC bridges the rooms of -irc-rooms to IRC, if -irc is set.
+func startIRC() {
+	if *ircServer == "" {
+		return
+	}
+	for _, pair := range strings.Split(*ircRooms, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "#") {
+			if pair != "" {
+				log.Println("irc: bad -irc-rooms entry", pair)
+			}
+			continue
+		}
+		room := roomName(parts[0])
+		if _, ok := findRoom(room); !ok {
+			log.Println("irc: no such room", room)
+			continue
+		}
+		ircBridge.channels[room] = parts[1]
+		ircBridge.rooms[strings.ToLower(parts[1])] = room
+	}
+	if len(ircBridge.channels) == 0 {
+		log.Println("irc: no rooms to bridge, see -irc-rooms")
+		return
+	}
+	go relayToIRC()
+	wait := time.Second
+	for {
+		start := time.Now()
+		err := ircSession()
+		log.Println("irc:", err)
+		if time.Since(start) > 5*time.Minute {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > 5*time.Minute {
+			wait = 5 * time.Minute
+		}
+	}
+}
+
+func init() {
+	services = append(services, startIRC)
+	cmdMap["irc"] = command{
+		Desc:     "Lists the IRC users in the channel bridged to a room, the current one if none is named.",
+		Usage:    "irc [#room]",
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			room := c.currentRoom()
+			if len(args) > 1 {
+				room = roomName(args[1])
+			}
+			channel, ok := ircChannel(room)
+			if !ok {
+				return c.appendMsg("#msg-list", c.trf("#%s isn't bridged to IRC", room))
+			}
+			ircBridge.Lock()
+			up := ircBridge.up
+			var nicks []string
+			for nick := range ircBridge.nicks[room] {
+				nicks = append(nicks, nick)
+			}
+			ircBridge.Unlock()
+			if !up {
+				return c.appendMsg("#msg-list", c.trf("The bridge to %s is down", channel))
+			}
+			sort.Strings(nicks)
+			return c.appendMsg("#msg-list", c.trf("%s on %s (%d): %s", channel, *ircServer, len(nicks), strings.Join(nicks, " ")))
+		},
+		Complete: completeRooms,
+	}
+}
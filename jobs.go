@@ -0,0 +1,184 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Job control. A command line ending in & runs in the background so the
+terminal stays usable while it works; its output appears when it's ready.
+jobs lists the background jobs, fg waits for one and kill forgets one.
+
+Only commands marked Background can run as jobs: the connection has a single
+reader, so commands that prompt or query the page must run in the
+foreground. A command can't be interrupted midway, kill stops tracking the
+job and discards its result.
+*/
+
+//
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jobMax = 5 // running jobs per client
+
+// job is a command running in the background.
+type job struct {
+	id     int
+	line   string
+	start  time.Time
+	done   chan bool // closed when the command returns
+	err    error     // set when done
+	killed bool      // by kill
+	waited bool      // by fg, which reports the result
+}
+
+// jobTable holds a client's background jobs.
+type jobTable struct {
+	sync.Mutex
+	list []*job
+	next int
+}
+
+// remove takes j out of the table. Callers must hold the lock.
+func (t *jobTable) remove(j *job) {
+	for i, x := range t.list {
+		if x == j {
+			t.list = append(t.list[:i], t.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// find returns the job named by arg (n or %n), or the latest job if arg is
+// empty. Callers must hold the lock.
+func (t *jobTable) find(arg string) *job {
+	if len(t.list) == 0 {
+		return nil
+	}
+	if arg == "" {
+		return t.list[len(t.list)-1]
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(arg, "%"))
+	if err != nil {
+		return nil
+	}
+	for _, j := range t.list {
+		if j.id == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// startJob runs cmd in the background.
+func (c *client) startJob(line string, cmd command, args []string) error {
+	if !cmd.Background {
+		return c.appendMsg("#msg-list", c.trf("%s can't run in the background", args[0]))
+	}
+	c.jobs.Lock()
+	if len(c.jobs.list) >= jobMax {
+		c.jobs.Unlock()
+		return c.appendMsg("#msg-list", "Too many jobs, wait for one to finish")
+	}
+	c.jobs.next++
+	j := &job{id: c.jobs.next, line: strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), "&")),
+		start: time.Now(), done: make(chan bool)}
+	c.jobs.list = append(c.jobs.list, j)
+	c.jobs.Unlock()
+	go func() {
+		err := c.run(cmd, args)
+		c.jobs.Lock()
+		j.err = err
+		quiet := j.killed || j.waited
+		c.jobs.remove(j)
+		c.jobs.Unlock()
+		close(j.done)
+		ev := map[string]string{"owner": c.user.Name, "job": strconv.Itoa(j.id), "line": j.line}
+		if err != nil {
+			ev["error"] = err.Error()
+		}
+		emit("job.done", ev)
+		switch {
+		case quiet:
+		case err != nil:
+			c.appendMsg("#msg-list", "["+strconv.Itoa(j.id)+"] Exit "+j.line+": "+err.Error())
+		default:
+			c.appendMsg("#msg-list", "["+strconv.Itoa(j.id)+"] Done "+j.line)
+		}
+	}()
+	return c.appendMsg("#msg-list", "["+strconv.Itoa(j.id)+"] "+j.line)
+}
+
+func init() {
+	cmdMap["jobs"] = command{
+		Desc:     "Lists the commands running in the background (started with a trailing &).",
+		Usage:    "jobs",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			c.jobs.Lock()
+			rows := [][]string{{"Job", "Running", "Command"}}
+			for _, j := range c.jobs.list {
+				rows = append(rows, []string{"%" + strconv.Itoa(j.id),
+					time.Since(j.start).Round(time.Second).String(), j.line})
+			}
+			c.jobs.Unlock()
+			if len(rows) == 1 {
+				return c.appendMsg("#msg-list", "No jobs")
+			}
+			return c.appendPre("#msg-list", formatTable(rows, true))
+		},
+	}
+	cmdMap["fg"] = command{
+		Desc:     "Waits for a background job to finish.",
+		Usage:    "fg [%n]",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			arg := ""
+			if len(args) > 1 {
+				arg = args[1]
+			}
+			c.jobs.Lock()
+			j := c.jobs.find(arg)
+			if j != nil {
+				j.waited = true
+			}
+			c.jobs.Unlock()
+			if j == nil {
+				return c.appendMsg("#msg-list", "fg: no such job")
+			}
+			if e = c.appendMsg("#msg-list", j.line); e != nil {
+				return
+			}
+			<-j.done
+			if j.err != nil {
+				return c.appendMsg("#msg-list", "fg: "+j.err.Error())
+			}
+			return
+		},
+	}
+	cmdMap["kill"] = command{
+		Desc:     "Stops tracking a background job and discards its result.",
+		Usage:    "kill %n",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: kill %n")
+			}
+			c.jobs.Lock()
+			j := c.jobs.find(args[1])
+			if j != nil {
+				j.killed = true
+				c.jobs.remove(j)
+			}
+			c.jobs.Unlock()
+			if j == nil {
+				return c.appendMsg("#msg-list", "kill: no such job: "+args[1])
+			}
+			return c.appendMsg("#msg-list", "["+strconv.Itoa(j.id)+"] Killed "+j.line)
+		},
+	}
+}
@@ -0,0 +1,61 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Keepalive. The server pings every client each -ping interval and browsers
+answer with a pong on their own. A client that misses -ping-misses pongs in a
+row is taken for dead: its read times out, the listener returns and the client
+is cleaned up as on a normal disconnect, instead of a goroutine waiting
+forever on a TCP connection that silently went away. Writes time out after
+writeWait for the same reason.
+*/
+
+//
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const writeWait = 10 * time.Second
+
+var (
+	pingInterval = flag.Duration("ping", 30*time.Second, "interval between websocket pings, 0 to disable")
+	pingMisses   = flag.Int("ping-misses", 3, "missed pongs after which a client is dropped")
+)
+
+// keepAlive starts pinging c until done is closed or a ping fails, and drops
+// c when pongs stop coming. It is called from serveWs before the listener
+// starts reading.
+func (c *client) keepAlive(done <-chan struct{}) {
+	if *pingInterval <= 0 {
+		return
+	}
+	misses := *pingMisses
+	if misses < 1 {
+		misses = 1
+	}
+	wait := *pingInterval * time.Duration(misses)
+	c.ws.SetReadDeadline(time.Now().Add(wait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(wait))
+	})
+	go func() {
+		t := time.NewTicker(*pingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)) != nil {
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,327 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Login history. Every login to an account, with the password, a token or an
+API key, is recorded with the time, the address and the browser, and so is
+every failed login; when an account's last client disconnects or logs out the
+time of its last input is kept as last seen. After login the previous login
+is shown, along with the failed logins since then, and lastlog lists the
+history.
+
+Admins see anyone's history with lastlog <name>, and lastlog review lists the
+accounts with failed logins or logged in from many addresses of late, and the
+addresses that logged in to several accounts, to look into.
+
+The history is kept in work/lastlog.json, the last lastlogMax logins of each
+account.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lastlogMax    = 50
+	reviewWindow  = 7 * 24 * time.Hour
+	reviewAddrMax = 3 // addresses an account logs in from before review lists it
+)
+
+// loginRecord is a login, or a failed attempt, to an account.
+type loginRecord struct {
+	Time    time.Time
+	Address string
+	Agent   string `json:",omitempty"`
+	How     string `json:",omitempty"` // password, token or API key
+	Failed  bool   `json:",omitempty"`
+}
+
+// loginHistory is what is kept of an account's logins.
+type loginHistory struct {
+	User     string
+	LastSeen time.Time     `json:",omitempty"`
+	Logins   []loginRecord // oldest first
+}
+
+var lastlog = struct {
+	sync.Mutex
+	list map[string]*loginHistory // lower case name -> history
+}{list: make(map[string]*loginHistory)}
+
+// lastlogPath is the file the login history is persisted in.
+func lastlogPath() string {
+	return *work + SEP + "lastlog.json"
+}
+
+// saveLastlog writes the history to disk. Callers must hold the lock.
+func saveLastlog() error {
+	var list []*loginHistory
+	for _, h := range lastlog.list {
+		list = append(list, h)
+	}
+	return saveJSON(list, lastlogPath())
+}
+
+// loadLastlog reads the persisted history. It is called once from main.
+func loadLastlog() {
+	var list []*loginHistory
+	if e := loadJSON(&list, lastlogPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	lastlog.Lock()
+	defer lastlog.Unlock()
+	for _, h := range list {
+		lastlog.list[strings.ToLower(h.User)] = h
+	}
+}
+
+// recordLogin adds r to the history of the account name and returns the
+// last successful login before it, the zero record if there was none, and
+// the number of failed logins since.
+func recordLogin(name string, r loginRecord) (prev loginRecord, failed int) {
+	lastlog.Lock()
+	defer lastlog.Unlock()
+	h := lastlog.list[strings.ToLower(name)]
+	if h == nil {
+		h = &loginHistory{User: name}
+		lastlog.list[strings.ToLower(name)] = h
+	}
+	for i := len(h.Logins) - 1; i >= 0; i-- {
+		if !h.Logins[i].Failed {
+			prev = h.Logins[i]
+			break
+		}
+		failed++
+	}
+	h.Logins = append(h.Logins, r)
+	if len(h.Logins) > lastlogMax {
+		h.Logins = h.Logins[len(h.Logins)-lastlogMax:]
+	}
+	if e := saveLastlog(); e != nil {
+		log.Println(e)
+	}
+	return
+}
+
+// loginFailed records a failed login to the account name from c.
+func loginFailed(c *client, name string) {
+	recordLogin(name, loginRecord{Time: time.Now(), Address: hostOf(c.address), Agent: c.sess.agent, Failed: true})
+}
+
+// noteSeen keeps when c, logged in, last sent input as its user's last seen.
+func noteSeen(c *client) {
+	if c.user.key == nil {
+		return
+	}
+	seen := time.Now().Add(-c.sess.idle())
+	lastlog.Lock()
+	defer lastlog.Unlock()
+	h := lastlog.list[strings.ToLower(c.user.Name)]
+	if h == nil || !seen.After(h.LastSeen) {
+		return
+	}
+	h.LastSeen = seen
+	if e := saveLastlog(); e != nil {
+		log.Println(e)
+	}
+}
+
+// loginHistoryOf returns a copy of the history of the account name.
+func loginHistoryOf(name string) (h loginHistory, ok bool) {
+	lastlog.Lock()
+	defer lastlog.Unlock()
+	p := lastlog.list[strings.ToLower(name)]
+	if p == nil {
+		return h, false
+	}
+	h = *p
+	h.Logins = append([]loginRecord(nil), p.Logins...)
+	return h, true
+}
+
+// forgetLogins drops the history of the account name.
+func forgetLogins(name string) {
+	lastlog.Lock()
+	defer lastlog.Unlock()
+	delete(lastlog.list, strings.ToLower(name))
+	if e := saveLastlog(); e != nil {
+		log.Println(e)
+	}
+}
+
+// recordLoggedIn records the login of c, just logged in, and tells it about
+// the one before.
+func (c *client) recordLoggedIn() error {
+	how := "password"
+	if c.apiKeyID != "" {
+		how = "API key"
+	} else if c.sessionID != "" {
+		how = "token"
+	}
+	prev, failed := recordLogin(c.user.Name, loginRecord{Time: time.Now(), Address: hostOf(c.address), Agent: c.sess.agent, How: how})
+	if prev.Time.IsZero() {
+		return nil
+	}
+	e := c.appendMsg("#msg-list", c.trf("Last login: %s from %s", prev.Time.In(c.user.location()).Format("Mon Jan 2 15:04 2006"), prev.Address))
+	if e == nil && failed > 0 {
+		e = c.appendMsg("#msg-list", c.trf("%d failed login attempts since then", failed))
+	}
+	return e
+}
+
+// showLastlog shows c the login history of the account name.
+func showLastlog(c *client, name string) error {
+	h, ok := loginHistoryOf(name)
+	if !ok {
+		return c.appendMsg("#msg-list", c.trf("No logins recorded for %s", name))
+	}
+	loc := c.user.location()
+	var lines []string
+	if !h.LastSeen.IsZero() {
+		lines = append(lines, c.trf("Last seen: %s", h.LastSeen.In(loc).Format("2006-01-02 15:04")), "")
+	}
+	rows := [][]string{{c.tr("Time"), c.tr("Address"), c.tr("How"), c.tr("Browser")}}
+	for i := len(h.Logins) - 1; i >= 0; i-- {
+		r := h.Logins[i]
+		how := c.tr(r.How)
+		if r.Failed {
+			how = c.tr("failed")
+		}
+		agent := r.Agent
+		if len(agent) > 40 {
+			agent = agent[:40] + "..."
+		}
+		rows = append(rows, []string{r.Time.In(loc).Format("2006-01-02 15:04"), r.Address, how, agent})
+	}
+	lines = append(lines, strings.Split(formatTable(rows, true), "\n")...)
+	return c.pageLines(lines, false)
+}
+
+// reviewLogins shows c, an admin, the accounts and addresses with recent
+// logins worth a look.
+func reviewLogins(c *client) error {
+	since := time.Now().Add(-reviewWindow)
+	type account struct {
+		name          string
+		logins, fails int
+		addrs         map[string]bool
+		last          time.Time
+	}
+	var accounts []*account
+	addrUsers := make(map[string]map[string]bool)
+	lastlog.Lock()
+	for _, h := range lastlog.list {
+		a := &account{name: h.User, addrs: make(map[string]bool)}
+		for _, r := range h.Logins {
+			if r.Time.Before(since) {
+				continue
+			}
+			if r.Failed {
+				a.fails++
+				a.last = r.Time
+				continue
+			}
+			a.logins++
+			a.addrs[r.Address] = true
+			if addrUsers[r.Address] == nil {
+				addrUsers[r.Address] = make(map[string]bool)
+			}
+			addrUsers[r.Address][h.User] = true
+		}
+		if a.fails > 0 || len(a.addrs) > reviewAddrMax {
+			accounts = append(accounts, a)
+		}
+	}
+	lastlog.Unlock()
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].fails != accounts[j].fails {
+			return accounts[i].fails > accounts[j].fails
+		}
+		return len(accounts[i].addrs) > len(accounts[j].addrs)
+	})
+	var lines []string
+	if len(accounts) > 0 {
+		loc := c.user.location()
+		rows := [][]string{{c.tr("User"), c.tr("Logins"), c.tr("Failed"), c.tr("Addresses"), c.tr("Last failure")}}
+		for _, a := range accounts {
+			last := ""
+			if !a.last.IsZero() {
+				last = a.last.In(loc).Format("2006-01-02 15:04")
+			}
+			rows = append(rows, []string{a.name, strconv.Itoa(a.logins), strconv.Itoa(a.fails), strconv.Itoa(len(a.addrs)), last})
+		}
+		lines = append(lines, strings.Split(formatTable(rows, true), "\n")...)
+	}
+	rows := [][]string{{c.tr("Address"), c.tr("Accounts")}}
+	for addr, names := range addrUsers {
+		if len(names) < 2 {
+			continue
+		}
+		var list []string
+		for name := range names {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		rows = append(rows, []string{addr, strings.Join(list, ", ")})
+	}
+	if len(rows) > 1 {
+		sort.Slice(rows[1:], func(i, j int) bool { return rows[i+1][0] < rows[j+1][0] })
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, strings.Split(formatTable(rows, true), "\n")...)
+	}
+	if len(lines) == 0 {
+		return c.appendMsg("#msg-list", "Nothing to review")
+	}
+	return c.pageLines(lines, false)
+}
+
+func init() {
+	cmdMap["lastlog"] = command{
+		Desc:     "Lists the recent logins to your account; admins may name another account.",
+		Usage:    "lastlog [name]",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			switch {
+			case len(args) == 1:
+				return showLastlog(c, c.user.Name)
+			case len(args) == 2 && (strings.EqualFold(args[1], c.user.Name) || isAdmin(&c.user)):
+				return showLastlog(c, args[1])
+			case len(args) == 2:
+				return c.fail(codeForbidden, "", c.trf("%s: permission denied", "lastlog"))
+			}
+			return c.usage("lastlog", commandNamed("lastlog"))
+		},
+		Complete: func(c *client, words []string) []string {
+			if isAdmin(&c.user) {
+				return onlineNames()
+			}
+			return nil
+		},
+		Sub: map[string]command{
+			"review": {
+				Desc:  "Lists accounts with failed logins or many addresses, and addresses used by several accounts, over the last week.",
+				Usage: "lastlog review",
+				Role:  roleAdmin,
+				Handler: func(c *client, args []string) error {
+					return reviewLogins(c)
+				},
+			},
+		},
+	}
+}
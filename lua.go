@@ -0,0 +1,219 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Lua scripts add commands without a rebuild. Every .lua file in the -scripts
+directory is loaded at startup, and again by reload (see reload.go), and
+registers commands with command():
+
+	command("hello", "Greets you.", function(args)
+		local name = args[2] or prompt("What's your name?")
+		print("Hello, " .. name .. "!")
+	end)
+
+The handler gets the typed words, the command name first. Scripts run in a
+sandbox with only the base, string, table and math libraries, without file
+access or loading other code, and talk to the terminal through:
+
+	print(text)        show a line of text
+	pre(text)          show preformatted text
+	prompt(text)       ask for a line of input and return it
+	user()             the user's name
+	logged_in()        whether the user is logged in
+
+Each run of a command gets a fresh interpreter, so runs don't share globals
+and a slow script only holds up the user running it. Runs are cancelled after
+luaTimeout.
+*/
+
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const luaTimeout = 2 * time.Minute
+
+var scriptDir = flag.String("scripts", "scripts", "directory of Lua command scripts (.lua) to load")
+
+// luaState returns a sandboxed interpreter with the safe libraries open.
+func luaState(ctx context.Context) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 256, RegistryMaxSize: 1 << 16})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if ctx != nil {
+		L.SetContext(ctx)
+	}
+	return L
+}
+
+// luaScript is a loaded script.
+type luaScript struct {
+	path  string
+	proto *lua.FunctionProto
+}
+
+// run runs the script's top level in L, calling add for each command it
+// registers.
+func (s *luaScript) run(L *lua.LState, add func(name, desc string, fn *lua.LFunction)) error {
+	L.SetGlobal("command", L.NewFunction(func(L *lua.LState) int {
+		add(L.CheckString(1), L.CheckString(2), L.CheckFunction(3))
+		return 0
+	}))
+	L.Push(L.NewFunctionFromProto(s.proto))
+	return L.PCall(0, 0, nil)
+}
+
+// bindLua gives L's terminal functions to c.
+func bindLua(L *lua.LState, c *client) {
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		var parts []string
+		for i := 1; i <= L.GetTop(); i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		if e := c.appendMsg("#msg-list", strings.Join(parts, "\t")); e != nil {
+			L.RaiseError("%s", e.Error())
+		}
+		return 0
+	}))
+	L.SetGlobal("pre", L.NewFunction(func(L *lua.LState) int {
+		if e := c.appendPre("#msg-list", L.CheckString(1)); e != nil {
+			L.RaiseError("%s", e.Error())
+		}
+		return 0
+	}))
+	L.SetGlobal("prompt", L.NewFunction(func(L *lua.LState) int {
+		s, e := c.prompt(L.OptString(1, ""))
+		if e != nil {
+			L.RaiseError("%s", e.Error())
+		}
+		L.Push(lua.LString(s))
+		return 1
+	}))
+	L.SetGlobal("user", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(c.user.Name))
+		return 1
+	}))
+	L.SetGlobal("logged_in", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(c.user.key != nil))
+		return 1
+	}))
+}
+
+// call runs the command name of the script for c.
+func (s *luaScript) call(c *client, name string, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), luaTimeout)
+	defer cancel()
+	L := luaState(ctx)
+	defer L.Close()
+	bindLua(L, c)
+	var fn *lua.LFunction
+	if err := s.run(L, func(n, _ string, f *lua.LFunction) {
+		if n == name {
+			fn = f
+		}
+	}); err != nil {
+		return err
+	}
+	if fn == nil {
+		return errors.New(name + " is no longer defined in " + s.path)
+	}
+	t := L.NewTable()
+	for _, a := range args {
+		t.Append(lua.LString(a))
+	}
+	return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, t)
+}
+
+// loadScript compiles a script and registers its commands.
+func loadScript(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	proto, err := lua.Compile(chunk, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	s := &luaScript{path: path, proto: proto}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	L := luaState(ctx)
+	defer L.Close()
+	var errs []string
+	err = s.run(L, func(name, desc string, _ *lua.LFunction) {
+		name = strings.ToLower(name)
+		err := RegisterCommand(name, desc, func(c *client, args []string) error {
+			if err := s.call(c, name, args); err != nil {
+				log.Println(c.address, path+":", err)
+				return c.appendMsg("#msg-list", c.trf("%s: script error", name))
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			trackCommand(name, path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// loadScripts loads the scripts in the -scripts directory. A script that
+// fails to load is logged and skipped; the errors are returned.
+func loadScripts() (errs []error) {
+	if *scriptDir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(*scriptDir + SEP + "*.lua")
+	if err != nil {
+		log.Println(err)
+		return []error{err}
+	}
+	for _, path := range paths {
+		if err := loadScript(path); err != nil {
+			log.Println("script", path+":", err)
+			errs = append(errs, errors.New("script "+path+": "+err.Error()))
+		} else {
+			log.Println("script", path, "loaded")
+		}
+	}
+	return errs
+}
@@ -0,0 +1,211 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Macros are named sequences of commands saved in the user's account. They're
+defined at once with macro save deploy 'build; test; ship' or recorded:
+macro record deploy keeps the commands typed until macro stop. Typing the
+name of a macro runs its commands one after the other through the dispatcher,
+so aliases and & work in them. Macros can't run other macros.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	macroMax     = 50 // macros per user
+	macroStepMax = 20 // commands per macro
+)
+
+// macroState tracks the macro a client is recording or playing.
+type macroState struct {
+	recording string // name of the macro being recorded
+	steps     []string
+	playing   bool
+}
+
+// recordMacro adds a typed command to the macro being recorded.
+func (c *client) recordMacro(line string) {
+	if c.macro.recording == "" {
+		return
+	}
+	if args, err := getArgs([]byte(line)); err != nil || len(args) == 0 || strings.ToLower(args[0]) == "macro" {
+		return
+	}
+	if len(c.macro.steps) < macroStepMax {
+		c.macro.steps = append(c.macro.steps, strings.TrimSpace(line))
+	}
+}
+
+// playMacro runs the commands of a macro.
+func (c *client) playMacro(name string, steps []string) error {
+	if c.macro.playing {
+		return c.appendMsg("#msg-list", "Macros can't run other macros: "+name)
+	}
+	c.macro.playing = true
+	defer func() { c.macro.playing = false }()
+	for _, step := range steps {
+		if e := c.appendMsg("#msg-list", name+"> "+step); e != nil {
+			return e
+		}
+		if e := c.dispatch(step); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// saveMacro stores a macro in c's account.
+func (c *client) saveMacro(name string, steps []string) error {
+	if len(steps) == 0 {
+		return c.appendMsg("#msg-list", "macro: no commands")
+	}
+	if len(steps) > macroStepMax {
+		return c.appendMsg("#msg-list", "macro: at most "+strconv.Itoa(macroStepMax)+" commands")
+	}
+	if _, exists := c.user.Macros[name]; !exists && len(c.user.Macros) >= macroMax {
+		return c.appendMsg("#msg-list", "macro: too many macros")
+	}
+	if c.user.Macros == nil {
+		c.user.Macros = make(map[string][]string)
+	}
+	c.user.Macros[name] = steps
+	if e := c.user.commit(); e != nil {
+		return e
+	}
+	return c.appendMsg("#msg-list", "Macro "+name+" saved ("+strconv.Itoa(len(steps))+" commands)")
+}
+
+// macroName checks the name of a new macro.
+func (c *client) macroName(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if name == "" || !isName(name) {
+		c.appendMsg("#msg-list", "macro: invalid name: "+name)
+		return "", false
+	}
+	if _, exists := lookupCommand(name); exists {
+		c.appendMsg("#msg-list", "macro: "+name+" is a command")
+		return "", false
+	}
+	return name, true
+}
+
+// listMacros shows c's macros.
+func listMacros(c *client) error {
+	if len(c.user.Macros) == 0 {
+		return c.appendMsg("#msg-list", "No macros")
+	}
+	var names []string
+	for name := range c.user.Macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rows := [][]string{{"Macro", "Commands"}}
+	for _, name := range names {
+		rows = append(rows, []string{name, strings.Join(c.user.Macros[name], "; ")})
+	}
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+func init() {
+	cmdMap["macro"] = command{
+		Desc:     "Saves sequences of commands you run by typing the macro's name.",
+		Category: "Shell",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return listMacros(c)
+			}
+			return c.usage("macro", commandNamed("macro"))
+		},
+		Sub: map[string]command{
+			"save": {
+				Desc:     "Saves a macro; type a macro's name to run it.",
+				Usage:    "macro save <name> '<command>; <command>...'",
+				Examples: []string{"macro save morning 'weather berlin; remind list'"},
+				Handler: func(c *client, args []string) error {
+					if len(args) < 4 {
+						return c.usage("macro", commandNamed("macro"))
+					}
+					name, ok := c.macroName(args[2])
+					if !ok {
+						return nil
+					}
+					var steps []string
+					for _, step := range strings.Split(strings.Join(args[3:], " "), ";") {
+						if step = strings.TrimSpace(step); step != "" {
+							steps = append(steps, step)
+						}
+					}
+					return c.saveMacro(name, steps)
+				},
+			},
+			"record": {
+				Desc:  "Records the commands you type until macro stop.",
+				Usage: "macro record <name>",
+				Handler: func(c *client, args []string) error {
+					if len(args) != 3 {
+						return c.usage("macro", commandNamed("macro"))
+					}
+					name, ok := c.macroName(args[2])
+					if !ok {
+						return nil
+					}
+					c.macro.recording, c.macro.steps = name, nil
+					return c.appendMsg("#msg-list", "Recording macro "+name+", type macro stop when done")
+				},
+			},
+			"stop": {
+				Desc: "Saves the macro being recorded.",
+				Handler: func(c *client, args []string) error {
+					if c.macro.recording == "" {
+						return c.appendMsg("#msg-list", "macro: not recording")
+					}
+					name, steps := c.macro.recording, c.macro.steps
+					c.macro.recording, c.macro.steps = "", nil
+					return c.saveMacro(name, steps)
+				},
+			},
+			"list": {
+				Desc: "Shows your macros.",
+				Handler: func(c *client, args []string) error {
+					return listMacros(c)
+				},
+			},
+			"rm": {
+				Desc:  "Removes a macro.",
+				Usage: "macro rm <name>",
+				Handler: func(c *client, args []string) (e error) {
+					if len(args) != 3 {
+						return c.usage("macro", commandNamed("macro"))
+					}
+					name := strings.ToLower(args[2])
+					if _, exists := c.user.Macros[name]; !exists {
+						return c.appendMsg("#msg-list", "macro: no such macro: "+name)
+					}
+					delete(c.user.Macros, name)
+					if e = c.user.commit(); e != nil {
+						return
+					}
+					return c.appendMsg("#msg-list", "Macro "+name+" removed")
+				},
+				Complete: func(c *client, words []string) []string {
+					var names []string
+					if len(words) == 3 {
+						for name := range c.user.Macros {
+							names = append(names, name)
+						}
+					}
+					return names
+				},
+			},
+		},
+	}
+}
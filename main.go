@@ -9,16 +9,22 @@ import (
 	"flag"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/jmptrader/soshell/protocol"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"regexp"
 	"text/template"
+	"time"
 )
 
 const SEP = string(os.PathSeparator)
 
+// version is the server version, set at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
 var (
 	httpAddr    = flag.String("http", ":8080", "http service address")
 	httpsAddr   = flag.String("https", ":8090", "https service address")
@@ -39,15 +45,10 @@ func isTLS(r *http.Request) bool {
 	return false
 }
 
-// getArgs splits a slice of bytes into a slice of string arguments.
-//Anything in '', "", or `` are consider a single argument (including spaces).
-func getArgs(b []byte) (s []string) {
-	re := regexp.MustCompile("`([\\S\\s]*)`|('([\\S \\t\\r]*)'|\"([\\S ]*)\"|\\S+)")
-	args := re.FindAllSubmatch(b, -1)
-	for _, val := range args {
-		s = append(s, string(val[0]))
-	}
-	return
+// getArgs splits a slice of bytes into a slice of string arguments, see
+// tokenize for the quoting rules.
+func getArgs(b []byte) ([]string, error) {
+	return tokenize(string(b))
 }
 
 // serveWs serves the websocket and starts the listener on successful connection.
@@ -56,24 +57,78 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
-	if r.Header.Get("Origin") != "https://"+r.Host {
-		http.Error(w, "Origin not allowed", 403)
+	if isBanned(r.RemoteAddr) {
+		http.Error(w, "Forbidden", 403)
 		return
 	}
-	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
-	if _, ok := err.(websocket.HandshakeError); ok {
-		http.Error(w, "Not a websocket handshake", 400)
+	// Scripts have no Origin and log in with an API key instead, see
+	// apikey.go.
+	var key apiKey
+	var keyUser *user
+	if token := bearerToken(r); token != "" && r.Header.Get("Origin") == "" {
+		var e error
+		if key, keyUser, e = openAPIKey(token, r.RemoteAddr); e != nil {
+			securitySuspicious(r.RemoteAddr, "bad API key for "+r.URL.Path)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		if !key.allows("connect") || userBanned(keyUser.Name) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+	} else if r.Header.Get("Origin") != "https://"+r.Host {
+		http.Error(w, "Origin not allowed", 403)
 		return
-	} else if err != nil {
-		log.Println(err)
+	}
+	hdr := make(http.Header)
+	wire := negotiateWire(r)
+	if wire != "" {
+		hdr.Set("Sec-Websocket-Protocol", wire)
+	}
+	ws, err := upgrader(r).Upgrade(w, r, hdr)
+	if err != nil {
+		if _, ok := err.(websocket.HandshakeError); !ok {
+			log.Println(err)
+		}
 		return
 	}
 	defer ws.Close()
-	var c = client{ws: ws, address: ws.RemoteAddr().String(), user: user{Name: "Guest"}}
+	var c = client{ws: ws, address: ws.RemoteAddr().String(), user: newGuest(), binary: wire == protocol.Msgpack, compressMin: compressMin(r)}
+	c.sess = session{id: randomToken(4), connected: time.Now(), secure: r.TLS != nil, agent: r.UserAgent()}
 	log.Println(c.address, r.URL, "connected")
+	c.setLocale(negotiateLocale(r.Header.Get("Accept-Language")))
+	addOnline(&c)
+	c.enterRoom(defaultRoom)
+	emit("user.join", map[string]string{"user": c.user.Name, "room": defaultRoom})
+	count(&counters.connections)
+	defer removeOnline(&c)
+	defer leaveGames(&c)
+	defer closeEdits(&c)
+	defer stopRecording(&c)
+	defer parkOutbox(&c)
+	defer c.unsubscribe(nil)
+	done := make(chan struct{})
+	defer close(done)
+	c.startWriter(done)
 	c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+	if keyUser != nil {
+		c.become(*keyUser)
+		c.apiKeyID = key.Id
+		if e := c.loggedIn(); e != nil {
+			log.Println(e)
+		}
+	}
+	showBanner(&c)
+	if e := c.replayRoom(c.currentRoom()); e != nil {
+		log.Println(e)
+	}
+	c.keepAlive(done)
+	c.watchIdle(done)
+	c.startReader()
 	e := c.listener()
-	if e != nil && e != io.EOF {
+	if ne, ok := e.(net.Error); ok && ne.Timeout() {
+		log.Println(c.address, "stopped answering pings")
+	} else if e != nil && e != io.EOF {
 		log.Println(e)
 	}
 	log.Println(c.address, "disconnected")
@@ -97,10 +152,11 @@ func serveClient(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	type data struct {
-		SockUrl, Status string
+		SockUrl, Status, CSRFToken string
 	}
 	sockUrl := "wss://" + *hostname + *httpsAddr + "/ws"
-	clientTempl.Execute(w, data{SockUrl: sockUrl})
+	token := csrfToken(w, r)
+	clientTempl.Execute(w, data{SockUrl: sockUrl, CSRFToken: token})
 }
 
 func init() {
@@ -133,10 +189,50 @@ func init() {
 	clientTempl = template.Must(template.ParseFiles(*public + SEP + "client.html"))
 }
 
+// services are extra servers compiled in with build tags. Each is started in
+// its own goroutine from main.
+var services []func()
+
 func main() {
+	go runHub()
+	loadReminders()
+	loadCrons()
+	loadBans()
+	loadMutes()
+	loadRooms()
+	loadRoles()
+	checkPasswordFlags()
+	checkIdleFlags()
+	dropRecoveries()
+	loadSessions()
+	loadAPIKeys()
+	loadDevices()
+	loadLastlog()
+	loadEvents()
+	startFeeds()
+	loadHooks()
+	loadWebhooks()
+	loadReads()
+	go sampleRates()
+	go expireSecurity()
+	loadBanner()
+	loadLocales()
+	loadCommands()
+	loadPlugins()
+	loadScripts()
+	go reloadOnHangup()
 	r := mux.NewRouter()
 	r.HandleFunc("/", serveClient)
 	r.HandleFunc("/ws", serveWs)
+	r.HandleFunc("/cal/{room}.ics", serveCal)
+	r.HandleFunc("/hooks/{token}", serveHook)
+	r.HandleFunc("/_matrix/app/v1/transactions/{txn}", serveMatrix).Methods("PUT")
+	r.PathPrefix("/_matrix/app/").HandlerFunc(serveMatrix)
+	r.HandleFunc("/metrics", serveMetrics)
+	routeAPI(r)
+	for _, start := range services {
+		go start()
+	}
 	http.Handle("/", r)
 	http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir(*public))))
 	go func() {
@@ -0,0 +1,372 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The Matrix bridge is an application service: it bridges rooms to Matrix
+rooms, so soshell users talk with the federation from the terminal. It is off
+unless -matrix names the homeserver, and -matrix-rooms pairs the rooms with
+Matrix room ids or aliases:
+
+	soshell -matrix https://matrix.example.org -matrix-domain example.org \
+		-matrix-as-token ... -matrix-hs-token ... -matrix-rooms lobby=#hawks:example.org
+
+The homeserver is told about the bridge by a registration file in its
+config, whose tokens are the two above and whose url is this server:
+
+	id: soshell
+	url: https://soshell.example.org
+	as_token: ...
+	hs_token: ...
+	sender_localpart: soshell
+	namespaces:
+	  users: [{exclusive: true, regex: "@soshell_.*:example.org"}]
+
+Each soshell user talking in a bridged room appears in Matrix as a puppet,
+@soshell_alice:example.org, registered and joined the first time it is
+needed, and its messages are sent with their markdown rendered. The
+homeserver pushes the Matrix room events to /_matrix/app/v1/transactions:
+messages are posted in the room from "bob:matrix.org", and the room is told
+when Matrix users join and leave.
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	matrixServer  = flag.String("matrix", "", "Matrix homeserver URL to bridge rooms to, empty to disable")
+	matrixDomain  = flag.String("matrix-domain", "", "server name of the Matrix homeserver, like example.org")
+	matrixASToken = flag.String("matrix-as-token", "", "token the bridge authenticates to the homeserver with")
+	matrixHSToken = flag.String("matrix-hs-token", "", "token the homeserver authenticates to the bridge with")
+	matrixPrefix  = flag.String("matrix-prefix", "soshell_", "prefix of the Matrix users puppeting soshell users")
+	matrixRooms   = flag.String("matrix-rooms", "", "rooms bridged to Matrix rooms, as room=!id:server or room=#alias:server,...")
+)
+
+// matrixEvent is the part of a Matrix room event the bridge reads.
+type matrixEvent struct {
+	Type     string
+	RoomId   string `json:"room_id"`
+	Sender   string
+	StateKey *string `json:"state_key"`
+	Content  struct {
+		MsgType    string `json:"msgtype"`
+		Body       string
+		Membership string
+	}
+}
+
+// matrixBridge is the state of the bridge.
+var matrixBridge = struct {
+	sync.Mutex
+	rooms    map[string]string // room -> Matrix room id
+	channels map[string]string // Matrix room id -> room
+	joined   map[string]bool   // puppet + " " + room id, known to be in it
+	txns     map[string]bool   // transactions handled
+	nextTxn  int
+}{rooms: make(map[string]string), channels: make(map[string]string), joined: make(map[string]bool), txns: make(map[string]bool)}
+
+var matrixClient = &http.Client{Timeout: 30 * time.Second}
+
+// matrixPuppet returns the Matrix user id of the soshell user name. What
+// Matrix doesn't allow in user ids, like the @ of IRC nicks or the spaces of
+// feed titles, is escaped as =xx.
+func matrixPuppet(name string) string {
+	var b strings.Builder
+	for _, c := range []byte(strings.ToLower(name)) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("._-/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("=" + strconv.FormatInt(int64(c)|0x100, 16)[1:])
+		}
+	}
+	return "@" + *matrixPrefix + b.String() + ":" + *matrixDomain
+}
+
+// matrixName returns the name Matrix user id posts as, "bob:matrix.org" for
+// "@bob:matrix.org"; the colon keeps it apart from the names of users.
+func matrixName(id string) string {
+	return strings.TrimPrefix(id, "@")
+}
+
+// isPuppet reports whether id is a user of the bridge.
+func isPuppet(id string) bool {
+	return strings.HasPrefix(id, "@"+*matrixPrefix) && strings.HasSuffix(id, ":"+*matrixDomain)
+}
+
+// matrixCall calls the client-server API of the homeserver as the user as,
+// "" for the bridge, decoding the response into out if it isn't nil.
+func matrixCall(method, path, as string, body, out interface{}) error {
+	u := strings.TrimSuffix(*matrixServer, "/") + "/_matrix/client/v3" + path
+	if as != "" {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "user_id=" + url.QueryEscape(as)
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*matrixASToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := matrixClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		var merr struct{ Errcode, Error string }
+		json.Unmarshal(b, &merr)
+		return errors.New(merr.Errcode + ": " + merr.Error + " (" + resp.Status + ")")
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+// ensurePuppet makes sure the puppet of name exists and is in the Matrix
+// room id.
+func ensurePuppet(name, id string) error {
+	puppet := matrixPuppet(name)
+	key := puppet + " " + id
+	matrixBridge.Lock()
+	joined := matrixBridge.joined[key]
+	matrixBridge.Unlock()
+	if joined {
+		return nil
+	}
+	err := matrixCall("POST", "/register", "", map[string]string{
+		"type":     "m.login.application_service",
+		"username": strings.TrimPrefix(strings.SplitN(puppet, ":", 2)[0], "@"),
+	}, nil)
+	if err != nil && !strings.HasPrefix(err.Error(), "M_USER_IN_USE") {
+		return err
+	}
+	if err == nil {
+		matrixCall("PUT", "/profile/"+url.PathEscape(puppet)+"/displayname", puppet, map[string]string{"displayname": name}, nil)
+	}
+	if err := matrixCall("POST", "/join/"+url.PathEscape(id), puppet, struct{}{}, nil); err != nil {
+		return err
+	}
+	matrixBridge.Lock()
+	matrixBridge.joined[key] = true
+	matrixBridge.Unlock()
+	return nil
+}
+
+// matrixSend sends text from the soshell user name to the Matrix room id.
+func matrixSend(name, id, text string) error {
+	if err := ensurePuppet(name, id); err != nil {
+		return err
+	}
+	matrixBridge.Lock()
+	matrixBridge.nextTxn++
+	txn := strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.Itoa(matrixBridge.nextTxn)
+	matrixBridge.Unlock()
+	content := map[string]string{
+		"msgtype":        "m.text",
+		"body":           text,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": richHTML(text),
+	}
+	return matrixCall("PUT", "/rooms/"+url.PathEscape(id)+"/send/m.room.message/"+txn, matrixPuppet(name), content, nil)
+}
+
+// matrixRoom returns the room bridged to the Matrix room id.
+func matrixRoom(id string) (string, bool) {
+	matrixBridge.Lock()
+	defer matrixBridge.Unlock()
+	room, ok := matrixBridge.channels[id]
+	return room, ok
+}
+
+// handleMatrix acts on an event the homeserver pushed.
+func handleMatrix(ev matrixEvent) {
+	room, ok := matrixRoom(ev.RoomId)
+	if !ok || isPuppet(ev.Sender) {
+		return
+	}
+	switch ev.Type {
+	case "m.room.message":
+		text := ev.Content.Body
+		switch ev.Content.MsgType {
+		case "m.text", "m.notice":
+		case "m.emote":
+			text = "*" + text + "*"
+		default:
+			return // images and files aren't bridged
+		}
+		if _, err := postRoom(room, matrixName(ev.Sender), text); err != nil {
+			log.Println("matrix:", err)
+		}
+	case "m.room.member":
+		if ev.StateKey == nil || *ev.StateKey != ev.Sender {
+			return
+		}
+		switch ev.Content.Membership {
+		case "join":
+			noticeRoom(room, matrixName(ev.Sender), "%s joined")
+		case "leave":
+			noticeRoom(room, matrixName(ev.Sender), "%s left")
+		}
+	}
+}
+
+// matrixAuthorized reports whether r comes from the homeserver.
+func matrixAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token") // before v1.4 of the spec
+	}
+	return *matrixHSToken != "" && token == *matrixHSToken
+}
+
+// matrixError answers a request of the homeserver with the error code.
+func matrixError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	w.Write([]byte(`{"errcode":"` + code + `"}`))
+}
+
+// serveMatrix serves the application service API to the homeserver:
+// transactions of events, and queries for users and aliases, which the
+// bridge doesn't create on demand.
+func serveMatrix(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if *matrixServer == "" {
+		matrixError(w, 404, "M_NOT_FOUND")
+		return
+	}
+	if !matrixAuthorized(r) {
+		matrixError(w, 403, "M_FORBIDDEN")
+		return
+	}
+	txn, ok := mux.Vars(r)["txn"]
+	if !ok {
+		matrixError(w, 404, "M_NOT_FOUND")
+		return
+	}
+	var body struct{ Events []matrixEvent }
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(&body); err != nil {
+		matrixError(w, 400, "M_BAD_JSON")
+		return
+	}
+	matrixBridge.Lock()
+	seen := matrixBridge.txns[txn]
+	if len(matrixBridge.txns) > 1000 {
+		matrixBridge.txns = make(map[string]bool)
+	}
+	matrixBridge.txns[txn] = true
+	matrixBridge.Unlock()
+	if !seen {
+		for _, ev := range body.Events {
+			handleMatrix(ev)
+		}
+	}
+	w.Write([]byte("{}"))
+}
+
+// relayToMatrix sends the room messages of bridged rooms to their Matrix
+// rooms, from the puppets of their senders, in order.
+func relayToMatrix() {
+	type send struct{ from, id, text string }
+	queue := make(chan send, 256)
+	go func() {
+		for s := range queue {
+			if err := matrixSend(s.from, s.id, s.text); err != nil {
+				log.Println("matrix:", err)
+			}
+		}
+	}()
+	ch, _ := listen()
+	for ev := range ch {
+		matrixBridge.Lock()
+		id, ok := matrixBridge.rooms[ev.Data["room"]]
+		matrixBridge.Unlock()
+		from := ev.Data["from"]
+		if !ok || ev.Event != "room.message" || strings.Contains(from, ":") {
+			continue
+		}
+		select {
+		case queue <- send{from, id, ev.Data["text"]}:
+		default:
+			log.Println("matrix: send queue full, dropped a message to", id)
+		}
+	}
+}
+
+// startMatrix bridges the rooms of -matrix-rooms to Matrix, if -matrix is
+// set.
+func startMatrix() {
+	if *matrixServer == "" {
+		return
+	}
+	if *matrixDomain == "" || *matrixASToken == "" || *matrixHSToken == "" {
+		log.Println("matrix: -matrix needs -matrix-domain, -matrix-as-token and -matrix-hs-token")
+		*matrixServer = ""
+		return
+	}
+	for _, pair := range strings.Split(*matrixRooms, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[1] == "" || !strings.Contains("!#", parts[1][:1]) {
+			if pair != "" {
+				log.Println("matrix: bad -matrix-rooms entry", pair)
+			}
+			continue
+		}
+		room := roomName(parts[0])
+		if _, ok := findRoom(room); !ok {
+			log.Println("matrix: no such room", room)
+			continue
+		}
+		id := parts[1]
+		if strings.HasPrefix(id, "#") {
+			var alias struct {
+				RoomId string `json:"room_id"`
+			}
+			if err := matrixCall("GET", "/directory/room/"+url.PathEscape(id), "", nil, &alias); err != nil {
+				log.Println("matrix:", id, err)
+				continue
+			}
+			id = alias.RoomId
+		}
+		matrixBridge.Lock()
+		matrixBridge.rooms[room] = id
+		matrixBridge.channels[id] = room
+		matrixBridge.Unlock()
+		log.Println("matrix: bridging", "#"+room, "to", parts[1])
+	}
+	relayToMatrix()
+}
+
+func init() {
+	services = append(services, startMatrix)
+}
@@ -0,0 +1,65 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Mentions. A room message naming a user with @name, "thanks @alice", is
+highlighted for that user wherever they are: clients in the room see the
+line marked, clients elsewhere are sent a "mention" packet with the room,
+the sender and the text, and every client of the user gets a notification
+(see client.notify), which set notify turns into a toast or off. At most
+mentionMax users are mentioned by one message; people mentioning themselves
+aren't told.
+*/
+
+//
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+const mentionMax = 5
+
+var mentionReg = regexp.MustCompile(`(?:^|[^\w@])@(\w+)`)
+
+// mentioned returns the lower case names of the users text from mentions,
+// other than from.
+func mentioned(from, text string) map[string]bool {
+	names := make(map[string]bool)
+	for _, m := range mentionReg.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(m[1])
+		if len(names) == mentionMax {
+			break
+		}
+		if name != strings.ToLower(from) && userExists(name) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// isMentioned reports whether c's user is in names, from mentioned.
+func (c *client) isMentioned(names map[string]bool) bool {
+	return c.user.key != nil && names[strings.ToLower(c.user.Name)]
+}
+
+// notifyMention tells c its user was mentioned by from in room.
+func (c *client) notifyMention(room, from, text string) {
+	c.notify(c.trf("%s mentioned you in #%s", from, room), text)
+}
+
+// deliverMentions sends the users in names that aren't in room the message
+// from sent there.
+func deliverMentions(room, from, text string, names map[string]bool) {
+	for name := range names {
+		for _, c := range clientsByName(name) {
+			if c.inRoom(room) {
+				continue
+			}
+			c.sendOn(chanChat, Mention{Room: room, From: from, Text: text}.packet())
+			c.notifyMention(room, from, text)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The metrics system keeps server wide counters and serves them in the
+Prometheus text format at /metrics (localhost only). The stats command shows
+the same numbers to users.
+
+Each command's calls, errors and run time are counted too, by the command (and
+sub-command) name, so operators can see which commands are actually used:
+admins see them with stats commands. The run time includes waiting for the
+user to answer prompts.
+*/
+
+//
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	startTime = time.Now()
+	counters  struct {
+		messages, commands, connections int64
+	}
+	// messageRate samples the message counter every rateStep over rateSpan
+	// to give a recent messages/sec figure.
+	messageRate = struct {
+		sync.Mutex
+		samples []int64
+	}{}
+	rateStep = 5 * time.Second
+	rateSpan = 12 // samples, one minute
+	// commandStats holds the usage of each command, keyed by name.
+	commandStats = struct {
+		sync.Mutex
+		m map[string]*commandStat
+	}{m: make(map[string]*commandStat)}
+)
+
+// commandStat is the usage of a command.
+type commandStat struct {
+	Calls, Errors int64
+	Total, Max    time.Duration
+}
+
+// countCommand records a run of the command name.
+func countCommand(name string, took time.Duration, err error) {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+	s, ok := commandStats.m[name]
+	if !ok {
+		s = new(commandStat)
+		commandStats.m[name] = s
+	}
+	s.Calls++
+	if err != nil {
+		s.Errors++
+	}
+	s.Total += took
+	if took > s.Max {
+		s.Max = took
+	}
+}
+
+// readCommandStats returns a copy of the command usage.
+func readCommandStats() map[string]commandStat {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+	m := make(map[string]commandStat, len(commandStats.m))
+	for name, s := range commandStats.m {
+		m[name] = *s
+	}
+	return m
+}
+
+// count increments a counter.
+func count(n *int64) {
+	atomic.AddInt64(n, 1)
+}
+
+// sampleRates records the message counter every rateStep. It is started
+// once from main.
+func sampleRates() {
+	for range time.Tick(rateStep) {
+		messageRate.Lock()
+		messageRate.samples = append(messageRate.samples, atomic.LoadInt64(&counters.messages))
+		if len(messageRate.samples) > rateSpan+1 {
+			messageRate.samples = messageRate.samples[1:]
+		}
+		messageRate.Unlock()
+	}
+}
+
+// messagesPerSec returns the message rate over the sampled span.
+func messagesPerSec() float64 {
+	messageRate.Lock()
+	defer messageRate.Unlock()
+	n := len(messageRate.samples)
+	if n < 2 {
+		return 0
+	}
+	diff := messageRate.samples[n-1] - messageRate.samples[0]
+	return float64(diff) / (float64(n-1) * rateStep.Seconds())
+}
+
+// serverStats is a snapshot of the server's state.
+type serverStats struct {
+	Uptime                    time.Duration
+	Goroutines                int
+	HeapBytes, SysBytes       uint64
+	Clients, Users, Rooms     int
+	Messages, Commands, Conns int64
+	MessageRate               float64
+}
+
+// readStats returns the current server stats.
+func readStats() (s serverStats) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	s.Uptime = time.Since(startTime)
+	s.Goroutines = runtime.NumGoroutine()
+	s.HeapBytes, s.SysBytes = mem.HeapAlloc, mem.Sys
+	users := make(map[string]bool)
+	for _, c := range onlineClients() {
+		s.Clients++
+		if c.user.key != nil {
+			users[c.user.Name] = true
+		}
+	}
+	rooms.Lock()
+	s.Users, s.Rooms = len(users), len(rooms.members)
+	rooms.Unlock()
+	s.Messages = atomic.LoadInt64(&counters.messages)
+	s.Commands = atomic.LoadInt64(&counters.commands)
+	s.Conns = atomic.LoadInt64(&counters.connections)
+	s.MessageRate = messagesPerSec()
+	return
+}
+
+// serveMetrics writes the stats in the Prometheus text format. Only local
+// requests are served.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	s := readStats()
+	metrics := map[string]string{
+		"soshell_uptime_seconds":      strconv.FormatFloat(s.Uptime.Seconds(), 'f', 0, 64),
+		"soshell_goroutines":          strconv.Itoa(s.Goroutines),
+		"soshell_heap_bytes":          strconv.FormatUint(s.HeapBytes, 10),
+		"soshell_sys_bytes":           strconv.FormatUint(s.SysBytes, 10),
+		"soshell_clients":             strconv.Itoa(s.Clients),
+		"soshell_users":               strconv.Itoa(s.Users),
+		"soshell_rooms":               strconv.Itoa(s.Rooms),
+		"soshell_messages_total":      strconv.FormatInt(s.Messages, 10),
+		"soshell_commands_total":      strconv.FormatInt(s.Commands, 10),
+		"soshell_connections_total":   strconv.FormatInt(s.Conns, 10),
+		"soshell_messages_per_second": strconv.FormatFloat(s.MessageRate, 'f', 3, 64),
+	}
+	for name, cs := range readCommandStats() {
+		label := `{command="` + name + `"}`
+		metrics["soshell_command_calls_total"+label] = strconv.FormatInt(cs.Calls, 10)
+		metrics["soshell_command_errors_total"+label] = strconv.FormatInt(cs.Errors, 10)
+		metrics["soshell_command_seconds_total"+label] = strconv.FormatFloat(cs.Total.Seconds(), 'f', 3, 64)
+		metrics["soshell_command_seconds_max"+label] = strconv.FormatFloat(cs.Max.Seconds(), 'f', 3, 64)
+	}
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintln(w, name, metrics[name])
+	}
+}
+
+func init() {
+	cmdMap["stats"] = command{
+		Desc:     "Shows server uptime, memory, clients and message rates.",
+		Usage:    "stats [commands]",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			s := readStats()
+			rows := [][]string{
+				{"Version", version + " (" + runtime.Version() + ")"},
+				{"Uptime", s.Uptime.Truncate(time.Second).String()},
+				{"Goroutines", strconv.Itoa(s.Goroutines)},
+				{"Memory", formatSize(int64(s.HeapBytes)) + " heap, " + formatSize(int64(s.SysBytes)) + " from OS"},
+				{"Clients", strconv.Itoa(s.Clients) + " (" + strconv.Itoa(s.Users) + " users)"},
+				{"Rooms", strconv.Itoa(s.Rooms)},
+				{"Messages", strconv.FormatInt(s.Messages, 10) + " (" + strconv.FormatFloat(s.MessageRate, 'f', 2, 64) + "/sec)"},
+				{"Commands", strconv.FormatInt(s.Commands, 10)},
+				{"Connections", strconv.FormatInt(s.Conns, 10)},
+			}
+			return c.appendPre("#msg-list", formatTable(rows, false))
+		},
+		Sub: map[string]command{
+			"commands": {
+				Desc: "Shows how often each command ran, its errors and run time.",
+				Role: roleAdmin,
+				Handler: func(c *client, args []string) error {
+					stats := readCommandStats()
+					if len(stats) == 0 {
+						return c.appendMsg("#msg-list", "No commands run yet")
+					}
+					var names []string
+					for name := range stats {
+						names = append(names, name)
+					}
+					sort.Slice(names, func(i, j int) bool {
+						a, b := stats[names[i]], stats[names[j]]
+						if a.Calls != b.Calls {
+							return a.Calls > b.Calls
+						}
+						return names[i] < names[j]
+					})
+					rows := [][]string{{"Command", "Calls", "Errors", "Avg", "Max"}}
+					for _, name := range names {
+						s := stats[name]
+						errRate := strconv.FormatFloat(100*float64(s.Errors)/float64(s.Calls), 'f', 1, 64) + "%"
+						rows = append(rows, []string{name, strconv.FormatInt(s.Calls, 10), strconv.FormatInt(s.Errors, 10) + " (" + errRate + ")",
+							(s.Total / time.Duration(s.Calls)).Round(time.Millisecond).String(), s.Max.Round(time.Millisecond).String()})
+					}
+					return c.pageLines(strings.Split(formatTable(rows, true), "\n"), false)
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,94 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Command middleware wraps every command run by the listener, so checks shared
+by all commands live in one place instead of in each handler. Middleware is
+added with Use and runs in the order added, the first being outermost; each
+decides whether and how to call the next handler. The built-in middleware
+counts commands, logs handler errors, checks the command's role and enforces
+its cooldown.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Handler runs a command. args[0] is the command name as typed.
+type Handler func(c *client, args []string) error
+
+var middleware []func(next Handler) Handler
+
+// Use adds middleware wrapping every command. It must be called before
+// clients connect, e.g. from init.
+func Use(m func(next Handler) Handler) {
+	middleware = append(middleware, m)
+}
+
+// run runs cmd through the middleware.
+func (c *client) run(cmd command, args []string) error {
+	cmd, n := cmd.find(args)
+	h := cmd.Handler
+	if h == nil {
+		h = func(c *client, args []string) error {
+			return c.usage(strings.Join(args[:n], " "), cmd)
+		}
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h(c, args)
+}
+
+// countCommands counts the commands run for the metrics, and each command's
+// calls, errors and run time.
+func countCommands(next Handler) Handler {
+	return func(c *client, args []string) error {
+		count(&counters.commands)
+		cmd, ok := lookupCommand(strings.ToLower(args[0]))
+		if !ok {
+			return next(c, args)
+		}
+		_, n := cmd.find(args)
+		start := time.Now()
+		err := next(c, args)
+		countCommand(strings.ToLower(strings.Join(args[:n], " ")), time.Since(start), err)
+		return err
+	}
+}
+
+// logErrors logs the errors returned by commands.
+func logErrors(next Handler) Handler {
+	return func(c *client, args []string) error {
+		err := next(c, args)
+		if err != nil {
+			log.Println(c.address, args[0]+":", err)
+		}
+		return err
+	}
+}
+
+// checkRole stops users from running commands above their role.
+func checkRole(next Handler) Handler {
+	return func(c *client, args []string) error {
+		if cmd, ok := lookupCommand(strings.ToLower(args[0])); ok {
+			if cmd, n := cmd.find(args); !c.allowed(strings.Join(args[:n], " "), cmd) {
+				return nil
+			}
+		}
+		return next(c, args)
+	}
+}
+
+func init() {
+	Use(countCommands)
+	Use(logErrors)
+	Use(checkRole)
+	Use(throttle)
+}
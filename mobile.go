@@ -0,0 +1,87 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Mobile input mode adapts the terminal to touch clients. Clients announcing a
+touch screen in their hello packet (see caps.go) get larger tap targets, a
+command palette of buttons that fill in the command line (so commands don't
+have to be typed on a soft keyboard) and prompts that set the keyboard type
+and bring the keyboard up.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// paletteCommands are shown first in the command palette.
+var paletteCommands = []string{"help", "login", "register", "calc", "weather", "remind", "translate", "clear"}
+
+// palette returns the palette's commands: the common ones, then the rest in
+// alphabetical order.
+func palette() []string {
+	seen := make(map[string]bool)
+	var list, rest []string
+	for _, name := range paletteCommands {
+		if _, ok := lookupCommand(name); ok {
+			list = append(list, name)
+			seen[name] = true
+		}
+	}
+	for name := range commandList() {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append(list, rest...)
+}
+
+// showPalette sends the command palette to c, or hides it.
+func (c *client) showPalette(show bool) error {
+	var p Palette
+	if show {
+		p.Commands = strings.Join(palette(), " ")
+	}
+	return c.send(p.packet())
+}
+
+// inputHint tells touch clients which soft keyboard suits the next answer
+// ("text", "email", "numeric", ...) and to bring it up.
+func (c *client) inputHint(mode string) error {
+	if !c.capabilities().Touch {
+		return nil
+	}
+	return c.send(InputHint{Value: mode}.packet())
+}
+
+// promptAs is prompt with a soft keyboard suited to mode on touch clients.
+func (c *client) promptAs(text, mode string) (string, error) {
+	c.inputHint(mode)
+	defer c.inputHint("text")
+	return c.prompt(text)
+}
+
+func init() {
+	cmdMap["palette"] = command{
+		Desc:     "Shows or hides the command palette for touch screens.",
+		Usage:    "palette [on|off]",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			show := len(args) < 2 || args[1] != "off"
+			return c.showPalette(show)
+		},
+	}
+}
+
+// startMobile switches a touch client to mobile input mode.
+func startMobile(c *client) error {
+	if e := c.send(Mobile{}.packet()); e != nil {
+		return e
+	}
+	return c.showPalette(true)
+}
@@ -0,0 +1,156 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Private messages. msg sends a message to another user, shown on every client
+they are logged in on and stored in the conversation of the two (see
+history.go); reply answers whoever last sent you one. Messages to a user who
+isn't online wait in their inbox, an "inbox" file next to their user file,
+and are shown the next time they log in. The API and gRPC send messages
+the same way, see sendDirect.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const dmInboxMax = 100 // messages kept for a user who is offline
+
+var inbox = struct {
+	sync.Mutex
+	replyTo map[string]string // lower case name -> last user to message it
+}{replyTo: make(map[string]string)}
+
+// inboxPath is the file that keeps the messages waiting for name.
+func inboxPath(name string) string {
+	return userDir(name) + SEP + "inbox"
+}
+
+// queueInbox keeps m, sent to the offline user name, for their next login.
+func queueInbox(name string, m message) {
+	inbox.Lock()
+	defer inbox.Unlock()
+	var list []message
+	if e := loadJSON(&list, inboxPath(name)); e != nil && !os.IsNotExist(e) {
+		log.Println(e)
+	}
+	list = append(list, m)
+	if len(list) > dmInboxMax {
+		list = list[len(list)-dmInboxMax:]
+	}
+	if e := saveJSON(list, inboxPath(name)); e != nil {
+		log.Println(e)
+	}
+}
+
+// deliverInbox shows c, just logged in, the messages sent while it was
+// offline and empties its inbox.
+func deliverInbox(c *client) {
+	inbox.Lock()
+	defer inbox.Unlock()
+	var list []message
+	if e := loadJSON(&list, inboxPath(c.user.Name)); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	if e := os.Remove(inboxPath(c.user.Name)); e != nil {
+		log.Println(e)
+	}
+	if len(list) == 0 {
+		return
+	}
+	loc := c.user.location()
+	lines := []string{c.trf("%d messages while you were away:", len(list))}
+	for _, m := range list {
+		lines = append(lines, m.Time.In(loc).Format("2006-01-02 15:04")+" ["+m.From+" -> you] "+m.Text)
+	}
+	inbox.replyTo[strings.ToLower(c.user.Name)] = list[len(list)-1].From
+	if e := c.appendPre("#msg-list", strings.Join(lines, "\n")); e != nil {
+		log.Println(c.address, e)
+	}
+}
+
+// noteReplyTo remembers that from last messaged to, for reply.
+func noteReplyTo(to, from string) {
+	inbox.Lock()
+	defer inbox.Unlock()
+	inbox.replyTo[strings.ToLower(to)] = from
+}
+
+// replyTarget returns the user who last messaged name, "" if none did.
+func replyTarget(name string) string {
+	inbox.Lock()
+	defer inbox.Unlock()
+	return inbox.replyTo[strings.ToLower(name)]
+}
+
+// directMessage sends text from c to the user to, telling c if it can't or
+// the message waits in their inbox.
+func directMessage(c *client, to, text string) error {
+	text = strings.TrimSpace(text)
+	switch {
+	case !userExists(to):
+		return c.appendMsg("#msg-list", c.trf("No such user: %s", to))
+	case strings.EqualFold(to, c.user.Name):
+		return c.appendMsg("#msg-list", "You can't message yourself")
+	case text == "":
+		return nil
+	}
+	online := len(clientsByName(to)) > 0
+	if _, e := sendDirect(c.user.Name, to, text); e != nil {
+		log.Println(e)
+		return c.appendMsg("#msg-list", c.trf("Couldn't send the message to %s", to))
+	}
+	if !online {
+		return c.appendMsg("#msg-list", c.trf("%s is offline, they'll get it when they log in", to))
+	}
+	return nil
+}
+
+func init() {
+	cmdMap["msg"] = command{
+		Desc:     "Sends a private message to a user, kept for them if they're offline.",
+		Usage:    "msg <user> <text>",
+		Examples: []string{"msg alice are you around?"},
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) < 3 {
+				return c.appendMsg("#msg-list", "Usage: msg <user> <text>")
+			}
+			return directMessage(c, args[1], strings.Join(args[2:], " "))
+		},
+		Complete: func(c *client, words []string) []string {
+			if len(words) == 2 {
+				return onlineNames()
+			}
+			return nil
+		},
+	}
+	cmdMap["reply"] = command{
+		Desc:     "Answers the last user who sent you a private message.",
+		Usage:    "reply <text>",
+		Examples: []string{"reply on my way"},
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: reply <text>")
+			}
+			to := replyTarget(c.user.Name)
+			if to == "" {
+				return c.appendMsg("#msg-list", "Nobody has sent you a message yet")
+			}
+			return directMessage(c, to, strings.Join(args[1:], " "))
+		},
+	}
+}
@@ -0,0 +1,296 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Room moderation. Moderators, and the operators of a room in it (see
+roomperm.go), mute a user in a room for a while: postRoom then refuses the
+user's messages there, whether typed, sent through the API or gRPC, and the
+user is told so. A shadow mute, mute --shadow, refuses them silently instead:
+the user's own clients are shown the message as if it had been said, nobody
+else sees it and it isn't stored. Mutes are kept in work/mutes.json until
+they run out or unmute lifts them; mute alone lists them.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errMuted is what postRoom returns for messages from a muted user.
+var errMuted = errors.New("muted in this room")
+
+// mute keeps a user from talking in a room.
+type mute struct {
+	User   string
+	Room   string
+	Until  time.Time
+	By     string
+	Reason string `json:",omitempty"`
+	Shadow bool   `json:",omitempty"` // messages are only echoed to the user
+}
+
+var mutes = struct {
+	sync.Mutex
+	list map[string]*mute // muteKey -> mute
+}{list: make(map[string]*mute)}
+
+// muteKey returns the key of the mute of name in room.
+func muteKey(name, room string) string {
+	return strings.ToLower(name) + "#" + room
+}
+
+// mutesPath is the file mutes are persisted in.
+func mutesPath() string {
+	return *work + SEP + "mutes.json"
+}
+
+// saveMutes writes the mutes to disk. Callers must hold the lock.
+func saveMutes() error {
+	var list []*mute
+	for _, m := range mutes.list {
+		list = append(list, m)
+	}
+	return saveJSON(list, mutesPath())
+}
+
+// loadMutes reads the persisted mutes. It is called once from main.
+func loadMutes() {
+	var list []*mute
+	if e := loadJSON(&list, mutesPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	mutes.Lock()
+	defer mutes.Unlock()
+	for _, m := range list {
+		if time.Now().Before(m.Until) {
+			mutes.list[muteKey(m.User, m.Room)] = m
+		}
+	}
+}
+
+// addMute mutes m.User in m.Room, replacing any mute there.
+func addMute(m *mute) error {
+	mutes.Lock()
+	defer mutes.Unlock()
+	mutes.list[muteKey(m.User, m.Room)] = m
+	return saveMutes()
+}
+
+// forgetMutes drops the mutes of name.
+func forgetMutes(name string) {
+	mutes.Lock()
+	defer mutes.Unlock()
+	for key, m := range mutes.list {
+		if strings.EqualFold(m.User, name) {
+			delete(mutes.list, key)
+		}
+	}
+	if e := saveMutes(); e != nil {
+		log.Println(e)
+	}
+}
+
+// findMute returns a copy of the mute of name in room, if there is one.
+func findMute(name, room string) (mute, bool) {
+	mutes.Lock()
+	defer mutes.Unlock()
+	key := muteKey(name, room)
+	m, ok := mutes.list[key]
+	if !ok {
+		return mute{}, false
+	}
+	if !time.Now().Before(m.Until) {
+		delete(mutes.list, key)
+		return mute{}, false
+	}
+	return *m, true
+}
+
+// mayModerate reports whether u runs room: moderators run every room, the
+// owner and operators of a room run it, see roomperm.go.
+func mayModerate(u *user, room string) bool {
+	if u.role() >= roleModerator {
+		return true
+	}
+	r, ok := findRoom(room)
+	return ok && u.key != nil && r.isOp(u.Name)
+}
+
+// canModerate reports whether c runs room.
+func (c *client) canModerate(room string) bool {
+	return mayModerate(&c.user, room)
+}
+
+// echoShadow shows the clients of from in room its message, as if it had
+// been said there.
+func echoShadow(room, from, text string) {
+	for _, c := range clientsByName(from) {
+		if c.inRoom(room) {
+			c.sendOn(chanChat, richPacket(c.roomPrefix(room, from), text, "msg"))
+		}
+	}
+}
+
+// tellMuted tells c, whose message to room was refused, why.
+func (c *client) tellMuted(room string) error {
+	m, _ := findMute(c.user.Name, room)
+	until := m.Until.In(c.user.location()).Format("2006-01-02 15:04")
+	return c.appendMsg("#msg-list", c.trf("You're muted in #%s until %s", room, until))
+}
+
+// listMutes shows c the mutes in force, in room if it isn't "".
+func listMutes(c *client, room string) error {
+	rows := [][]string{{c.tr("User"), c.tr("Room"), c.tr("Until"), c.tr("By"), c.tr("Reason")}}
+	mutes.Lock()
+	for _, m := range mutes.list {
+		if !time.Now().Before(m.Until) || room != "" && m.Room != room {
+			continue
+		}
+		user := m.User
+		if m.Shadow {
+			user += " (" + c.tr("shadow") + ")"
+		}
+		rows = append(rows, []string{user, "#" + m.Room, m.Until.In(c.user.location()).Format("2006-01-02 15:04"), m.By, m.Reason})
+	}
+	mutes.Unlock()
+	if len(rows) == 1 {
+		return c.appendMsg("#msg-list", "Nobody is muted")
+	}
+	sort.Slice(rows[1:], func(i, j int) bool { return rows[i+1][1]+rows[i+1][0] < rows[j+1][1]+rows[j+1][0] })
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+// muteArgs returns the user and room of the mute commands: a #room may
+// follow the user, the current room otherwise. It tells c what's wrong if c
+// may not mute the user there.
+func muteArgs(c *client, cmd string, rest []string) (name, room string, args []string, ok bool) {
+	name, r, args, ok := roomTarget(c, cmd, rest)
+	room = r.Name
+	switch {
+	case !ok:
+	case strings.EqualFold(name, c.user.Name):
+		if cmd == "mute" {
+			c.appendMsg("#msg-list", "You can't mute yourself")
+		} else {
+			c.appendMsg("#msg-list", "You can't unmute yourself")
+		}
+	case !c.canModerate(room):
+		c.fail(codeForbidden, "", c.trf("%s: permission denied", cmd))
+	case userRole(name) >= roleModerator && userRole(name) >= c.user.role():
+		c.appendMsg("#msg-list", c.trf("You can't mute %s", name))
+	default:
+		return name, room, args, true
+	}
+	return "", "", nil, false
+}
+
+func init() {
+	cmdMap["mute"] = command{
+		Desc:  "Keeps a user from talking in a room for a while; without arguments lists the mutes.",
+		Usage: "mute [<user> [#room] <duration> [reason]]",
+		Flags: []flagDoc{
+			{"shadow", "", "let the user go on talking, but only to themselves"},
+		},
+		Examples: []string{"mute spammer 1h stop posting links", "mute troll #dev 1d --shadow"},
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			opts, rest, err := parseFlags(args, commandNamed("mute").flagSpec())
+			if err != nil {
+				return c.appendMsg("#msg-list", err.Error())
+			}
+			if len(rest) == 0 {
+				return listMutes(c, "")
+			}
+			name, room, rest, ok := muteArgs(c, "mute", rest)
+			if !ok {
+				return nil
+			}
+			if len(rest) == 0 {
+				return c.usage("mute", commandNamed("mute"))
+			}
+			until, _, err := parseWhen("in", rest[:1], time.Now())
+			if err != nil {
+				return c.appendMsg("#msg-list", "mute: "+err.Error())
+			}
+			m := &mute{User: name, Room: room, Until: until, By: c.user.Name, Reason: strings.Join(rest[1:], " "), Shadow: opts["shadow"] != ""}
+			if e := addMute(m); e != nil {
+				return e
+			}
+			if !m.Shadow {
+				left := until.Sub(time.Now()).Round(time.Minute).String()
+				for _, oc := range clientsByName(name) {
+					msg := oc.trf("You have been muted in #%s for %s by %s", room, left, c.user.Name)
+					if m.Reason != "" {
+						msg += ": " + m.Reason
+					}
+					oc.appendMsg("#msg-list", msg)
+				}
+			}
+			log.Println(c.user.Name, "muted", name, "in #"+room, "until", until.UTC().Format(time.RFC3339), m.Shadow, m.Reason)
+			emit("user.muted", map[string]string{"user": name, "room": room, "by": c.user.Name, "until": until.UTC().Format(time.RFC3339), "reason": m.Reason})
+			return c.appendMsg("#msg-list", c.trf("Muted %s in #%s until %s", name, room, until.In(c.user.location()).Format("2006-01-02 15:04")))
+		},
+		Complete: func(c *client, words []string) []string {
+			if len(words) == 2 {
+				return onlineNames()
+			}
+			return nil
+		},
+	}
+	cmdMap["unmute"] = command{
+		Desc:     "Lets a muted user talk in a room again.",
+		Usage:    "unmute <user> [#room]",
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			name, room, rest, ok := muteArgs(c, "unmute", args[1:])
+			if !ok {
+				return nil
+			}
+			if len(rest) > 0 {
+				return c.usage("unmute", commandNamed("unmute"))
+			}
+			mutes.Lock()
+			m, muted := mutes.list[muteKey(name, room)]
+			delete(mutes.list, muteKey(name, room))
+			e := saveMutes()
+			mutes.Unlock()
+			if !muted {
+				return c.appendMsg("#msg-list", c.trf("%s isn't muted in #%s", name, room))
+			}
+			if e != nil {
+				return e
+			}
+			if !m.Shadow {
+				for _, oc := range clientsByName(name) {
+					oc.appendMsg("#msg-list", oc.trf("You may talk in #%s again", room))
+				}
+			}
+			log.Println(c.user.Name, "unmuted", name, "in #"+room)
+			emit("user.unmuted", map[string]string{"user": name, "room": room, "by": c.user.Name})
+			return c.appendMsg("#msg-list", c.trf("Unmuted %s in #%s", name, room))
+		},
+		Complete: func(c *client, words []string) []string {
+			mutes.Lock()
+			defer mutes.Unlock()
+			var names []string
+			for _, m := range mutes.list {
+				names = append(names, m.User)
+			}
+			return names
+		},
+	}
+}
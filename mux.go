@@ -0,0 +1,60 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Channels let independent streams share the websocket. A packet's Chan names
+its stream: the terminal, the default, has none; "ctl" carries protocol
+packets such as hello, welcome, acks and pager state; "chat" room and direct
+messages; "file" downloads; "event" server events the page subscribed to,
+see subscribe.go. Each end hands a packet to the handler of its channel, so
+streams don't get mixed up with each other, and pages that don't know
+channels still run every packet as a DOM op as before.
+
+Packets from the page on the terminal and control channels go to packetMap
+as they always did, those on other channels to channelMap. Packet types
+needing a role (see roles.go) are refused to users without it.
+*/
+
+//
+package main
+
+const (
+	chanTerm = ""
+	chanCtl  = "ctl"
+	chanChat = "chat"
+	chanFile = "file"
+)
+
+// channelMap holds the handlers for packets the page sends on channels other
+// than the terminal, keyed by channel.
+var channelMap = make(map[string]func(*client, packet) error)
+
+// sendOn sends p on channel ch.
+func (c *client) sendOn(ch string, p packet) error {
+	p.Chan = ch
+	return c.send(p)
+}
+
+// demux passes a packet from the page to the handler of its channel and
+// reports whether there was one.
+func (c *client) demux(p packet) (bool, error) {
+	switch p.Chan {
+	case chanTerm, chanCtl:
+		// Control packets are handled like terminal ones, the channel only
+		// keeps them apart on the page's side.
+		handler, ok := packetMap[p.Type]
+		if !ok {
+			return false, nil
+		}
+		if !c.mayReceive(p) {
+			return true, nil
+		}
+		return true, handler(c, p)
+	}
+	handler, ok := channelMap[p.Chan]
+	if !ok {
+		return false, nil
+	}
+	return true, handler(c, p)
+}
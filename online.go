@@ -0,0 +1,225 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file keeps track of the currently connected clients, through the hub
+(see hub.go), so that server side events (reminders, messages, etc) can be
+delivered to other users, either by name or to everyone in a room, or
+broadcast to all of them. The who command lists them and admins announce
+things to everyone with wall.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultRoom is the room clients start in and commands use when they
+// don't name one.
+const defaultRoom = "lobby"
+
+// addOnline registers a connected client.
+func addOnline(c *client) {
+	hub.register <- c
+}
+
+// removeOnline unregisters a disconnected client, taking it out of its rooms.
+func removeOnline(c *client) {
+	hub.unregister <- c
+	noteSeen(c)
+	emit("user.leave", map[string]string{"user": c.user.Name, "room": c.currentRoom()})
+	announceLeave(c, &c.user, leaveRooms(c), true)
+}
+
+// onlineClients returns all connected clients.
+func onlineClients() []*client {
+	return selectClients(nil)
+}
+
+// broadcast sends packets to every connected client. Each client is sent to
+// from a goroutine of its own, so a slow connection doesn't hold up the rest.
+func broadcast(packets ...packet) {
+	hub.broadcast <- hubCast{packets: packets}
+}
+
+// broadcastImportant is broadcast for packets that must not get lost, see
+// ack.go.
+func broadcastImportant(packets ...packet) {
+	hub.broadcast <- hubCast{packets: packets, important: true}
+}
+
+// broadcastTo is broadcast for the clients to picks, see hub.go for what to
+// may do.
+func broadcastTo(to func(c *client) bool, packets ...packet) {
+	hub.broadcast <- hubCast{packets: packets, to: to}
+}
+
+// clientsByName returns the connected clients logged in as name.
+func clientsByName(name string) []*client {
+	return selectClients(func(c *client) bool {
+		return c.user.key != nil && strings.EqualFold(c.user.Name, name)
+	})
+}
+
+// postRoom stores a message from a user or service in the room's history
+// and delivers it to everyone in room, see rooms.go, and to the users it
+// mentions, see mention.go. The clients talking in room and the sender's
+// have read it, the others are sent the room's unread count. Messages from
+// users muted in room are refused with errMuted, or only echoed back to
+// them, see mute.go.
+func postRoom(room, from, text string) (message, error) {
+	if m, ok := findMute(from, room); ok {
+		if !m.Shadow {
+			return message{}, errMuted
+		}
+		echoShadow(room, from, text)
+		return message{From: from, Text: text, Time: time.Now()}, nil
+	}
+	m, err := storeMessage(roomKey(room), from, text)
+	if err != nil {
+		log.Println(err)
+	}
+	emit("room.message", map[string]string{"room": room, "from": from, "text": text})
+	names := mentioned(from, text)
+	for _, c := range roomClients(room) {
+		class := "msg"
+		if c.isMentioned(names) {
+			class = "msg mention"
+			c.notifyMention(room, from, text)
+		}
+		c.sendOn(chanChat, richPacket(c.roomPrefix(room, from), text, class))
+		if c.user.key != nil && err == nil && (c.currentRoom() == room || strings.EqualFold(c.user.Name, from)) {
+			markRead(c.user.Name, room, m.Id)
+		}
+	}
+	noteUnread(room)
+	deliverMentions(room, from, text, names)
+	return m, err
+}
+
+// sendDirect stores a direct message between two users and delivers it to
+// both of their connected clients, or to the recipient's inbox when it has
+// none (see msg.go).
+func sendDirect(from, to, text string) (message, error) {
+	m, err := storeMessage(dmKey(from, to), from, text)
+	if err != nil {
+		return m, err
+	}
+	noteReplyTo(to, from)
+	cs := clientsByName(to)
+	if len(cs) == 0 {
+		queueInbox(to, m)
+	}
+	for _, c := range cs {
+		c.sendOn(chanChat, richPacket("["+from+" -> you] ", text, "msg"))
+	}
+	if !strings.EqualFold(from, to) {
+		for _, c := range clientsByName(from) {
+			c.sendOn(chanChat, richPacket("[you -> "+to+"] ", text, "msg"))
+		}
+	}
+	return m, nil
+}
+
+// postRoomHTML is postRoom for already safe html, e.g. from markdownHTML.
+func postRoomHTML(room, from, html string) {
+	for _, c := range roomClients(room) {
+		c.appendHTML("#msg-list", "<b>["+from+"]</b> "+html)
+	}
+}
+
+// roomArg returns the room named by a leading "#room" argument, or the
+// default room, along with the remaining arguments.
+func roomArg(args []string) (string, []string) {
+	if len(args) > 0 && strings.HasPrefix(args[0], "#") && isName(args[0][1:]) && len(args[0]) > 1 {
+		return strings.ToLower(args[0][1:]), args[1:]
+	}
+	return defaultRoom, args
+}
+
+func init() {
+	cmdMap["who"] = command{
+		Desc:     "Lists the users online, how long they have been idle and their room.",
+		Usage:    "who [#room]",
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			room := ""
+			if len(args) > 1 {
+				if len(args) > 2 || len(args[1]) < 2 || args[1][0] != '#' || !isName(args[1][1:]) {
+					return c.appendMsg("#msg-list", "Usage: who [#room]")
+				}
+				room = strings.ToLower(args[1][1:])
+			}
+			var cs []*client
+			if room != "" && !maySee(&c.user, room) {
+				return c.appendMsg("#msg-list", "Nobody is online")
+			}
+			for _, oc := range onlineClients() {
+				if room == "" || oc.inRoom(room) {
+					cs = append(cs, oc)
+				}
+			}
+			sort.Slice(cs, func(i, j int) bool {
+				if cs[i].user.Name != cs[j].user.Name {
+					return strings.ToLower(cs[i].user.Name) < strings.ToLower(cs[j].user.Name)
+				}
+				return cs[i].sess.connected.Before(cs[j].sess.connected)
+			})
+			admin := isAdmin(&c.user)
+			header := []string{c.tr("User"), c.tr("Idle"), c.tr("Room"), c.tr("Connected")}
+			if admin {
+				header = append(header, c.tr("Address"))
+			}
+			rows := [][]string{header}
+			for _, oc := range cs {
+				name := oc.user.Name
+				if oc == c {
+					name += " *"
+				}
+				current := "#" + oc.currentRoom()
+				if !maySee(&c.user, oc.currentRoom()) {
+					current = ""
+				}
+				row := []string{name, oc.sess.idle().Truncate(time.Second).String(), current,
+					time.Since(oc.sess.connected).Truncate(time.Minute).String()}
+				if admin {
+					row = append(row, oc.address)
+				}
+				rows = append(rows, row)
+			}
+			if len(rows) == 1 {
+				return c.appendMsg("#msg-list", "Nobody is online")
+			}
+			lines := strings.Split(formatTable(rows, true), "\n")
+			lines = append(lines, c.trf("%d connected", len(cs)))
+			return c.pageLines(lines, false)
+		},
+	}
+}
+
+func init() {
+	cmdMap["wall"] = command{
+		Desc:     "Sends an announcement to everyone connected.",
+		Usage:    "wall <message>",
+		Examples: []string{"wall The server restarts in 5 minutes"},
+		Category: "Admin",
+		Role:     roleAdmin,
+		Handler: func(c *client, args []string) error {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: wall <message>")
+			}
+			text := "Announcement from " + c.user.Name + ": " + strings.Join(args[1:], " ")
+			msg := AppendElement{Selector: "#msg-list", Element: "div", Class: "msg wall", Text: text, Scroll: true}
+			broadcastImportant(msg.packet(), Announce{Text: text, Urgent: true}.packet())
+			log.Println(c.user.Name, "wall:", strings.Join(args[1:], " "))
+			emit("wall", map[string]string{"from": c.user.Name, "text": strings.Join(args[1:], " ")})
+			return nil
+		},
+	}
+}
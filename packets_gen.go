@@ -0,0 +1,776 @@
+// Code generated by genpackets.go from packets.schema. DO NOT EDIT.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/jmptrader/soshell/protocol"
+)
+
+// Announce is the announce packet.
+type Announce struct {
+	Text   string
+	Urgent bool
+}
+
+// packet returns p as a packet.
+func (p Announce) packet() packet {
+	pack := protocol.New("announce")
+	pack.Data["Selector"] = "body"
+	pack.Data["Text"] = p.Text
+	if p.Urgent {
+		pack.Data["Urgent"] = "true"
+	}
+	return pack
+}
+
+// AppendRich is the appendRich packet.
+type AppendRich struct {
+	Prefix string
+	HTML   string
+	Class  string
+}
+
+// packet returns p as a packet.
+func (p AppendRich) packet() packet {
+	pack := protocol.New("appendRich")
+	pack.Data["Selector"] = "#msg-list"
+	if p.Prefix != "" {
+		pack.Data["Prefix"] = p.Prefix
+	}
+	pack.Data["HTML"] = p.HTML
+	if p.Class != "" {
+		pack.Data["Class"] = p.Class
+	}
+	return pack
+}
+
+// AppendElement is the appendElement packet.
+type AppendElement struct {
+	Selector  string
+	Element   string
+	Class     string
+	Id        string
+	Attribute string
+	Value     string
+	Text      string
+	HTML      string
+	Href      string
+	Target    string
+	Alt       string
+	Role      string
+	Aria      map[string]string
+	OnClick   string
+	Focus     bool
+	Scroll    bool
+}
+
+// packet returns p as a packet.
+func (p AppendElement) packet() packet {
+	pack := protocol.New("appendElement")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Element"] = p.Element
+	if p.Class != "" {
+		pack.Data["Class"] = p.Class
+	}
+	if p.Id != "" {
+		pack.Data["Id"] = p.Id
+	}
+	if p.Attribute != "" {
+		pack.Data["Attribute"] = p.Attribute
+	}
+	if p.Value != "" {
+		pack.Data["Value"] = p.Value
+	}
+	if p.Text != "" {
+		pack.Data["Text"] = p.Text
+	}
+	if p.HTML != "" {
+		pack.Data["HTML"] = p.HTML
+	}
+	if p.Href != "" {
+		pack.Data["Href"] = p.Href
+	}
+	if p.Target != "" {
+		pack.Data["Target"] = p.Target
+	}
+	if p.Alt != "" {
+		pack.Data["Alt"] = p.Alt
+	}
+	if p.Role != "" {
+		pack.Data["Role"] = p.Role
+	}
+	for k, v := range p.Aria {
+		pack.Data["aria-"+strings.TrimPrefix(k, "aria-")] = v
+	}
+	if p.OnClick != "" {
+		pack.Data["OnClick"] = p.OnClick
+	}
+	if p.Focus {
+		pack.Data["Focus"] = "true"
+	}
+	if p.Scroll {
+		pack.Data["Scroll"] = "true"
+	}
+	return pack
+}
+
+// Background is the background packet.
+type Background struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p Background) packet() packet {
+	pack := protocol.New("background")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// BackgroundColor is the background-color packet.
+type BackgroundColor struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p BackgroundColor) packet() packet {
+	pack := protocol.New("background-color")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Border is the border packet.
+type Border struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p Border) packet() packet {
+	pack := protocol.New("border")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// BorderColor is the border-color packet.
+type BorderColor struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p BorderColor) packet() packet {
+	pack := protocol.New("border-color")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Color is the color packet.
+type Color struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p Color) packet() packet {
+	pack := protocol.New("color")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Download is the download packet.
+type Download struct {
+	Name    string
+	Mime    string
+	Content string
+}
+
+// packet returns p as a packet.
+func (p Download) packet() packet {
+	pack := protocol.New("download")
+	pack.Data["Selector"] = "body"
+	pack.Data["Name"] = p.Name
+	if p.Mime != "" {
+		pack.Data["Mime"] = p.Mime
+	}
+	pack.Data["Content"] = p.Content
+	return pack
+}
+
+// EditClose is the editClose packet.
+type EditClose struct {
+	Id string
+}
+
+// packet returns p as a packet.
+func (p EditClose) packet() packet {
+	pack := protocol.New("editClose")
+	pack.Data["Selector"] = "body"
+	pack.Data["Id"] = p.Id
+	return pack
+}
+
+// EditOp is the editOp packet.
+type EditOp struct {
+	Id     string
+	Rev    int
+	Pos    int
+	Del    int
+	Ins    string
+	Len    int
+	Author string
+}
+
+// packet returns p as a packet.
+func (p EditOp) packet() packet {
+	pack := protocol.New("editOp")
+	pack.Data["Selector"] = "body"
+	pack.Data["Id"] = p.Id
+	pack.Data["Rev"] = strconv.Itoa(p.Rev)
+	pack.Data["Pos"] = strconv.Itoa(p.Pos)
+	pack.Data["Del"] = strconv.Itoa(p.Del)
+	if p.Ins != "" {
+		pack.Data["Ins"] = p.Ins
+	}
+	pack.Data["Len"] = strconv.Itoa(p.Len)
+	pack.Data["Author"] = p.Author
+	return pack
+}
+
+// Editable is the editable packet.
+type Editable struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p Editable) packet() packet {
+	pack := protocol.New("editable")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Editor is the editor packet.
+type Editor struct {
+	Id     string
+	Title  string
+	Text   string
+	Rev    int
+	Author string
+}
+
+// packet returns p as a packet.
+func (p Editor) packet() packet {
+	pack := protocol.New("editor")
+	pack.Data["Selector"] = "body"
+	pack.Data["Id"] = p.Id
+	pack.Data["Title"] = p.Title
+	if p.Text != "" {
+		pack.Data["Text"] = p.Text
+	}
+	pack.Data["Rev"] = strconv.Itoa(p.Rev)
+	pack.Data["Author"] = p.Author
+	return pack
+}
+
+// Error is the error packet.
+type Error struct {
+	Selector string
+	Code     string
+	Message  string
+	Request  string
+}
+
+// packet returns p as a packet.
+func (p Error) packet() packet {
+	pack := protocol.New("error")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Code"] = p.Code
+	pack.Data["Message"] = p.Message
+	if p.Request != "" {
+		pack.Data["Request"] = p.Request
+	}
+	return pack
+}
+
+// Event is the event packet.
+type Event struct {
+	Event string
+	Time  string
+	Extra map[string]string
+}
+
+// packet returns p as a packet.
+func (p Event) packet() packet {
+	pack := protocol.New("event")
+	for k, v := range p.Extra {
+		pack.Data[k] = v
+	}
+	pack.Data["Event"] = p.Event
+	pack.Data["Time"] = p.Time
+	return pack
+}
+
+// Exists is the exists packet.
+type Exists struct {
+	Selector string
+}
+
+// packet returns p as a packet.
+func (p Exists) packet() packet {
+	pack := protocol.New("exists")
+	pack.Data["Selector"] = p.Selector
+	return pack
+}
+
+// Focus is the focus packet.
+type Focus struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p Focus) packet() packet {
+	pack := protocol.New("focus")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// GetAttribute is the getAttribute packet.
+type GetAttribute struct {
+	Selector  string
+	Attribute string
+}
+
+// packet returns p as a packet.
+func (p GetAttribute) packet() packet {
+	pack := protocol.New("getAttribute")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Attribute"] = p.Attribute
+	return pack
+}
+
+// GetHTML is the getHTML packet.
+type GetHTML struct {
+	Selector string
+}
+
+// packet returns p as a packet.
+func (p GetHTML) packet() packet {
+	pack := protocol.New("getHTML")
+	pack.Data["Selector"] = p.Selector
+	return pack
+}
+
+// GetProperty is the getProperty packet.
+type GetProperty struct {
+	Selector string
+	Property string
+}
+
+// packet returns p as a packet.
+func (p GetProperty) packet() packet {
+	pack := protocol.New("getProperty")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Property"] = p.Property
+	return pack
+}
+
+// InnerHTML is the innerHTML packet.
+type InnerHTML struct {
+	Selector string
+	Value    string
+}
+
+// packet returns p as a packet.
+func (p InnerHTML) packet() packet {
+	pack := protocol.New("innerHTML")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// InputHint is the inputHint packet.
+type InputHint struct {
+	Value string
+}
+
+// packet returns p as a packet.
+func (p InputHint) packet() packet {
+	pack := protocol.New("inputHint")
+	pack.Data["Selector"] = "#msg-txt"
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// InputValue is the inputValue packet.
+type InputValue struct {
+	Value string
+}
+
+// packet returns p as a packet.
+func (p InputValue) packet() packet {
+	pack := protocol.New("inputValue")
+	pack.Data["Selector"] = "#msg-txt"
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Mention is the mention packet.
+type Mention struct {
+	Room string
+	From string
+	Text string
+}
+
+// packet returns p as a packet.
+func (p Mention) packet() packet {
+	pack := protocol.New("mention")
+	pack.Data["Selector"] = "#msg-list"
+	pack.Data["Room"] = p.Room
+	pack.Data["From"] = p.From
+	pack.Data["Text"] = p.Text
+	return pack
+}
+
+// Mobile is the mobile packet.
+type Mobile struct {
+}
+
+// packet returns p as a packet.
+func (p Mobile) packet() packet {
+	pack := protocol.New("mobile")
+	pack.Data["Selector"] = "body"
+	return pack
+}
+
+// Notify is the notify packet.
+type Notify struct {
+	Title string
+	Text  string
+}
+
+// packet returns p as a packet.
+func (p Notify) packet() packet {
+	pack := protocol.New("notify")
+	pack.Data["Selector"] = "body"
+	pack.Data["Title"] = p.Title
+	pack.Data["Text"] = p.Text
+	return pack
+}
+
+// Pager is the pager packet.
+type Pager struct {
+	Active bool
+}
+
+// packet returns p as a packet.
+func (p Pager) packet() packet {
+	pack := protocol.New("pager")
+	pack.Data["Selector"] = "#msg-txt"
+	if p.Active {
+		pack.Data["Active"] = "true"
+	}
+	return pack
+}
+
+// Palette is the palette packet.
+type Palette struct {
+	Commands string
+}
+
+// packet returns p as a packet.
+func (p Palette) packet() packet {
+	pack := protocol.New("palette")
+	pack.Data["Selector"] = "body"
+	if p.Commands != "" {
+		pack.Data["Commands"] = p.Commands
+	}
+	return pack
+}
+
+// PaneClose is the paneClose packet.
+type PaneClose struct {
+	Id string
+}
+
+// packet returns p as a packet.
+func (p PaneClose) packet() packet {
+	pack := protocol.New("paneClose")
+	pack.Data["Selector"] = "body"
+	pack.Data["Id"] = p.Id
+	return pack
+}
+
+// PaneFocus is the paneFocus packet.
+type PaneFocus struct {
+	Id string
+}
+
+// packet returns p as a packet.
+func (p PaneFocus) packet() packet {
+	pack := protocol.New("paneFocus")
+	pack.Data["Selector"] = "body"
+	pack.Data["Id"] = p.Id
+	return pack
+}
+
+// PaneNew is the paneNew packet.
+type PaneNew struct {
+	Id    string
+	Value string
+}
+
+// packet returns p as a packet.
+func (p PaneNew) packet() packet {
+	pack := protocol.New("paneNew")
+	pack.Data["Selector"] = "body"
+	pack.Data["Id"] = p.Id
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Session is the session packet.
+type Session struct {
+	Token   string
+	Expires string
+}
+
+// packet returns p as a packet.
+func (p Session) packet() packet {
+	pack := protocol.New("session")
+	pack.Data["Selector"] = "body"
+	if p.Token != "" {
+		pack.Data["Token"] = p.Token
+	}
+	if p.Expires != "" {
+		pack.Data["Expires"] = p.Expires
+	}
+	return pack
+}
+
+// Device is the device packet.
+type Device struct {
+	Token string
+}
+
+// packet returns p as a packet.
+func (p Device) packet() packet {
+	pack := protocol.New("device")
+	pack.Data["Selector"] = "body"
+	if p.Token != "" {
+		pack.Data["Token"] = p.Token
+	}
+	return pack
+}
+
+// SetAria is the setAria packet.
+type SetAria struct {
+	Selector string
+	Role     string
+	Aria     map[string]string
+}
+
+// packet returns p as a packet.
+func (p SetAria) packet() packet {
+	pack := protocol.New("setAria")
+	pack.Data["Selector"] = p.Selector
+	if p.Role != "" {
+		pack.Data["Role"] = p.Role
+	}
+	for k, v := range p.Aria {
+		pack.Data["aria-"+strings.TrimPrefix(k, "aria-")] = v
+	}
+	return pack
+}
+
+// SetAttribute is the setAttribute packet.
+type SetAttribute struct {
+	Selector  string
+	Attribute string
+	Value     string
+}
+
+// packet returns p as a packet.
+func (p SetAttribute) packet() packet {
+	pack := protocol.New("setAttribute")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Attribute"] = p.Attribute
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// StreamChunk is the streamChunk packet.
+type StreamChunk struct {
+	Selector string
+	Chunk    string
+}
+
+// packet returns p as a packet.
+func (p StreamChunk) packet() packet {
+	pack := protocol.New("streamChunk")
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Chunk"] = p.Chunk
+	return pack
+}
+
+// StreamEnd is the streamEnd packet.
+type StreamEnd struct {
+	Selector string
+}
+
+// packet returns p as a packet.
+func (p StreamEnd) packet() packet {
+	pack := protocol.New("streamEnd")
+	pack.Data["Selector"] = p.Selector
+	return pack
+}
+
+// StreamStart is the streamStart packet.
+type StreamStart struct {
+	Selector string
+	Op       string
+	Field    string
+	Extra    map[string]string
+}
+
+// packet returns p as a packet.
+func (p StreamStart) packet() packet {
+	pack := protocol.New("streamStart")
+	for k, v := range p.Extra {
+		pack.Data[k] = v
+	}
+	pack.Data["Selector"] = p.Selector
+	pack.Data["Op"] = p.Op
+	pack.Data["Field"] = p.Field
+	return pack
+}
+
+// Subscribed is the subscribed packet.
+type Subscribed struct {
+	Events  string
+	Refused string
+}
+
+// packet returns p as a packet.
+func (p Subscribed) packet() packet {
+	pack := protocol.New("subscribed")
+	pack.Data["Selector"] = "body"
+	pack.Data["Events"] = p.Events
+	if p.Refused != "" {
+		pack.Data["Refused"] = p.Refused
+	}
+	return pack
+}
+
+// TabNew is the tabNew packet.
+type TabNew struct {
+	Id string
+}
+
+// packet returns p as a packet.
+func (p TabNew) packet() packet {
+	pack := protocol.New("tabNew")
+	pack.Data["Selector"] = "body"
+	pack.Data["Id"] = p.Id
+	return pack
+}
+
+// Theme is the theme packet.
+type Theme struct {
+	Value string
+}
+
+// packet returns p as a packet.
+func (p Theme) packet() packet {
+	pack := protocol.New("theme")
+	pack.Data["Selector"] = "body"
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Toast is the toast packet.
+type Toast struct {
+	Text string
+}
+
+// packet returns p as a packet.
+func (p Toast) packet() packet {
+	pack := protocol.New("toast")
+	pack.Data["Selector"] = "body"
+	pack.Data["Text"] = p.Text
+	return pack
+}
+
+// Typing is the typing packet.
+type Typing struct {
+	User string
+	Text string
+}
+
+// packet returns p as a packet.
+func (p Typing) packet() packet {
+	pack := protocol.New("typing")
+	pack.Data["Selector"] = "#typing"
+	pack.Data["User"] = p.User
+	if p.Text != "" {
+		pack.Data["Text"] = p.Text
+	}
+	return pack
+}
+
+// Unread is the unread packet.
+type Unread struct {
+	Room  string
+	Count int
+}
+
+// packet returns p as a packet.
+func (p Unread) packet() packet {
+	pack := protocol.New("unread")
+	pack.Data["Selector"] = "#rooms"
+	pack.Data["Room"] = p.Room
+	pack.Data["Count"] = strconv.Itoa(p.Count)
+	return pack
+}
+
+// UserCSS is the userCSS packet.
+type UserCSS struct {
+	Value string
+}
+
+// packet returns p as a packet.
+func (p UserCSS) packet() packet {
+	pack := protocol.New("userCSS")
+	pack.Data["Selector"] = "head"
+	pack.Data["Value"] = p.Value
+	return pack
+}
+
+// Welcome is the welcome packet.
+type Welcome struct {
+	Protocol string
+	Resume   string
+}
+
+// packet returns p as a packet.
+func (p Welcome) packet() packet {
+	pack := protocol.New("welcome")
+	pack.Data["Selector"] = "body"
+	pack.Data["Protocol"] = p.Protocol
+	if p.Resume != "" {
+		pack.Data["Resume"] = p.Resume
+	}
+	return pack
+}
@@ -0,0 +1,102 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Paged output. Commands that can print many lines (help, history, grep, find)
+hand them to pageLines, which sends one page and keeps the rest behind a
+--more-- prompt. A "pager" packet tells the page a prompt is showing; Enter or
+space in the empty command box then sends "pageNext" for the next page and q or
+Escape sends "pageQuit" to drop the rest. Typing a command drops it too.
+*/
+
+//
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+const pageSize = 20 // lines per page
+
+// pager holds the output waiting behind a --more-- prompt.
+type pager struct {
+	sync.Mutex
+	lines []string
+	html  bool // lines are HTML, not text
+}
+
+// pageLines sends lines a page at a time, preformatted. If html is set the
+// lines must already be safe, e.g. escaped with html.EscapeString.
+func (c *client) pageLines(lines []string, html bool) error {
+	c.pager.Lock()
+	c.pager.lines, c.pager.html = lines, html
+	c.pager.Unlock()
+	return c.nextPage()
+}
+
+// nextPage sends the next page of the waiting output, if any. Headless clients
+// get all of it at once.
+func (c *client) nextPage() error {
+	c.pager.Lock()
+	n := pageSize
+	if c.ws == nil || n > len(c.pager.lines) {
+		n = len(c.pager.lines)
+	}
+	page, html := c.pager.lines[:n], c.pager.html
+	c.pager.lines = c.pager.lines[n:]
+	left := len(c.pager.lines)
+	if left == 0 {
+		c.pager.lines = nil
+	}
+	c.pager.Unlock()
+	if n == 0 {
+		return nil
+	}
+	text := strings.Join(page, "\n")
+	var e error
+	if html {
+		e = c.appendHTML("#msg-list", "<div class=\"pre\">"+text+"</div>")
+	} else {
+		e = c.appendPre("#msg-list", text)
+	}
+	if e != nil {
+		return e
+	}
+	if left > 0 {
+		if e = c.appendMsg("#msg-list", c.trf("--more-- (%d lines left, Enter for more, q to quit)", left)); e != nil {
+			return e
+		}
+	}
+	return c.pagerState(left > 0)
+}
+
+// quitPage drops the waiting output.
+func (c *client) quitPage() error {
+	c.pager.Lock()
+	waiting := c.pager.lines != nil
+	c.pager.lines = nil
+	c.pager.Unlock()
+	if !waiting {
+		return nil
+	}
+	return c.pagerState(false)
+}
+
+// pagerState tells the page whether a --more-- prompt is showing.
+func (c *client) pagerState(active bool) error {
+	if c.ws == nil {
+		return nil
+	}
+	return c.sendOn(chanCtl, Pager{Active: active}.packet())
+}
+
+func init() {
+	packetMap["pageNext"] = func(c *client, p packet) error {
+		return c.nextPage()
+	}
+	packetMap["pageQuit"] = func(c *client, p packet) error {
+		return c.quitPage()
+	}
+}
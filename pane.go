@@ -0,0 +1,181 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The pane manager lets a client split its terminal into several output panes,
+grouped in tabs. Every pane is a message list with its own selector
+(#msg-list for the first one, #pane-N for the rest). The pane the user last
+clicked is focused: output sent to #msg-list is redirected to it, so every
+command works in any pane, while long running output (e.g. run-go) keeps going
+to the pane it was started in.
+*/
+
+//
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	paneMax = 4 // panes per tab
+	tabMax  = 8
+)
+
+// panes is a client's layout: tabs of pane ids and the focused pane.
+type panes struct {
+	sync.Mutex
+	tabs   [][]string
+	focus  string
+	nextId int
+}
+
+// out returns the selector of the focused pane.
+func (c *client) out() string {
+	c.panes.Lock()
+	defer c.panes.Unlock()
+	if c.panes.focus == "" {
+		return "#msg-list"
+	}
+	return "#" + c.panes.focus
+}
+
+// setup creates the initial single pane layout. Callers must hold the lock.
+func (ps *panes) setup() {
+	if ps.tabs == nil {
+		ps.tabs = [][]string{{"msg-list"}}
+		ps.focus = "msg-list"
+		ps.nextId = 1
+	}
+}
+
+// find returns the tab and index of pane id, or -1.
+func (ps *panes) find(id string) (int, int) {
+	for t, tab := range ps.tabs {
+		for i, p := range tab {
+			if p == id {
+				return t, i
+			}
+		}
+	}
+	return -1, -1
+}
+
+func init() {
+	cmdMap["split"] = command{
+		Desc:     "Splits the current tab side by side (or one above the other with h) into a new pane.",
+		Usage:    "split [h]",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			dir := "v"
+			if len(args) > 1 && args[1] == "h" {
+				dir = "h"
+			}
+			c.panes.Lock()
+			c.panes.setup()
+			t, _ := c.panes.find(c.panes.focus)
+			if len(c.panes.tabs[t]) >= paneMax {
+				c.panes.Unlock()
+				return c.appendMsg("#msg-list", "split: this tab already has "+strconv.Itoa(paneMax)+" panes")
+			}
+			id := "pane-" + strconv.Itoa(c.panes.nextId)
+			c.panes.nextId++
+			c.panes.tabs[t] = append(c.panes.tabs[t], id)
+			c.panes.focus = id
+			c.panes.Unlock()
+			return c.send(PaneNew{Id: id, Value: dir}.packet())
+		},
+	}
+	cmdMap["tab"] = command{
+		Desc:     "Opens a new tab or switches to one.",
+		Usage:    "tab new | tab <n>",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: tab new | tab <n>")
+			}
+			c.panes.Lock()
+			c.panes.setup()
+			if args[1] == "new" {
+				if len(c.panes.tabs) >= tabMax {
+					c.panes.Unlock()
+					return c.appendMsg("#msg-list", "tab: too many tabs")
+				}
+				id := "pane-" + strconv.Itoa(c.panes.nextId)
+				c.panes.nextId++
+				c.panes.tabs = append(c.panes.tabs, []string{id})
+				c.panes.focus = id
+				c.panes.Unlock()
+				return c.send(TabNew{Id: id}.packet())
+			}
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 || n > len(c.panes.tabs) {
+				c.panes.Unlock()
+				return c.appendMsg("#msg-list", "tab: no tab "+args[1])
+			}
+			id := c.panes.tabs[n-1][0]
+			c.panes.focus = id
+			c.panes.Unlock()
+			return c.send(PaneFocus{Id: id}.packet())
+		},
+	}
+	cmdMap["pane"] = command{
+		Desc:     "Closes the focused pane or lists your tabs and panes.",
+		Usage:    "pane close | pane list",
+		Category: "Shell",
+		Handler: func(c *client, args []string) (e error) {
+			c.panes.Lock()
+			c.panes.setup()
+			switch {
+			case len(args) == 2 && args[1] == "list":
+				var lines []string
+				for t, tab := range c.panes.tabs {
+					var names []string
+					for _, p := range tab {
+						if p == c.panes.focus {
+							p += "*"
+						}
+						names = append(names, "#"+p)
+					}
+					lines = append(lines, "tab "+strconv.Itoa(t+1)+": "+strings.Join(names, " "))
+				}
+				c.panes.Unlock()
+				return c.appendPre("#msg-list", strings.Join(lines, "\n"))
+			case len(args) == 2 && args[1] == "close":
+				id := c.panes.focus
+				if id == "msg-list" {
+					c.panes.Unlock()
+					return c.appendMsg("#msg-list", "pane: the first pane can't be closed")
+				}
+				t, i := c.panes.find(id)
+				c.panes.tabs[t] = append(c.panes.tabs[t][:i], c.panes.tabs[t][i+1:]...)
+				if len(c.panes.tabs[t]) == 0 {
+					c.panes.tabs = append(c.panes.tabs[:t], c.panes.tabs[t+1:]...)
+					t = 0
+				}
+				c.panes.focus = c.panes.tabs[t][0]
+				focus := c.panes.focus
+				c.panes.Unlock()
+				if e = c.send(PaneClose{Id: id}.packet()); e == nil {
+					e = c.send(PaneFocus{Id: focus}.packet())
+				}
+				return
+			}
+			c.panes.Unlock()
+			return c.appendMsg("#msg-list", "Usage: pane list | pane close")
+		},
+	}
+	// Sent by the client when the user clicks a pane or tab.
+	packetMap["paneFocus"] = func(c *client, p packet) error {
+		c.panes.Lock()
+		defer c.panes.Unlock()
+		c.panes.setup()
+		if t, _ := c.panes.find(p.Data["Id"]); t >= 0 {
+			c.panes.focus = p.Data["Id"]
+		}
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Password hashing. Each account has a "pass" file next to its user file holding
+the password hashed with -password-hash, argon2id or bcrypt, salted and with
+the cost it was hashed with, -password-cost. A password is checked against the
+hash before the account's files are opened.
+
+The key the account's files are encrypted with (see crypt.go) is derived from
+the password too, with argon2id whichever hash is used: for argon2id the hash
+and the key are the two halves of one derivation, for bcrypt the key is
+derived with the same salt and default argon2id parameters.
+
+Accounts from before there were pass files have their files keyed with an
+unsalted SHA-256 of the password. These, and accounts hashed with another
+algorithm or cost than configured, are re-hashed and their files re-encrypted
+on the next successful login. Login tokens (see token.go) hold the file key, so
+the user's other tokens are revoked then.
+*/
+
+//
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	passwordHash = flag.String("password-hash", "argon2id", "how passwords are stored: argon2id or bcrypt")
+	passwordCost = flag.Int("password-cost", 0, "argon2id passes or bcrypt cost of new password hashes, 0 for the default")
+)
+
+// argon2id parameters besides the passes.
+const (
+	argonTime    = 3
+	argonMemory  = 64 << 10 // KiB
+	argonThreads = 4
+)
+
+var errWrongPassword = errors.New("wrong password")
+
+// passRecord is a hashed password.
+type passRecord struct {
+	Algo    string
+	Hash    []byte
+	Salt    []byte
+	Cost    int    // argon2id passes or bcrypt cost
+	Memory  uint32 `json:",omitempty"` // argon2id memory in KiB
+	Threads uint8  `json:",omitempty"` // argon2id lanes
+}
+
+// passPath is the file name's password hash is kept in.
+func passPath(name string) string {
+	return userDir(name) + SEP + "pass"
+}
+
+// hashCost returns the configured cost of -password-hash.
+func hashCost() int {
+	switch {
+	case *passwordCost > 0:
+		return *passwordCost
+	case *passwordHash == "bcrypt":
+		return 12
+	}
+	return argonTime
+}
+
+// checkPasswordFlags makes sure -password-hash and -password-cost can be used.
+// It is called once from main.
+func checkPasswordFlags() {
+	switch *passwordHash {
+	case "argon2id":
+	case "bcrypt":
+		if c := hashCost(); c < bcrypt.MinCost || c > bcrypt.MaxCost {
+			log.Fatalf("-password-cost: bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		log.Fatalln("-password-hash: unknown hash", *passwordHash)
+	}
+}
+
+// hashPassword hashes pass as configured, returning the hash and the file key.
+func hashPassword(pass string) (*passRecord, []byte, error) {
+	r := &passRecord{Algo: *passwordHash, Cost: hashCost(), Salt: make([]byte, 16)}
+	if _, e := rand.Read(r.Salt); e != nil {
+		return nil, nil, e
+	}
+	if r.Algo == "bcrypt" {
+		h, e := bcrypt.GenerateFromPassword([]byte(pass), r.Cost)
+		if e != nil {
+			return nil, nil, e
+		}
+		r.Hash = h
+		return r, argon2.IDKey([]byte(pass), r.Salt, argonTime, argonMemory, argonThreads, 32), nil
+	}
+	r.Memory, r.Threads = argonMemory, argonThreads
+	out := argon2.IDKey([]byte(pass), r.Salt, uint32(r.Cost), r.Memory, r.Threads, 64)
+	r.Hash = out[:32]
+	return r, out[32:], nil
+}
+
+// check returns the file key if pass is the password hashed in r.
+func (r *passRecord) check(pass string) ([]byte, error) {
+	switch r.Algo {
+	case "argon2id":
+		out := argon2.IDKey([]byte(pass), r.Salt, uint32(r.Cost), r.Memory, r.Threads, 64)
+		if subtle.ConstantTimeCompare(out[:32], r.Hash) == 1 {
+			return out[32:], nil
+		}
+	case "bcrypt":
+		if bcrypt.CompareHashAndPassword(r.Hash, []byte(pass)) == nil {
+			return argon2.IDKey([]byte(pass), r.Salt, argonTime, argonMemory, argonThreads, 32), nil
+		}
+	default:
+		return nil, errors.New("unknown password hash " + r.Algo)
+	}
+	return nil, errWrongPassword
+}
+
+// current reports whether r is hashed as configured.
+func (r *passRecord) current() bool {
+	return r.Algo == *passwordHash && r.Cost == hashCost()
+}
+
+// passwordKey returns the file key of the account name if pass is its
+// password; stale tells whether the password needs re-hashing.
+func passwordKey(name, pass string) (key []byte, stale bool, e error) {
+	var r passRecord
+	if e = loadJSON(&r, passPath(name)); os.IsNotExist(e) {
+		// An account from before pass files; loading it checks the password.
+		return passKey(pass), true, nil
+	} else if e != nil {
+		return nil, false, e
+	}
+	key, e = r.check(pass)
+	return key, e == nil && !r.current(), e
+}
+
+// passwordOK reports whether pass is the password of the user c is logged in
+// as.
+func (c *client) passwordOK(pass string) bool {
+	key, _, e := passwordKey(c.user.Name, pass)
+	return pass != "" && e == nil && c.user.key != nil && subtle.ConstantTimeCompare(key, c.user.key) == 1
+}
+
+// setPassword hashes pass as the password of u, which must be logged in or
+// just created, and encrypts its files with the new key.
+func (u *user) setPassword(pass string) error {
+	r, key, e := hashPassword(pass)
+	if e != nil {
+		return e
+	}
+	old := u.key
+	var history []string
+	if old != nil && pathExists(commandsPath(u.Name)) {
+		if e := loadObjectKey(&history, commandsPath(u.Name), old); e != nil {
+			return e
+		}
+	}
+	// The pass file must derive the key the user file is encrypted with, so
+	// it's written aside first and only replaced once the user file is.
+	tmp := passPath(u.Name) + ".new"
+	if e := saveJSON(r, tmp); e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	u.key = key
+	if e := u.commit(); e != nil {
+		u.key = old
+		os.Remove(tmp)
+		return e
+	}
+	if e := os.Rename(tmp, passPath(u.Name)); e != nil {
+		os.Remove(tmp)
+		if u.key = old; old != nil {
+			if err := u.commit(); err != nil {
+				log.Println("restoring the user file of", u.Name+":", err)
+			}
+		}
+		return e
+	}
+	if history != nil {
+		if e := saveObjectKey(history, commandsPath(u.Name), key); e != nil {
+			log.Println(e)
+		}
+	}
+	if e := saveRecovery(u); e != nil {
+		log.Println(e)
+	}
+	if old != nil {
+		// Tokens hold the old key and connected clients write with it.
+		revokeSessions(u.Name, "")
+		if n := revokeAPIKeys(u.Name); n > 0 {
+			log.Println("password of", u.Name, "changed, revoked", n, "API keys")
+		}
+		for _, c := range onlineClients() {
+			if strings.EqualFold(c.user.Name, u.Name) && subtle.ConstantTimeCompare(c.user.key, old) == 1 {
+				c.user.key = key
+			}
+		}
+	}
+	return nil
+}
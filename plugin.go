@@ -0,0 +1,170 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Command plugins let commands be added without touching cmdMap. Code compiled
+into the server registers commands with RegisterCommand, or, without depending
+on package main, with the commands package; loadCommands adds those at
+startup. Commands can also be shipped separately as Go plugins: every .so file
+in the -plugins directory is loaded at startup, new ones also by reload, and
+its exported Register function is called to add its commands.
+
+A plugin can't import this package, so it talks to the server through unnamed
+interface and func types, which are identical wherever they're declared:
+
+	package main
+
+	type session = interface {
+		User() string
+		Print(text string) error
+		Prompt(text string) (string, error)
+	}
+
+	func Register(add func(name, desc string, h func(s session, args []string) error) error) error {
+		return add("hello", "hello greets you.", func(s session, args []string) error {
+			return s.Print("Hello, " + s.User())
+		})
+	}
+
+Build it with go build -buildmode=plugin against the same Go version as the
+server.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/jmptrader/soshell/commands"
+	"log"
+	"os"
+	"path/filepath"
+	"plugin"
+	"strings"
+)
+
+var pluginDir = flag.String("plugins", "", "directory of command plugins (.so) to load")
+
+// pluginSession is what a plugin command sees of the client running it.
+type pluginSession = interface {
+	User() string
+	Print(text string) error
+	Prompt(text string) (string, error)
+}
+
+// pluginHandler is the handler of a plugin command.
+type pluginHandler = func(s pluginSession, args []string) error
+
+// clientSession adapts a client to pluginSession and commands.Session.
+type clientSession struct {
+	c *client
+}
+
+func (s clientSession) User() string                       { return s.c.user.Name }
+func (s clientSession) LoggedIn() bool                     { return s.c.user.key != nil }
+func (s clientSession) Print(text string) error            { return s.c.appendMsg("#msg-list", text) }
+func (s clientSession) Preformatted(text string) error     { return s.c.appendPre("#msg-list", text) }
+func (s clientSession) Prompt(text string) (string, error) { return s.c.prompt(text) }
+func (s clientSession) PromptSecret(text string) (string, error) {
+	return s.c.promptSecure("#msg-txt", text)
+}
+
+// RegisterCommand adds a command. It fails if the name is invalid or already
+// taken, so a plugin can't replace a built-in command.
+func RegisterCommand(name, desc string, handler func(c *client, args []string) error) error {
+	name = strings.ToLower(name)
+	if name == "" || !isName(name) {
+		return errors.New("invalid command name: " + name)
+	}
+	if handler == nil {
+		return errors.New("command has no handler: " + name)
+	}
+	cmdMu.Lock()
+	defer cmdMu.Unlock()
+	if _, exists := cmdMap[name]; exists {
+		return errors.New("command already exists: " + name)
+	}
+	cmdMap[name] = command{Desc: desc, Handler: handler}
+	return nil
+}
+
+// loadPlugin opens a plugin and registers its commands.
+func loadPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("Register")
+	if err != nil {
+		return err
+	}
+	register, ok := sym.(func(func(string, string, pluginHandler) error) error)
+	if !ok {
+		return errors.New("Register has the wrong type")
+	}
+	return register(func(name, desc string, h pluginHandler) error {
+		if h == nil {
+			return errors.New("command has no handler: " + name)
+		}
+		err := RegisterCommand(name, desc, func(c *client, args []string) error {
+			return h(clientSession{c}, args)
+		})
+		if err == nil {
+			trackCommand(name, path)
+		}
+		return err
+	})
+}
+
+// loadCommands adds the commands registered with the commands package. A
+// command whose name is taken is logged and skipped.
+func loadCommands() {
+	for name, cmd := range commands.All() {
+		run := cmd.Run
+		err := RegisterCommand(name, cmd.Desc, func(c *client, args []string) error {
+			return run(clientSession{c}, args)
+		})
+		if err != nil {
+			log.Println("commands:", err)
+			continue
+		}
+		reg := cmdMap[name]
+		reg.Role = role(cmd.Role)
+		reg.Usage, reg.Examples, reg.Category = cmd.Usage, cmd.Examples, cmd.Category
+		if complete := cmd.Complete; complete != nil {
+			reg.Complete = func(c *client, words []string) []string {
+				return complete(clientSession{c}, words)
+			}
+		}
+		cmdMap[name] = reg
+	}
+}
+
+// loadPlugins loads the plugins in the -plugins directory. A plugin that
+// fails to load is logged and skipped; the errors are returned.
+func loadPlugins() (errs []error) {
+	if *pluginDir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(*pluginDir + SEP + "*.so")
+	if err != nil {
+		log.Println(err)
+		return []error{err}
+	}
+	if len(paths) == 0 {
+		if _, err := os.Stat(*pluginDir); err != nil {
+			log.Println(err)
+		}
+	}
+	for _, path := range paths {
+		if err := loadPlugin(path); err != nil {
+			log.Println("plugin", path+":", err)
+			errs = append(errs, errors.New("plugin "+path+": "+err.Error()))
+		} else {
+			log.Println("plugin", path, "loaded")
+		}
+	}
+	return errs
+}
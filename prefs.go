@@ -0,0 +1,207 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Preferences. set changes one of the settings in prefList, e.g. set timezone
+Europe/Oslo, right away and, for logged in users, in the account, which
+applies them again whenever a session starts; set with a name only goes back
+to the default. get shows them. Guests may set them too, for the session, and
+keep them if they register (see guest.go).
+
+The prompt is shown in front of the command box. Its format may use %u for
+the user name, %r for the room, %h for the server's host name and %% for a
+%.
+*/
+
+//
+package main
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const promptMax = 32
+
+// notifyModes are how notifications may be shown, see client.notify.
+var notifyModes = []string{"browser", "toast", "off"}
+
+// pref is a user preference.
+type pref struct {
+	Desc string
+	// get returns the value of the preference of u, "" for the default.
+	get func(u *user) string
+	// set checks value and applies it to c, returning what's wrong with
+	// it if it can't be used. An empty value sets the default.
+	set func(c *client, value string) (string, error)
+	// values are the values offered by completion, if there's a list.
+	values func() []string
+}
+
+// prefList holds the preferences, keyed by name.
+var prefList = map[string]pref{
+	"theme": {
+		Desc: "Color theme of the terminal.",
+		get:  func(u *user) string { return u.Theme },
+		set: func(c *client, value string) (string, error) {
+			if value != "" && !isTheme(value) {
+				return c.trf("No such theme: %s", value), nil
+			}
+			c.user.Theme = value
+			if value == "" {
+				value = themes[0]
+			}
+			return "", c.setTheme(value)
+		},
+		values: func() []string { return themes },
+	},
+	"timezone": {
+		Desc: "Time zone times are shown in, e.g. Europe/Oslo.",
+		get:  func(u *user) string { return u.TZ },
+		set: func(c *client, value string) (string, error) {
+			if _, e := time.LoadLocation(value); value != "" && e != nil {
+				return c.trf("Unknown time zone: %s", value), nil
+			}
+			c.user.TZ = value
+			return "", nil
+		},
+	},
+	"prompt": {
+		Desc: "Prompt in front of the command box: %u is your name, %r the room and %h the host.",
+		get:  func(u *user) string { return u.Prompt },
+		set: func(c *client, value string) (string, error) {
+			if utf8.RuneCountInString(value) > promptMax {
+				return c.trf("Prompts can be at most %d characters long", promptMax), nil
+			}
+			c.user.Prompt = value
+			return "", c.showPrompt()
+		},
+	},
+	"notify": {
+		Desc: "How notifications are shown: browser, toast or off.",
+		get:  func(u *user) string { return u.Notify },
+		set: func(c *client, value string) (string, error) {
+			value = strings.ToLower(value)
+			if value == notifyModes[0] {
+				value = ""
+			} else if value != "" && !contains(notifyModes, value) {
+				return c.trf("Use one of: %s", strings.Join(notifyModes, " ")), nil
+			}
+			c.user.Notify = value
+			return "", nil
+		},
+		values: func() []string { return notifyModes },
+	},
+}
+
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// promptText returns c's prompt, with its format expanded.
+func (c *client) promptText() string {
+	r := strings.NewReplacer("%u", c.user.Name, "%r", "#"+c.currentRoom(), "%h", *hostname, "%%", "%")
+	return r.Replace(c.user.Prompt)
+}
+
+// showPrompt shows c's prompt in front of its command box.
+func (c *client) showPrompt() error {
+	return c.innerHTML("#prompt", html.EscapeString(c.promptText()))
+}
+
+// applyPrefs applies the preferences saved in c's account. It is called on
+// login.
+func applyPrefs(c *client) {
+	applyTheme(c)
+	c.showPrompt()
+}
+
+// showPrefs shows c the preferences named, or all of them.
+func showPrefs(c *client, names []string) error {
+	if len(names) == 0 {
+		for name := range prefList {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	rows := [][]string{{c.tr("Name"), c.tr("Value"), c.tr("Description")}}
+	for _, name := range names {
+		p, ok := prefList[strings.ToLower(name)]
+		if !ok {
+			return c.appendMsg("#msg-list", c.trf("No such setting: %s", name))
+		}
+		value := p.get(&c.user)
+		if value == "" {
+			value = "(" + c.tr("default") + ")"
+		}
+		rows = append(rows, []string{strings.ToLower(name), value, c.tr(p.Desc)})
+	}
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+// completePrefs completes the names of the preferences and, for set, their
+// values.
+func completePrefs(c *client, words []string) []string {
+	if len(words) == 2 {
+		var names []string
+		for name := range prefList {
+			names = append(names, name)
+		}
+		return names
+	}
+	if p, ok := prefList[strings.ToLower(words[1])]; ok && len(words) == 3 && p.values != nil && words[0] == "set" {
+		return p.values()
+	}
+	return nil
+}
+
+func init() {
+	cmdMap["set"] = command{
+		Desc:     "Changes a setting, kept in your account; without a value it goes back to the default.",
+		Usage:    "set [name [value]]",
+		Examples: []string{"set timezone Europe/Oslo", "set prompt %u@%h %r>", "set notify toast", "set prompt"},
+		Category: "Account",
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return showPrefs(c, nil)
+			}
+			name := strings.ToLower(args[1])
+			p, ok := prefList[name]
+			if !ok {
+				return c.appendMsg("#msg-list", c.trf("No such setting: %s", args[1]))
+			}
+			bad, e := p.set(c, strings.Join(args[2:], " "))
+			if e != nil {
+				return e
+			}
+			if bad != "" {
+				return c.appendMsg("#msg-list", bad)
+			}
+			if e := c.user.commit(); e != nil {
+				return e
+			}
+			return showPrefs(c, []string{name})
+		},
+		Complete: completePrefs,
+	}
+	cmdMap["get"] = command{
+		Desc:     "Shows your settings, or the ones named.",
+		Usage:    "get [name...]",
+		Examples: []string{"get", "get timezone"},
+		Category: "Account",
+		Handler: func(c *client, args []string) error {
+			return showPrefs(c, args[1:])
+		},
+		Complete: completePrefs,
+	}
+}
@@ -0,0 +1,230 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Presence. When a logged in user enters a room, on login, with join or by
+connecting again, the room is told "alice joined", and "alice left" when the
+user's last client in the room leaves it. Guests come and go unannounced.
+
+A client that disconnects doesn't leave right away: its user's leave is
+announced -presence-grace later, and not at all if the user is back in the
+room by then, so reloading the page or a flaky connection doesn't flood the
+room with notices. The hub (see hub.go) keeps the leaves waiting, and online
+lists the users online along with the ones that may be reconnecting.
+*/
+
+//
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"time"
+)
+
+var presenceGrace = flag.Duration("presence-grace", 30*time.Second, "how long after a user disconnects leaving its rooms is announced, so it can reconnect unnoticed")
+
+// presenceChange is a logged in user entering or leaving a room.
+type presenceChange struct {
+	c          *client // the client that entered or left
+	name, room string
+	joined     bool
+	grace      bool // the client disconnected, wait for it to come back
+}
+
+// pendingLeave is a leave waiting for the grace period to end.
+type pendingLeave struct {
+	change presenceChange
+	timer  *time.Timer
+	since  time.Time
+}
+
+// announceJoin tells the room that c, if logged in, entered it.
+func (c *client) announceJoin(room string) {
+	if c.user.key != nil {
+		hub.presence <- presenceChange{c: c, name: c.user.Name, room: room, joined: true}
+	}
+}
+
+// announceLeave tells rooms that c, if u is logged in, left them; with grace
+// after -presence-grace, unless the user is back. u is c's user, or the one
+// it was before it logged out.
+func announceLeave(c *client, u *user, rooms []string, grace bool) {
+	if u.key == nil {
+		return
+	}
+	for _, room := range rooms {
+		hub.presence <- presenceChange{c: c, name: u.Name, room: room, grace: grace}
+	}
+}
+
+// presenceKey is the key of the leave of name from room.
+func presenceKey(name, room string) string {
+	return strings.ToLower(name) + "#" + room
+}
+
+// changePresence announces p unless it changes nothing: another client of
+// the user is in the room, or the user is back before its leave was
+// announced.
+func (h *hubState) changePresence(p presenceChange) {
+	key := presenceKey(p.name, p.room)
+	if l, ok := h.leaving[key]; ok {
+		l.timer.Stop()
+		delete(h.leaving, key)
+		if p.joined {
+			return
+		}
+	}
+	for c := range h.clients {
+		if c != p.c && c.user.key != nil && strings.EqualFold(c.user.Name, p.name) && c.inRoom(p.room) {
+			return
+		}
+	}
+	if p.joined || !p.grace || *presenceGrace <= 0 {
+		h.announce(p)
+		return
+	}
+	l := &pendingLeave{change: p, since: time.Now()}
+	l.timer = time.AfterFunc(*presenceGrace, func() { hub.expired <- l })
+	h.leaving[key] = l
+}
+
+// expireLeave announces l, a leave whose grace period is over, if it is
+// still waiting.
+func (h *hubState) expireLeave(l *pendingLeave) {
+	key := presenceKey(l.change.name, l.change.room)
+	if h.leaving[key] != l {
+		return
+	}
+	delete(h.leaving, key)
+	h.announce(l.change)
+}
+
+// announce tells the clients in the room of p about it.
+func (h *hubState) announce(p presenceChange) {
+	for c := range h.clients {
+		if c == p.c || !c.inRoom(p.room) {
+			continue
+		}
+		text := c.trf("%s left", p.name)
+		if p.joined {
+			text = c.trf("%s joined", p.name)
+		}
+		if p.room != c.currentRoom() {
+			text = "#" + p.room + " " + text
+		}
+		msg := AppendElement{Selector: "#msg-list", Element: "div", Class: "msg presence", Text: text, Scroll: true}
+		go c.sendOn(chanChat, msg.packet())
+	}
+}
+
+// noticeRoom tells the clients in room that name, a user of a bridged
+// network, did something, format taking the name. See irc.go and
+// matrix.go.
+func noticeRoom(room, name, format string) {
+	for _, c := range roomClients(room) {
+		text := c.trf(format, name)
+		if room != c.currentRoom() {
+			text = "#" + room + " " + text
+		}
+		c.sendOn(chanChat, AppendElement{Selector: "#msg-list", Element: "div", Class: "msg presence", Text: text, Scroll: true}.packet())
+	}
+}
+
+// listOnline shows c the users online, the ones that may be reconnecting
+// and the number of guests.
+func listOnline(c *client) error {
+	type entry struct {
+		name    string
+		clients int
+		idle    time.Duration
+		rooms   map[string]bool
+		away    time.Time
+	}
+	var cs []*client
+	var leaving []*pendingLeave
+	hubQuery(func(h *hubState) {
+		for oc := range h.clients {
+			cs = append(cs, oc)
+		}
+		for _, l := range h.leaving {
+			leaving = append(leaving, l)
+		}
+	})
+	users := make(map[string]*entry)
+	get := func(name string) *entry {
+		e := users[strings.ToLower(name)]
+		if e == nil {
+			e = &entry{name: name, rooms: make(map[string]bool)}
+			users[strings.ToLower(name)] = e
+		}
+		return e
+	}
+	guests := 0
+	for _, oc := range cs {
+		if oc.user.key == nil {
+			guests++
+			continue
+		}
+		e := get(oc.user.Name)
+		if idle := oc.sess.idle(); e.clients == 0 || idle < e.idle {
+			e.idle = idle
+		}
+		e.clients++
+		for _, room := range oc.joinedRooms() {
+			e.rooms[room] = true
+		}
+	}
+	for _, l := range leaving {
+		e := get(l.change.name)
+		e.rooms[l.change.room] = true
+		if e.away.IsZero() || l.since.Before(e.away) {
+			e.away = l.since
+		}
+	}
+	var list []*entry
+	for _, e := range users {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].name) < strings.ToLower(list[j].name) })
+	rows := [][]string{{c.tr("User"), c.tr("Status"), c.tr("Idle"), c.tr("Rooms")}}
+	online := 0
+	for _, e := range list {
+		status, idle := c.tr("online"), e.idle.Truncate(time.Second).String()
+		if e.clients > 1 {
+			status = c.trf("online (%d)", e.clients)
+		}
+		if e.clients == 0 {
+			status, idle = c.tr("reconnecting"), time.Since(e.away).Truncate(time.Second).String()
+		} else {
+			online++
+		}
+		var names []string
+		for room := range e.rooms {
+			if maySee(&c.user, room) {
+				names = append(names, "#"+room)
+			}
+		}
+		sort.Strings(names)
+		rows = append(rows, []string{e.name, status, idle, strings.Join(names, " ")})
+	}
+	var lines []string
+	if len(rows) > 1 {
+		lines = strings.Split(formatTable(rows, true), "\n")
+	}
+	lines = append(lines, c.trf("%d users and %d guests online", online, guests))
+	return c.pageLines(lines, false)
+}
+
+func init() {
+	cmdMap["online"] = command{
+		Desc:     "Lists the users online, their rooms and the ones reconnecting, and counts the guests.",
+		Usage:    "online",
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			return listOnline(c)
+		},
+	}
+}
@@ -0,0 +1,200 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+User profiles: a display name, a short bio (in the markdown subset of
+markdownHTML), an avatar image URL and a few links, set with profile set and
+shown to anyone with profile show. Profiles are public, so unlike the rest of
+an account they're kept unencrypted, in the "profile" file next to the user
+file.
+*/
+
+//
+package main
+
+import (
+	"html"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	displayMax = 64
+	bioMax     = 500
+	linksMax   = 5
+	urlMax     = 512
+)
+
+// profile is what a user shows others about themselves.
+type profile struct {
+	Display string   `json:",omitempty"`
+	Bio     string   `json:",omitempty"`
+	Avatar  string   `json:",omitempty"`
+	Links   []string `json:",omitempty"`
+}
+
+// profileMu serializes changes to profiles.
+var profileMu sync.Mutex
+
+// profilePath is the file name's profile is kept in.
+func profilePath(name string) string {
+	return userDir(name) + SEP + "profile"
+}
+
+// loadProfile returns the profile of name, empty if it has none.
+func loadProfile(name string) (p profile, e error) {
+	if e = loadJSON(&p, profilePath(name)); os.IsNotExist(e) {
+		e = nil
+	}
+	return
+}
+
+// webURL reports whether s is an http or https URL of at most urlMax bytes.
+func webURL(s string) bool {
+	u, e := url.Parse(s)
+	return e == nil && len(s) <= urlMax && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// setProfile sets field of c's profile to value, clearing it if value is
+// empty, and returns what's wrong with value if it can't be used.
+func setProfile(c *client, field string, value []string) (string, error) {
+	text := strings.TrimSpace(strings.Join(value, " "))
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	p, e := loadProfile(c.user.Name)
+	if e != nil {
+		return "", e
+	}
+	switch field {
+	case "display":
+		if utf8.RuneCountInString(text) > displayMax {
+			return c.trf("Display names can be at most %d characters long", displayMax), nil
+		}
+		p.Display = text
+	case "bio":
+		if utf8.RuneCountInString(text) > bioMax {
+			return c.trf("Bios can be at most %d characters long", bioMax), nil
+		}
+		// \n typed in the command box starts a new line.
+		p.Bio = strings.Replace(text, `\n`, "\n", -1)
+	case "avatar":
+		if text != "" && !webURL(text) {
+			return c.trf("Not a web address: %s", text), nil
+		}
+		p.Avatar = text
+	case "links":
+		if len(value) > linksMax {
+			return c.trf("You can have at most %d links", linksMax), nil
+		}
+		for _, link := range value {
+			if !webURL(link) {
+				return c.trf("Not a web address: %s", link), nil
+			}
+		}
+		p.Links = value
+	}
+	return "", saveJSON(p, profilePath(c.user.Name))
+}
+
+// profileHTML renders the profile of name.
+func profileHTML(name string, p profile) string {
+	var b strings.Builder
+	b.WriteString(`<div class="profile">`)
+	if p.Avatar != "" {
+		b.WriteString(`<img class="avatar" src="` + html.EscapeString(p.Avatar) + `" alt="" referrerpolicy="no-referrer">`)
+	}
+	title := html.EscapeString(name)
+	if p.Display != "" {
+		title = html.EscapeString(p.Display) + ` <span class="handle">@` + title + `</span>`
+	}
+	b.WriteString("<h3>" + title + "</h3>")
+	if p.Bio != "" {
+		b.WriteString(`<div class="bio">` + markdownHTML(p.Bio) + "</div>")
+	}
+	if len(p.Links) > 0 {
+		b.WriteString("<ul>")
+		for _, link := range p.Links {
+			l := html.EscapeString(link)
+			b.WriteString(`<li><a href="` + l + `" target="_blank" rel="noopener noreferrer nofollow">` + l + "</a></li>")
+		}
+		b.WriteString("</ul>")
+	}
+	b.WriteString("</div>")
+	return b.String()
+}
+
+// showProfile shows c the profile of name.
+func showProfile(c *client, name string) error {
+	if !userExists(name) {
+		return c.appendMsg("#msg-list", c.trf("No such user: %s", name))
+	}
+	p, e := loadProfile(name)
+	if e != nil {
+		return e
+	}
+	return c.appendHTML("#msg-list", profileHTML(name, p))
+}
+
+func init() {
+	cmdMap["profile"] = command{
+		Desc:     "Shows your profile.",
+		Usage:    "profile",
+		Category: "Account",
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 && c.user.key != nil {
+				return showProfile(c, c.user.Name)
+			}
+			return c.usage("profile", commandNamed("profile"))
+		},
+		Sub: map[string]command{
+			"show": {
+				Desc:  "Shows the profile of a user.",
+				Usage: "profile show <name>",
+				Handler: func(c *client, args []string) error {
+					if len(args) != 3 {
+						return c.usage("profile", commandNamed("profile"))
+					}
+					return showProfile(c, args[2])
+				},
+				Complete: func(c *client, words []string) []string {
+					return onlineNames()
+				},
+			},
+			"set": {
+				Desc:     "Sets your display name, bio, avatar image or links; leave the value out to clear it.",
+				Usage:    "profile set <display|bio|avatar|links> [value]",
+				Role:     roleUser,
+				Examples: []string{"profile set display Ada L.", `profile set bio Likes **maths**\nand engines`, "profile set links https://example.org"},
+				Handler: func(c *client, args []string) error {
+					if len(args) < 3 {
+						return c.usage("profile", commandNamed("profile"))
+					}
+					field := strings.ToLower(args[2])
+					switch field {
+					case "display", "bio", "avatar", "links":
+					default:
+						return c.usage("profile", commandNamed("profile"))
+					}
+					bad, e := setProfile(c, field, args[3:])
+					if e != nil {
+						return e
+					}
+					if bad != "" {
+						return c.appendMsg("#msg-list", bad)
+					}
+					return c.appendMsg("#msg-list", "Profile saved")
+				},
+				Complete: func(c *client, words []string) []string {
+					if len(words) == 3 {
+						return []string{"display", "bio", "avatar", "links"}
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,138 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Package protocol is the packet format spoken between the soshell server and
+the page over the websocket.
+
+Every message is a packet, a map with these keys, all strings:
+
+	Type  what to do, e.g. "appendElement"; the page runs packets by Type
+	Id    for queries, copied into the reply; for streams, the stream
+	Seq   for important packets, which the page acknowledges
+	Chan  the channel, the terminal if empty
+	Data  the arguments, a map of strings to strings; Data.Selector is the
+	      element acted on
+
+Id, Seq and Chan are left out when empty. Packets go as JSON text frames, or
+as MessagePack binary frames when the page asked for the Msgpack
+subprotocol. A page sends JSON packets, e.g.
+
+	{"Type": "reply", "Id": "7", "Chan": "ctl", "Data": {"Value": "true"}}
+
+or plain text, the line the user typed. The packets the server sends are
+listed, with their Data, in packets.schema.
+*/
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// The websocket subprotocols, one for each encoding of the packets sent to
+// the page.
+const (
+	JSON    = "soshell.json"
+	Msgpack = "soshell.msgpack"
+)
+
+// Packet is a message between the server and the page.
+type Packet struct {
+	Type string
+	Id   string `json:",omitempty"`
+	Seq  string `json:",omitempty"`
+	Chan string `json:",omitempty"`
+	Data map[string]string
+}
+
+// New returns a packet of type t with empty Data.
+func New(t string) Packet {
+	return Packet{Type: t, Data: make(map[string]string)}
+}
+
+// Clone returns a copy of p that doesn't share its Data.
+func (p Packet) Clone() Packet {
+	cp := Packet{Type: p.Type, Id: p.Id, Seq: p.Seq, Chan: p.Chan, Data: make(map[string]string, len(p.Data))}
+	for k, v := range p.Data {
+		cp.Data[k] = v
+	}
+	return cp
+}
+
+// Marshal returns p encoded as JSON.
+func Marshal(p Packet) ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// Unmarshal decodes a JSON packet sent by the page. Data is never nil.
+func Unmarshal(b []byte) (p Packet, err error) {
+	if len(b) == 0 || b[0] != '{' {
+		return p, errors.New("not a packet")
+	}
+	if err = json.Unmarshal(b, &p); err != nil {
+		return p, err
+	}
+	if p.Data == nil {
+		p.Data = make(map[string]string)
+	}
+	return p, nil
+}
+
+// MarshalMsgpack returns p encoded as a MessagePack map. Packets only hold
+// strings, so only maps and strings are written.
+func MarshalMsgpack(p Packet) []byte {
+	n := 2
+	if p.Id != "" {
+		n++
+	}
+	if p.Seq != "" {
+		n++
+	}
+	if p.Chan != "" {
+		n++
+	}
+	b := appendMapHeader(make([]byte, 0, 128), n)
+	b = appendString(appendString(b, "Type"), p.Type)
+	if p.Id != "" {
+		b = appendString(appendString(b, "Id"), p.Id)
+	}
+	if p.Seq != "" {
+		b = appendString(appendString(b, "Seq"), p.Seq)
+	}
+	if p.Chan != "" {
+		b = appendString(appendString(b, "Chan"), p.Chan)
+	}
+	b = appendMapHeader(appendString(b, "Data"), len(p.Data))
+	for k, v := range p.Data {
+		b = appendString(appendString(b, k), v)
+	}
+	return b
+}
+
+// appendMapHeader appends the header of a map of n pairs.
+func appendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n < 1<<16:
+		return append(b, 0xde, byte(n>>8), byte(n))
+	}
+	return append(b, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// appendString appends s as a MessagePack str.
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, s...)
+}
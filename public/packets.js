@@ -0,0 +1,53 @@
+// Code generated by genpackets.go from packets.schema. DO NOT EDIT.
+
+// PacketSchema describes the packets the server sends: the fields each always
+// has, those it may have, whether it may have aria-* or any other fields and
+// whether it is a DOM op, run by DomMap.
+var PacketSchema = {
+	"announce": {required: ["Selector", "Text"], optional: ["Urgent"], aria: false, open: false, dom: true},
+	"appendRich": {required: ["Selector", "HTML"], optional: ["Prefix", "Class"], aria: false, open: false, dom: true},
+	"appendElement": {required: ["Selector", "Element"], optional: ["Class", "Id", "Attribute", "Value", "Text", "HTML", "Href", "Target", "Alt", "Role", "OnClick", "Focus", "Scroll"], aria: true, open: false, dom: true},
+	"background": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"background-color": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"border": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"border-color": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"color": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"download": {required: ["Selector", "Name", "Content"], optional: ["Mime"], aria: false, open: false, dom: true},
+	"editClose": {required: ["Selector", "Id"], optional: [], aria: false, open: false, dom: true},
+	"editOp": {required: ["Selector", "Id", "Rev", "Pos", "Del", "Len", "Author"], optional: ["Ins"], aria: false, open: false, dom: true},
+	"editable": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"editor": {required: ["Selector", "Id", "Title", "Rev", "Author"], optional: ["Text"], aria: false, open: false, dom: true},
+	"error": {required: ["Selector", "Code", "Message"], optional: ["Request"], aria: false, open: false, dom: true},
+	"event": {required: ["Event", "Time"], optional: [], aria: false, open: true, dom: false},
+	"exists": {required: ["Selector"], optional: [], aria: false, open: false, dom: true},
+	"focus": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"getAttribute": {required: ["Selector", "Attribute"], optional: [], aria: false, open: false, dom: true},
+	"getHTML": {required: ["Selector"], optional: [], aria: false, open: false, dom: true},
+	"getProperty": {required: ["Selector", "Property"], optional: [], aria: false, open: false, dom: true},
+	"innerHTML": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"inputHint": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"inputValue": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"mention": {required: ["Selector", "Room", "From", "Text"], optional: [], aria: false, open: false, dom: true},
+	"mobile": {required: ["Selector"], optional: [], aria: false, open: false, dom: true},
+	"notify": {required: ["Selector", "Title", "Text"], optional: [], aria: false, open: false, dom: true},
+	"pager": {required: ["Selector"], optional: ["Active"], aria: false, open: false, dom: true},
+	"palette": {required: ["Selector"], optional: ["Commands"], aria: false, open: false, dom: true},
+	"paneClose": {required: ["Selector", "Id"], optional: [], aria: false, open: false, dom: true},
+	"paneFocus": {required: ["Selector", "Id"], optional: [], aria: false, open: false, dom: true},
+	"paneNew": {required: ["Selector", "Id", "Value"], optional: [], aria: false, open: false, dom: true},
+	"session": {required: ["Selector"], optional: ["Token", "Expires"], aria: false, open: false, dom: true},
+	"device": {required: ["Selector"], optional: ["Token"], aria: false, open: false, dom: true},
+	"setAria": {required: ["Selector"], optional: ["Role"], aria: true, open: false, dom: true},
+	"setAttribute": {required: ["Selector", "Attribute", "Value"], optional: [], aria: false, open: false, dom: true},
+	"streamChunk": {required: ["Selector", "Chunk"], optional: [], aria: false, open: false, dom: true},
+	"streamEnd": {required: ["Selector"], optional: [], aria: false, open: false, dom: true},
+	"streamStart": {required: ["Selector", "Op", "Field"], optional: [], aria: false, open: true, dom: true},
+	"subscribed": {required: ["Selector", "Events"], optional: ["Refused"], aria: false, open: false, dom: true},
+	"tabNew": {required: ["Selector", "Id"], optional: [], aria: false, open: false, dom: true},
+	"theme": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"toast": {required: ["Selector", "Text"], optional: [], aria: false, open: false, dom: true},
+	"typing": {required: ["Selector", "User"], optional: ["Text"], aria: false, open: false, dom: true},
+	"unread": {required: ["Selector", "Room", "Count"], optional: [], aria: false, open: false, dom: true},
+	"userCSS": {required: ["Selector", "Value"], optional: [], aria: false, open: false, dom: true},
+	"welcome": {required: ["Selector", "Protocol"], optional: ["Resume"], aria: false, open: false, dom: true}
+};
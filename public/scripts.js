@@ -5,29 +5,150 @@
 /* 
 This file contains the websocket functions along with the DomMap that is used inconjunction
 with server-side methods to provide interactive access to client-side html/css.
+The packet format is documented in the protocol package (protocol/protocol.go)
+and the packets the server sends in packets.schema.
 */
 
 var ws
+// Protocol is the protocol version agreed with the server in the welcome
+// packet; servers that don't send one speak version 1.
+var Protocol = 1;
+// ResumeToken, from the welcome packet, gets packets that weren't acknowledged
+// sent again after a reconnect; LastSeq is the highest Seq shown.
+var ResumeToken = "", LastSeq = 0;
 function startSock() {
-	ws = new WebSocket(sockUrl);
+	Protocol = 1;
+	ws = new WebSocket(sockUrl, ["soshell.msgpack", "soshell.json"]);
+	ws.binaryType = "arraybuffer";
 	ws.onopen = function (event) {
 		AppendMsg("#msg-list", "Connected");
 		document.getElementById("msg-txt").focus();
+		SendPacket("hello", {
+			Protocol: "7",
+			Resume: ResumeToken,
+			Session: localStorage.getItem("soshell.session") || "",
+			Device: localStorage.getItem("soshell.device") || "",
+			Notifications: String(!!window.Notification),
+			Clipboard: String(!!(navigator.clipboard && navigator.clipboard.writeText)),
+			Touch: String(window.matchMedia("(pointer: coarse)").matches),
+			Compression: String(typeof DecompressionStream != "undefined"),
+			Download: String("download" in document.createElement("a")),
+			Languages: (navigator.languages || [navigator.language]).join(",")
+		}, "ctl");
+		if (!localStorage.getItem("soshell.visited")) {
+			localStorage.setItem("soshell.visited", "true");
+			SendPacket("firstVisit", {});
+		}
 	};
 	ws.onclose = function(){
+		Streams = {};
 		AppendMsg("#msg-list", "Disconnected");
 		setTimeout(startSock, 3000);
 	};
 	ws.onmessage = function(event) {
-		var obj = JSON.parse(event.data);
+		var obj = typeof event.data == "string" ? JSON.parse(event.data) : Unpack(new Uint8Array(event.data));
+		if (obj && obj.Seq) {
+			var seq = parseInt(obj.Seq, 10);
+			SendPacket("ack", {Seq: obj.Seq}, "ctl");
+			if (seq <= LastSeq) {
+				return;
+			}
+			LastSeq = seq;
+		}
 		if (obj && obj["Type"]) {
-			if (DomMap[obj["Type"]]) {
-				RunDom(obj);
+			var handler = Channels[obj.Chan || ""];
+			if (handler) {
+				handler(obj);
 			}
 		}
 	};
 }
 startSock();
+// Unpack decodes a packet sent as MessagePack, which only holds maps and
+// strings.
+function Unpack(buf) {
+	var pos = 0, utf8 = new TextDecoder();
+	function uint(n) {
+		var v = 0;
+		for (var i = 0; i < n; i++) {
+			v = v * 256 + buf[pos++];
+		}
+		return v;
+	}
+	function str(n) {
+		var s = utf8.decode(buf.subarray(pos, pos + n));
+		pos += n;
+		return s;
+	}
+	function map(n) {
+		var m = {};
+		for (var i = 0; i < n; i++) {
+			var k = value();
+			m[k] = value();
+		}
+		return m;
+	}
+	function value() {
+		var b = buf[pos++];
+		if ((b & 0xe0) == 0xa0) {
+			return str(b & 0x1f);
+		}
+		if ((b & 0xf0) == 0x80) {
+			return map(b & 0x0f);
+		}
+		switch (b) {
+		case 0xc0: return null;
+		case 0xd9: return str(uint(1));
+		case 0xda: return str(uint(2));
+		case 0xdb: return str(uint(4));
+		case 0xde: return map(uint(2));
+		case 0xdf: return map(uint(4));
+		}
+		throw new Error("unsupported MessagePack type " + b);
+	}
+	return value();
+}
+// Paging is set while paged output waits behind a --more-- prompt.
+var Paging = false;
+// The arrow keys recall earlier commands from the server side history and tab
+// completes the command line. At a --more-- prompt Enter or space in the empty
+// command box shows the next page and q or Escape drops the rest.
+document.addEventListener("keydown", function(event) {
+	var input = event.target;
+	if (input.id != "msg-txt" || input.type == "password" || !ws || ws.readyState != WebSocket.OPEN) {
+		return;
+	}
+	if (Paging && input.value.length == 0 && (event.key == "Enter" || event.key == " ")) {
+		event.preventDefault();
+		SendPacket("pageNext", {});
+	} else if (Paging && input.value.length == 0 && (event.key == "q" || event.key == "Escape")) {
+		event.preventDefault();
+		SendPacket("pageQuit", {});
+	} else if (event.key == "Tab" && input.value.length > 0) {
+		event.preventDefault();
+		SendPacket("complete", {Line: input.value});
+	} else if (event.key == "ArrowUp" || event.key == "ArrowDown") {
+		event.preventDefault();
+		SendPacket("recall", {Dir: event.key == "ArrowUp" ? "up" : "down"});
+	}
+});
+// Typing in the command box sends the first word in a typing packet, at most
+// every TypingEvery ms, so the server can tell the room (see typing.go). Lines
+// starting with / are commands and aren't sent.
+var TypingEvery = 2000;
+var LastTyping = 0;
+document.addEventListener("input", function(event) {
+	var input = event.target;
+	if (input.id != "msg-txt" || input.type == "password" || !ws || ws.readyState != WebSocket.OPEN) {
+		return;
+	}
+	var word = input.value.trim().split(/\s+/)[0];
+	if (!word || word[0] == "/" || Date.now() - LastTyping < TypingEvery) {
+		return;
+	}
+	LastTyping = Date.now();
+	SendPacket("typing", {Word: word});
+});
 function AppendMsg(selector, text) {
 	var obj = {};
 	obj["Type"] = "appendElement";
@@ -45,6 +166,101 @@ function Send() {
 	elem.value = "";
 	return false
 }
+// SendPacket sends a packet on channel chan, the terminal if not given, and
+// returns its Id, which error packets about it carry in Request.
+var Requests = 0;
+function SendPacket(type, data, chan) {
+	var id = "r" + (++Requests);
+	ws.send(JSON.stringify({Type: type, Id: id, Chan: chan, Data: data}));
+	return id;
+}
+// Channels holds the handlers of the streams sharing the socket, keyed by
+// the Chan of their packets; the terminal has none. Packets on channels
+// without a handler are dropped.
+var Channels = {};
+function RunKnown(obj) {
+	if (CheckPacket(obj) && DomMap[obj.Type]) {
+		RunDom(obj);
+	}
+}
+// CheckPacket reports whether obj is a packet described in packets.schema
+// (see packets.js) with every field it must have, logging what's wrong
+// otherwise. Fields the schema doesn't know are logged but let through.
+function CheckPacket(obj) {
+	var s = PacketSchema[obj.Type];
+	if (!s) {
+		console.error("soshell: unknown packet " + obj.Type);
+		return false;
+	}
+	var d = obj.Data || {};
+	for (var i = 0; i < s.required.length; i++) {
+		if (!(s.required[i] in d)) {
+			console.error("soshell: " + obj.Type + " packet without " + s.required[i]);
+			return false;
+		}
+	}
+	if (!s.open) {
+		for (var k in d) {
+			if (s.required.indexOf(k) < 0 && s.optional.indexOf(k) < 0 && !(s.aria && k.indexOf("aria-") == 0)) {
+				console.error("soshell: " + obj.Type + " packet with unknown field " + k);
+			}
+		}
+	}
+	return true;
+}
+// Every DOM op in the schema needs a DomMap handler and every handler a
+// schema entry, or the page and the server have drifted apart.
+window.addEventListener("load", function() {
+	for (var t in PacketSchema) {
+		if (PacketSchema[t].dom && !DomMap[t]) {
+			console.error("soshell: no DomMap handler for " + t + " packets");
+		}
+	}
+	for (var t in DomMap) {
+		if (!PacketSchema[t]) {
+			console.error("soshell: DomMap handler for " + t + " packets isn't in packets.schema");
+		}
+	}
+});
+Channels[""] = RunKnown;
+Channels["ctl"] = RunKnown;
+Channels["chat"] = RunKnown;
+Channels["file"] = RunKnown;
+// Subscriptions holds the callbacks of the server events subscribed to with
+// Subscribe, by event name. Events are also dispatched on the document as
+// "soshell:" plus the name, with the packet's data in detail.
+var Subscriptions = {};
+function Subscribe(events, fn) {
+	events.forEach(function (e) {
+		(Subscriptions[e] = Subscriptions[e] || []).push(fn);
+	});
+	SendPacket("subscribe", {Events: events.join(",")}, "ctl");
+}
+function Unsubscribe(events) {
+	events.forEach(function (e) {
+		delete Subscriptions[e];
+	});
+	SendPacket("unsubscribe", {Events: events.join(",")}, "ctl");
+}
+Channels["event"] = function (obj) {
+	var d = obj.Data, fns = [];
+	[d.Event, d.Event + "#" + d.room, "*"].forEach(function (e) {
+		fns = fns.concat(Subscriptions[e] || []);
+	});
+	fns.forEach(function (fn) {
+		fn(d);
+	});
+	document.dispatchEvent(new CustomEvent("soshell:" + d.Event, {detail: d}));
+};
+// Reply answers the query packet obj with value, as a reply packet or, to
+// version 1 servers, as a bare frame.
+function Reply(obj, value) {
+	if (Protocol < 2) {
+		ws.send(value);
+	} else {
+		ws.send(JSON.stringify({Type: "reply", Id: obj.Id, Chan: "ctl", Data: {Value: value}}));
+	}
+}
 var OnClick = {};
 OnClick["removeDecoration"] = function (obj) {
 	obj.onclick = function() {
@@ -59,7 +275,44 @@ function RunDom(obj) {
 		}
 	}
 }
+// SetAria copies the Role and aria-* fields of a packet onto node.
+function SetAria(node, data) {
+	if (data.Role) {
+		node.setAttribute("role", data.Role);
+	}
+	for (var k in data) {
+		if (k.indexOf("aria-") == 0) {
+			node.setAttribute(k, data[k]);
+		}
+	}
+}
+// Announce reads text out to screen readers through a hidden live region.
+function Announce(text, urgent) {
+	var region = document.getElementById(urgent ? "announce-urgent" : "announce");
+	if (region) {
+		region.textContent = "";
+		setTimeout(function() {
+			region.textContent = text;
+		}, 50);
+	}
+}
+// FocusInput returns keyboard focus to the command line, e.g. after an
+// overlay closes, so keyboard users never lose their place.
+function FocusInput() {
+	var input = document.getElementById("msg-txt");
+	if (input) {
+		input.focus();
+	}
+}
 var DomMap = {};
+DomMap["announce"] = function (elem, obj) {
+	Announce(obj.Data.Text, obj.Data.Urgent == "true");
+}
+DomMap["setAria"] = function (elem, obj) {
+	if (elem) {
+		SetAria(elem, obj.Data);
+	}
+}
 DomMap["appendElement"] = function (elem, obj) {
 	if (obj.Data.Element) {
 		var node = document.createElement(obj.Data.Element);
@@ -85,6 +338,10 @@ DomMap["appendElement"] = function (elem, obj) {
 		if (obj.Data.Target) {
 			node.target = obj.Data.Target;
 		}
+		if (obj.Data.Alt) {
+			node.alt = obj.Data.Alt;
+		}
+		SetAria(node, obj.Data);
 		if (obj.Data.OnClick && OnClick[obj.Data.OnClick]) {
 			OnClick[obj.Data.OnClick](node);
 		}
@@ -125,25 +382,75 @@ DomMap["setAttribute"] = function (elem, obj) {
 		elem.setAttribute(obj.Data.Attribute, obj.Data.Value);
 	}
 }
+DomMap["welcome"] = function (elem, obj) {
+	Protocol = parseInt(obj.Data.Protocol, 10) || 1;
+	if (obj.Data.Resume != ResumeToken) {
+		ResumeToken = obj.Data.Resume || "";
+		LastSeq = 0;
+	}
+	var events = Object.keys(Subscriptions);
+	if (events.length > 0) {
+		SendPacket("subscribe", {Events: events.join(",")}, "ctl");
+	}
+}
+// The session packet holds the token that logs this browser back in on
+// reconnect; an empty one means it was revoked or the user logged out.
+DomMap["session"] = function (elem, obj) {
+	if (obj.Data.Token) {
+		localStorage.setItem("soshell.session", obj.Data.Token);
+	} else {
+		localStorage.removeItem("soshell.session");
+	}
+}
+// The device packet holds the token that lets this browser skip 2FA when
+// logging in.
+DomMap["device"] = function (elem, obj) {
+	if (obj.Data.Token) {
+		localStorage.setItem("soshell.device", obj.Data.Token);
+	} else {
+		localStorage.removeItem("soshell.device");
+	}
+}
+// Failures are shown apart from normal output and dispatched on the document
+// as "soshell:error", with the Code, Message and the Id of the failed
+// request, as returned by SendPacket, in detail.
+DomMap["error"] = function (elem, obj) {
+	var node = document.createElement("div");
+	node.className = "msg error";
+	node.setAttribute("role", "alert");
+	node.setAttribute("data-code", obj.Data.Code);
+	node.appendChild(document.createTextNode(obj.Data.Message));
+	elem.appendChild(node);
+	elem.scrollTop = elem.scrollHeight;
+	document.dispatchEvent(new CustomEvent("soshell:error", {detail: obj.Data}));
+}
+DomMap["subscribed"] = function (elem, obj) {
+	if (obj.Data.Refused) {
+		console.warn("soshell: not allowed to subscribe to " + obj.Data.Refused);
+	}
+}
+DomMap["pager"] = function (elem, obj) {
+	Paging = obj.Data.Active == "true";
+}
+DomMap["inputValue"] = function (elem, obj) {
+	elem.value = obj.Data.Value || "";
+	elem.setSelectionRange(elem.value.length, elem.value.length);
+}
 DomMap["getAttribute"] = function (elem, obj) {
 	if (obj.Data.Attribute) {
-		ws.send(elem.getAttribute(obj.Data.Attribute));
+		Reply(obj, elem.getAttribute(obj.Data.Attribute) || "");
 	}
 }
 DomMap["getProperty"] = function (elem, obj) {
 	if (obj.Data.Property) {
-		ws.send(window.getComputedStyle(elem,null).getPropertyValue(obj.Data.Property));
+		Reply(obj, window.getComputedStyle(elem,null).getPropertyValue(obj.Data.Property));
 	}
 }
 DomMap["exists"] = function (elem, obj) {
-	if (elem) { 
-		ws.send("true")
-	} else {
-		ws.send("false")
-	}
+	Reply(obj, elem ? "true" : "false");
 }
 DomMap["getHTML"] = function (elem, obj) {
-	ws.send(elem.innerHTML);
+	Reply(obj, elem.innerHTML);
 }
 DomMap["background"] = function (elem, obj) {
 	if (obj.Data.Value) {
@@ -169,4 +476,469 @@ DomMap["border-color"] = function (elem, obj) {
 	if (obj.Data.Value) {
 		elem.style.borderColor = obj.Data.Value;
 	}
-}
\ No newline at end of file
+}
+DomMap["toast"] = function (elem, obj) {
+	if (obj.Data.Text) {
+		var node = document.createElement("div");
+		node.className = "toast";
+		node.setAttribute("role", "alert");
+		node.appendChild(document.createTextNode(obj.Data.Text));
+		elem.appendChild(node);
+		setTimeout(function() {
+			elem.removeChild(node);
+		}, 5000);
+	}
+}
+// appendRich shows a chat message: Prefix as text, then HTML, which the server
+// built from the message escaped (see rich.go).
+DomMap["appendRich"] = function (elem, obj) {
+	var node = document.createElement("div");
+	node.className = obj.Data.Class || "msg";
+	if (obj.Data.Prefix) {
+		node.appendChild(document.createTextNode(obj.Data.Prefix));
+	}
+	var body = document.createElement("span");
+	body.className = "rich";
+	body.innerHTML = obj.Data.HTML;
+	node.appendChild(body);
+	elem.appendChild(node);
+	elem.scrollTop = elem.scrollHeight;
+}
+DomMap["mention"] = function (elem, obj) {
+	var node = document.createElement("div");
+	node.className = "msg mention";
+	node.appendChild(document.createTextNode("#" + obj.Data.Room + " [" + obj.Data.From + "] " + obj.Data.Text));
+	elem.appendChild(node);
+	elem.scrollTop = elem.scrollHeight;
+}
+// Typers holds the users typing in the room, with the text shown for them and
+// the timer that forgets them unless the server says they're still at it.
+var Typers = {};
+DomMap["typing"] = function (elem, obj) {
+	var user = obj.Data.User;
+	if (Typers[user]) {
+		clearTimeout(Typers[user].timer);
+		delete Typers[user];
+	}
+	if (obj.Data.Text) {
+		Typers[user] = {text: obj.Data.Text, timer: setTimeout(function() {
+			delete Typers[user];
+			ShowTypers(elem);
+		}, 6000)};
+	}
+	ShowTypers(elem);
+}
+function ShowTypers(elem) {
+	elem.textContent = Object.keys(Typers).sort().map(function(user) {
+		return Typers[user].text;
+	}).join(" ");
+}
+// Unread holds the unread counts of the rooms the user is in but not
+// talking in, from unread packets; clicking a room joins it.
+var Unread = {};
+DomMap["unread"] = function (elem, obj) {
+	var count = parseInt(obj.Data.Count, 10);
+	if (count > 0) {
+		Unread[obj.Data.Room] = count;
+	} else {
+		delete Unread[obj.Data.Room];
+	}
+	elem.textContent = "";
+	Object.keys(Unread).sort().forEach(function(room) {
+		var link = document.createElement("a");
+		link.href = "#";
+		link.className = "unread";
+		link.textContent = "#" + room + " (" + Unread[room] + ")";
+		link.onclick = function() {
+			ws.send("join #" + room);
+			return false;
+		};
+		elem.appendChild(link);
+	});
+}
+DomMap["notify"] = function (elem, obj) {
+	if (!window.Notification) {
+		DomMap["toast"](elem, obj);
+		return;
+	}
+	var show = function() {
+		if (Notification.permission === "granted") {
+			new Notification(obj.Data.Title || "", {body: obj.Data.Text});
+		} else {
+			DomMap["toast"](elem, obj);
+		}
+	};
+	if (Notification.permission === "default") {
+		Notification.requestPermission(show);
+	} else {
+		show();
+	}
+}
+DomMap["theme"] = function (elem, obj) {
+	SetTheme(obj.Data.Value);
+	localStorage.setItem("soshell.theme", obj.Data.Value);
+}
+function SetTheme(name) {
+	var classes = document.body.className.split(" ").filter(function(c) {
+		return c && c.indexOf("theme-") != 0;
+	});
+	if (name && name != "dark") {
+		classes.push("theme-" + name);
+	}
+	document.body.className = classes.join(" ");
+}
+window.addEventListener("load", function() {
+	SetTheme(localStorage.getItem("soshell.theme"));
+});
+// The pane manager (see pane.go) moves #msg-list into the first tab the first
+// time a pane or tab is created.
+function PaneInit() {
+	if (document.getElementById("panes")) {
+		return;
+	}
+	var list = document.getElementById("msg-list");
+	var panes = document.createElement("div");
+	panes.id = "panes";
+	var bar = document.createElement("div");
+	bar.id = "tab-bar";
+	panes.appendChild(bar);
+	list.parentNode.insertBefore(panes, list);
+	PaneTab(list);
+	PaneFocus(list);
+}
+function PaneTab(pane) {
+	var tab = document.createElement("div");
+	tab.className = "tab";
+	var button = document.createElement("button");
+	button.className = "tab-button";
+	button.onclick = function() {
+		var first = tab.querySelector(".pane");
+		PaneFocus(first);
+		SendPacket("paneFocus", {Id: first.id});
+	};
+	tab.button = button;
+	document.getElementById("tab-bar").appendChild(button);
+	document.getElementById("panes").appendChild(tab);
+	PaneAdd(tab, pane);
+	PaneNumber();
+	return tab;
+}
+function PaneAdd(tab, pane) {
+	pane.classList.add("pane");
+	pane.onclick = function() {
+		if (!pane.classList.contains("focused")) {
+			PaneFocus(pane);
+			SendPacket("paneFocus", {Id: pane.id});
+		}
+	};
+	tab.appendChild(pane);
+}
+function PaneNew(id) {
+	var pane = document.createElement("div");
+	pane.id = id;
+	pane.setAttribute("role", "log");
+	pane.setAttribute("aria-live", "polite");
+	pane.setAttribute("aria-label", "Pane " + id.replace("pane-", ""));
+	return pane;
+}
+function PaneNumber() {
+	var buttons = document.querySelectorAll("#tab-bar .tab-button");
+	for (var i = 0; i < buttons.length; i++) {
+		buttons[i].textContent = i + 1;
+	}
+}
+function PaneFocus(pane) {
+	var tabs = document.querySelectorAll("#panes .tab");
+	for (var i = 0; i < tabs.length; i++) {
+		var shown = tabs[i] == pane.parentNode;
+		tabs[i].style.display = shown ? "" : "none";
+		tabs[i].button.className = shown ? "tab-button active" : "tab-button";
+	}
+	var focused = document.querySelectorAll("#panes .pane.focused");
+	for (var i = 0; i < focused.length; i++) {
+		focused[i].classList.remove("focused");
+	}
+	pane.classList.add("focused");
+	FocusInput();
+}
+DomMap["paneNew"] = function (elem, obj) {
+	PaneInit();
+	var tab = document.querySelector("#panes .pane.focused").parentNode;
+	if (obj.Data.Value == "h") {
+		tab.classList.add("h");
+	}
+	var pane = PaneNew(obj.Data.Id);
+	PaneAdd(tab, pane);
+	PaneFocus(pane);
+}
+DomMap["tabNew"] = function (elem, obj) {
+	PaneInit();
+	var pane = PaneNew(obj.Data.Id);
+	PaneTab(pane);
+	PaneFocus(pane);
+}
+DomMap["paneFocus"] = function (elem, obj) {
+	var pane = document.getElementById(obj.Data.Id);
+	if (pane && document.getElementById("panes")) {
+		PaneFocus(pane);
+	}
+}
+DomMap["paneClose"] = function (elem, obj) {
+	var pane = document.getElementById(obj.Data.Id);
+	if (pane && pane.id != "msg-list") {
+		var tab = pane.parentNode;
+		tab.removeChild(pane);
+		if (!tab.querySelector(".pane")) {
+			tab.button.parentNode.removeChild(tab.button);
+			tab.parentNode.removeChild(tab);
+			PaneNumber();
+		}
+	}
+}
+DomMap["userCSS"] = function (elem, obj) {
+	var style = document.getElementById("user-css");
+	if (!style) {
+		style = document.createElement("style");
+		style.id = "user-css";
+		elem.appendChild(style);
+	}
+	style.textContent = obj.Data.Value || "";
+}
+DomMap["mobile"] = function (elem, obj) {
+	document.body.classList.add("mobile");
+}
+// The command palette is a strip of buttons that fill in the command line.
+DomMap["palette"] = function (elem, obj) {
+	var old = document.getElementById("palette");
+	if (old) {
+		old.parentNode.removeChild(old);
+	}
+	document.body.classList.toggle("with-palette", !!obj.Data.Commands);
+	if (!obj.Data.Commands) {
+		return;
+	}
+	var bar = document.createElement("div");
+	bar.id = "palette";
+	bar.setAttribute("role", "toolbar");
+	bar.setAttribute("aria-label", "Commands");
+	obj.Data.Commands.split(" ").forEach(function(name) {
+		var button = document.createElement("button");
+		button.type = "button";
+		button.textContent = name;
+		button.onclick = function() {
+			var input = document.getElementById("msg-txt");
+			input.value = name + " ";
+			input.focus();
+		};
+		bar.appendChild(button);
+	});
+	elem.appendChild(bar);
+}
+DomMap["inputHint"] = function (elem, obj) {
+	elem.setAttribute("inputmode", obj.Data.Value || "text");
+	elem.setAttribute("enterkeyhint", "send");
+	if (document.body.classList.contains("mobile")) {
+		elem.focus();
+		elem.scrollIntoView(false);
+	}
+}
+// Streams holds the packets being streamed, by Id, until their streamEnd.
+var Streams = {};
+DomMap["streamStart"] = function (elem, obj) {
+	Streams[obj.Id] = {packet: obj, chunks: []};
+}
+DomMap["streamChunk"] = function (elem, obj) {
+	var s = Streams[obj.Id];
+	if (s) {
+		s.chunks.push(obj.Data.Chunk || "");
+	}
+}
+DomMap["streamEnd"] = function (elem, obj) {
+	var s = Streams[obj.Id];
+	delete Streams[obj.Id];
+	if (s) {
+		var p = s.packet;
+		p.Type = p.Data.Op;
+		p.Data[p.Data.Field] = s.chunks.join("");
+		delete p.Id;
+		delete p.Data.Op;
+		delete p.Data.Field;
+		RunKnown(p);
+	}
+}
+DomMap["download"] = function (elem, obj) {
+	var bin = atob(obj.Data.Content || "");
+	var bytes = new Uint8Array(bin.length);
+	for (var i = 0; i < bin.length; i++) {
+		bytes[i] = bin.charCodeAt(i);
+	}
+	var url = URL.createObjectURL(new Blob([bytes], {type: obj.Data.Mime || "application/octet-stream"}));
+	var a = document.createElement("a");
+	a.href = url;
+	a.download = obj.Data.Name || "download";
+	elem.appendChild(a);
+	a.click();
+	elem.removeChild(a);
+	setTimeout(function() {
+		URL.revokeObjectURL(url);
+	}, 1000);
+}
+// Editors holds the state of each open shared editor, keyed by session id.
+// Local changes are sent one op at a time; remote ops are transformed against
+// the unacknowledged ones (see edit.go for the server half).
+var Editors = {};
+function EditTransform(a, b, aFirst) {
+	var as = a.Pos, ae = a.Pos + a.Del;
+	var bs = b.Pos, be = b.Pos + b.Del, bl = b.Ins.length;
+	var r = {Pos: a.Pos, Del: a.Del, Ins: a.Ins};
+	if (as == bs && a.Del == 0 && b.Del == 0) {
+		if (!aFirst) {
+			r.Pos += bl;
+		}
+	} else if (ae <= bs) {
+		// a is entirely before b
+	} else if (as >= be) {
+		r.Pos += bl - b.Del;
+	} else if (as == bs && ae == be) {
+		if (aFirst) {
+			r.Del = bl;
+		} else {
+			r = {Pos: bs + bl, Del: 0, Ins: ""};
+		}
+	} else if (as <= bs && be <= ae) {
+		r.Del += bl - b.Del;
+	} else if (bs <= as && ae <= be) {
+		r = {Pos: bs + bl, Del: 0, Ins: ""};
+	} else if (as < bs) {
+		r.Del = bs - as;
+	} else {
+		r = {Pos: bs + bl, Del: ae - be, Ins: a.Ins};
+	}
+	return r;
+}
+function EditFlush(ed) {
+	if (!ed.inflight && ed.pending.length > 0) {
+		ed.inflight = ed.pending.shift();
+		SendPacket("editOp", {Id: ed.id, Base: String(ed.rev), Pos: String(ed.inflight.Pos),
+			Del: String(ed.inflight.Del), Ins: ed.inflight.Ins});
+	}
+}
+function EditLocal(ed) {
+	var a = ed.text, b = ed.area.value;
+	var start = 0;
+	while (start < a.length && start < b.length && a[start] == b[start]) {
+		start++;
+	}
+	var ea = a.length, eb = b.length;
+	while (ea > start && eb > start && a[ea - 1] == b[eb - 1]) {
+		ea--;
+		eb--;
+	}
+	if (ea == start && eb == start) {
+		return;
+	}
+	ed.pending.push({Pos: start, Del: ea - start, Ins: b.substring(start, eb)});
+	ed.text = b;
+	EditFlush(ed);
+}
+// EditCheck asks for the whole document again if, with nothing left to
+// send, the local text length no longer matches the server's.
+function EditCheck(ed, obj) {
+	if (!ed.inflight && ed.pending.length == 0 && ed.text.length != parseInt(obj.Data.Len, 10)) {
+		SendPacket("editOp", {Id: ed.id, Base: "-1"});
+	}
+}
+DomMap["editor"] = function (elem, obj) {
+	var ed = Editors[obj.Data.Id];
+	if (!ed) {
+		var pane = document.createElement("div");
+		pane.className = "editor";
+		pane.setAttribute("role", "dialog");
+		pane.setAttribute("aria-label", "Editing " + obj.Data.Title);
+		var title = document.createElement("div");
+		title.className = "editor-title";
+		title.appendChild(document.createTextNode(obj.Data.Title));
+		var area = document.createElement("textarea");
+		var save = document.createElement("button");
+		save.appendChild(document.createTextNode("save"));
+		var close = document.createElement("button");
+		close.appendChild(document.createTextNode("close"));
+		pane.appendChild(title);
+		pane.appendChild(area);
+		pane.appendChild(save);
+		pane.appendChild(close);
+		area.setAttribute("aria-label", obj.Data.Title);
+		elem.appendChild(pane);
+		area.focus();
+		pane.onkeydown = function(event) {
+			if (event.key == "Escape") {
+				SendPacket("editClose", {Id: ed.id});
+			}
+		};
+		ed = {id: obj.Data.Id, pane: pane, area: area};
+		Editors[ed.id] = ed;
+		area.oninput = function() {
+			EditLocal(ed);
+		};
+		save.onclick = function() {
+			SendPacket("editSave", {Id: ed.id});
+		};
+		close.onclick = function() {
+			SendPacket("editClose", {Id: ed.id});
+		};
+	}
+	// A (re)sent document resets all local state.
+	ed.author = obj.Data.Author;
+	ed.rev = parseInt(obj.Data.Rev, 10);
+	ed.text = obj.Data.Text || "";
+	ed.area.value = ed.text;
+	ed.inflight = null;
+	ed.pending = [];
+	ed.area.focus();
+}
+DomMap["editOp"] = function (elem, obj) {
+	var ed = Editors[obj.Data.Id];
+	if (!ed) {
+		return;
+	}
+	ed.rev = parseInt(obj.Data.Rev, 10);
+	if (obj.Data.Author == ed.author) {
+		ed.inflight = null;
+		EditCheck(ed, obj);
+		EditFlush(ed);
+		return;
+	}
+	var op = {Pos: parseInt(obj.Data.Pos, 10), Del: parseInt(obj.Data.Del, 10), Ins: obj.Data.Ins || ""};
+	var queue = ed.inflight ? [ed.inflight].concat(ed.pending) : ed.pending;
+	for (var i = 0; i < queue.length; i++) {
+		var p = queue[i];
+		queue[i] = EditTransform(p, op, false);
+		op = EditTransform(op, p, true);
+	}
+	if (ed.inflight) {
+		ed.inflight = queue.shift();
+	}
+	ed.pending = queue;
+	var start = ed.area.selectionStart, end = ed.area.selectionEnd;
+	var shift = function(n) {
+		if (n <= op.Pos) {
+			return n;
+		}
+		if (n >= op.Pos + op.Del) {
+			return n + op.Ins.length - op.Del;
+		}
+		return op.Pos + op.Ins.length;
+	};
+	ed.text = ed.text.substring(0, op.Pos) + op.Ins + ed.text.substring(op.Pos + op.Del);
+	ed.area.value = ed.text;
+	ed.area.setSelectionRange(shift(start), shift(end));
+	EditCheck(ed, obj);
+}
+DomMap["editClose"] = function (elem, obj) {
+	var ed = Editors[obj.Data.Id];
+	if (ed) {
+		ed.pane.parentNode.removeChild(ed.pane);
+		delete Editors[obj.Data.Id];
+		FocusInput();
+	}
+}
@@ -0,0 +1,44 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"encoding/base64"
+	"rsc.io/qr"
+	"strings"
+	"time"
+)
+
+// qrDataURI encodes text as a QR code and returns it as a PNG data URI.
+func qrDataURI(text string) (string, error) {
+	code, e := qr.Encode(text, qr.M)
+	if e != nil {
+		return "", e
+	}
+	code.Scale = 6
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()), nil
+}
+
+func init() {
+	cmdMap["qr"] = command{
+		Desc:     "Shows a QR code for the text.",
+		Usage:    "qr <text|url>",
+		Category: "Tools",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: qr <text|url>")
+			}
+			text := strings.Join(args[1:], " ")
+			src, err := qrDataURI(text)
+			if err != nil {
+				return c.appendMsg("#msg-list", "qr: "+err.Error())
+			}
+			return c.appendImage("#msg-list", src, text)
+		},
+		Background: true,
+		Cooldown:   2 * time.Second,
+	}
+}
@@ -0,0 +1,84 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The rate limiter is a keyed token bucket. Each key (usually a client address
+or user name) gets its own bucket that refills at a fixed rate up to a burst
+size; every allowed action takes one token. Buckets that have filled up again
+are no different from new ones, so they're dropped now and then.
+*/
+
+//
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64
+	buckets map[string]*bucket
+	pruned  time.Time // when full buckets were last dropped
+}
+
+const prunePeriod = time.Minute
+
+// newRateLimiter returns a limiter allowing n actions per period per key,
+// with bursts of up to n.
+func newRateLimiter(n int, period time.Duration) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(n) / period.Seconds(),
+		burst:   float64(n),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from key's bucket and reports whether one was available.
+func (rl *rateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rl.pruned) > prunePeriod {
+		rl.prune(now)
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	return b.take(now, rl.rate, rl.burst)
+}
+
+// prune drops the buckets that are full again. Callers must hold the lock.
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.pruned = now
+}
+
+// take refills b at rate up to burst, then takes a token and reports whether
+// one was available.
+func (b *bucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
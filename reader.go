@@ -0,0 +1,163 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Reading. A single goroutine per connection, reader, reads everything the page
+sends and hands each message to whoever is waiting for it:
+
+	reply packets         the query with the same Id
+	typed input           the oldest prompt waiting for input, if any
+	everything else       the listener, through the inbox
+
+so commands running in the background can query the page and prompt just like
+those run by the listener, without reads racing each other. The listener
+falling more than inboxMax messages behind the page disconnects it.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/jmptrader/soshell/protocol"
+	"strconv"
+)
+
+const inboxMax = 256
+
+var errNotConnected = errors.New("not connected")
+
+// startReader starts c's reader.
+func (c *client) startReader() {
+	c.ws.SetReadLimit(*maxFrame)
+	c.inbox = make(chan []byte, inboxMax)
+	c.gone = make(chan struct{})
+	go c.reader()
+}
+
+// reader reads c's websocket until it fails.
+func (c *client) reader() {
+	defer close(c.gone)
+	defer close(c.inbox)
+	for {
+		t, b, e := c.ws.ReadMessage()
+		if e != nil {
+			c.readErr = e
+			return
+		}
+		if t != websocket.TextMessage || c.route(b) {
+			continue
+		}
+		select {
+		case c.inbox <- b:
+		default:
+			c.readErr = errors.New("too much input")
+			c.wmu.Lock()
+			c.ws.Close()
+			c.wmu.Unlock()
+			return
+		}
+	}
+}
+
+// route passes b to the query or prompt waiting for it and reports whether
+// there was one. Replies nobody waits for any more are dropped, and lines
+// typed on a locked terminal go to the listener, see idle.go.
+func (c *client) route(b []byte) bool {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if p, err := protocol.Unmarshal(b); err == nil {
+		if p.Type != "reply" {
+			return false
+		}
+		if ch, ok := c.pending[p.Id]; ok {
+			ch <- p.Data["Value"]
+			delete(c.pending, p.Id)
+		}
+		return true
+	}
+	if len(c.waiting) == 0 || c.isLocked() {
+		return false
+	}
+	c.waiting[0] <- b
+	c.waiting = c.waiting[1:]
+	return true
+}
+
+// recieve returns the next message for the listener.
+func (c *client) recieve() ([]byte, error) {
+	if c.inbox == nil {
+		return nil, errNotConnected
+	}
+	b, ok := <-c.inbox
+	if !ok {
+		return nil, c.readErr
+	}
+	return b, nil
+}
+
+// input returns the next line typed, or for version 1 clients (see caps.go)
+// the next answer to a query.
+func (c *client) input() ([]byte, error) {
+	if c.inbox == nil {
+		return nil, errNotConnected
+	}
+	ch := make(chan []byte, 1)
+	c.rmu.Lock()
+	if c.isLocked() {
+		c.rmu.Unlock()
+		return nil, errLocked
+	}
+	c.waiting = append(c.waiting, ch)
+	c.rmu.Unlock()
+	select {
+	case b, ok := <-ch:
+		if !ok {
+			return nil, errLocked
+		}
+		return b, nil
+	case <-c.gone:
+		return nil, c.readErr
+	}
+}
+
+// query sends p with a new Id and returns the Value of the client's reply
+// with the same Id. Several queries may be in flight at once, from any
+// goroutine.
+func (c *client) query(p packet) (string, error) {
+	if c.inbox == nil {
+		return "", errNotConnected
+	}
+	if c.protocol() < 2 {
+		if e := c.send(p); e != nil {
+			return "", e
+		}
+		b, e := c.input()
+		return string(b), e
+	}
+	ch := make(chan string, 1)
+	c.rmu.Lock()
+	c.lastID++
+	p.Id = strconv.FormatUint(c.lastID, 10)
+	if c.pending == nil {
+		c.pending = make(map[string]chan string)
+	}
+	c.pending[p.Id] = ch
+	c.rmu.Unlock()
+	defer func() {
+		c.rmu.Lock()
+		delete(c.pending, p.Id)
+		c.rmu.Unlock()
+	}()
+	if e := c.send(p); e != nil {
+		return "", e
+	}
+	select {
+	case s := <-ch:
+		return s, nil
+	case <-c.gone:
+		return "", c.readErr
+	}
+}
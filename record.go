@@ -0,0 +1,317 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Session recording keeps the packet stream of a session so support can see
+exactly what a user saw. Users opt in with record on; admin sessions are
+always recorded. Every packet sent to the client and every command typed is
+written with its time offset to work/sessions/<id>.log. Answers to prompts
+(passwords in particular) are never recorded, nor are control packets, which
+carry login tokens, or output sent off the record, like new API keys and 2FA
+secrets.
+
+Admins play a session back with replay <id> [speed]: the messages it showed
+are re-rendered into a box in the admin's terminal with the original timing,
+sped up by speed.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	recordMax    int64 = 10 << 20 // bytes per session
+	replayMaxGap       = 5 * time.Second
+	replays            = struct {
+		sync.Mutex
+		stop map[*client]chan bool
+	}{stop: make(map[*client]chan bool)}
+)
+
+// recorder writes a session's packets to disk.
+type recorder struct {
+	sync.Mutex
+	id    string
+	f     *os.File
+	start time.Time
+	size  int64
+}
+
+// recEntry is a line of a recording. Dir is "meta", "out" (packet sent to the
+// client) or "in" (command typed).
+type recEntry struct {
+	T    int64 // milliseconds since the start
+	Dir  string
+	Data json.RawMessage
+}
+
+// sessionsDir is where recordings are kept.
+func sessionsDir() string {
+	return *work + SEP + "sessions"
+}
+
+// write appends an entry to the recording. It stops recording silently once
+// the size limit is reached.
+func (r *recorder) write(dir string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	b, _ := json.Marshal(recEntry{time.Since(r.start).Milliseconds(), dir, data})
+	r.Lock()
+	defer r.Unlock()
+	if r.f == nil || r.size+int64(len(b)) > recordMax {
+		return
+	}
+	n, _ := r.f.Write(append(b, '\n'))
+	r.size += int64(n)
+}
+
+// recordable reports whether v may be written to a recording: control
+// packets, login tokens among them, may not.
+func recordable(v interface{}) bool {
+	p, ok := v.(packet)
+	return !ok || p.Chan != chanCtl && p.Type != "session"
+}
+
+// offRecord runs f, keeping what is sent to c meanwhile out of its
+// recording. Output holding secrets is sent through it.
+func (c *client) offRecord(f func() error) error {
+	c.wmu.Lock()
+	c.offRec++
+	c.wmu.Unlock()
+	defer func() {
+		c.wmu.Lock()
+		c.offRec--
+		c.wmu.Unlock()
+	}()
+	return f()
+}
+
+// close ends the recording.
+func (r *recorder) close() {
+	r.Lock()
+	defer r.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// startRecording starts recording c's session and returns its id. It does
+// nothing if the session is already being recorded.
+func startRecording(c *client) (string, error) {
+	c.wmu.Lock()
+	rec := c.rec
+	c.wmu.Unlock()
+	if rec != nil {
+		return rec.id, nil
+	}
+	if err := os.MkdirAll(sessionsDir(), 0700); err != nil {
+		return "", err
+	}
+	id := randomToken(8)
+	f, err := os.OpenFile(sessionsDir()+SEP+id+".log", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	rec = &recorder{id: id, f: f, start: time.Now()}
+	rec.write("meta", map[string]string{
+		"user": c.user.Name, "address": c.address, "start": rec.start.UTC().Format(time.RFC3339)})
+	c.wmu.Lock()
+	c.rec = rec
+	c.wmu.Unlock()
+	return id, nil
+}
+
+// stopRecording ends the recording of c's session, if any.
+func stopRecording(c *client) {
+	c.wmu.Lock()
+	rec := c.rec
+	c.rec = nil
+	c.wmu.Unlock()
+	if rec != nil {
+		rec.close()
+	}
+}
+
+// recordCommand records a command typed by c.
+func recordCommand(c *client, cmd string) {
+	c.wmu.Lock()
+	rec := c.rec
+	c.wmu.Unlock()
+	if rec != nil {
+		rec.write("in", cmd)
+	}
+}
+
+// readRecording returns the entries of a recording.
+func readRecording(id string) ([]recEntry, error) {
+	if !isName(id) || id == "" {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.Open(sessionsDir() + SEP + id + ".log")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var list []recEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 4<<20)
+	for s.Scan() {
+		var e recEntry
+		if json.Unmarshal(s.Bytes(), &e) == nil {
+			list = append(list, e)
+		}
+	}
+	return list, s.Err()
+}
+
+// replay re-renders a recording into a box in c's terminal.
+func replay(c *client, id string, entries []recEntry, speed float64, stop chan bool) {
+	defer func() {
+		replays.Lock()
+		if replays.stop[c] == stop {
+			delete(replays.stop, c)
+		}
+		replays.Unlock()
+	}()
+	box := "replay-" + id
+	p := AppendElement{Selector: "#msg-list", Element: "div", Id: box, Class: "msg replay", Role: "region",
+		Aria: map[string]string{"label": "Replay of session " + id}, Scroll: true}
+	if c.send(p.packet()) != nil {
+		return
+	}
+	var last int64
+	for _, e := range entries {
+		wait := time.Duration(float64(time.Duration(e.T-last)*time.Millisecond) / speed)
+		if wait > replayMaxGap {
+			wait = replayMaxGap
+		}
+		last = e.T
+		select {
+		case <-stop:
+			c.appendMsg("#"+box, "[replay stopped]")
+			return
+		case <-time.After(wait):
+		}
+		switch e.Dir {
+		case "in":
+			var cmd string
+			json.Unmarshal(e.Data, &cmd)
+			if c.appendMsg("#"+box, "> "+cmd) != nil {
+				return
+			}
+		case "out":
+			var rp packet
+			if json.Unmarshal(e.Data, &rp) != nil || rp.Type != "appendElement" {
+				continue
+			}
+			// Only messages are replayed; other ops would act on the
+			// admin's own page.
+			if sel := rp.Data["Selector"]; sel != "#msg-list" && !strings.HasPrefix(sel, "#pane-") {
+				continue
+			}
+			rp.Data["Selector"] = "#" + box
+			delete(rp.Data, "Id")
+			delete(rp.Data, "OnClick")
+			if c.send(rp) != nil {
+				return
+			}
+		}
+	}
+	c.appendMsg("#"+box, "[end of session "+id+"]")
+}
+
+func init() {
+	cmdMap["record"] = command{
+		Desc:     "Lets support record your session to help with problems you report.",
+		Usage:    "record on|off",
+		Category: "Account",
+		Handler: func(c *client, args []string) (e error) {
+			switch {
+			case len(args) == 2 && args[1] == "on":
+				id, err := startRecording(c)
+				if err != nil {
+					return c.appendMsg("#msg-list", "record: "+err.Error())
+				}
+				return c.appendMsg("#msg-list", "Recording this session as "+id+", mention it when reporting a problem")
+			case len(args) == 2 && args[1] == "off":
+				if isAdmin(&c.user) {
+					return c.appendMsg("#msg-list", "Admin sessions are always recorded")
+				}
+				stopRecording(c)
+				return c.appendMsg("#msg-list", "Recording stopped")
+			}
+			return c.appendMsg("#msg-list", "Usage: record on|off")
+		},
+	}
+	cmdMap["replay"] = command{
+		Desc:     "Lists recorded sessions or plays one back.",
+		Usage:    "replay [<id> [speed]|stop]",
+		Category: "Admin",
+		Role:     roleAdmin,
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) == 1 {
+				files, err := os.ReadDir(sessionsDir())
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				rows := [][]string{{"Id", "Updated", "Size"}}
+				for _, f := range files {
+					info, err := f.Info()
+					if err != nil || !strings.HasSuffix(f.Name(), ".log") {
+						continue
+					}
+					rows = append(rows, []string{strings.TrimSuffix(f.Name(), ".log"),
+						info.ModTime().In(c.user.location()).Format("2006-01-02 15:04"), formatSize(info.Size())})
+				}
+				if len(rows) == 1 {
+					return c.appendMsg("#msg-list", "No recorded sessions")
+				}
+				sort.Slice(rows[1:], func(i, j int) bool { return rows[i+1][1] > rows[j+1][1] })
+				return c.appendPre("#msg-list", formatTable(rows, true))
+			}
+			replays.Lock()
+			running := replays.stop[c]
+			if args[1] == "stop" && running != nil {
+				delete(replays.stop, c)
+				close(running)
+			}
+			replays.Unlock()
+			if args[1] == "stop" {
+				return
+			}
+			if running != nil {
+				return c.appendMsg("#msg-list", "replay: already replaying, replay stop first")
+			}
+			speed := 1.0
+			if len(args) > 2 {
+				if f, err := strconv.ParseFloat(strings.TrimSuffix(args[2], "x"), 64); err == nil && f > 0 {
+					speed = f
+				}
+			}
+			entries, err := readRecording(args[1])
+			if err != nil {
+				return c.appendMsg("#msg-list", "replay: no such session: "+args[1])
+			}
+			stop := make(chan bool)
+			replays.Lock()
+			replays.stop[c] = stop
+			replays.Unlock()
+			go replay(c, args[1], entries, speed, stop)
+			return
+		},
+	}
+}
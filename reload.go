@@ -0,0 +1,94 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Reloading. The reload admin command, or a SIGHUP, drops the commands added by
+Lua scripts and plugins and loads the -scripts and -plugins directories again,
+so new and edited scripts take effect without a restart; connected clients
+stay connected. Go can't unload a plugin, so a plugin is only ever loaded from
+its first build: new plugins are picked up, changed ones need a restart.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	reloadMu sync.Mutex // held during a reload
+	loaded   = struct {
+		sync.Mutex
+		m map[string]string // command name -> script or plugin path
+	}{m: make(map[string]string)}
+)
+
+// trackCommand records that the command name came from the script or plugin
+// at path, so reloading replaces it.
+func trackCommand(name, path string) {
+	loaded.Lock()
+	defer loaded.Unlock()
+	loaded.m[strings.ToLower(name)] = path
+}
+
+// reloadCommands replaces the script and plugin commands with those in the
+// directories now. It returns the number of commands loaded and the scripts
+// and plugins that failed.
+func reloadCommands() (int, []error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	loaded.Lock()
+	old := loaded.m
+	loaded.m = make(map[string]string)
+	loaded.Unlock()
+	cmdMu.Lock()
+	for name := range old {
+		delete(cmdMap, name)
+	}
+	cmdMu.Unlock()
+	errs := append(loadPlugins(), loadScripts()...)
+	loaded.Lock()
+	defer loaded.Unlock()
+	return len(loaded.m), errs
+}
+
+// reloadOnHangup reloads the commands on SIGHUP. It is started once from main.
+func reloadOnHangup() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		n, errs := reloadCommands()
+		log.Println("SIGHUP: reloaded", n, "commands,", len(errs), "errors")
+	}
+}
+
+func init() {
+	cmdMap["reload"] = command{
+		Desc:     "Reloads the commands of Lua scripts and plugins without disconnecting anyone.",
+		Usage:    "reload",
+		Category: "Admin",
+		Role:     roleAdmin,
+		Sudo:     true,
+		Handler: func(c *client, args []string) error {
+			n, errs := reloadCommands()
+			log.Println(c.user.Name, "reloaded", n, "commands")
+			if len(errs) > 0 {
+				var lines []string
+				for _, err := range errs {
+					lines = append(lines, err.Error())
+				}
+				if e := c.appendPre("#msg-list", strings.Join(lines, "\n")); e != nil {
+					return e
+				}
+			}
+			return c.appendMsg("#msg-list", c.trf("Reloaded %d commands, %d scripts or plugins failed", n, len(errs)))
+		},
+	}
+}
@@ -0,0 +1,277 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The remind system lets users schedule reminders for themselves or others.
+Reminders are kept in the work directory so they survive restarts and are
+delivered through the scheduler. Reminders that come due while the recipient
+is offline are delivered the next time they log in.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reminder is a single scheduled reminder.
+type reminder struct {
+	Id       string
+	From, To string
+	Text     string
+	Via      string // chat, toast or push
+	At       time.Time
+	Due      bool // fired while the recipient was offline
+}
+
+var reminders = struct {
+	sync.Mutex
+	list   map[string]*reminder
+	nextId int
+}{list: make(map[string]*reminder)}
+
+var remindDays = regexp.MustCompile(`^(\d+)d`)
+
+// remindersPath is the file reminders are persisted in.
+func remindersPath() string {
+	return *work + SEP + "reminders.json"
+}
+
+// saveReminders writes all reminders to disk. Callers must hold the lock.
+func saveReminders() error {
+	var list []*reminder
+	for _, r := range reminders.list {
+		list = append(list, r)
+	}
+	return saveJSON(list, remindersPath())
+}
+
+// loadReminders reads persisted reminders and schedules them. It is called
+// once from main.
+func loadReminders() {
+	var list []*reminder
+	if e := loadJSON(&list, remindersPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	reminders.Lock()
+	defer reminders.Unlock()
+	for _, r := range list {
+		reminders.list[r.Id] = r
+		if n, _ := strconv.Atoi(r.Id); n >= reminders.nextId {
+			reminders.nextId = n + 1
+		}
+		if !r.Due {
+			scheduleReminder(r)
+		}
+	}
+}
+
+// scheduleReminder arranges for r to fire at r.At.
+func scheduleReminder(r *reminder) {
+	sched.at("remind:"+r.Id, r.At, func() { fireReminder(r.Id) })
+}
+
+// fireReminder delivers a reminder to every connected session of its
+// recipient, or marks it as due when they are offline.
+func fireReminder(id string) {
+	reminders.Lock()
+	defer reminders.Unlock()
+	r, ok := reminders.list[id]
+	if !ok {
+		return
+	}
+	cs := clientsByName(r.To)
+	if len(cs) == 0 {
+		r.Due = true
+	} else {
+		for _, c := range cs {
+			deliverReminder(c, r)
+		}
+		delete(reminders.list, id)
+	}
+	if e := saveReminders(); e != nil {
+		log.Println(e)
+	}
+}
+
+// deliverReminder sends r to c using its delivery method.
+func deliverReminder(c *client, r *reminder) {
+	text := "Reminder: " + r.Text
+	if !strings.EqualFold(r.From, r.To) {
+		text = "Reminder from " + r.From + ": " + r.Text
+	}
+	var e error
+	switch r.Via {
+	case "toast":
+		e = c.toast(text)
+	case "push":
+		e = c.notify("soshell", text)
+	}
+	if e == nil {
+		e = c.appendMsg("#msg-list", text)
+	}
+	if e != nil {
+		log.Println(c.address, e)
+	}
+}
+
+// deliverDueReminders sends c any reminders that came due while offline.
+func deliverDueReminders(c *client) {
+	reminders.Lock()
+	defer reminders.Unlock()
+	changed := false
+	for id, r := range reminders.list {
+		if r.Due && strings.EqualFold(r.To, c.user.Name) {
+			deliverReminder(c, r)
+			delete(reminders.list, id)
+			changed = true
+		}
+	}
+	if changed {
+		if e := saveReminders(); e != nil {
+			log.Println(e)
+		}
+	}
+}
+
+// parseWhen parses "in <duration>" or "at <time>" into an absolute time.
+// Durations accept Go syntax plus a leading day count (e.g. 1d12h). Times
+// are HH:MM (today, or tomorrow if already past) or YYYY-MM-DD HH:MM.
+func parseWhen(kind string, args []string, now time.Time) (t time.Time, used int, e error) {
+	if len(args) == 0 {
+		return t, 0, errors.New("missing time")
+	}
+	switch kind {
+	case "in":
+		s := args[0]
+		var days time.Duration
+		if m := remindDays.FindStringSubmatch(s); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			days = time.Duration(n) * 24 * time.Hour
+			s = s[len(m[0]):]
+		}
+		var d time.Duration
+		if s != "" {
+			if d, e = time.ParseDuration(s); e != nil {
+				return t, 0, errors.New("bad duration: " + args[0])
+			}
+		}
+		if d+days <= 0 {
+			return t, 0, errors.New("duration must be positive")
+		}
+		return now.Add(d + days), 1, nil
+	case "at":
+		if len(args) > 1 {
+			if t, e = time.ParseInLocation("2006-01-02 15:04", args[0]+" "+args[1], now.Location()); e == nil {
+				return t, 2, nil
+			}
+		}
+		clock, err := time.ParseInLocation("15:04", args[0], now.Location())
+		if err != nil {
+			return t, 0, errors.New("bad time: " + args[0])
+		}
+		t = time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, 1, nil
+	}
+	return t, 0, errors.New("expected in or at")
+}
+
+func init() {
+	cmdMap["remind"] = command{
+		Desc:     "Schedules a reminder for you or another user.",
+		Usage:    "remind <me|@user> <in 20m|at 15:00> [to] <text> [via chat|toast|push] | remind list | remind cancel <id>",
+		Examples: []string{"remind me in 20m to stretch", "remind @ana at 15:00 standup via toast"},
+		Category: "Tools",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			usage := "Usage: remind <me|@user> <in 20m|at 15:00> [to] <text> [via chat|toast|push]"
+			if len(args) == 2 && args[1] == "list" {
+				reminders.Lock()
+				rows := [][]string{{"Id", "When", "To", "Text"}}
+				for _, r := range reminders.list {
+					if strings.EqualFold(r.From, c.user.Name) || strings.EqualFold(r.To, c.user.Name) {
+						rows = append(rows, []string{r.Id, r.At.In(c.user.location()).Format("2006-01-02 15:04"), r.To, r.Text})
+					}
+				}
+				reminders.Unlock()
+				if len(rows) == 1 {
+					return c.appendMsg("#msg-list", "No reminders")
+				}
+				return c.appendPre("#msg-list", formatTable(rows, true))
+			}
+			if len(args) == 3 && args[1] == "cancel" {
+				reminders.Lock()
+				defer reminders.Unlock()
+				r, ok := reminders.list[args[2]]
+				if !ok || !strings.EqualFold(r.From, c.user.Name) {
+					return c.appendMsg("#msg-list", "No such reminder: "+args[2])
+				}
+				sched.cancel("remind:" + r.Id)
+				delete(reminders.list, r.Id)
+				if e = saveReminders(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "Reminder cancelled")
+			}
+			if len(args) < 5 {
+				return c.appendMsg("#msg-list", usage)
+			}
+			to := c.user.Name
+			if args[1] != "me" {
+				if !strings.HasPrefix(args[1], "@") {
+					return c.appendMsg("#msg-list", usage)
+				}
+				to = args[1][1:]
+				if !userExists(to) {
+					return c.appendMsg("#msg-list", "User does not exist: "+to)
+				}
+			}
+			at, used, err := parseWhen(args[2], args[3:], time.Now().In(c.user.location()))
+			if err != nil {
+				return c.appendMsg("#msg-list", "remind: "+err.Error())
+			}
+			rest := args[3+used:]
+			if len(rest) > 0 && rest[0] == "to" {
+				rest = rest[1:]
+			}
+			via := "chat"
+			if n := len(rest); n > 2 && rest[n-2] == "via" {
+				via = rest[n-1]
+				rest = rest[:n-2]
+			}
+			if via != "chat" && via != "toast" && via != "push" {
+				return c.appendMsg("#msg-list", "remind: unknown delivery method "+via)
+			}
+			if len(rest) == 0 {
+				return c.appendMsg("#msg-list", usage)
+			}
+			reminders.Lock()
+			r := &reminder{Id: strconv.Itoa(reminders.nextId), From: c.user.Name, To: to,
+				Text: strings.Join(rest, " "), Via: via, At: at}
+			reminders.nextId++
+			reminders.list[r.Id] = r
+			e = saveReminders()
+			reminders.Unlock()
+			if e != nil {
+				return
+			}
+			scheduleReminder(r)
+			return c.appendMsg("#msg-list", "Reminder "+r.Id+" set for "+at.In(c.user.location()).Format("Mon Jan 2 15:04"))
+		},
+	}
+}
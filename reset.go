@@ -0,0 +1,277 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Password reset. forgot <name> mails the account's address a reset token,
+valid for resetTTL, and reset <token> asks for a new password. Mail goes
+through a pluggable mailer chosen with -mail: smtp, log (writes the mail to the
+server log, for testing) or none, which turns reset off.
+
+The account's files are encrypted with a key derived from the password (see
+passwd.go), so the server can't open them without it. To reset a password it
+keeps the file key and the email address in a "recovery" file next to the
+user file, sealed with the server's key (see seal in token.go). It is written
+when the password is set and on login, so accounts that haven't logged in
+since can't be reset. It is only kept while reset is on and the account has
+an email address, and removed otherwise, so that with -mail none the server
+can't open anybody's files.
+*/
+
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const resetTTL = 30 * time.Minute
+
+var (
+	mailName  = flag.String("mail", "none", "how mail is sent (smtp, log or none)")
+	mailFrom  = flag.String("mail-from", "", "sender address of mail")
+	smtpAddr  = flag.String("smtp", "localhost:25", "SMTP server address, host:port")
+	smtpUser  = flag.String("smtp-user", "", "SMTP user name, if the server needs one")
+	smtpPass  = flag.String("smtp-pass", "", "SMTP password")
+	forgotAll = newRateLimiter(3, time.Hour) // per account and per address
+)
+
+// mailer is implemented by each way of sending mail.
+type mailer interface {
+	mail(to, subject, body string) error
+}
+
+// mailers maps mailer names to their constructors.
+var mailers = map[string]func() mailer{
+	"smtp": func() mailer { return smtpMailer{*smtpAddr, *smtpUser, *smtpPass, *mailFrom} },
+	"log":  func() mailer { return logMailer{} },
+}
+
+// smtpMailer sends mail through an SMTP server.
+type smtpMailer struct {
+	addr, user, pass, from string
+}
+
+func (m smtpMailer) mail(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.user != "" {
+		host, _, _ := net.SplitHostPort(m.addr)
+		auth = smtp.PlainAuth("", m.user, m.pass, host)
+	}
+	msg := "From: " + m.from + "\r\nTo: " + to + "\r\nSubject: " + subject +
+		"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, []byte(msg))
+}
+
+// logMailer writes mail to the log instead of sending it.
+type logMailer struct{}
+
+func (logMailer) mail(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// resetOn reports whether a mailer is configured, which password reset needs.
+func resetOn() bool {
+	_, ok := mailers[*mailName]
+	return ok
+}
+
+// sendMail sends mail with the configured mailer.
+func sendMail(to, subject, body string) error {
+	newMailer, ok := mailers[*mailName]
+	if !ok {
+		return errors.New("mail is off")
+	}
+	return newMailer().mail(to, subject, body)
+}
+
+// recovery is what the server keeps to reset a password.
+type recovery struct {
+	Email string
+	Key   []byte
+}
+
+// recoveryPath is the file name's recovery data is sealed in.
+func recoveryPath(name string) string {
+	return userDir(name) + SEP + "recovery"
+}
+
+// keepsRecovery reports whether the recovery data of u is to be kept.
+func keepsRecovery(u *user) bool {
+	return resetOn() && u.Email != ""
+}
+
+// saveRecovery seals the email address and file key of u, which must be
+// logged in, or removes them if they aren't to be kept.
+func saveRecovery(u *user) error {
+	if !keepsRecovery(u) {
+		if e := os.Remove(recoveryPath(u.Name)); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+		return nil
+	}
+	b, _ := json.Marshal(recovery{Email: u.Email, Key: u.key})
+	b, e := seal(b)
+	if e != nil {
+		return e
+	}
+	return saveJSON(b, recoveryPath(u.Name))
+}
+
+// loadRecovery opens the recovery data of name.
+func loadRecovery(name string) (r recovery, e error) {
+	var b []byte
+	if e = loadJSON(&b, recoveryPath(name)); e == nil {
+		if b, e = unseal(b); e == nil {
+			e = json.Unmarshal(b, &r)
+		}
+	}
+	return
+}
+
+// dropRecoveries removes the recovery files of every account if reset is
+// off. It is called once from main.
+func dropRecoveries() {
+	if resetOn() {
+		return
+	}
+	names, e := accountNames()
+	if e != nil {
+		log.Println(e)
+	}
+	for _, name := range names {
+		if e := os.Remove(recoveryPath(name)); e != nil && !os.IsNotExist(e) {
+			log.Println(e)
+		}
+	}
+}
+
+// resetRequest is a reset token mailed to a user.
+type resetRequest struct {
+	user    string
+	expires time.Time
+}
+
+var resets = struct {
+	sync.Mutex
+	list map[string]resetRequest // token -> request
+}{list: make(map[string]resetRequest)}
+
+// requestReset mails name a reset token, if name may reset its password.
+func requestReset(name, addr string) error {
+	if userBanned(name) || !userExists(name) {
+		return nil
+	}
+	r, e := loadRecovery(name)
+	if e != nil {
+		return fmt.Errorf("can't reset password of %s: %v", name, e)
+	}
+	token := randomToken(16)
+	resets.Lock()
+	for t, req := range resets.list {
+		if strings.EqualFold(req.user, name) || time.Now().After(req.expires) {
+			delete(resets.list, t)
+		}
+	}
+	resets.list[token] = resetRequest{user: name, expires: time.Now().Add(resetTTL)}
+	resets.Unlock()
+	body := fmt.Sprintf("Someone at %s asked to reset the password of the soshell account %s.\n"+
+		"To choose a new one, type this in soshell within %s:\n\n    reset %s\n\n"+
+		"If it wasn't you, ignore this mail; your password stays the same.\n", hostOf(addr), name, resetTTL, token)
+	return sendMail(r.Email, "soshell password reset", body)
+}
+
+// takeReset returns the user a valid reset token was mailed to, using it up.
+func takeReset(token string) (string, bool) {
+	resets.Lock()
+	defer resets.Unlock()
+	req, ok := resets.list[token]
+	delete(resets.list, token)
+	if !ok || time.Now().After(req.expires) {
+		return "", false
+	}
+	return req.user, true
+}
+
+func init() {
+	cmdMap["forgot"] = command{
+		Desc:      "Mails you a token to reset your password with.",
+		Usage:     "forgot <name>",
+		Category:  "Account",
+		PerMinute: 3,
+		Handler: func(c *client, args []string) error {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: forgot <name>")
+			}
+			if _, ok := mailers[*mailName]; !ok {
+				return c.appendMsg("#msg-list", "Password reset is not available on this server")
+			}
+			name := args[1]
+			if !isName(name) {
+				return c.appendMsg("#msg-list", "Invalid characters in name")
+			}
+			if forgotAll.allow(strings.ToLower(name)) && forgotAll.allow(hostOf(c.address)) {
+				// Mailing can be slow and must not tell whether the account
+				// exists, so it happens in the background either way.
+				go func() {
+					if e := requestReset(name, c.address); e != nil {
+						log.Println(e)
+					}
+				}()
+			}
+			return c.appendMsg("#msg-list", c.trf("If %s has an email address, a reset token was sent to it", name))
+		},
+	}
+	cmdMap["reset"] = command{
+		Desc:     "Sets a new password with a token from forgot.",
+		Usage:    "reset <token>",
+		Category: "Account",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: reset <token>")
+			}
+			name, ok := takeReset(args[1])
+			if !ok {
+				securityLoginFailed(c.address, "reset")
+				return c.appendMsg("#msg-list", "Invalid or expired reset token")
+			}
+			pass1, e := c.promptSecure("#msg-txt", "Enter a good password")
+			if e != nil {
+				return
+			}
+			pass2, e := c.promptSecure("#msg-txt", "Re-enter your password")
+			if e != nil {
+				return
+			}
+			if pass1 == "" || pass1 != pass2 {
+				return c.appendMsg("#msg-list", "Failed! Passwords did not match")
+			}
+			r, e := loadRecovery(name)
+			var u user
+			if e == nil {
+				e = u.loadKey(name, r.Key)
+			}
+			if e == nil {
+				e = u.setPassword(pass1)
+			}
+			if e != nil {
+				log.Println("resetting password of", name+":", e)
+				return c.appendMsg("#msg-list", "Password reset failed")
+			}
+			log.Println(c.address, "reset the password of", name)
+			kickClients(&ban{Target: name, User: true}, "Your password was reset")
+			return c.appendMsg("#msg-list", c.trf("Password of %s changed, you can log in now", name))
+		},
+	}
+}
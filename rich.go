@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Rich chat messages. Room and private messages are stored as typed, and shown
+rendered: the inline markdown of markdownHTML (**bold**, *italic*, `code`)
+plus ~~strike~~ and [links](https://...), with emoji shortcodes like :smile:
+replaced by the emoji. The text is escaped before any markup is added, so the
+result is safe, and it is sent in an "appendRich" packet, which holds the
+plain prefix ("#room [alice] ") apart from the HTML, rather than the
+appendElement of appendMsg.
+*/
+
+//
+package main
+
+import (
+	"regexp"
+)
+
+var (
+	mdStrike = regexp.MustCompile(`~~(.+?)~~`)
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s()]+)\)`)
+	emojiReg = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+)
+
+// emojis maps the shortcodes expanded in messages to their emoji.
+var emojis = map[string]string{
+	"+1":               "👍",
+	"-1":               "👎",
+	"100":              "💯",
+	"angry":            "😠",
+	"beer":             "🍺",
+	"blush":            "😊",
+	"bug":              "🐛",
+	"clap":             "👏",
+	"coffee":           "☕",
+	"confused":         "😕",
+	"cry":              "😢",
+	"eyes":             "👀",
+	"fire":             "🔥",
+	"grin":             "😁",
+	"heart":            "❤️",
+	"joy":              "😂",
+	"laughing":         "😆",
+	"ok_hand":          "👌",
+	"party":            "🥳",
+	"pray":             "🙏",
+	"rocket":           "🚀",
+	"sad":              "😞",
+	"see_no_evil":      "🙈",
+	"shrug":            "🤷",
+	"smile":            "😄",
+	"smiley":           "😃",
+	"sob":              "😭",
+	"sparkles":         "✨",
+	"star":             "⭐",
+	"sunglasses":       "😎",
+	"tada":             "🎉",
+	"thinking":         "🤔",
+	"thumbsdown":       "👎",
+	"thumbsup":         "👍",
+	"upside_down_face": "🙃",
+	"warning":          "⚠️",
+	"wave":             "👋",
+	"white_check_mark": "✅",
+	"wink":             "😉",
+	"x":                "❌",
+}
+
+// expandEmoji replaces the emoji shortcodes in s.
+func expandEmoji(s string) string {
+	return emojiReg.ReplaceAllStringFunc(s, func(code string) string {
+		if e, ok := emojis[code[1:len(code)-1]]; ok {
+			return e
+		}
+		return code
+	})
+}
+
+// richHTML renders the chat message text as safe HTML.
+func richHTML(text string) string {
+	s := mdInline(expandEmoji(text))
+	s = mdStrike.ReplaceAllString(s, "<s>$1</s>")
+	return mdLink.ReplaceAllString(s, `<a href="$2" target="_blank" rel="noopener noreferrer">$1</a>`)
+}
+
+// richPacket returns the packet showing the message text after prefix, in
+// an element of class.
+func richPacket(prefix, text, class string) packet {
+	return AppendRich{Prefix: prefix, HTML: richHTML(text), Class: class}.packet()
+}
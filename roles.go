@@ -0,0 +1,207 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Roles. Everyone is a guest, logged in users are users, and admins may grant
+users the moderator or admin role with the role command. The users named in
+-admins are always admins.
+
+A user file is encrypted with its owner's password, so admins can't write
+roles into it; grants are kept by the server in work/roles.json instead and
+looked up when a user's role is needed, so they take effect at once.
+
+The role needed to run a command is its Role (see allowed in cmd.go);
+packets from the page are checked against packetRoles before they're
+handled (see demux in mux.go).
+*/
+
+//
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var grants = struct {
+	sync.Mutex
+	list map[string]role // lower case user name -> role
+}{list: make(map[string]role)}
+
+// packetRoles holds the lowest role allowed to send packets of a type; types
+// not in it may be sent by anyone.
+var packetRoles = map[string]role{
+	"editOp":    roleUser,
+	"editSave":  roleUser,
+	"editClose": roleUser,
+}
+
+// rolesPath is the file role grants are persisted in.
+func rolesPath() string {
+	return *work + SEP + "roles.json"
+}
+
+// saveRoles writes the grants to disk. Callers must hold the lock.
+func saveRoles() error {
+	list := make(map[string]string, len(grants.list))
+	for name, r := range grants.list {
+		list[name] = r.String()
+	}
+	return saveJSON(list, rolesPath())
+}
+
+// loadRoles reads the persisted grants. It is called once from main.
+func loadRoles() {
+	var list map[string]string
+	if e := loadJSON(&list, rolesPath()); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return
+	}
+	grants.Lock()
+	defer grants.Unlock()
+	for name, r := range list {
+		if r, ok := parseRole(r); ok {
+			grants.list[name] = r
+		}
+	}
+}
+
+// grantedRole returns the role granted to name, roleUser if none was.
+func grantedRole(name string) role {
+	grants.Lock()
+	defer grants.Unlock()
+	if r, ok := grants.list[strings.ToLower(name)]; ok {
+		return r
+	}
+	return roleUser
+}
+
+// userRole returns the role of the registered user name when logged in.
+func userRole(name string) role {
+	if flagAdmin(name) {
+		return roleAdmin
+	}
+	return grantedRole(name)
+}
+
+// setRole grants name r, or takes its grant away if r is roleUser.
+func setRole(name string, r role) error {
+	grants.Lock()
+	defer grants.Unlock()
+	if r <= roleUser {
+		delete(grants.list, strings.ToLower(name))
+	} else {
+		grants.list[strings.ToLower(name)] = r
+	}
+	return saveRoles()
+}
+
+// mayReceive reports whether c may send p, telling c why not if it may not.
+func (c *client) mayReceive(p packet) bool {
+	r, ok := packetRoles[p.Type]
+	if !ok || c.user.role() >= r {
+		return true
+	}
+	c.fail(codeForbidden, p.Id, c.trf("%s: permission denied", p.Type))
+	return false
+}
+
+// listRoles shows c the users with a role above user.
+func listRoles(c *client) error {
+	rows := [][]string{{"User", "Role", "Set by"}}
+	for _, name := range strings.Split(*admins, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			rows = append(rows, []string{name, roleAdmin.String(), "-admins"})
+		}
+	}
+	grants.Lock()
+	for name, r := range grants.list {
+		if !flagAdmin(name) {
+			rows = append(rows, []string{name, r.String(), "role grant"})
+		}
+	}
+	grants.Unlock()
+	if len(rows) == 1 {
+		return c.appendMsg("#msg-list", "No roles granted")
+	}
+	sort.Slice(rows[1:], func(i, j int) bool { return rows[i+1][0] < rows[j+1][0] })
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+func init() {
+	cmdMap["role"] = command{
+		Desc:     "Lists the moderators and admins.",
+		Usage:    "role",
+		Category: "Admin",
+		Role:     roleAdmin,
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return listRoles(c)
+			}
+			return c.usage("role", commandNamed("role"))
+		},
+		Sub: map[string]command{
+			"grant": {
+				Desc:     "Makes a user a moderator or an admin.",
+				Usage:    "role grant <user> <moderator|admin>",
+				Examples: []string{"role grant alice moderator"},
+				Sudo:     true,
+				Handler: func(c *client, args []string) error {
+					if len(args) != 4 {
+						return c.usage("role", commandNamed("role"))
+					}
+					r, ok := parseRole(args[3])
+					if !ok || r <= roleUser {
+						return c.appendMsg("#msg-list", c.trf("Roles that can be granted: %s", "moderator, admin"))
+					}
+					name := args[2]
+					if !userExists(name) {
+						return c.appendMsg("#msg-list", c.trf("No such user: %s", name))
+					}
+					if flagAdmin(name) {
+						return c.appendMsg("#msg-list", c.trf("%s is an admin set with -admins", name))
+					}
+					if e := setRole(name, r); e != nil {
+						return e
+					}
+					log.Println(c.user.Name, "granted", name, r)
+					return c.appendMsg("#msg-list", c.trf("%s is now %s", name, r.String()))
+				},
+				Complete: func(c *client, words []string) []string {
+					if len(words) == 4 {
+						return []string{"moderator", "admin"}
+					}
+					return onlineNames()
+				},
+			},
+			"revoke": {
+				Desc:  "Makes a moderator or an admin a plain user again.",
+				Usage: "role revoke <user>",
+				Sudo:  true,
+				Handler: func(c *client, args []string) error {
+					if len(args) != 3 {
+						return c.usage("role", commandNamed("role"))
+					}
+					name := args[2]
+					if flagAdmin(name) {
+						return c.appendMsg("#msg-list", c.trf("%s is an admin set with -admins", name))
+					}
+					if grantedRole(name) <= roleUser {
+						return c.appendMsg("#msg-list", c.trf("%s has no role granted", name))
+					}
+					if e := setRole(name, roleUser); e != nil {
+						return e
+					}
+					log.Println(c.user.Name, "revoked the role of", name)
+					return c.appendMsg("#msg-list", c.trf("%s is now %s", name, roleUser.String()))
+				},
+			},
+		},
+	}
+}
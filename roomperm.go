@@ -0,0 +1,457 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Room permissions, loosely after IRC. The user who creates a room owns it, and
+the owner and the operators granted with op run it: they mute users in it
+(see mute.go), invite users and set its modes with mode. A room in mode +i is
+invite only: only its operators, the users invited and the users already in
+it may join. A room in mode +k asks for a password on join, which invited
+users skip. Mode +f sets the room's flood limit, see flood.go. Anyone in an
+open room may invite others to it; moderators run every room. The same rules
+keep the API, GraphQL and gRPC out of the rooms their user couldn't join, and
+the commands reading or posting into a room without joining it: exportlog,
+history, event, hook and feed. Private rooms have no public calendar, and
+who and online only show who is in them to those who may join them.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// containsFold reports whether list holds name, ignoring case.
+func containsFold(list []string, name string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// addFold returns list with name added, unless it is in it. list isn't
+// changed, as copies of rooms share it.
+func addFold(list []string, name string) []string {
+	if containsFold(list, name) {
+		return list
+	}
+	return append(list[:len(list):len(list)], name)
+}
+
+// removeFold returns list without name. list isn't changed.
+func removeFold(list []string, name string) (out []string) {
+	for _, s := range list {
+		if !strings.EqualFold(s, name) {
+			out = append(out, s)
+		}
+	}
+	return
+}
+
+// isOp reports whether name owns r or is one of its operators.
+func (r chatRoom) isOp(name string) bool {
+	return strings.EqualFold(r.Owner, name) || containsFold(r.Ops, name)
+}
+
+// modes returns the modes of r, like "+ikf 5/10s", or "" for none.
+func (r chatRoom) modes() string {
+	s := ""
+	if r.InviteOnly {
+		s += "i"
+	}
+	if r.Key != nil {
+		s += "k"
+	}
+	if r.Flood != "" {
+		s += "f"
+	}
+	switch {
+	case s == "":
+		return ""
+	case r.Flood != "":
+		return "+" + s + " " + r.Flood
+	}
+	return "+" + s
+}
+
+// updateRoom changes the room called name with f and saves the rooms.
+func updateRoom(name string, f func(r *chatRoom)) error {
+	rooms.Lock()
+	defer rooms.Unlock()
+	r, ok := rooms.list[name]
+	if !ok {
+		return nil
+	}
+	f(r)
+	return saveRooms()
+}
+
+// forgetRoomUser drops name from the owners, operators and invites of the
+// rooms, so that whoever registers the name next gets none of them.
+func forgetRoomUser(name string) {
+	var names []string
+	rooms.Lock()
+	for _, r := range rooms.list {
+		if r.isOp(name) || containsFold(r.Invited, name) {
+			names = append(names, r.Name)
+		}
+	}
+	rooms.Unlock()
+	for _, room := range names {
+		e := updateRoom(room, func(r *chatRoom) {
+			if strings.EqualFold(r.Owner, name) {
+				r.Owner = ""
+			}
+			r.Ops = removeFold(r.Ops, name)
+			r.Invited = removeFold(r.Invited, name)
+		})
+		if e != nil {
+			log.Println(e)
+		}
+	}
+}
+
+// mayEnter reports whether u may be in room without a password.
+func mayEnter(u *user, room string) bool {
+	return admits(room, u.Name, u.role(), containsFold(u.Rooms, room))
+}
+
+// mayEnterAs is mayEnter for the account name when it isn't logged in, as
+// for its webhooks: the rooms it joined are in its user file, so of the
+// private rooms only those it runs or is invited to count.
+func mayEnterAs(name, room string) bool {
+	return admits(room, name, userRole(name), false)
+}
+
+// admits reports whether room lets in the user name, of role r, who is in it
+// already if in.
+func admits(room, name string, r role, in bool) bool {
+	rm, ok := findRoom(room)
+	switch {
+	case !ok:
+		return false
+	case !rm.InviteOnly && rm.Key == nil, r >= roleModerator:
+		return true
+	}
+	return rm.isOp(name) || containsFold(rm.Invited, name) || in
+}
+
+// reachRoom reports whether c may read or post into room without joining
+// it, as cmd does, telling c why not.
+func (c *client) reachRoom(cmd, room string) bool {
+	if _, ok := findRoom(room); !ok {
+		c.appendMsg("#msg-list", c.trf("No such room: #%s, create it with create", room))
+		return false
+	}
+	if !mayEnter(&c.user, room) {
+		c.fail(codeForbidden, "", c.trf("%s: permission denied", cmd))
+		return false
+	}
+	return true
+}
+
+// isPrivate reports whether room is invite only or has a password.
+func isPrivate(room string) bool {
+	r, ok := findRoom(room)
+	return ok && (r.InviteOnly || r.Key != nil)
+}
+
+// maySee reports whether u may see who is in room: everybody may for
+// open rooms.
+func maySee(u *user, room string) bool {
+	return !isPrivate(room) || mayEnter(u, room)
+}
+
+// admit reports whether c may join r, asking for its password if it has
+// one, and tells c why not.
+func (c *client) admit(r chatRoom) (bool, error) {
+	if mayEnter(&c.user, r.Name) {
+		return true, nil
+	}
+	if r.InviteOnly {
+		return false, c.appendMsg("#msg-list", c.trf("#%s is invite only", r.Name))
+	}
+	pass, e := c.promptSecure("#msg-txt", c.trf("Password for #%s", r.Name))
+	if e != nil {
+		return false, e
+	}
+	if _, e := r.Key.check(pass); e != nil {
+		log.Println(c.user.Name, "at", c.address, "gave a wrong password for #"+r.Name)
+		return false, c.appendMsg("#msg-list", c.trf("Wrong password for #%s", r.Name))
+	}
+	return true, nil
+}
+
+// roomTarget parses the <user> [#room] arguments of the room commands, the
+// current room if none is named, and tells c what's wrong with them.
+func roomTarget(c *client, cmd string, rest []string) (name string, r chatRoom, args []string, ok bool) {
+	if len(rest) == 0 {
+		c.usage(cmd, commandNamed(cmd))
+		return
+	}
+	room := c.currentRoom()
+	name, args = rest[0], rest[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "#") {
+		room, args = roomName(args[0]), args[1:]
+	}
+	switch {
+	case !userExists(name):
+		c.appendMsg("#msg-list", c.trf("No such user: %s", name))
+	case room == "":
+		c.appendMsg("#msg-list", "You're not in a room, join one first")
+	default:
+		if r, ok = findRoom(room); !ok {
+			c.appendMsg("#msg-list", c.trf("No such room: #%s, create it with create", room))
+		}
+		return strings.ToLower(name), r, args, ok
+	}
+	return
+}
+
+// tellUser shows the clients of name the message format, translated for
+// each, with args.
+func tellUser(name, format string, args ...interface{}) {
+	for _, c := range clientsByName(name) {
+		c.appendMsg("#msg-list", c.trf(format, args...))
+	}
+}
+
+// setOp makes name an operator of room, or no longer one, for c.
+func setOp(c *client, name, room string, on bool) error {
+	if r, _ := findRoom(room); strings.EqualFold(r.Owner, name) {
+		return c.appendMsg("#msg-list", c.trf("%s owns #%s", name, room))
+	}
+	e := updateRoom(room, func(r *chatRoom) {
+		if on {
+			r.Ops = addFold(r.Ops, name)
+		} else {
+			r.Ops = removeFold(r.Ops, name)
+		}
+	})
+	if e != nil {
+		return e
+	}
+	event := "room.op"
+	if !on {
+		event = "room.deop"
+	}
+	log.Println(c.user.Name, event, name, "in #"+room)
+	emit(event, map[string]string{"room": room, "by": c.user.Name, "user": name})
+	if on {
+		tellUser(name, "%s made you an operator of #%s", c.user.Name, room)
+		return c.appendMsg("#msg-list", c.trf("%s is now an operator of #%s", name, room))
+	}
+	tellUser(name, "%s took your operator status in #%s", c.user.Name, room)
+	return c.appendMsg("#msg-list", c.trf("%s is no longer an operator of #%s", name, room))
+}
+
+// showModes shows c the modes and operators of r.
+func showModes(c *client, r chatRoom) error {
+	modes := r.modes()
+	if modes == "" {
+		modes = c.tr("none")
+	}
+	e := c.appendMsg("#msg-list", c.trf("#%s modes: %s", r.Name, modes))
+	if e == nil && r.Owner != "" {
+		e = c.appendMsg("#msg-list", c.trf("Owner: %s", r.Owner))
+	}
+	if e == nil && len(r.Ops) > 0 {
+		e = c.appendMsg("#msg-list", c.trf("Operators: %s", strings.Join(r.Ops, ", ")))
+	}
+	if e == nil && len(r.Invited) > 0 && c.canModerate(r.Name) {
+		e = c.appendMsg("#msg-list", c.trf("Invited: %s", strings.Join(r.Invited, ", ")))
+	}
+	return e
+}
+
+// setModes changes the modes of r as args say, +i, -i, +k, -k, +f <limit>,
+// -f, +o <user> and -o <user>, for c. The password of +k is asked for.
+func setModes(c *client, r chatRoom, args []string) error {
+	var changes []func(r *chatRoom)
+	for i := 0; i < len(args); i++ {
+		mode := args[i]
+		if len(mode) != 2 || mode[0] != '+' && mode[0] != '-' {
+			return c.usage("mode", commandNamed("mode"))
+		}
+		on := mode[0] == '+'
+		switch mode[1] {
+		case 'i':
+			changes = append(changes, func(r *chatRoom) { r.InviteOnly = on })
+		case 'k':
+			if !on {
+				changes = append(changes, func(r *chatRoom) { r.Key = nil })
+				continue
+			}
+			pass, e := c.promptSecure("#msg-txt", c.trf("New password for #%s", r.Name))
+			if e != nil {
+				return e
+			}
+			if pass == "" {
+				return c.appendMsg("#msg-list", "The password can't be empty")
+			}
+			key, _, e := hashPassword(pass)
+			if e != nil {
+				return e
+			}
+			changes = append(changes, func(r *chatRoom) { r.Key = key })
+		case 'f':
+			if !on {
+				changes = append(changes, func(r *chatRoom) { r.Flood = "" })
+				continue
+			}
+			if i++; i == len(args) {
+				return c.usage("mode", commandNamed("mode"))
+			}
+			limit := args[i]
+			if _, _, e := parseFlood(limit); e != nil {
+				return c.appendMsg("#msg-list", e.Error())
+			}
+			changes = append(changes, func(r *chatRoom) { r.Flood = limit })
+		case 'o':
+			if i++; i == len(args) {
+				return c.usage("mode", commandNamed("mode"))
+			}
+			name := args[i]
+			if !userExists(name) {
+				return c.appendMsg("#msg-list", c.trf("No such user: %s", name))
+			}
+			if e := setOp(c, strings.ToLower(name), r.Name, on); e != nil {
+				return e
+			}
+		default:
+			return c.appendMsg("#msg-list", c.trf("Unknown mode: %s", mode))
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	e := updateRoom(r.Name, func(r *chatRoom) {
+		for _, f := range changes {
+			f(r)
+		}
+	})
+	if e != nil {
+		return e
+	}
+	r, _ = findRoom(r.Name)
+	log.Println(c.user.Name, "set the modes of #"+r.Name, "to", r.modes())
+	emit("room.mode", map[string]string{"room": r.Name, "by": c.user.Name, "modes": r.modes()})
+	return showModes(c, r)
+}
+
+func init() {
+	cmdMap["op"] = command{
+		Desc:     "Makes a user an operator of a room, the current one if none is named.",
+		Usage:    "op <user> [#room]",
+		Examples: []string{"op alice", "op alice #dev"},
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			name, r, rest, ok := roomTarget(c, "op", args[1:])
+			switch {
+			case !ok:
+				return nil
+			case len(rest) > 0:
+				return c.usage("op", commandNamed("op"))
+			case !c.canModerate(r.Name):
+				return c.fail(codeForbidden, "", c.trf("%s: permission denied", "op"))
+			}
+			return setOp(c, name, r.Name, true)
+		},
+		Complete: func(c *client, words []string) []string {
+			if len(words) == 2 {
+				return onlineNames()
+			}
+			return completeRooms(c, words)
+		},
+	}
+	cmdMap["deop"] = command{
+		Desc:     "Takes the operator status of a user in a room, the current one if none is named.",
+		Usage:    "deop <user> [#room]",
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			name, r, rest, ok := roomTarget(c, "deop", args[1:])
+			switch {
+			case !ok:
+				return nil
+			case len(rest) > 0:
+				return c.usage("deop", commandNamed("deop"))
+			case !c.canModerate(r.Name):
+				return c.fail(codeForbidden, "", c.trf("%s: permission denied", "deop"))
+			}
+			return setOp(c, name, r.Name, false)
+		},
+		Complete: func(c *client, words []string) []string {
+			if len(words) == 2 {
+				if r, ok := findRoom(c.currentRoom()); ok {
+					return r.Ops
+				}
+				return nil
+			}
+			return completeRooms(c, words)
+		},
+	}
+	cmdMap["invite"] = command{
+		Desc:     "Invites a user to a room, the current one if none is named, letting them join it even if it is invite only or has a password.",
+		Usage:    "invite <user> [#room]",
+		Examples: []string{"invite bob", "invite bob #dev"},
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			name, r, rest, ok := roomTarget(c, "invite", args[1:])
+			switch {
+			case !ok:
+				return nil
+			case len(rest) > 0:
+				return c.usage("invite", commandNamed("invite"))
+			case !c.canModerate(r.Name) && (r.InviteOnly || r.Key != nil || !c.inRoom(r.Name)):
+				return c.fail(codeForbidden, "", c.trf("%s: permission denied", "invite"))
+			}
+			if e := updateRoom(r.Name, func(r *chatRoom) { r.Invited = addFold(r.Invited, name) }); e != nil {
+				return e
+			}
+			log.Println(c.user.Name, "invited", name, "to #"+r.Name)
+			emit("room.invite", map[string]string{"room": r.Name, "by": c.user.Name, "user": name})
+			tellUser(name, "%s invites you to #%s, join it with join #%s", c.user.Name, r.Name, r.Name)
+			return c.appendMsg("#msg-list", c.trf("Invited %s to #%s", name, r.Name))
+		},
+		Complete: func(c *client, words []string) []string {
+			if len(words) == 2 {
+				return onlineNames()
+			}
+			return completeRooms(c, words)
+		},
+	}
+	cmdMap["mode"] = command{
+		Desc:     "Shows or changes the modes of a room, the current one if none is named: +i invite only, +k password, +f flood limit, +o operator.",
+		Usage:    "mode [#room] [+i|-i|+k|-k|+f <limit>|-f|+o <user>|-o <user>]...",
+		Examples: []string{"mode", "mode #dev +i", "mode +k", "mode +f 10/30s", "mode -i -k +o alice"},
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			room, rest := c.currentRoom(), args[1:]
+			if len(rest) > 0 && strings.HasPrefix(rest[0], "#") {
+				room, rest = roomName(rest[0]), rest[1:]
+			}
+			if room == "" {
+				return c.appendMsg("#msg-list", "You're not in a room, join one first")
+			}
+			r, ok := findRoom(room)
+			switch {
+			case !ok:
+				return c.appendMsg("#msg-list", c.trf("No such room: #%s, create it with create", room))
+			case len(rest) == 0:
+				return showModes(c, r)
+			case c.user.key == nil || !c.canModerate(room):
+				return c.fail(codeForbidden, "", c.trf("%s: permission denied", "mode"))
+			}
+			return setModes(c, r, rest)
+		},
+		Complete: completeRooms,
+	}
+}
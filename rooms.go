@@ -0,0 +1,487 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Rooms. A room has a name, a topic and the user who created it; the rooms are
+kept in work/rooms.json, and the lobby always exists. Clients join rooms with
+join, which also makes the room the current one, and leave them with leave;
+create makes a new room and joins it, rooms lists them.
+
+A line whose first word isn't a command, alias or macro is said in the current
+room: it is stored in the room's history and sent to every client that joined
+the room (see postRoom). Clients in the room but talking in another one see
+it prefixed with the room's name. A line starting with / is always a command,
+and say says anything.
+
+Clients join the lobby when they connect. Logged in users keep the rooms they
+are in in their account and rejoin them on login. Rooms are told when users
+come and go, see presence.go. Who may join a room, and its operators, are
+up to the room's owner, see roomperm.go.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const roomNameMax = 32
+
+// errRoomExists is what createRoom returns for a name already taken.
+var errRoomExists = errors.New("room exists")
+
+// chatRoom is a room users talk in.
+type chatRoom struct {
+	Name       string
+	Topic      string      `json:",omitempty"`
+	Owner      string      `json:",omitempty"`
+	Ops        []string    `json:",omitempty"` // operators besides the owner
+	Invited    []string    `json:",omitempty"`
+	InviteOnly bool        `json:",omitempty"` // mode +i
+	Key        *passRecord `json:",omitempty"` // password, mode +k
+	Flood      string      `json:",omitempty"` // flood limit, mode +f, see flood.go
+	Created    time.Time
+}
+
+// rooms holds the rooms and the clients in them. Its lock also guards the
+// room field of clients, which is only changed by the client's listener.
+var rooms = struct {
+	sync.Mutex
+	list    map[string]*chatRoom        // name -> room
+	members map[string]map[*client]bool // name -> clients in it
+}{list: make(map[string]*chatRoom), members: make(map[string]map[*client]bool)}
+
+// roomsPath is the file rooms are persisted in.
+func roomsPath() string {
+	return *work + SEP + "rooms.json"
+}
+
+// saveRooms writes the rooms to disk. Callers must hold the lock.
+func saveRooms() error {
+	var list []*chatRoom
+	for _, r := range rooms.list {
+		list = append(list, r)
+	}
+	return saveJSON(list, roomsPath())
+}
+
+// loadRooms reads the persisted rooms, making the lobby on first run. It is
+// called once from main.
+func loadRooms() {
+	var list []*chatRoom
+	if e := loadJSON(&list, roomsPath()); e != nil && !os.IsNotExist(e) {
+		log.Println(e)
+	}
+	rooms.Lock()
+	defer rooms.Unlock()
+	for _, r := range list {
+		rooms.list[r.Name] = r
+	}
+	if rooms.list[defaultRoom] == nil {
+		rooms.list[defaultRoom] = &chatRoom{Name: defaultRoom, Topic: "Everyone starts here", Created: time.Now()}
+		if e := saveRooms(); e != nil {
+			log.Println(e)
+		}
+	}
+}
+
+// isRoomName reports whether name may be the name of a room.
+func isRoomName(name string) bool {
+	return name != "" && len(name) <= roomNameMax && isName(name)
+}
+
+// roomName returns the room named by s, with or without a leading #.
+func roomName(s string) string {
+	return strings.ToLower(strings.TrimPrefix(s, "#"))
+}
+
+// findRoom returns a copy of the room called name.
+func findRoom(name string) (chatRoom, bool) {
+	rooms.Lock()
+	defer rooms.Unlock()
+	r, ok := rooms.list[name]
+	if !ok {
+		return chatRoom{}, false
+	}
+	return *r, true
+}
+
+// createRoom makes the room name, owned by owner, unless there is one.
+func createRoom(name, owner, topic string) error {
+	rooms.Lock()
+	defer rooms.Unlock()
+	if rooms.list[name] != nil {
+		return errRoomExists
+	}
+	rooms.list[name] = &chatRoom{Name: name, Topic: topic, Owner: owner, Created: time.Now()}
+	return saveRooms()
+}
+
+// roomClients returns the connected clients in room.
+func roomClients(room string) (cs []*client) {
+	rooms.Lock()
+	defer rooms.Unlock()
+	for c := range rooms.members[room] {
+		cs = append(cs, c)
+	}
+	return
+}
+
+// currentRoom returns the room c talks in, "" if it is in none.
+func (c *client) currentRoom() string {
+	rooms.Lock()
+	defer rooms.Unlock()
+	return c.room
+}
+
+// inRoom reports whether c is in room.
+func (c *client) inRoom(room string) bool {
+	rooms.Lock()
+	defer rooms.Unlock()
+	return rooms.members[room][c]
+}
+
+// joinedRooms returns the rooms c is in, sorted.
+func (c *client) joinedRooms() (list []string) {
+	rooms.Lock()
+	defer rooms.Unlock()
+	for name, members := range rooms.members {
+		if members[c] {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return
+}
+
+// enterRoom adds c to room, an existing one, and makes it the current room,
+// reporting whether c wasn't in it already.
+func (c *client) enterRoom(room string) bool {
+	rooms.Lock()
+	defer rooms.Unlock()
+	c.room = room
+	if rooms.members[room][c] {
+		return false
+	}
+	if rooms.members[room] == nil {
+		rooms.members[room] = make(map[*client]bool)
+	}
+	rooms.members[room][c] = true
+	return true
+}
+
+// exitRoom takes c out of room, switching to another room c is in if it was
+// the current one, and reports whether c was in it.
+func (c *client) exitRoom(room string) bool {
+	rooms.Lock()
+	defer rooms.Unlock()
+	if !rooms.members[room][c] {
+		return false
+	}
+	delete(rooms.members[room], c)
+	if len(rooms.members[room]) == 0 {
+		delete(rooms.members, room)
+	}
+	if c.room == room {
+		c.room = ""
+		for name, members := range rooms.members {
+			if members[c] && (c.room == "" || name < c.room) {
+				c.room = name
+			}
+		}
+	}
+	return true
+}
+
+// joinRoom adds c to room, keeping the rooms c is in in the account.
+func (c *client) joinRoom(room string) error {
+	if !c.enterRoom(room) {
+		c.readRoom(room)
+		return c.showPrompt()
+	}
+	c.readRoom(room)
+	c.announceJoin(room)
+	emit("user.join", map[string]string{"user": c.user.Name, "room": room})
+	c.user.Rooms = c.joinedRooms()
+	if e := c.user.commit(); e != nil {
+		return e
+	}
+	if e := c.replayRoom(room); e != nil {
+		return e
+	}
+	return c.showPrompt()
+}
+
+// leaveRoom takes c out of room, keeping the rooms c is in in the account.
+func (c *client) leaveRoom(room string) error {
+	if !c.exitRoom(room) {
+		return nil
+	}
+	announceLeave(c, &c.user, []string{room}, false)
+	emit("user.leave", map[string]string{"user": c.user.Name, "room": room})
+	c.sendOn(chanChat, Unread{Room: room}.packet())
+	c.readRoom(c.currentRoom())
+	c.user.Rooms = c.joinedRooms()
+	if e := c.user.commit(); e != nil {
+		return e
+	}
+	return c.showPrompt()
+}
+
+// leaveRooms takes c out of every room without touching the account, when
+// it disconnects or changes user, and returns the rooms it was in. The
+// caller announces it.
+func leaveRooms(c *client) (left []string) {
+	rooms.Lock()
+	defer rooms.Unlock()
+	for name, members := range rooms.members {
+		if !members[c] {
+			continue
+		}
+		left = append(left, name)
+		delete(members, c)
+		if len(members) == 0 {
+			delete(rooms.members, name)
+		}
+	}
+	c.room = ""
+	sort.Strings(left)
+	return
+}
+
+// restoreRooms puts c, just logged in, in the rooms kept in its account, or
+// the lobby if it has none.
+func (c *client) restoreRooms() error {
+	leaveRooms(c)
+	list := c.user.Rooms
+	if len(list) == 0 {
+		list = []string{defaultRoom}
+	}
+	for _, room := range list {
+		if _, ok := findRoom(room); ok && c.enterRoom(room) {
+			c.announceJoin(room)
+		}
+	}
+	if c.currentRoom() == "" && c.enterRoom(defaultRoom) {
+		c.announceJoin(defaultRoom)
+	}
+	c.showUnread()
+	c.readRoom(c.currentRoom())
+	if e := c.replayRoom(c.currentRoom()); e != nil {
+		return e
+	}
+	return c.showPrompt()
+}
+
+// isChat reports whether line is something to say rather than a command:
+// its first word isn't a command, alias or macro, and c is in a room.
+func (c *client) isChat(line string) bool {
+	words := strings.Fields(line)
+	if len(words) == 0 || c.currentRoom() == "" {
+		return false
+	}
+	name := strings.ToLower(words[0])
+	if _, ok := lookupCommand(name); ok {
+		return false
+	}
+	_, alias := c.user.Aliases[name]
+	_, macro := c.user.Macros[name]
+	return !alias && !macro
+}
+
+// say posts text from c in its current room.
+func (c *client) say(text string) error {
+	room := c.currentRoom()
+	if room == "" {
+		return c.appendMsg("#msg-list", "You're not in a room, join one first")
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	c.stopTyping(room)
+	if flooding(&c.user, room, []*client{c}) {
+		return nil
+	}
+	_, e := postRoom(room, c.user.Name, text)
+	if e == errMuted {
+		return c.tellMuted(room)
+	}
+	return e
+}
+
+// roomPrefix returns what goes in front of the text of a message from a
+// user in room shown to c.
+func (c *client) roomPrefix(room, from string) string {
+	if room != c.currentRoom() {
+		return "#" + room + " [" + from + "] "
+	}
+	return "[" + from + "] "
+}
+
+// listRooms shows c the rooms, marking the current one with * and the others
+// it is in with +, and the messages of those it hasn't read.
+func listRooms(c *client) error {
+	rooms.Lock()
+	var list []chatRoom
+	counts := make(map[string]int)
+	for name, r := range rooms.list {
+		list = append(list, *r)
+		counts[name] = len(rooms.members[name])
+	}
+	rooms.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	current := c.currentRoom()
+	rows := [][]string{{c.tr("Room"), c.tr("Online"), c.tr("Unread"), c.tr("Topic")}}
+	for _, r := range list {
+		name, unread := "#"+r.Name, ""
+		if r.Name == current {
+			name += " *"
+		} else if c.inRoom(r.Name) {
+			name += " +"
+		}
+		if c.user.key != nil && r.Name != current {
+			if n := unreadCount(c.user.Name, r.Name); n > 0 {
+				unread = strconv.Itoa(n)
+			}
+		}
+		rows = append(rows, []string{name, strconv.Itoa(counts[r.Name]), unread, r.Topic})
+	}
+	return c.pageLines(strings.Split(formatTable(rows, true), "\n"), false)
+}
+
+// completeRooms completes the names of the rooms.
+func completeRooms(c *client, words []string) []string {
+	rooms.Lock()
+	defer rooms.Unlock()
+	var names []string
+	for name := range rooms.list {
+		names = append(names, "#"+name)
+	}
+	return names
+}
+
+func init() {
+	cmdMap["join"] = command{
+		Desc:     "Joins a room and talks in it.",
+		Usage:    "join <#room>",
+		Examples: []string{"join #lobby"},
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			if len(args) != 2 {
+				return c.appendMsg("#msg-list", "Usage: join <#room>")
+			}
+			room := roomName(args[1])
+			r, ok := findRoom(room)
+			if !ok {
+				return c.appendMsg("#msg-list", c.trf("No such room: #%s, create it with create", room))
+			}
+			if !c.inRoom(room) {
+				if ok, e := c.admit(r); !ok {
+					return e
+				}
+			}
+			if containsFold(r.Invited, c.user.Name) {
+				if e := updateRoom(room, func(r *chatRoom) { r.Invited = removeFold(r.Invited, c.user.Name) }); e != nil {
+					return e
+				}
+			}
+			if e := c.joinRoom(room); e != nil {
+				return e
+			}
+			e := c.appendMsg("#msg-list", c.trf("Now talking in #%s", room))
+			if e == nil && r.Topic != "" {
+				e = c.appendMsg("#msg-list", c.trf("Topic: %s", r.Topic))
+			}
+			return e
+		},
+		Complete: completeRooms,
+	}
+	cmdMap["leave"] = command{
+		Desc:     "Leaves a room, the current one if none is named.",
+		Usage:    "leave [#room]",
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			room := c.currentRoom()
+			if len(args) == 2 {
+				room = roomName(args[1])
+			} else if len(args) > 2 {
+				return c.appendMsg("#msg-list", "Usage: leave [#room]")
+			}
+			if room == "" || !c.inRoom(room) {
+				return c.appendMsg("#msg-list", c.trf("You're not in #%s", room))
+			}
+			if e := c.leaveRoom(room); e != nil {
+				return e
+			}
+			e := c.appendMsg("#msg-list", c.trf("Left #%s", room))
+			if now := c.currentRoom(); e == nil && now != "" {
+				e = c.appendMsg("#msg-list", c.trf("Now talking in #%s", now))
+			}
+			return e
+		},
+		Complete: func(c *client, words []string) []string {
+			var names []string
+			for _, room := range c.joinedRooms() {
+				names = append(names, "#"+room)
+			}
+			return names
+		},
+	}
+	cmdMap["create"] = command{
+		Desc:     "Creates a room and joins it.",
+		Usage:    "create <#room> [topic]",
+		Examples: []string{"create #gophers Talk about Go"},
+		Category: "Rooms",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: create <#room> [topic]")
+			}
+			room := roomName(args[1])
+			if !isRoomName(room) {
+				return c.appendMsg("#msg-list", c.trf("Room names are letters, digits and _, at most %d long", roomNameMax))
+			}
+			if e := createRoom(room, c.user.Name, strings.Join(args[2:], " ")); e == errRoomExists {
+				return c.appendMsg("#msg-list", c.trf("#%s already exists", room))
+			} else if e != nil {
+				return e
+			}
+			log.Println(c.user.Name, "created #"+room)
+			emit("room.created", map[string]string{"room": room, "owner": c.user.Name})
+			if e := c.joinRoom(room); e != nil {
+				return e
+			}
+			return c.appendMsg("#msg-list", c.trf("Created #%s, now talking in it", room))
+		},
+	}
+	cmdMap["rooms"] = command{
+		Desc:     "Lists the rooms, marking the current one with * and the others you're in with +.",
+		Usage:    "rooms",
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			return listRooms(c)
+		},
+	}
+	cmdMap["say"] = command{
+		Desc:     "Says something in the current room, even if it starts like a command.",
+		Usage:    "say <text>",
+		Examples: []string{"say help me out here"},
+		Category: "Rooms",
+		Handler: func(c *client, args []string) error {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: say <text>")
+			}
+			return c.say(strings.Join(args[1:], " "))
+		},
+	}
+}
@@ -0,0 +1,174 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The sandbox runs user supplied code snippets inside throwaway containers with
+no network, a read-only root filesystem and CPU, memory, process and time
+limits. Output is streamed back to the client line by line as it's produced.
+Any docker compatible runtime (docker, podman) can be set with -sandbox; code
+execution is off without one, and only logged in users may run code.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sandboxBin     = flag.String("sandbox", "", "container runtime for run-go/run-py, e.g. docker, empty to disable")
+	sandboxGo      = flag.String("sandbox-go", "golang:1.22-alpine", "container image for run-go")
+	sandboxPy      = flag.String("sandbox-py", "python:3.12-alpine", "container image for run-py")
+	sandboxTimeout = 10 * time.Second
+	sandboxOutput  = 200 // maximum lines of output streamed back
+	sandboxSlots   = make(chan bool, 2)
+	sandboxLimit   = newRateLimiter(5, time.Minute)
+	sandboxBusy    = struct {
+		sync.Mutex
+		clients map[*client]bool
+	}{clients: make(map[*client]bool)}
+)
+
+// sandboxLang describes how to run a snippet in a given language. The code
+// is written to the container's stdin.
+type sandboxLang struct {
+	image  *string
+	script string
+	env    []string
+}
+
+var sandboxLangs = map[string]sandboxLang{
+	"run-go": {sandboxGo, "cat > /tmp/main.go && cd /tmp && go run main.go",
+		[]string{"GOCACHE=/tmp/cache", "GOPATH=/tmp/go", "CGO_ENABLED=0"}},
+	"run-py": {sandboxPy, "python3 -", nil},
+}
+
+// sandboxArgs returns the container runtime arguments for lang, in a
+// container called name.
+func sandboxArgs(lang sandboxLang, name string) []string {
+	args := []string{"run", "--rm", "-i", "--name", name,
+		"--network", "none",
+		"--memory", "256m", "--memory-swap", "256m",
+		"--cpus", "0.5",
+		"--pids-limit", "64",
+		"--read-only",
+		"--tmpfs", "/tmp:rw,exec,size=256m",
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+		"--user", "65534:65534"}
+	for _, env := range lang.env {
+		args = append(args, "-e", env)
+	}
+	return append(args, *lang.image, "sh", "-c", lang.script)
+}
+
+// runSandbox runs code and streams its output to c, in the pane it was
+// started from.
+func runSandbox(c *client, lang sandboxLang, code string) {
+	pane := c.out()
+	defer func() {
+		sandboxBusy.Lock()
+		delete(sandboxBusy.clients, c)
+		sandboxBusy.Unlock()
+	}()
+	select {
+	case sandboxSlots <- true:
+		defer func() { <-sandboxSlots }()
+	case <-time.After(sandboxTimeout):
+		c.appendMsg(pane, "run: server busy, try again later")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sandboxTimeout)
+	defer cancel()
+	name := "soshell-sandbox-" + randomToken(8)
+	cmd := exec.CommandContext(ctx, *sandboxBin, sandboxArgs(lang, name)...)
+	cmd.Stdin = strings.NewReader(code)
+	out, w := io.Pipe()
+	cmd.Stdout, cmd.Stderr = w, w
+	if err := cmd.Start(); err != nil {
+		c.appendMsg(pane, "run: "+err.Error())
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		w.Close()
+		done <- err
+	}()
+	lines := 0
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		if lines++; lines > sandboxOutput {
+			cancel()
+			c.appendMsg(pane, "run: output limit reached, stopped")
+			break
+		}
+		c.appendPre(pane, s.Text())
+	}
+	go io.Copy(io.Discard, out)
+	err := <-done
+	if ctx.Err() != nil {
+		// Killing the runtime's client leaves the container running.
+		exec.Command(*sandboxBin, "rm", "-f", name).Run()
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		c.appendMsg(pane, "run: time limit of "+sandboxTimeout.String()+" exceeded")
+	case err != nil && lines <= sandboxOutput:
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			c.appendMsg(pane, "run: exited with status "+strconv.Itoa(exit.ExitCode()))
+		} else {
+			c.appendMsg(pane, "run: "+err.Error())
+		}
+	}
+}
+
+func init() {
+	for name, lang := range sandboxLangs {
+		name, lang := name, lang
+		cmdMap[name] = command{
+			Desc:     "Runs a code snippet (or a file from your home) in a sandbox.",
+			Usage:    name + " <code|file>",
+			Category: "Tools",
+			Role:     roleUser,
+			Handler: func(c *client, args []string) (e error) {
+				if *sandboxBin == "" {
+					return c.appendMsg("#msg-list", name+": code execution is disabled")
+				}
+				if len(args) < 2 {
+					return c.appendMsg("#msg-list", "Usage: "+name+" <code|file>")
+				}
+				code := strings.Join(args[1:], " ")
+				if len(args) == 2 {
+					if b, err := readVFile(c.user.Name, args[1]); err == nil {
+						code = string(b)
+					}
+				}
+				if !sandboxLimit.allow(c.user.Name) {
+					return c.appendMsg("#msg-list", name+": rate limit reached, try again later")
+				}
+				sandboxBusy.Lock()
+				busy := sandboxBusy.clients[c]
+				sandboxBusy.clients[c] = true
+				sandboxBusy.Unlock()
+				if busy {
+					return c.appendMsg("#msg-list", name+": you already have code running")
+				}
+				go runSandbox(c, lang, code)
+				return
+			},
+		}
+	}
+}
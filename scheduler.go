@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The scheduler runs functions at a given time. Jobs are identified by an id so
+they can be replaced or cancelled; persistence is left to the owner of the job
+which re-schedules it on startup.
+*/
+
+//
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type scheduler struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+var sched = &scheduler{timers: make(map[string]*time.Timer)}
+
+// at runs fn at time t, replacing any job already scheduled under id. Jobs in
+// the past run immediately.
+func (s *scheduler) at(id string, t time.Time, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.timers[id]; ok {
+		old.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(t), func() {
+		s.mu.Lock()
+		if s.timers[id] == timer {
+			delete(s.timers, id)
+		}
+		s.mu.Unlock()
+		fn()
+	})
+	s.timers[id] = timer
+}
+
+// cancel stops the job scheduled under id and reports whether there was one.
+func (s *scheduler) cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timer, ok := s.timers[id]
+	if ok {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	return ok
+}
@@ -0,0 +1,161 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Scrollback. Room and private messages are kept by the history system (see
+history.go), so a client joining a room, connecting or logging in is shown
+the room's last -replay messages before anything new; each room is replayed
+once per connection. history --before <time> pages further back, through the
+current room or the #room or @user named, and ends with the history command
+showing the page before.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"time"
+)
+
+const scrollbackPage = 20
+
+var replayCount = flag.Int("replay", 20, "messages of a room shown to clients joining it, 0 for none")
+
+// beforeLayouts are the time formats history --before takes, in the user's
+// time zone.
+var beforeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "15:04"}
+
+// scrollbackPrefix returns what goes in front of the text of message m of
+// room, "" for a private conversation, shown to c.
+func (c *client) scrollbackPrefix(room string, m message) string {
+	loc := c.user.location()
+	t, now := m.Time.In(loc), time.Now().In(loc)
+	stamp := t.Format("15:04")
+	if t.Year() != now.Year() || t.YearDay() != now.YearDay() {
+		stamp = t.Format("2006-01-02 15:04")
+	}
+	if room == "" {
+		return stamp + " [" + m.From + "] "
+	}
+	return stamp + " " + c.roomPrefix(room, m.From)
+}
+
+// showScrollback shows c msgs of room, oldest first, dimmed.
+func (c *client) showScrollback(room string, msgs []message) error {
+	for _, m := range msgs {
+		class := "msg replay"
+		if room != "" && c.isMentioned(mentioned(m.From, m.Text)) {
+			class += " mention"
+		}
+		if e := c.send(richPacket(c.scrollbackPrefix(room, m), m.Text, class)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// replayRoom shows c the last messages of room, unless it saw them since it
+// connected.
+func (c *client) replayRoom(room string) error {
+	if room == "" || *replayCount <= 0 || c.replayed[room] {
+		return nil
+	}
+	if c.replayed == nil {
+		c.replayed = make(map[string]bool)
+	}
+	c.replayed[room] = true
+	msgs, e := pageHistory(roomKey(room), 0, *replayCount)
+	if e != nil || len(msgs) == 0 {
+		return e
+	}
+	return c.showScrollback(room, msgs)
+}
+
+// parseBefore parses the time of history --before in loc. A time of day
+// alone is today's.
+func parseBefore(s string, loc *time.Location) (time.Time, bool) {
+	for _, layout := range beforeLayouts {
+		t, err := time.ParseInLocation(layout, s, loc)
+		if err != nil {
+			continue
+		}
+		if layout == "15:04" {
+			now := time.Now().In(loc)
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// scrollback shows c a page of the messages of the conversation target, the
+// current room if "", sent before the time before, the latest if "".
+func scrollback(c *client, target, before string) error {
+	var key, room string
+	switch {
+	case target == "":
+		if room = c.currentRoom(); room == "" {
+			return c.appendMsg("#msg-list", "You're not in a room, join one first")
+		}
+		key = roomKey(room)
+	case strings.HasPrefix(target, "#") && isRoomName(roomName(target)):
+		room = roomName(target)
+		if !c.reachRoom("history", room) {
+			return nil
+		}
+		key = roomKey(room)
+	case strings.HasPrefix(target, "@") && userExists(target[1:]):
+		key = dmKey(c.user.Name, target[1:])
+	default:
+		return c.appendMsg("#msg-list", c.trf("No such room or user: %s", target))
+	}
+	loc := c.user.location()
+	t := time.Now()
+	if before != "" {
+		var ok bool
+		if t, ok = parseBefore(before, loc); !ok {
+			return c.appendMsg("#msg-list", "Times look like 2026-10-01T18:30, 2026-10-01 or 18:30")
+		}
+	}
+	msgs, e := historyBefore(key, t, scrollbackPage+1)
+	if e != nil {
+		return e
+	}
+	if len(msgs) == 0 {
+		return c.appendMsg("#msg-list", "No messages before then")
+	}
+	more := len(msgs) > scrollbackPage
+	if more {
+		msgs = msgs[1:]
+	}
+	if e := c.showScrollback(room, msgs); e != nil || !more {
+		return e
+	}
+	next := "history"
+	if target != "" {
+		next += " " + target
+	}
+	next += " --before " + msgs[0].Time.In(loc).Format("2006-01-02T15:04:05")
+	return c.appendMsg("#msg-list", c.trf("Older messages: %s", next))
+}
+
+// historyArgs reports whether args ask history for messages rather than
+// commands, returning the conversation and time.
+func historyArgs(args []string) (target, before string, chat bool, err error) {
+	opts, rest, err := parseFlags(args, commandNamed("history").flagSpec())
+	if err != nil {
+		return "", "", true, err
+	}
+	before, chat = opts["before"]
+	if len(rest) == 1 && (strings.HasPrefix(rest[0], "#") || strings.HasPrefix(rest[0], "@")) {
+		return rest[0], before, true, nil
+	}
+	if chat && len(rest) > 0 {
+		return "", "", true, errors.New("too many arguments")
+	}
+	return "", before, chat, nil
+}
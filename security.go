@@ -0,0 +1,180 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The security system watches for suspicious patterns: credential stuffing
+(many failed logins, or failures across many accounts, from one address),
+rapid account creation and malformed packets that look like attempts to inject
+DOM selectors. When a rule trips, an alert is logged, sent to the outgoing
+webhooks as "security.alert" and shown to online admins, and the address is
+banned for a while.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// securityRule is a threshold of events per address within a window.
+type securityRule struct {
+	name   string
+	limit  int
+	window time.Duration
+	ban    time.Duration
+}
+
+var (
+	ruleLoginFail = securityRule{"credential stuffing", 10, 10 * time.Minute, 30 * time.Minute}
+	ruleAccounts  = securityRule{"credential stuffing (many accounts)", 5, 10 * time.Minute, time.Hour}
+	ruleRegister  = securityRule{"rapid account creation", 3, time.Hour, time.Hour}
+	rulePackets   = securityRule{"malformed packets", 5, 10 * time.Minute, 15 * time.Minute}
+	security      = struct {
+		sync.Mutex
+		events map[string][]time.Time     // rule + address -> times
+		names  map[string]map[string]bool // address -> account names that failed
+		bans   map[string]time.Time       // address -> banned until
+	}{events: make(map[string][]time.Time), names: make(map[string]map[string]bool), bans: make(map[string]time.Time)}
+)
+
+// hostOf strips the port from an address.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// isBanned reports whether addr is temporarily banned, or banned by an admin
+// (see ban.go).
+func isBanned(addr string) bool {
+	if addrBanned(addr) {
+		return true
+	}
+	security.Lock()
+	defer security.Unlock()
+	until, ok := security.bans[hostOf(addr)]
+	if ok && time.Now().After(until) {
+		delete(security.bans, hostOf(addr))
+		return false
+	}
+	return ok
+}
+
+// record adds an event for rule and reports whether the rule tripped.
+// Callers must hold the lock.
+func (r securityRule) record(host string) bool {
+	key := r.name + " " + host
+	now := time.Now()
+	times := security.events[key][:0]
+	for _, t := range security.events[key] {
+		if now.Sub(t) < r.window {
+			times = append(times, t)
+		}
+	}
+	times = append(times, now)
+	security.events[key] = times
+	if len(times) > r.limit {
+		delete(security.events, key)
+		return true
+	}
+	return false
+}
+
+// alert bans host and raises an alert. Callers must hold the lock.
+func alert(r securityRule, host, detail string) {
+	security.bans[host] = time.Now().Add(r.ban)
+	msg := "Security alert: " + r.name + " from " + host + " (" + detail + "), banned for " + r.ban.String()
+	log.Println(msg)
+	go func() {
+		emit("security.alert", map[string]string{"rule": r.name, "address": host, "detail": detail, "ban": r.ban.String()})
+		broadcastTo(func(c *client) bool { return isAdmin(&c.user) }, Toast{Text: msg}.packet())
+	}()
+}
+
+// securityLoginFailed records a failed login for name from addr.
+func securityLoginFailed(addr, name string) {
+	host := hostOf(addr)
+	security.Lock()
+	defer security.Unlock()
+	if security.names[host] == nil {
+		security.names[host] = make(map[string]bool)
+	}
+	security.names[host][strings.ToLower(name)] = true
+	if ruleLoginFail.record(host) {
+		alert(ruleLoginFail, host, "repeated failed logins")
+	} else if n := len(security.names[host]); n > ruleAccounts.limit {
+		delete(security.names, host)
+		alert(ruleAccounts, host, strconv.Itoa(n)+" accounts tried")
+	}
+}
+
+// securityRegistered records an account registration from addr.
+func securityRegistered(addr string) {
+	host := hostOf(addr)
+	security.Lock()
+	defer security.Unlock()
+	if ruleRegister.record(host) {
+		alert(ruleRegister, host, "too many new accounts")
+	}
+}
+
+// securitySuspicious records a malformed or suspicious packet from addr.
+func securitySuspicious(addr, detail string) {
+	host := hostOf(addr)
+	security.Lock()
+	defer security.Unlock()
+	if rulePackets.record(host) {
+		alert(rulePackets, host, detail)
+	}
+}
+
+// expireSecurity forgets old failed login names so the many accounts rule
+// only counts recent ones. It is started once from main.
+func expireSecurity() {
+	for range time.Tick(ruleAccounts.window) {
+		security.Lock()
+		security.names = make(map[string]map[string]bool)
+		security.Unlock()
+	}
+}
+
+func init() {
+	cmdMap["bans"] = command{
+		Desc:     "Lists temporarily banned addresses or lifts a ban.",
+		Usage:    "bans [rm <address>]",
+		Category: "Admin",
+		Role:     roleAdmin,
+		Sudo:     true,
+		Handler: func(c *client, args []string) (e error) {
+			security.Lock()
+			defer security.Unlock()
+			if len(args) == 3 && args[1] == "rm" {
+				if _, ok := security.bans[args[2]]; !ok {
+					return c.appendMsg("#msg-list", "Not banned: "+args[2])
+				}
+				delete(security.bans, args[2])
+				return c.appendMsg("#msg-list", "Ban lifted for "+args[2])
+			}
+			rows := [][]string{{"Address", "Until"}}
+			for host, until := range security.bans {
+				if time.Now().Before(until) {
+					rows = append(rows, []string{host, until.In(c.user.location()).Format("2006-01-02 15:04")})
+				}
+			}
+			if len(rows) == 1 {
+				return c.appendMsg("#msg-list", "No bans")
+			}
+			sort.Slice(rows[1:], func(i, j int) bool { return rows[i+1][0] < rows[j+1][0] })
+			return c.appendPre("#msg-list", formatTable(rows, true))
+		},
+	}
+}
@@ -0,0 +1,100 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Session info. Every connection has an id and keeps when it connected, whether
+it came over TLS, the browser it uses and counts of the packets it sent and
+received; whoami shows them along with the user and address.
+*/
+
+//
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// session describes a client's connection. The counters and active are
+// updated atomically, the other fields are set once on connect.
+type session struct {
+	id         string // names the connection in sessions, see token.go
+	connected  time.Time
+	secure     bool   // connected over TLS
+	agent      string // User-Agent of the browser
+	packetsIn  int64
+	packetsOut int64
+	active     int64 // unix time of the last input
+}
+
+// touch records input from the client.
+func (s *session) touch() {
+	count(&s.packetsIn)
+	atomic.StoreInt64(&s.active, time.Now().Unix())
+}
+
+// idle returns how long the client has sent no input.
+func (s *session) idle() time.Duration {
+	last := atomic.LoadInt64(&s.active)
+	if last == 0 {
+		return time.Since(s.connected)
+	}
+	return time.Since(time.Unix(last, 0))
+}
+
+// wireName returns the name of the packet encoding.
+func wireName(binary bool) string {
+	if binary {
+		return "MessagePack"
+	}
+	return "JSON"
+}
+
+func init() {
+	cmdMap["whoami"] = command{
+		Desc:     "Shows who you are logged in as and details of your connection.",
+		Usage:    "whoami",
+		Category: "Account",
+		Handler: func(c *client, args []string) (e error) {
+			s := &c.sess
+			name := c.user.Name
+			if c.user.key == nil {
+				name += " (" + c.tr("not logged in") + ")"
+			} else if r := c.user.role(); r > roleUser {
+				name += " (" + r.String() + ")"
+			}
+			tls := c.tr("no")
+			if s.secure {
+				tls = c.tr("yes")
+			}
+			compression := c.tr("off")
+			if c.compressMin > 0 {
+				compression = c.trf("messages from %d bytes", c.compressMin)
+			}
+			loc := c.user.location()
+			c.lmu.Lock()
+			locale := c.locale
+			c.lmu.Unlock()
+			rows := [][]string{
+				{c.tr("User"), name},
+				{c.tr("Session"), s.id},
+				{c.tr("Address"), c.address},
+				{"TLS", tls},
+				{c.tr("Browser"), s.agent},
+				{c.tr("Connected"), s.connected.In(loc).Format("2006-01-02 15:04:05") + " (" + time.Since(s.connected).Truncate(time.Second).String() + ")"},
+				{c.tr("Packets"), strconv.FormatInt(atomic.LoadInt64(&s.packetsIn), 10) + " " + c.tr("in") + ", " + strconv.FormatInt(atomic.LoadInt64(&s.packetsOut), 10) + " " + c.tr("out")},
+				{c.tr("Room"), "#" + c.currentRoom()},
+				{c.tr("Language"), locale},
+				{c.tr("Encoding"), wireName(c.binary)},
+				{c.tr("Protocol"), strconv.Itoa(c.protocol())},
+				{c.tr("Compression"), compression},
+			}
+			if c.elevated() {
+				rows = append(rows, []string{"sudo", c.trf("until %s", c.sudoUntil.In(loc).Format("15:04:05"))})
+			}
+			return c.appendPre("#msg-list", formatTable(rows, false))
+		},
+	}
+}
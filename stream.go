@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Streaming. A packet with one large field, a download's contents or a long
+output, is sent in bounded pieces instead of one giant frame: a streamStart
+packet with the rest of the packet, its Type in Op and the name of the large
+field in Field, then streamChunk packets with up to chunkSize bytes of the
+field each, then streamEnd. All three carry the same Id; the page joins the
+chunks and runs the original packet. Text is split between characters, never
+inside one. Pages older than protocol version 4 (see caps.go) get the packet
+whole.
+*/
+
+//
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const chunkSize = 16 << 10
+
+// sendStreamed sends p on channel ch, streaming its field if that is large.
+func (c *client) sendStreamed(ch string, p packet, field string) error {
+	s := p.Data[field]
+	if len(s) <= chunkSize || c.protocol() < 4 {
+		return c.sendOn(ch, p)
+	}
+	id := "s" + strconv.FormatUint(atomic.AddUint64(&c.streams, 1), 10)
+	start := StreamStart{Selector: p.Data["Selector"], Op: p.Type, Field: field, Extra: p.Data}.packet()
+	start.Id = id
+	delete(start.Data, field)
+	if e := c.sendOn(ch, start); e != nil {
+		return e
+	}
+	for len(s) > 0 {
+		n := chunkSize
+		if n >= len(s) {
+			n = len(s)
+		} else {
+			for n > 0 && !utf8.RuneStart(s[n]) {
+				n--
+			}
+		}
+		chunk := StreamChunk{Selector: p.Data["Selector"], Chunk: s[:n]}.packet()
+		chunk.Id = id
+		if e := c.sendOn(ch, chunk); e != nil {
+			return e
+		}
+		s = s[n:]
+	}
+	end := StreamEnd{Selector: p.Data["Selector"]}.packet()
+	end.Id = id
+	return c.sendOn(ch, end)
+}
@@ -0,0 +1,73 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Sub-commands. A command with a Sub map is a tree: cron add, cron rm and so on
+are commands of their own, found by the words after the command name, each with
+its own description, role, handler and completion. A sub-command's handler gets
+all the words typed, so its own arguments start after its name.
+
+When no sub-command matches, the parent's Handler runs if it has one, and
+otherwise the usage is listed from the sub-commands the user may run. A
+sub-command can't be run by roles its parent doesn't allow, nor without sudo if
+its parent needs it.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// find returns the sub-command of cmd named by args and the number of words
+// naming it, at least 1 for cmd itself.
+func (cmd command) find(args []string) (command, int) {
+	n := 1
+	for n < len(args) {
+		sub, ok := cmd.Sub[strings.ToLower(args[n])]
+		if !ok {
+			break
+		}
+		if sub.Role < cmd.Role {
+			sub.Role = cmd.Role
+		}
+		sub.Sudo = sub.Sudo || cmd.Sudo
+		cmd = sub
+		n++
+	}
+	return cmd, n
+}
+
+// subNames returns the names of the sub-commands of cmd c may run.
+func (c *client) subNames(cmd command) []string {
+	var names []string
+	for name, sub := range cmd.Sub {
+		if c.user.role() >= sub.Role {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subUsage returns the usage lines of the sub-commands of the command named
+// path.
+func (c *client) subUsage(path string, cmd command) []string {
+	var rows [][]string
+	for _, name := range c.subNames(cmd) {
+		sub := cmd.Sub[name]
+		rows = append(rows, []string{"  " + c.usageOf(path+" "+name, sub), c.tr(sub.Desc)})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return strings.Split(formatTable(rows, false), "\n")
+}
+
+// usage lists the sub-commands of the command named path.
+func (c *client) usage(path string, cmd command) error {
+	return c.pageLines(append([]string{c.tr("Usage:")}, c.subUsage(path, cmd)...), false)
+}
@@ -0,0 +1,187 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Event subscriptions let the page be told about server events (see emit in
+webhook.go) as they happen instead of having to ask. The page sends a
+"subscribe" packet with a comma separated list of event names in Events, and
+"unsubscribe" to stop; names take the same #room suffix as webhooks, and "*"
+means every event the user may see. The server answers with a "subscribed"
+packet listing the events now subscribed to, and pushes each matching event
+as an "event" packet on the "event" channel, holding the event's data plus
+its name in Event and time in Time.
+
+Which events a user may subscribe to depends on their role, see
+subscribable. Room events are only pushed for the user's own room, and
+job.done only to the user who started the job.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const chanEvent = "event"
+
+// subscribable maps the events pages may subscribe to to the lowest role
+// allowed to.
+var subscribable = map[string]role{
+	"user.join":       roleGuest,
+	"user.leave":      roleGuest,
+	"room.message":    roleGuest,
+	"wall":            roleGuest,
+	"job.done":        roleUser,
+	"user.login":      roleAdmin,
+	"user.registered": roleAdmin,
+	"user.deleted":    roleAdmin,
+	"user.kicked":     roleAdmin,
+	"user.banned":     roleAdmin,
+	"user.unbanned":   roleAdmin,
+	"user.muted":      roleModerator,
+	"user.unmuted":    roleModerator,
+	"user.disabled":   roleAdmin,
+	"user.enabled":    roleAdmin,
+	"user.reset":      roleAdmin,
+	"security.alert":  roleAdmin,
+}
+
+// subscriptions are the events a client subscribed to.
+type subscriptions struct {
+	sync.Mutex
+	events map[string]bool
+	stop   func() // stops the goroutine pushing events, nil if none
+}
+
+// subscribe adds events to c's subscriptions, starting to push them if it
+// wasn't already, and returns the names refused.
+func (c *client) subscribe(events []string) (refused []string) {
+	r := c.user.role()
+	c.subs.Lock()
+	defer c.subs.Unlock()
+	for _, e := range events {
+		name := e
+		if i := strings.IndexByte(e, '#'); i >= 0 {
+			name = e[:i]
+		}
+		if min, ok := subscribable[name]; (!ok || r < min) && e != "*" {
+			refused = append(refused, e)
+			continue
+		}
+		if c.subs.events == nil {
+			c.subs.events = make(map[string]bool)
+		}
+		c.subs.events[e] = true
+	}
+	if c.subs.stop == nil && len(c.subs.events) > 0 {
+		ch, stop := listen()
+		done := make(chan struct{})
+		c.subs.stop = func() {
+			stop()
+			close(done)
+		}
+		go c.pushEvents(ch, done)
+	}
+	return
+}
+
+// unsubscribe removes events from c's subscriptions, or all of them if
+// events is empty.
+func (c *client) unsubscribe(events []string) {
+	c.subs.Lock()
+	defer c.subs.Unlock()
+	for _, e := range events {
+		delete(c.subs.events, e)
+	}
+	if len(events) == 0 || len(c.subs.events) == 0 {
+		c.subs.events = nil
+		if c.subs.stop != nil {
+			c.subs.stop()
+			c.subs.stop = nil
+		}
+	}
+}
+
+// subscribed returns the events c subscribed to, sorted.
+func (c *client) subscribed() (events []string) {
+	c.subs.Lock()
+	defer c.subs.Unlock()
+	for e := range c.subs.events {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+	return
+}
+
+// mayWatch reports whether u may see ev, wherever it is pushed: the role
+// its event needs, and for jobs their owner.
+func mayWatch(u *user, ev serverEvent) bool {
+	min, ok := subscribable[ev.Event]
+	if !ok || u.role() < min {
+		return false
+	}
+	return ev.Event != "job.done" || u.key != nil && strings.EqualFold(ev.Data["owner"], u.Name)
+}
+
+// wants reports whether c subscribed to ev and may see it.
+func (c *client) wants(ev serverEvent) bool {
+	if !mayWatch(&c.user, ev) {
+		return false
+	}
+	room := ev.Data["room"]
+	if room != "" && !c.inRoom(room) && c.user.role() < roleAdmin {
+		return false
+	}
+	c.subs.Lock()
+	defer c.subs.Unlock()
+	return c.subs.events["*"] || c.subs.events[ev.Event] || (room != "" && c.subs.events[ev.Event+"#"+room])
+}
+
+// pushEvents sends the events from ch that c wants until done is closed.
+func (c *client) pushEvents(ch chan serverEvent, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case ev := <-ch:
+			if !c.wants(ev) {
+				continue
+			}
+			p := Event{Event: ev.Event, Time: ev.Time.Format(time.RFC3339), Extra: ev.Data}
+			if c.sendOn(chanEvent, p.packet()) != nil {
+				return
+			}
+		}
+	}
+}
+
+// eventList splits the comma separated Events of a packet.
+func eventList(p packet) (events []string) {
+	for _, e := range strings.Split(p.Data["Events"], ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			events = append(events, e)
+		}
+	}
+	return
+}
+
+// sendSubscribed tells the page what c is subscribed to.
+func (c *client) sendSubscribed(refused []string) error {
+	p := Subscribed{Events: strings.Join(c.subscribed(), ","), Refused: strings.Join(refused, ",")}
+	return c.sendOn(chanCtl, p.packet())
+}
+
+func init() {
+	packetMap["subscribe"] = func(c *client, p packet) error {
+		return c.sendSubscribed(c.subscribe(eventList(p)))
+	}
+	packetMap["unsubscribe"] = func(c *client, p packet) error {
+		c.unsubscribe(eventList(p))
+		return c.sendSubscribed(nil)
+	}
+}
@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Privilege elevation. Commands marked Sudo, like ban, only run if the user
+typed their password in the last few minutes, so a session left open can't be
+used to do damage. sudo asks for the password and elevates the session for
+sudoTimeout; sudo <command> does so and runs the command, and running a Sudo
+command on a session that isn't elevated asks for the password first. sudo -k
+ends the elevation early. Wrong passwords count as failed logins.
+*/
+
+//
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const sudoTimeout = 5 * time.Minute
+
+// elevated reports whether c typed its password recently.
+func (c *client) elevated() bool {
+	return time.Now().Before(c.sudoUntil)
+}
+
+// elevate asks c for its password and elevates the session if it's right.
+func (c *client) elevate() (bool, error) {
+	if c.user.key == nil {
+		return false, c.appendMsg("#msg-list", c.trf("%s: you must be logged in", "sudo"))
+	}
+	pass, e := c.promptSecure("#msg-txt", c.trf("[sudo] password for %s", c.user.Name))
+	if e != nil {
+		return false, e
+	}
+	if !c.passwordOK(pass) {
+		securityLoginFailed(c.address, c.user.Name)
+		return false, c.appendMsg("#msg-list", "sudo: wrong password")
+	}
+	c.sudoUntil = time.Now().Add(sudoTimeout)
+	return true, nil
+}
+
+// checkSudo asks for the password before running Sudo commands on sessions
+// that aren't elevated.
+func checkSudo(next Handler) Handler {
+	return func(c *client, args []string) error {
+		cmd, ok := lookupCommand(strings.ToLower(args[0]))
+		if !ok {
+			return next(c, args)
+		}
+		if cmd, _ = cmd.find(args); cmd.Sudo && !c.elevated() {
+			if ok, e := c.elevate(); !ok {
+				return e
+			}
+		}
+		return next(c, args)
+	}
+}
+
+func init() {
+	Use(checkSudo)
+	cmdMap["sudo"] = command{
+		Desc:     "Confirms your password so commands that need it can run for a few minutes, or runs one command.",
+		Usage:    "sudo [-k | <command>]",
+		Examples: []string{"sudo", "sudo ban spammer 7d", "sudo -k"},
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) == 2 && args[1] == "-k" {
+				c.sudoUntil = time.Time{}
+				return c.appendMsg("#msg-list", "sudo: elevation ended")
+			}
+			if !c.elevated() {
+				if ok, e := c.elevate(); !ok {
+					return e
+				}
+			}
+			if len(args) == 1 {
+				return c.appendMsg("#msg-list", c.trf("sudo: elevated for %s", sudoTimeout))
+			}
+			return c.dispatch(joinArgs(args[1:]))
+		},
+		Complete: func(c *client, words []string) []string {
+			if len(words) != 2 {
+				return nil
+			}
+			var names []string
+			for name, cmd := range commandList() {
+				if cmd.Sudo && c.user.role() >= cmd.Role {
+					names = append(names, name)
+				}
+			}
+			return names
+		},
+	}
+}
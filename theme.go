@@ -0,0 +1,119 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Themes change the look of the terminal. Besides the built-in color themes a
+user can add a snippet of custom CSS. theme save stores both in the account so
+they're applied automatically on every login.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	themes    = []string{"dark", "light"}
+	cssMax    = 4096
+	cssUnsafe = regexp.MustCompile(`(?i)@import|url\s*\(|expression\s*\(|behavior\s*:|-moz-binding`)
+)
+
+// isTheme reports whether name is a built-in theme.
+func isTheme(name string) bool {
+	for _, t := range themes {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCSS rejects custom CSS that is too long or could load remote content.
+func checkCSS(css string) error {
+	if len(css) > cssMax {
+		return errors.New("custom CSS is limited to 4KB")
+	}
+	if cssUnsafe.MatchString(css) {
+		return errors.New("custom CSS can't use @import, url() or other remote content")
+	}
+	return nil
+}
+
+// setCSS applies a custom CSS snippet to the client, replacing any earlier
+// one. An empty snippet removes it.
+func (c *client) setCSS(css string) (e error) {
+	if e = c.send(UserCSS{Value: css}.packet()); e == nil {
+		c.css = css
+	}
+	return
+}
+
+// applyTheme applies the theme saved in c's account, if any. It is called on
+// login.
+func applyTheme(c *client) {
+	if c.user.Theme != "" && isTheme(c.user.Theme) {
+		c.setTheme(c.user.Theme)
+	}
+	if c.user.CSS != "" && checkCSS(c.user.CSS) == nil {
+		c.setCSS(c.user.CSS)
+	}
+}
+
+func init() {
+	cmdMap["theme"] = command{
+		Desc:     "Switches theme or adds custom CSS; theme save keeps them in your account.",
+		Usage:    "theme <" + strings.Join(themes, "|") + "> | theme css <rules> | theme save | theme reset",
+		Examples: []string{"theme light", "theme css #msg-list { font-size: 120% }"},
+		Category: "Account",
+		Handler: func(c *client, args []string) (e error) {
+			switch {
+			case len(args) == 1:
+				current := c.theme
+				if current == "" {
+					current = "default"
+				}
+				return c.appendMsg("#msg-list", "Theme: "+current+", available: "+strings.Join(themes, " "))
+			case len(args) == 2 && isTheme(args[1]):
+				return c.setTheme(args[1])
+			case len(args) > 2 && args[1] == "css":
+				css := strings.Join(args[2:], " ")
+				if err := checkCSS(css); err != nil {
+					return c.appendMsg("#msg-list", "theme: "+err.Error())
+				}
+				return c.setCSS(css)
+			case len(args) == 2 && (args[1] == "save" || args[1] == "reset"):
+				if c.user.key == nil {
+					return c.appendMsg("#msg-list", "You must be logged in to save a theme")
+				}
+				if args[1] == "reset" {
+					if e = c.setTheme(themes[0]); e != nil {
+						return
+					}
+					if e = c.setCSS(""); e != nil {
+						return
+					}
+				}
+				c.user.Theme, c.user.CSS = c.theme, c.css
+				if e = c.user.commit(); e != nil {
+					return
+				}
+				if args[1] == "reset" {
+					return c.appendMsg("#msg-list", "Theme reset")
+				}
+				return c.appendMsg("#msg-list", "Theme saved")
+			}
+			return c.appendMsg("#msg-list", "Usage: theme <"+strings.Join(themes, "|")+"> | theme css <rules> | theme save | theme reset")
+		},
+		Complete: func(c *client, words []string) []string {
+			if len(words) != 2 {
+				return nil
+			}
+			return append([]string{"css", "save", "reset"}, themes...)
+		},
+	}
+}
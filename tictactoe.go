@@ -0,0 +1,84 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// tictactoeLines are the winning rows, columns and diagonals.
+var tictactoeLines = [][3]int{
+	{0, 1, 2}, {3, 4, 5}, {6, 7, 8},
+	{0, 3, 6}, {1, 4, 7}, {2, 5, 8},
+	{0, 4, 8}, {2, 4, 6},
+}
+
+// tictactoe is the classic two player game. Squares are numbered 1-9.
+type tictactoe struct {
+	cells [9]int // 0 empty, 1 X, 2 O
+	moves int
+}
+
+func (t *tictactoe) start(n int) {
+	*t = tictactoe{}
+}
+
+func (t *tictactoe) move(player int, arg string) error {
+	n, e := strconv.Atoi(strings.TrimSpace(arg))
+	if e != nil || n < 1 || n > 9 {
+		return errors.New("pick a square from 1 to 9")
+	}
+	if t.cells[n-1] != 0 {
+		return errors.New("that square is taken")
+	}
+	t.cells[n-1] = player + 1
+	t.moves++
+	return nil
+}
+
+func (t *tictactoe) board(names []string) string {
+	marks := " XO"
+	var rows []string
+	for r := 0; r < 3; r++ {
+		var cols []string
+		for col := 0; col < 3; col++ {
+			i := r*3 + col
+			if t.cells[i] == 0 {
+				cols = append(cols, strconv.Itoa(i+1))
+			} else {
+				cols = append(cols, string(marks[t.cells[i]]))
+			}
+		}
+		rows = append(rows, " "+strings.Join(cols, " | "))
+	}
+	legend := ""
+	for i, name := range names {
+		legend += "\n" + string(marks[i+1]) + ": " + name
+	}
+	return strings.Join(rows, "\n---+---+---\n") + "\n" + legend
+}
+
+func (t *tictactoe) result(names []string) (bool, string) {
+	for _, l := range tictactoeLines {
+		if p := t.cells[l[0]]; p != 0 && p == t.cells[l[1]] && p == t.cells[l[2]] {
+			return true, names[p-1] + " wins!"
+		}
+	}
+	if t.moves == 9 {
+		return true, "it's a draw"
+	}
+	return false, ""
+}
+
+func init() {
+	gameKinds["tictactoe"] = gameKind{
+		desc: "three in a row (2 players)",
+		min:  2, max: 2,
+		new: func() gameRules { return &tictactoe{} },
+	}
+}
@@ -0,0 +1,438 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Login tokens. After login the page is sent a "session" packet holding a token
+it keeps and presents in its hello packet when it reconnects, which logs it
+back in without asking for the password again.
+
+A token holds the user's name, when it expires and the user's file key, sealed
+with AES-GCM under a key only the server knows, work/session.key, so it can't
+be read or forged (see seal; password reset uses it too). The server also
+keeps every token it issued, without the file key, in work/sessions.json; a
+token it no longer has is refused, so tokens are revoked by forgetting them:
+logout, sessions revoke and banning the user do so. Tokens last -session-ttl.
+
+An account may be logged in from any number of clients at once. sessions
+lists the ones connected, by the id of their connection, and the tokens of
+browsers not connected; sessions revoke takes either id, forgets the token
+and disconnects the clients using it.
+
+Resuming a session doesn't elevate it, sudo still asks for the password.
+*/
+
+//
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sessionTTL = flag.Duration("session-ttl", 30*24*time.Hour, "how long a login token lets a browser log back in")
+
+var errBadSession = errors.New("invalid or expired session")
+
+// loginSession is a login token issued to a browser.
+type loginSession struct {
+	Id      string
+	User    string
+	Created time.Time
+	Expires time.Time
+	Address string // where it was issued
+	Agent   string // User-Agent of the browser it was issued to
+}
+
+// sessionClaims are what a token holds.
+type sessionClaims struct {
+	Id      string
+	User    string
+	Expires int64
+	Key     []byte
+}
+
+var sessions = struct {
+	sync.Mutex
+	list map[string]*loginSession // Id -> session
+	aead cipher.AEAD
+}{list: make(map[string]*loginSession)}
+
+// sessionsPath is the file issued sessions are persisted in.
+func sessionsPath() string {
+	return *work + SEP + "sessions.json"
+}
+
+// sessionKeyPath is the file of the key tokens are sealed with.
+func sessionKeyPath() string {
+	return *work + SEP + "session.key"
+}
+
+// saveSessions writes the sessions to disk. Callers must hold the lock.
+func saveSessions() error {
+	var list []*loginSession
+	for _, s := range sessions.list {
+		list = append(list, s)
+	}
+	return saveJSON(list, sessionsPath())
+}
+
+// loadSessions reads the sealing key, making one on first run, and the
+// sessions still valid. It is called once from main.
+func loadSessions() {
+	key, e := ioutil.ReadFile(sessionKeyPath())
+	if os.IsNotExist(e) {
+		key = make([]byte, 32)
+		if _, e = rand.Read(key); e == nil {
+			e = ioutil.WriteFile(sessionKeyPath(), key, 0600)
+		}
+	}
+	if e == nil && len(key) != 32 {
+		e = errors.New(sessionKeyPath() + ": not a 32 byte key")
+	}
+	if e != nil {
+		log.Println(e, "- login tokens disabled")
+		return
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	var list []*loginSession
+	if e := loadJSON(&list, sessionsPath()); e != nil && !os.IsNotExist(e) {
+		log.Println(e)
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	sessions.aead = aead
+	for _, s := range list {
+		if time.Now().Before(s.Expires) {
+			sessions.list[s.Id] = s
+		}
+	}
+}
+
+// seal encrypts b with the server's key so only unseal can read it.
+func seal(b []byte) ([]byte, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sessions.aead == nil {
+		return nil, errors.New("no server key")
+	}
+	nonce := make([]byte, sessions.aead.NonceSize())
+	if _, e := rand.Read(nonce); e != nil {
+		return nil, e
+	}
+	return sessions.aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// unseal returns what b, returned by seal, holds.
+func unseal(b []byte) ([]byte, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sessions.aead == nil {
+		return nil, errors.New("no server key")
+	}
+	n := sessions.aead.NonceSize()
+	if len(b) < n {
+		return nil, errors.New("sealed data too short")
+	}
+	return sessions.aead.Open(nil, b[:n], b[n:], nil)
+}
+
+// issueSession returns a new token logging c's user back in.
+func issueSession(c *client) (string, *loginSession, error) {
+	now := time.Now()
+	s := &loginSession{Id: randomToken(8), User: c.user.Name, Created: now, Expires: now.Add(*sessionTTL),
+		Address: hostOf(c.address), Agent: c.sess.agent}
+	b, _ := json.Marshal(sessionClaims{Id: s.Id, User: s.User, Expires: s.Expires.Unix(), Key: c.user.key})
+	b, e := seal(b)
+	if e != nil {
+		return "", nil, e
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	sessions.Lock()
+	defer sessions.Unlock()
+	for id, old := range sessions.list {
+		if !now.Before(old.Expires) {
+			delete(sessions.list, id)
+		}
+	}
+	sessions.list[s.Id] = s
+	return token, s, saveSessions()
+}
+
+// openSession returns the session of token and the file key it holds, or
+// errBadSession if it isn't one the server issued, expired or was revoked.
+func openSession(token string) (*loginSession, []byte, error) {
+	b, e := base64.RawURLEncoding.DecodeString(token)
+	if e == nil {
+		b, e = unseal(b)
+	}
+	var cl sessionClaims
+	if e != nil || json.Unmarshal(b, &cl) != nil {
+		return nil, nil, errBadSession
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, ok := sessions.list[cl.Id]
+	if !ok || s.User != cl.User || !time.Now().Before(s.Expires) || time.Now().Unix() >= cl.Expires {
+		return nil, nil, errBadSession
+	}
+	return s, cl.Key, nil
+}
+
+// revokeSession forgets the session id, reporting whether there was one.
+func revokeSession(id string) bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if _, ok := sessions.list[id]; !ok {
+		return false
+	}
+	delete(sessions.list, id)
+	if e := saveSessions(); e != nil {
+		log.Println(e)
+	}
+	return true
+}
+
+// revokeSessions forgets the sessions of user, except keep, returning how
+// many there were.
+func revokeSessions(name, keep string) int {
+	sessions.Lock()
+	defer sessions.Unlock()
+	n := 0
+	for id, s := range sessions.list {
+		if id != keep && strings.EqualFold(s.User, name) {
+			delete(sessions.list, id)
+			n++
+		}
+	}
+	if n > 0 {
+		if e := saveSessions(); e != nil {
+			log.Println(e)
+		}
+	}
+	return n
+}
+
+// userSessions returns the sessions of user, oldest first.
+func userSessions(name string) (list []*loginSession) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	for _, s := range sessions.list {
+		if strings.EqualFold(s.User, name) && time.Now().Before(s.Expires) {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return
+}
+
+// startSession sends c, just logged in, a token to log back in with. Pages
+// older than protocol version 6 can't keep one and aren't sent any.
+func (c *client) startSession() error {
+	if c.protocol() < 6 {
+		return nil
+	}
+	token, s, e := issueSession(c)
+	if e != nil {
+		log.Println(e)
+		return nil
+	}
+	c.sessionID = s.Id
+	return c.sendOn(chanCtl, Session{Token: token, Expires: s.Expires.UTC().Format(time.RFC3339)}.packet())
+}
+
+// resumeSession logs c in with the token it presented in its hello packet;
+// a token that's no good is refused and the page told to forget it.
+func (c *client) resumeSession(token string) error {
+	s, key, e := openSession(token)
+	if e == nil && (userBanned(s.User) || isBanned(c.address)) {
+		e = errBadSession
+	}
+	if e == nil {
+		var u user
+		if e = u.loadKey(s.User, key); e == nil {
+			c.become(u)
+			c.sessionID = s.Id
+			if e := c.appendMsg("#msg-list", c.trf("Welcome back, %s", c.user.Name)); e != nil {
+				return e
+			}
+			return c.loggedIn()
+		}
+		log.Println(c.address, "resuming session of", s.User+":", e)
+	}
+	if e := c.sendOn(chanCtl, Session{}.packet()); e != nil {
+		return e
+	}
+	return c.fail(codeSession, "", "Your session has expired, please log in again")
+}
+
+// logout ends c's login, revoking its token.
+func (c *client) logout() error {
+	if c.sessionID != "" {
+		revokeSession(c.sessionID)
+		c.sessionID = ""
+	}
+	c.sudoUntil = time.Time{}
+	if c.protocol() >= 6 {
+		if e := c.sendOn(chanCtl, Session{}.packet()); e != nil {
+			return e
+		}
+	}
+	if e := c.becomeGuest(); e != nil {
+		return e
+	}
+	return c.appendMsg("#msg-list", "Logged out")
+}
+
+// userClients returns the clients logged in as c's user, oldest first.
+func userClients(c *client) []*client {
+	cs := clientsByName(c.user.Name)
+	sort.Slice(cs, func(i, j int) bool { return cs[i].sess.connected.Before(cs[j].sess.connected) })
+	return cs
+}
+
+// listSessions shows c the clients logged in as its user, then the browsers
+// that may log back in with a token but aren't connected.
+func listSessions(c *client) error {
+	loc := c.user.location()
+	rows := [][]string{{"Id", c.tr("Since"), c.tr("Status"), c.tr("Address"), c.tr("Browser")}}
+	used := make(map[string]bool)
+	for _, o := range userClients(c) {
+		id, agent := o.sess.id, o.sess.agent
+		if o == c {
+			id += " *"
+		}
+		if o.apiKeyID != "" {
+			agent = c.tr("API key") + " " + o.apiKeyID
+		}
+		if len(agent) > 40 {
+			agent = agent[:40] + "..."
+		}
+		used[o.sessionID] = true
+		rows = append(rows, []string{id, o.sess.connected.In(loc).Format("2006-01-02 15:04"),
+			c.trf("online, idle %s", o.sess.idle().Truncate(time.Second)), hostOf(o.address), agent})
+	}
+	for _, s := range userSessions(c.user.Name) {
+		if used[s.Id] {
+			continue
+		}
+		agent := s.Agent
+		if len(agent) > 40 {
+			agent = agent[:40] + "..."
+		}
+		rows = append(rows, []string{s.Id, s.Created.In(loc).Format("2006-01-02 15:04"),
+			c.trf("saved login until %s", s.Expires.In(loc).Format("2006-01-02")), s.Address, agent})
+	}
+	if len(rows) == 1 {
+		return c.appendMsg("#msg-list", "No sessions")
+	}
+	return c.appendPre("#msg-list", formatTable(rows, true))
+}
+
+// dropSessions disconnects the clients other than c logged in with the
+// session id, or all other clients of c's user if id is empty.
+func dropSessions(c *client, id string) {
+	for _, o := range userClients(c) {
+		if o != c && (id == "" || o.sessionID == id) {
+			o.disconnect("Your session was revoked")
+		}
+	}
+}
+
+// revokeID logs out the other client of c's user with the connection id, or
+// the browser with the token id, reporting whether there was one.
+func revokeID(c *client, id string) bool {
+	for _, o := range userClients(c) {
+		if o != c && o.sess.id == id {
+			if o.sessionID != "" {
+				revokeSession(o.sessionID)
+			}
+			o.disconnect("Your session was revoked")
+			return true
+		}
+	}
+	for _, s := range userSessions(c.user.Name) {
+		if s.Id == id {
+			revokeSession(s.Id)
+			dropSessions(c, s.Id)
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	cmdMap["logout"] = command{
+		Desc:     "Logs you out and forgets this browser's login.",
+		Usage:    "logout",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			return c.logout()
+		},
+	}
+	cmdMap["sessions"] = command{
+		Desc:     "Lists the clients logged in to your account, marking this one with *, and the browsers that stay logged in.",
+		Usage:    "sessions",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) == 1 {
+				return listSessions(c)
+			}
+			return c.usage("sessions", commandNamed("sessions"))
+		},
+		Sub: map[string]command{
+			"revoke": {
+				Desc:     "Logs a client or browser out, disconnecting it, or all but this one.",
+				Usage:    "sessions revoke <id|all>",
+				Examples: []string{"sessions revoke all"},
+				Handler: func(c *client, args []string) error {
+					if len(args) != 3 {
+						return c.usage("sessions", commandNamed("sessions"))
+					}
+					if args[2] == "all" {
+						n := revokeSessions(c.user.Name, c.sessionID)
+						for _, o := range userClients(c) {
+							if o != c && o.sessionID == "" {
+								n++
+							}
+						}
+						dropSessions(c, "")
+						return c.appendMsg("#msg-list", c.trf("Revoked %d sessions", n))
+					}
+					if args[2] == c.sess.id || args[2] == c.sessionID {
+						return c.logout()
+					}
+					if !revokeID(c, args[2]) {
+						return c.appendMsg("#msg-list", c.trf("No such session: %s", args[2]))
+					}
+					return c.appendMsg("#msg-list", c.trf("Revoked %d sessions", 1))
+				},
+				Complete: func(c *client, words []string) []string {
+					var ids []string
+					for _, o := range userClients(c) {
+						ids = append(ids, o.sess.id)
+					}
+					for _, s := range userSessions(c.user.Name) {
+						ids = append(ids, s.Id)
+					}
+					return append(ids, "all")
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,194 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Two-factor authentication with time-based one-time passwords (RFC 6238), as
+made by authenticator apps. 2fa enable makes a secret, shows it as an otpauth
+QR code to scan and turns 2FA on once a code from the app is typed back; login
+then asks for a code after the password, unless the browser is trusted (see
+device.go). A code is accepted for the 30 second step it belongs to and the
+steps either side, once. Turning 2FA on logs the account's other clients and
+browsers out and forgets its trusted browsers.
+
+The secret is kept in the user file, encrypted with the rest of the account.
+Logging back in with a token (see token.go) doesn't ask for a code, the token
+was issued after one. Basic auth to the HTTP API has no room for a code, so
+accounts with 2FA use it with API keys (see apikey.go).
+*/
+
+//
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1 // steps either side accepted
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random secret, base32 encoded as apps expect.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, e := rand.Read(b); e != nil {
+		return "", e
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode returns the code of secret for the step counter.
+func totpCode(secret string, counter int64) string {
+	key, e := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if e != nil {
+		return ""
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// totpURI returns the otpauth URI apps scan to add the secret of u.
+func totpURI(u *user, secret string) string {
+	label := url.PathEscape("soshell:" + u.Name)
+	v := url.Values{"secret": {secret}, "issuer": {"soshell"}, "digits": {fmt.Sprint(totpDigits)},
+		"period": {fmt.Sprint(int(totpStep.Seconds()))}}
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// totpCheck returns the step matching code for secret, or 0 if none after
+// last, the step of the last code accepted, does.
+func totpCheck(secret, code string, last int64) int64 {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0
+	}
+	now := time.Now().Unix() / int64(totpStep.Seconds())
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step > last && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+// checkTOTP asks c for a code of u, which has 2FA on, reporting whether it
+// was right. A used code can't be used again.
+func (c *client) checkTOTP(u *user) (bool, error) {
+	code, e := c.promptAs("Enter the code from your authenticator app", "numeric")
+	if e != nil {
+		return false, e
+	}
+	step := totpCheck(u.TOTP, code, u.TOTPStep)
+	if step == 0 {
+		return false, nil
+	}
+	u.TOTPStep = step
+	return true, u.commit()
+}
+
+func init() {
+	cmdMap["2fa"] = command{
+		Desc:     "Shows whether two-factor authentication is on for your account.",
+		Usage:    "2fa",
+		Category: "Account",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) error {
+			if len(args) > 1 {
+				return c.usage("2fa", commandNamed("2fa"))
+			}
+			if c.user.TOTP != "" {
+				return c.appendMsg("#msg-list", "Two-factor authentication is on")
+			}
+			return c.appendMsg("#msg-list", "Two-factor authentication is off")
+		},
+		Sub: map[string]command{
+			"enable": {
+				Desc:  "Turns on two-factor authentication with an authenticator app.",
+				Usage: "2fa enable",
+				Sudo:  true,
+				Handler: func(c *client, args []string) error {
+					if c.user.TOTP != "" {
+						return c.appendMsg("#msg-list", "Two-factor authentication is already on")
+					}
+					secret, e := newTOTPSecret()
+					if e != nil {
+						return e
+					}
+					src, e := qrDataURI(totpURI(&c.user, secret))
+					if e != nil {
+						return e
+					}
+					e = c.offRecord(func() error {
+						if e := c.appendMsg("#msg-list", "Scan this code with your authenticator app, or enter the key below:"); e != nil {
+							return e
+						}
+						if e := c.appendImage("#msg-list", src, "otpauth QR code"); e != nil {
+							return e
+						}
+						return c.appendPre("#msg-list", secret)
+					})
+					if e != nil {
+						return e
+					}
+					u := c.user
+					u.TOTP = secret
+					ok, e := c.checkTOTP(&u)
+					if e != nil || !ok {
+						if e == nil {
+							e = c.appendMsg("#msg-list", "Wrong code, two-factor authentication stays off")
+						}
+						return e
+					}
+					c.user = u
+					// Nothing logged in without a code may stay logged in.
+					revokeDevices(c.user.Name, "")
+					revokeSessions(c.user.Name, c.sessionID)
+					dropSessions(c, "")
+					return c.appendMsg("#msg-list", "Two-factor authentication is on")
+				},
+			},
+			"disable": {
+				Desc:  "Turns off two-factor authentication.",
+				Usage: "2fa disable",
+				Sudo:  true,
+				Handler: func(c *client, args []string) error {
+					if c.user.TOTP == "" {
+						return c.appendMsg("#msg-list", "Two-factor authentication is off")
+					}
+					ok, e := c.checkTOTP(&c.user)
+					if e != nil {
+						return e
+					}
+					if !ok {
+						securityLoginFailed(c.address, c.user.Name)
+						return c.appendMsg("#msg-list", "Wrong code")
+					}
+					c.user.TOTP, c.user.TOTPStep = "", 0
+					if e := c.user.commit(); e != nil {
+						return e
+					}
+					revokeDevices(c.user.Name, "")
+					return c.appendMsg("#msg-list", "Two-factor authentication is off")
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The tour is a short guided introduction run on a visitor's first connection
+(the client remembers in localStorage that it has been shown) and any time
+later with the tour command.
+*/
+
+//
+package main
+
+import (
+	"strings"
+)
+
+var tourSteps = []wizardStep{
+	{Text: "Welcome! soshell is a chat server you use by typing commands into the box below. Press enter to continue"},
+	{Text: "A few commands to try: help lists everything, calc 2^10 does math, remind me in 5m to ... sets a reminder " +
+		"and weather <place> shows the forecast. Press enter to continue"},
+	{Text: "An account keeps your files, reminders and settings. Create one now?", Choices: []string{"no", "yes"},
+		Run: func(c *client, answer string) error {
+			if answer == "no" {
+				return nil
+			}
+			if c.user.key != nil {
+				return c.appendMsg("#msg-list", "You're already logged in as "+c.user.Name)
+			}
+			for {
+				name, e := c.prompt("Pick a user name (letters, digits and _)")
+				if e != nil {
+					return e
+				}
+				name = strings.TrimSpace(name)
+				switch {
+				case name == "" || !isName(name):
+					c.appendMsg("#msg-list", "Invalid characters in name")
+				case userExists(name):
+					c.appendMsg("#msg-list", "That name is taken")
+				default:
+					return c.run(commandNamed("register"), []string{"register", name})
+				}
+			}
+		}},
+	{Text: "Pick a color theme", Choices: []string{"dark", "light"},
+		Run: func(c *client, answer string) error {
+			return c.setTheme(answer)
+		}},
+	{Text: "That's it! Type tour to see this again. Press enter to finish"},
+}
+
+// runTour runs the tour for c.
+func runTour(c *client) error {
+	_, e := runWizard(c, tourSteps)
+	return e
+}
+
+func init() {
+	cmdMap["tour"] = command{
+		Desc:     "Runs the guided introduction again.",
+		Usage:    "tour",
+		Category: "Shell",
+		Handler: func(c *client, args []string) error {
+			return runTour(c)
+		},
+	}
+	// Sent by the client on its first ever connection.
+	packetMap["firstVisit"] = func(c *client, p packet) error {
+		return runTour(c)
+	}
+}
@@ -0,0 +1,162 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The translate system translates text through a pluggable translateProvider.
+Calls to the upstream API are rate limited both per client and overall since
+most providers meter usage.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	translateName = flag.String("translate", "libre", "translation provider (libre or deepl)")
+	translateURL  = flag.String("translate-url", "https://libretranslate.com", "LibreTranslate server URL")
+	translateKey  = flag.String("translate-key", "", "translation provider API key")
+	translateUser = newRateLimiter(10, time.Minute)
+	translateAll  = newRateLimiter(60, time.Minute)
+)
+
+// translateLangs are the target language codes accepted by translate.
+var translateLangs = map[string]bool{
+	"ar": true, "bg": true, "cs": true, "da": true, "de": true, "el": true,
+	"en": true, "es": true, "et": true, "fi": true, "fr": true, "hu": true,
+	"id": true, "it": true, "ja": true, "ko": true, "lt": true, "lv": true,
+	"nb": true, "nl": true, "pl": true, "pt": true, "ro": true, "ru": true,
+	"sk": true, "sl": true, "sv": true, "tr": true, "uk": true, "zh": true,
+}
+
+// translateProvider is implemented by each upstream translation API. It
+// returns the translated text and the detected source language.
+type translateProvider interface {
+	translate(text, target string) (string, string, error)
+}
+
+// translateProviders maps provider names to their constructors.
+var translateProviders = map[string]func(key string) translateProvider{
+	"libre": func(key string) translateProvider { return libreProvider{*translateURL, key} },
+	"deepl": func(key string) translateProvider { return deeplProvider{key} },
+}
+
+// libreProvider uses a LibreTranslate server.
+type libreProvider struct {
+	url, key string
+}
+
+func (p libreProvider) translate(text, target string) (s, src string, e error) {
+	body := map[string]string{"q": text, "source": "auto", "target": target, "format": "text"}
+	if p.key != "" {
+		body["api_key"] = p.key
+	}
+	var r struct {
+		TranslatedText   string
+		DetectedLanguage struct{ Language string }
+	}
+	if e = postJSON(strings.TrimRight(p.url, "/")+"/translate", body, &r); e == nil {
+		s, src = r.TranslatedText, r.DetectedLanguage.Language
+	}
+	return
+}
+
+// deeplProvider uses the DeepL API. Free plan keys end in ":fx" and use a
+// different host.
+type deeplProvider struct {
+	key string
+}
+
+func (p deeplProvider) translate(text, target string) (s, src string, e error) {
+	if p.key == "" {
+		return "", "", errors.New("no API key configured")
+	}
+	host := "https://api.deepl.com"
+	if strings.HasSuffix(p.key, ":fx") {
+		host = "https://api-free.deepl.com"
+	}
+	form := url.Values{"text": {text}, "target_lang": {strings.ToUpper(target)}}
+	req, e := http.NewRequest("POST", host+"/v2/translate", strings.NewReader(form.Encode()))
+	if e != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+p.key)
+	var r struct {
+		Translations []struct {
+			Detected_source_language, Text string
+		}
+	}
+	if e = doJSON(req, &r); e != nil {
+		return
+	}
+	if len(r.Translations) == 0 {
+		return "", "", errors.New("empty response")
+	}
+	return r.Translations[0].Text, strings.ToLower(r.Translations[0].Detected_source_language), nil
+}
+
+// translateText translates text to target for client c, enforcing limits.
+func translateText(c *client, text, target string) (string, string, error) {
+	key := hostOf(c.address)
+	if c.user.key != nil {
+		key = strings.ToLower(c.user.Name)
+	}
+	if !translateUser.allow(key) || !translateAll.allow("") {
+		return "", "", errors.New("rate limit reached, try again later")
+	}
+	newProvider, ok := translateProviders[*translateName]
+	if !ok {
+		return "", "", errors.New("unknown translation provider: " + *translateName)
+	}
+	return newProvider(*translateKey).translate(text, target)
+}
+
+func init() {
+	cmdMap["translate"] = command{
+		Desc:     "Translates text, or sets the language to translate to by default.",
+		Usage:    "translate [lang] <text> | translate default <lang>",
+		Examples: []string{"translate de good morning", "translate default es"},
+		Category: "Tools",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: translate [lang] <text> or translate default <lang>")
+			}
+			if strings.ToLower(args[1]) == "default" {
+				if len(args) != 3 || !translateLangs[strings.ToLower(args[2])] {
+					return c.appendMsg("#msg-list", "Usage: translate default <lang>")
+				}
+				c.user.Lang = strings.ToLower(args[2])
+				if e = c.user.commit(); e != nil {
+					return
+				}
+				return c.appendMsg("#msg-list", "Default translation language set to "+c.user.Lang)
+			}
+			target, text := c.user.Lang, args[1:]
+			if translateLangs[strings.ToLower(args[1])] && len(args) > 2 {
+				target, text = strings.ToLower(args[1]), args[2:]
+			}
+			if target == "" {
+				target = "en"
+			}
+			s, src, err := translateText(c, strings.Join(text, " "), target)
+			if err != nil {
+				return c.appendMsg("#msg-list", "translate: "+err.Error())
+			}
+			if src != "" {
+				s = "[" + src + " -> " + target + "] " + s
+			}
+			return c.appendMsg("#msg-list", s)
+		},
+		Background: true,
+		PerMinute:  10,
+	}
+}
@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Typing indicators. While the user types something to say the page sends a
+"typing" packet with the first word of the line, and the others in the room
+are shown "alice is typing…" for a few seconds, see DomMap["typing"] in
+scripts.js. Lines that are commands, answers to prompts and lines typed in no
+room aren't announced. However often the page sends it, the room is told at
+most every typingEvery; saying the line takes the indicator down.
+*/
+
+//
+package main
+
+import (
+	"time"
+)
+
+const typingEvery = 3 * time.Second
+
+// typing tells the others in c's room that c is typing, or stopped when
+// stopped is set.
+func (c *client) typing(room string, stopped bool) {
+	for _, oc := range roomClients(room) {
+		if oc == c || oc.currentRoom() != room || (oc.user.key != nil && oc.user.Name == c.user.Name) {
+			continue
+		}
+		p := Typing{User: c.user.Name}
+		if !stopped {
+			p.Text = oc.trf("%s is typing…", c.user.Name)
+		}
+		oc.sendOn(chanChat, p.packet())
+	}
+}
+
+// stopTyping takes c's typing indicator down, if it put one up.
+func (c *client) stopTyping(room string) {
+	if c.typingAt.IsZero() {
+		return
+	}
+	c.typingAt = time.Time{}
+	c.typing(room, true)
+}
+
+func init() {
+	packetMap["typing"] = func(c *client, p packet) error {
+		c.rmu.Lock()
+		prompted := len(c.waiting) > 0
+		c.rmu.Unlock()
+		if prompted || !c.isChat(p.Data["Word"]) || time.Since(c.typingAt) < typingEvery {
+			return nil
+		}
+		room := c.currentRoom()
+		if _, muted := findMute(c.user.Name, room); muted {
+			return nil
+		}
+		c.typingAt = time.Now()
+		c.typing(room, false)
+		return nil
+	}
+}
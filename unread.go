@@ -0,0 +1,62 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Unread counts. The read markers of history.go record, per user and room, the
+last message the user has seen: a message said in a room is read by the
+clients talking in it, and a room is read up to its end when the user joins
+it or switches to it. Clients in a room but talking in another one are sent
+an "unread" packet with the room's count as messages arrive, and the page
+shows the rooms with unread messages above the input; rooms lists the counts
+too. Guests have no markers.
+*/
+
+//
+package main
+
+// unreadCount returns the number of messages of room name hasn't read.
+func unreadCount(name, room string) int {
+	if n := lastId(roomKey(room)) - lastRead(name, room); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// readRoom marks room read by c's user up to its latest message, and tells
+// the user's clients.
+func (c *client) readRoom(room string) {
+	if c.user.key == nil || room == "" {
+		return
+	}
+	if id := lastId(roomKey(room)); id > 0 {
+		markRead(c.user.Name, room, id)
+	}
+	for _, oc := range clientsByName(c.user.Name) {
+		oc.sendOn(chanChat, Unread{Room: room}.packet())
+	}
+}
+
+// noteUnread sends the clients of logged in users in room, but talking in
+// another one, its unread count.
+func noteUnread(room string) {
+	for _, c := range roomClients(room) {
+		if c.user.key != nil && c.currentRoom() != room {
+			c.sendOn(chanChat, Unread{Room: room, Count: unreadCount(c.user.Name, room)}.packet())
+		}
+	}
+}
+
+// showUnread sends c the unread counts of the rooms it is in, when it logs
+// in.
+func (c *client) showUnread() {
+	if c.user.key == nil {
+		return
+	}
+	current := c.currentRoom()
+	for _, room := range c.joinedRooms() {
+		if n := unreadCount(c.user.Name, room); room != current && n > 0 {
+			c.sendOn(chanChat, Unread{Room: room, Count: n}.packet())
+		}
+	}
+}
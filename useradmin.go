@@ -0,0 +1,347 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+User management for admins, so the user store doesn't have to be looked at on
+the server. user list walks the users directory for accounts, user info shows
+what the server knows of one, user disable keeps it from logging in until
+user enable, and user reset-password gives it a new, random password the admin
+passes on.
+
+A user file is encrypted with its owner's password, so what info shows comes
+from the server's own records: the email address from the recovery file (see
+reset.go), the history from lastlog.go and so on. Resetting a password needs
+the recovery file too, so it only works while password reset is on. A
+disabled account has a "disabled" file next to its user file; it counts as
+banned (see ban.go) everywhere a ban is checked.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// disabled is what the "disabled" file of an account holds.
+type disabled struct {
+	By     string
+	At     time.Time
+	Reason string `json:",omitempty"`
+}
+
+// disabledPath is the file that disables the account name.
+func disabledPath(name string) string {
+	return userDir(name) + SEP + "disabled"
+}
+
+// accountDisabled returns why the account name is disabled, nil if it isn't.
+func accountDisabled(name string) *disabled {
+	if !isName(name) || name == "" {
+		return nil
+	}
+	var d disabled
+	if e := loadJSON(&d, disabledPath(name)); e != nil {
+		if !os.IsNotExist(e) {
+			log.Println(e)
+		}
+		return nil
+	}
+	return &d
+}
+
+// accountNames returns the names of the registered accounts, sorted. Names
+// are kept lower case in index paths, so that's how they come back.
+func accountNames() ([]string, error) {
+	root := filepath.Clean(*users)
+	var names []string
+	e := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			// Only single character directories are index branches.
+			if p != root && len(fi.Name()) != 1 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Name() != "user" {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err == nil && rel != "." {
+			names = append(names, strings.Replace(rel, SEP, "", -1))
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, e
+}
+
+// accountStatus returns what keeps the account name out, if anything, and
+// whether it is online.
+func accountStatus(c *client, name string) string {
+	var status []string
+	if d := accountDisabled(name); d != nil {
+		status = append(status, c.tr("disabled"))
+	} else if userBanned(name) {
+		status = append(status, c.tr("banned"))
+	}
+	if n := len(clientsByName(name)); n > 0 {
+		status = append(status, c.trf("online (%d)", n))
+	}
+	return strings.Join(status, ", ")
+}
+
+// listAccounts shows c, an admin, the registered accounts.
+func listAccounts(c *client) error {
+	names, e := accountNames()
+	if e != nil {
+		return e
+	}
+	if len(names) == 0 {
+		return c.appendMsg("#msg-list", "No accounts")
+	}
+	loc := c.user.location()
+	rows := [][]string{{c.tr("User"), c.tr("Role"), c.tr("Last login"), c.tr("Status")}}
+	for _, name := range names {
+		last := ""
+		if h, ok := loginHistoryOf(name); ok {
+			for i := len(h.Logins) - 1; i >= 0; i-- {
+				if !h.Logins[i].Failed {
+					last = h.Logins[i].Time.In(loc).Format("2006-01-02 15:04")
+					break
+				}
+			}
+		}
+		rows = append(rows, []string{name, userRole(name).String(), last, accountStatus(c, name)})
+	}
+	lines := strings.Split(formatTable(rows, true), "\n")
+	lines = append(lines, c.trf("%d accounts", len(names)))
+	return c.pageLines(lines, false)
+}
+
+// accountInfo shows c, an admin, what the server knows of the account name.
+func accountInfo(c *client, name string) error {
+	if !userExists(name) {
+		return c.appendMsg("#msg-list", c.trf("No such user: %s", name))
+	}
+	loc := c.user.location()
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.In(loc).Format("2006-01-02 15:04")
+	}
+	email := "-"
+	if r, e := loadRecovery(name); e == nil {
+		email = r.Email
+	}
+	var lastLogin, lastSeen time.Time
+	logins, failed := 0, 0
+	if h, ok := loginHistoryOf(name); ok {
+		lastSeen = h.LastSeen
+		for _, r := range h.Logins {
+			if r.Failed {
+				failed++
+			} else {
+				logins++
+				lastLogin = r.Time
+			}
+		}
+	}
+	_, used := storageUsage(name)
+	p, _ := loadProfile(name)
+	rows := [][]string{
+		{c.tr("User"), name},
+		{c.tr("Display name"), p.Display},
+		{c.tr("Email"), email},
+		{c.tr("Role"), userRole(name).String()},
+		{c.tr("Status"), accountStatus(c, name)},
+		{c.tr("Last login"), format(lastLogin)},
+		{c.tr("Last seen"), format(lastSeen)},
+		{c.tr("Logins"), c.trf("%d, %d failed", logins, failed)},
+		{c.tr("Sessions"), strconv.Itoa(len(userSessions(name)))},
+		{c.tr("API keys"), strconv.Itoa(len(userAPIKeys(name)))},
+		{c.tr("Storage"), formatSize(used) + " / " + formatSize(*quota)},
+	}
+	if d := accountDisabled(name); d != nil {
+		why := c.trf("by %s on %s", d.By, format(d.At))
+		if d.Reason != "" {
+			why += ": " + d.Reason
+		}
+		rows = append(rows, []string{c.tr("Disabled"), why})
+	}
+	return c.appendPre("#msg-list", formatTable(rows, false))
+}
+
+// disableAccount disables the account name, logging it out everywhere.
+func disableAccount(c *client, name, reason string) (int, error) {
+	d := disabled{By: c.user.Name, At: time.Now(), Reason: reason}
+	if e := saveJSON(d, disabledPath(name)); e != nil {
+		return 0, e
+	}
+	msg := "Your account was disabled by " + c.user.Name
+	if reason != "" {
+		msg += ": " + reason
+	}
+	n := kickClients(&ban{Target: name, User: true}, msg)
+	revokeSessions(name, "")
+	revokeDevices(name, "")
+	log.Println(c.user.Name, "disabled the account", name, reason)
+	emit("user.disabled", map[string]string{"user": name, "by": c.user.Name, "reason": reason})
+	return n, nil
+}
+
+// resetAccountPassword gives the account name a new random password, which
+// it returns, with the file key from its recovery file.
+func resetAccountPassword(name string) (string, error) {
+	r, e := loadRecovery(name)
+	if e != nil {
+		return "", e
+	}
+	var u user
+	if e := u.loadKey(name, r.Key); e != nil {
+		return "", e
+	}
+	pass := randomToken(8)
+	if e := u.setPassword(pass); e != nil {
+		return "", e
+	}
+	return pass, nil
+}
+
+// accountArg returns the account named by args[2], telling c if there's no
+// such account or c may not manage it.
+func accountArg(c *client, args []string, cmd string) (string, bool) {
+	if len(args) < 3 {
+		c.usage("user", commandNamed("user"))
+		return "", false
+	}
+	name := args[2]
+	switch {
+	case !userExists(name):
+		c.appendMsg("#msg-list", c.trf("No such user: %s", name))
+	case strings.EqualFold(name, c.user.Name):
+		c.appendMsg("#msg-list", c.trf("%s: use your own account's commands", cmd))
+	case userRole(name) > c.user.role():
+		c.fail(codeForbidden, "", c.trf("%s: permission denied", cmd))
+	default:
+		return strings.ToLower(name), true
+	}
+	return "", false
+}
+
+// completeAccounts completes the names of the registered accounts.
+func completeAccounts(c *client, words []string) []string {
+	if len(words) != 3 {
+		return nil
+	}
+	names, _ := accountNames()
+	return names
+}
+
+func init() {
+	cmdMap["user"] = command{
+		Desc:     "Manages the registered accounts.",
+		Usage:    "user",
+		Category: "Admin",
+		Role:     roleAdmin,
+		Sub: map[string]command{
+			"list": {
+				Desc:  "Lists the registered accounts, their role, last login and status.",
+				Usage: "user list",
+				Handler: func(c *client, args []string) error {
+					return listAccounts(c)
+				},
+			},
+			"info": {
+				Desc:  "Shows what the server knows of an account.",
+				Usage: "user info <name>",
+				Handler: func(c *client, args []string) error {
+					if len(args) != 3 {
+						return c.usage("user", commandNamed("user"))
+					}
+					return accountInfo(c, args[2])
+				},
+				Complete: completeAccounts,
+			},
+			"disable": {
+				Desc:     "Keeps an account from logging in, logging it out everywhere.",
+				Usage:    "user disable <name> [reason]",
+				Examples: []string{"user disable spammer posting ads"},
+				Sudo:     true,
+				Handler: func(c *client, args []string) error {
+					name, ok := accountArg(c, args, "user disable")
+					if !ok {
+						return nil
+					}
+					if accountDisabled(name) != nil {
+						return c.appendMsg("#msg-list", c.trf("%s is already disabled", name))
+					}
+					n, e := disableAccount(c, name, strings.Join(args[3:], " "))
+					if e != nil {
+						return e
+					}
+					return c.appendMsg("#msg-list", c.trf("Disabled %s, %d sessions disconnected", name, n))
+				},
+				Complete: completeAccounts,
+			},
+			"enable": {
+				Desc:  "Lets a disabled account log in again.",
+				Usage: "user enable <name>",
+				Sudo:  true,
+				Handler: func(c *client, args []string) error {
+					name, ok := accountArg(c, args, "user enable")
+					if !ok {
+						return nil
+					}
+					if accountDisabled(name) == nil {
+						return c.appendMsg("#msg-list", c.trf("%s is not disabled", name))
+					}
+					if e := os.Remove(disabledPath(name)); e != nil {
+						return e
+					}
+					log.Println(c.user.Name, "enabled the account", name)
+					emit("user.enabled", map[string]string{"user": name, "by": c.user.Name})
+					return c.appendMsg("#msg-list", c.trf("Enabled %s", name))
+				},
+				Complete: completeAccounts,
+			},
+			"reset-password": {
+				Desc:  "Sets a random password on an account, logging it out everywhere, and shows it to you to pass on.",
+				Usage: "user reset-password <name>",
+				Sudo:  true,
+				Handler: func(c *client, args []string) error {
+					name, ok := accountArg(c, args, "user reset-password")
+					if !ok {
+						return nil
+					}
+					pass, e := resetAccountPassword(name)
+					if os.IsNotExist(e) {
+						return c.appendMsg("#msg-list", c.trf("%s can't be reset: password reset is off or it has no email address", name))
+					}
+					if e != nil {
+						log.Println("resetting password of", name+":", e)
+						return c.appendMsg("#msg-list", "Password reset failed")
+					}
+					kickClients(&ban{Target: name, User: true}, "Your password was reset")
+					log.Println(c.user.Name, "reset the password of", name)
+					emit("user.reset", map[string]string{"user": name, "by": c.user.Name})
+					return c.offRecord(func() error {
+						return c.appendMsg("#msg-list", c.trf("New password of %s: %s", name, pass))
+					})
+				},
+				Complete: completeAccounts,
+			},
+		},
+	}
+}
@@ -7,13 +7,30 @@ package main
 
 import (
 	//"errors"
+	"flag"
 	"log"
 	//"os"
 	"regexp"
+	"strings"
+	"time"
 )
 
+var admins = flag.String("admins", "", "comma separated names of admin users")
+
 type user struct {
 	Email, Name string
+	Lang        string // default translation target language
+	Locale      string // language of the user interface
+	Theme, CSS  string // saved theme and custom CSS snippet
+	TZ          string // IANA time zone name, e.g. Europe/Oslo
+	Prompt      string `json:",omitempty"` // prompt format, see prefs.go
+	Notify      string `json:",omitempty"` // how notifications are shown, "" for browser
+	Aliases     map[string]string
+	Rooms       []string `json:",omitempty"` // rooms joined, see rooms.go
+	Macros      map[string][]string
+	TOTP        string `json:",omitempty"` // two-factor secret, see totp.go
+	TOTPStep    int64  `json:",omitempty"` // step of the last code used
+	key         []byte // file key kept after login so changes can be saved
 }
 
 // isEmail makes she that email is properly formated as an email address.
@@ -28,10 +45,66 @@ func isName(name string) bool {
 	return !nameReg.MatchString(name)
 }
 
+// userExists reports whether a registered account named name exists.
+func userExists(name string) bool {
+	return len(name) > 0 && isName(name) && pathExists(userDir(name)+SEP+"user")
+}
+
+// isAdmin reports whether u is logged in as an admin, one of the -admins or
+// granted the role (see roles.go).
+func isAdmin(u *user) bool {
+	return u.role() == roleAdmin
+}
+
+// flagAdmin reports whether name is one of the -admins.
+func flagAdmin(name string) bool {
+	for _, admin := range strings.Split(*admins, ",") {
+		if strings.EqualFold(strings.TrimSpace(admin), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// location returns the user's time zone, defaulting to the server's.
+func (u *user) location() *time.Location {
+	if u.TZ != "" {
+		if loc, err := time.LoadLocation(u.TZ); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
 // load is used to load a users info from json stored in an encrypted file.
+// Passwords hashed the old way, or not as configured, are re-hashed, see
+// passwd.go.
 func (u *user) load(name, pass string) error {
-	path := *users + SEP + indexPath([]byte(name))
-	return loadObject(u, path+SEP+"user", pass)
+	key, stale, err := passwordKey(name, pass)
+	if err == nil {
+		err = u.loadKey(name, key)
+	}
+	if err == nil && stale {
+		if e := u.setPassword(pass); e != nil {
+			log.Println("re-hashing password of", name+":", e)
+		}
+	} else if err == nil && pathExists(recoveryPath(name)) != keepsRecovery(u) {
+		// Accounts from before password reset, or since it was turned on
+		// or off, see reset.go.
+		if e := saveRecovery(u); e != nil {
+			log.Println(e)
+		}
+	}
+	return err
+}
+
+// loadKey is load with the file key instead of the password, see token.go.
+func (u *user) loadKey(name string, key []byte) error {
+	err := loadObjectKey(u, userDir(name)+SEP+"user", key)
+	if err == nil {
+		u.key = key
+	}
+	return err
 }
 
 // save will save a users info as json in an encrypted file.
@@ -44,7 +117,17 @@ func (u *user) save(name, pass string) error {
 			return err
 		}
 	}
-	return saveObject(u, path+SEP+"user", pass)
+	u.key = nil
+	return u.setPassword(pass)
+}
+
+// commit re-saves a logged in user's info using the key from load or save.
+// Guests have no key and commit does nothing for them.
+func (u *user) commit() error {
+	if u.key == nil {
+		return nil
+	}
+	return saveObjectKey(u, userDir(u.Name)+SEP+"user", u.key)
 }
 
 func init() {
@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Input validation. Everything the page sends is checked before it gets to a
+handler:
+
+	frames      at most -max-frame bytes; a larger one drops the connection
+	lines       typed lines at most lineMax bytes and argsMax words
+	packets     a Type known on the packet's channel, at most fieldsMax Data
+	            fields of short names, and no Selector, which pages never send
+
+Input that fails isn't run but answered with an error packet, see fail.go.
+Malformed and unknown packets also count towards the malformed packets
+security rule, see security.go.
+*/
+
+//
+package main
+
+import (
+	"flag"
+	"strconv"
+)
+
+const (
+	lineMax   = 4 << 10
+	argsMax   = 256
+	fieldsMax = 32
+	nameMax   = 64 // of packet types and Data keys
+)
+
+var maxFrame = flag.Int64("max-frame", 256<<10, "largest websocket message accepted from a client, in bytes")
+
+// inputError is input from the page that failed validation.
+type inputError struct {
+	code, msg  string
+	suspicious bool // counts towards the malformed packets rule
+}
+
+func (e *inputError) Error() string {
+	return e.code + ": " + e.msg
+}
+
+// validatePacket checks a packet from the page.
+func validatePacket(p packet) *inputError {
+	switch {
+	case p.Type == "" || len(p.Type) > nameMax:
+		return &inputError{codeMalformed, "packet without a valid Type", true}
+	case len(p.Data) > fieldsMax:
+		return &inputError{codeTooMany, p.Type + " packet with more than " + strconv.Itoa(fieldsMax) + " fields", true}
+	}
+	for k := range p.Data {
+		if len(k) > nameMax {
+			return &inputError{codeMalformed, p.Type + " packet with a field name too long", true}
+		}
+	}
+	// Clients never send selectors, one is an attempt to inject into pages.
+	if _, ok := p.Data["Selector"]; ok {
+		return &inputError{codeSelector, "selector in " + p.Type + " packet", true}
+	}
+	switch p.Chan {
+	case chanTerm, chanCtl:
+		if _, ok := packetMap[p.Type]; !ok {
+			return &inputError{codeUnknown, "unknown packet type " + p.Type, true}
+		}
+	default:
+		if _, ok := channelMap[p.Chan]; !ok {
+			return &inputError{codeChannel, "unknown channel " + p.Chan, true}
+		}
+	}
+	return nil
+}
+
+// validateLine checks a typed line.
+func (c *client) validateLine(line string) *inputError {
+	if len(line) > lineMax {
+		return &inputError{codeLineLong, c.trf("Lines can be at most %d bytes long", lineMax), false}
+	}
+	return nil
+}
+
+// validateArgs checks the words of a command line.
+func (c *client) validateArgs(args []string) *inputError {
+	if len(args) > argsMax {
+		return &inputError{codeArgs, c.trf("Commands take at most %d words", argsMax), false}
+	}
+	return nil
+}
+
+// reject answers input that failed validation, from the packet with Id
+// request if it was one, with an error packet.
+func (c *client) reject(err *inputError, request string) error {
+	if err.suspicious {
+		securitySuspicious(c.address, err.msg)
+	}
+	return c.fail(err.code, request, err.msg)
+}
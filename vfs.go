@@ -0,0 +1,187 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The virtual filesystem gives each registered user a private home directory
+stored inside their index path (users/<index>/files). Paths given by users are
+always resolved relative to their home so they can't escape it, and everything
+a user stores under their index path counts against their quota.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var quota = flag.Int64("quota", 10<<20, "per-user storage quota in bytes")
+
+var errQuota = errors.New("quota exceeded")
+
+// userDir returns the index directory of user name.
+func userDir(name string) string {
+	return *users + SEP + indexPath([]byte(name))
+}
+
+// homeDir returns the virtual filesystem root of user name.
+func homeDir(name string) string {
+	return userDir(name) + SEP + "files"
+}
+
+// vfsPath resolves p, relative to the user's home, to a real path. The
+// cleaned virtual path (always starting with /) is returned as well.
+func vfsPath(name, p string) (real, virtual string) {
+	virtual = path.Clean("/" + p)
+	return homeDir(name) + filepath.FromSlash(virtual), virtual
+}
+
+// dirSize returns the total size of the files below p.
+func dirSize(p string) (n int64) {
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// storageUsage returns the bytes used by each of a user's stores. Single
+// character directories are other users' index branches and are skipped.
+func storageUsage(name string) (usage map[string]int64, total int64) {
+	usage = make(map[string]int64)
+	dir := userDir(name)
+	infos, _ := ioutil.ReadDir(dir)
+	for _, fi := range infos {
+		if fi.IsDir() && len(fi.Name()) == 1 {
+			continue
+		}
+		n := fi.Size()
+		if fi.IsDir() {
+			n = dirSize(dir + SEP + fi.Name())
+		}
+		usage[fi.Name()] = n
+		total += n
+	}
+	return
+}
+
+// checkQuota returns errQuota if storing extra more bytes for user name
+// would exceed the quota.
+func checkQuota(name string, extra int64) error {
+	if _, used := storageUsage(name); used+extra > *quota {
+		return errQuota
+	}
+	return nil
+}
+
+// writeVFile writes data to a file in user name's virtual filesystem,
+// creating parent directories and enforcing the quota.
+func writeVFile(name, p string, data []byte) error {
+	real, virtual := vfsPath(name, p)
+	if virtual == "/" {
+		return errors.New("not a file")
+	}
+	var old int64
+	if fi, err := os.Stat(real); err == nil {
+		if fi.IsDir() {
+			return errors.New(virtual + " is a directory")
+		}
+		old = fi.Size()
+	}
+	if err := checkQuota(name, int64(len(data))-old); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(real), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(real, data, 0600)
+}
+
+// readVFile reads a file from user name's virtual filesystem.
+func readVFile(name, p string) ([]byte, error) {
+	real, virtual := vfsPath(name, p)
+	b, e := ioutil.ReadFile(real)
+	if os.IsNotExist(e) {
+		e = errors.New(virtual + ": no such file")
+	}
+	return b, e
+}
+
+func init() {
+	cmdMap["df"] = command{
+		Desc:     "Shows how much of your storage quota is used.",
+		Usage:    "df",
+		Category: "Files",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			usage, total := storageUsage(c.user.Name)
+			var names []string
+			for k := range usage {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			rows := [][]string{{"Store", "Used"}}
+			for _, k := range names {
+				rows = append(rows, []string{k, formatSize(usage[k])})
+			}
+			free := *quota - total
+			if free < 0 {
+				free = 0
+			}
+			pct := "0%"
+			if *quota > 0 {
+				pct = formatPercent(float64(total) / float64(*quota))
+			}
+			rows = append(rows, []string{"", ""},
+				[]string{"total", formatSize(total) + " of " + formatSize(*quota) + " (" + pct + "), " + formatSize(free) + " free"})
+			return c.appendPre("#msg-list", formatTable(rows, true))
+		},
+	}
+	cmdMap["du"] = command{
+		Desc:     "Shows the disk usage of files and directories in your home.",
+		Usage:    "du [path]",
+		Category: "Files",
+		Role:     roleUser,
+		Handler: func(c *client, args []string) (e error) {
+			p := "/"
+			if len(args) > 1 {
+				p = args[1]
+			}
+			real, virtual := vfsPath(c.user.Name, p)
+			fi, err := os.Stat(real)
+			if err != nil {
+				if virtual == "/" {
+					return c.appendPre("#msg-list", "0 B  /")
+				}
+				return c.appendMsg("#msg-list", "du: "+virtual+": no such file or directory")
+			}
+			if !fi.IsDir() {
+				return c.appendPre("#msg-list", formatSize(fi.Size())+"  "+virtual)
+			}
+			infos, _ := ioutil.ReadDir(real)
+			var rows [][]string
+			for _, fi := range infos {
+				n := fi.Size()
+				name := path.Join(virtual, fi.Name())
+				if fi.IsDir() {
+					n = dirSize(real + SEP + fi.Name())
+					name += "/"
+				}
+				rows = append(rows, []string{formatSize(n), name})
+			}
+			rows = append(rows, []string{formatSize(dirSize(real)), strings.TrimSuffix(virtual, "/") + "/ (total)"})
+			return c.appendPre("#msg-list", formatTable(rows, false))
+		},
+		Background: true,
+	}
+}
@@ -0,0 +1,193 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The weather system looks up current conditions for a location through a
+pluggable weatherProvider. Results are cached per location for a short time
+so repeated lookups don't hit the upstream API.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	weatherName = flag.String("weather", "metno", "weather provider (metno or owm)")
+	weatherKey  = flag.String("weather-key", "", "weather provider API key")
+	weatherTTL  = 10 * time.Minute
+	weatherMu   sync.Mutex
+	weatherMap  = make(map[string]weatherCache)
+)
+
+// weather holds the current conditions of a location.
+type weather struct {
+	Location, Summary                 string
+	Temp, Feels, Humidity, Wind, Pres float64
+}
+
+// weatherProvider is implemented by each upstream weather API.
+type weatherProvider interface {
+	current(location string) (weather, error)
+}
+
+type weatherCache struct {
+	w       weather
+	expires time.Time
+}
+
+// weatherProviders maps provider names to their constructors.
+var weatherProviders = map[string]func(key string) weatherProvider{
+	"owm":   func(key string) weatherProvider { return owmProvider{key} },
+	"metno": func(key string) weatherProvider { return metnoProvider{} },
+}
+
+// owmProvider uses the OpenWeatherMap current weather API.
+type owmProvider struct {
+	key string
+}
+
+func (p owmProvider) current(location string) (w weather, e error) {
+	if p.key == "" {
+		return w, errors.New("no API key configured")
+	}
+	var r struct {
+		Name string
+		Sys  struct{ Country string }
+		Main struct {
+			Temp, Feels_like, Humidity, Pressure float64
+		}
+		Wind    struct{ Speed float64 }
+		Weather []struct{ Description string }
+	}
+	u := "https://api.openweathermap.org/data/2.5/weather?units=metric&q=" +
+		url.QueryEscape(location) + "&appid=" + url.QueryEscape(p.key)
+	if e = getJSON(u, &r); e != nil {
+		return
+	}
+	w.Location = r.Name
+	if r.Sys.Country != "" {
+		w.Location += ", " + r.Sys.Country
+	}
+	if len(r.Weather) > 0 {
+		w.Summary = r.Weather[0].Description
+	}
+	w.Temp, w.Feels, w.Humidity, w.Pres = r.Main.Temp, r.Main.Feels_like, r.Main.Humidity, r.Main.Pressure
+	w.Wind = r.Wind.Speed
+	return
+}
+
+// metnoProvider uses the Norwegian Meteorological Institute's free forecast
+// API, geocoding the location through OpenStreetMap's nominatim first.
+type metnoProvider struct{}
+
+func (p metnoProvider) current(location string) (w weather, e error) {
+	var places []struct {
+		Lat, Lon, Display_name string
+	}
+	u := "https://nominatim.openstreetmap.org/search?format=json&limit=1&q=" + url.QueryEscape(location)
+	if e = getJSON(u, &places); e != nil {
+		return
+	}
+	if len(places) == 0 {
+		return w, errors.New("location not found")
+	}
+	var r struct {
+		Properties struct {
+			Timeseries []struct {
+				Data struct {
+					Instant struct {
+						Details struct {
+							Air_temperature, Relative_humidity, Wind_speed, Air_pressure_at_sea_level float64
+						}
+					}
+					Next_1_hours struct {
+						Summary struct{ Symbol_code string }
+					}
+				}
+			}
+		}
+	}
+	u = "https://api.met.no/weatherapi/locationforecast/2.0/compact?lat=" + places[0].Lat + "&lon=" + places[0].Lon
+	if e = getJSON(u, &r); e != nil {
+		return
+	}
+	if len(r.Properties.Timeseries) == 0 {
+		return w, errors.New("no forecast data")
+	}
+	d := r.Properties.Timeseries[0].Data
+	det := d.Instant.Details
+	w.Location = places[0].Display_name
+	w.Summary = strings.Split(d.Next_1_hours.Summary.Symbol_code, "_")[0]
+	w.Temp, w.Feels, w.Humidity = det.Air_temperature, det.Air_temperature, det.Relative_humidity
+	w.Wind, w.Pres = det.Wind_speed, det.Air_pressure_at_sea_level
+	return
+}
+
+// getWeather returns the current weather for location using the configured
+// provider, serving from the cache when a fresh entry exists.
+func getWeather(location string) (w weather, e error) {
+	key := strings.ToLower(strings.TrimSpace(location))
+	weatherMu.Lock()
+	cached, ok := weatherMap[key]
+	weatherMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.w, nil
+	}
+	newProvider, ok := weatherProviders[*weatherName]
+	if !ok {
+		return w, errors.New("unknown weather provider: " + *weatherName)
+	}
+	w, e = newProvider(*weatherKey).current(location)
+	if e == nil {
+		now := time.Now()
+		weatherMu.Lock()
+		for k, c := range weatherMap {
+			if !now.Before(c.expires) {
+				delete(weatherMap, k)
+			}
+		}
+		weatherMap[key] = weatherCache{w: w, expires: now.Add(weatherTTL)}
+		weatherMu.Unlock()
+	}
+	return
+}
+
+func init() {
+	cmdMap["weather"] = command{
+		Desc:     "Shows the current weather conditions for a location.",
+		Usage:    "weather <location>",
+		Examples: []string{"weather berlin", "weather 52.52,13.40"},
+		Category: "Tools",
+		Handler: func(c *client, args []string) (e error) {
+			if len(args) < 2 {
+				return c.appendMsg("#msg-list", "Usage: weather <location>")
+			}
+			w, err := getWeather(strings.Join(args[1:], " "))
+			if err != nil {
+				return c.appendMsg("#msg-list", "weather: "+err.Error())
+			}
+			rows := [][]string{
+				{"Location", w.Location},
+				{"Conditions", w.Summary},
+				{"Temperature", fmt.Sprintf("%.1f°C (%.1f°F)", w.Temp, w.Temp*9/5+32)},
+				{"Feels like", fmt.Sprintf("%.1f°C", w.Feels)},
+				{"Humidity", fmt.Sprintf("%.0f%%", w.Humidity)},
+				{"Wind", fmt.Sprintf("%.1f m/s", w.Wind)},
+				{"Pressure", fmt.Sprintf("%.0f hPa", w.Pres)},
+			}
+			return c.appendPre("#msg-list", formatTable(rows, false))
+		},
+		Background: true,
+		PerMinute:  6,
+	}
+}
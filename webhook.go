@@ -0,0 +1,181 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The webhook system delivers server events (user.registered, user.login,
+room.message, ...) to outgoing webhooks configured in a JSON file:
+
+	[{"URL": "https://example.com/hook", "Secret": "s3cret",
+	  "Events": ["user.registered", "room.message#lobby"]}]
+
+An event name may be suffixed with #room to only match events in that room.
+Payloads are JSON signed with HMAC-SHA256 of the secret in the
+X-Soshell-Signature header. Failed deliveries are retried with backoff and
+every attempt is recorded in the delivery log in the work directory.
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	webhooksFile = flag.String("webhooks", "", "outgoing webhooks config file (JSON)")
+	webhookTries = 4
+	webhookList  []webhook
+	webhookLog   = struct {
+		sync.Mutex
+		file *os.File
+	}{}
+	listeners = struct {
+		sync.Mutex
+		list map[chan serverEvent]bool
+	}{list: make(map[chan serverEvent]bool)}
+)
+
+// serverEvent is an event passed to in-process listeners.
+type serverEvent struct {
+	Event string
+	Time  time.Time
+	Data  map[string]string
+}
+
+// listen returns a channel receiving every emitted event until the returned
+// function is called. Events are dropped when the channel is full.
+func listen() (chan serverEvent, func()) {
+	ch := make(chan serverEvent, 64)
+	listeners.Lock()
+	listeners.list[ch] = true
+	listeners.Unlock()
+	return ch, func() {
+		listeners.Lock()
+		delete(listeners.list, ch)
+		listeners.Unlock()
+	}
+}
+
+// webhook is an outgoing webhook subscription.
+type webhook struct {
+	URL, Secret string
+	Events      []string
+}
+
+// matches reports whether the webhook subscribes to event in room.
+func (w webhook) matches(event, room string) bool {
+	for _, e := range w.Events {
+		if e == event || e == "*" || (room != "" && e == event+"#"+room) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadWebhooks reads the webhooks config and opens the delivery log. It is
+// called once from main.
+func loadWebhooks() {
+	if *webhooksFile == "" {
+		return
+	}
+	if e := loadJSON(&webhookList, *webhooksFile); e != nil {
+		log.Fatal(e)
+	}
+	f, e := os.OpenFile(*work+SEP+"webhooks.log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if e != nil {
+		log.Fatal(e)
+	}
+	webhookLog.file = f
+}
+
+// logDelivery records a delivery attempt.
+func logDelivery(url, event string, try int, status string) {
+	webhookLog.Lock()
+	defer webhookLog.Unlock()
+	if webhookLog.file != nil {
+		webhookLog.file.WriteString(time.Now().UTC().Format(time.RFC3339) + " " + event + " " + url +
+			" try " + strconv.Itoa(try) + ": " + status + "\n")
+	}
+}
+
+// emit fires event to every listener and to the webhooks subscribed to it.
+// data is sent along with the event name and time; data["room"] is used for
+// room filters.
+func emit(event string, data map[string]string) {
+	ev := serverEvent{event, time.Now().UTC(), data}
+	listeners.Lock()
+	for ch := range listeners.list {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	listeners.Unlock()
+	var targets []webhook
+	for _, w := range webhookList {
+		if w.matches(event, data["room"]) {
+			targets = append(targets, w)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	body, e := json.Marshal(map[string]interface{}{
+		"event": event,
+		"time":  time.Now().UTC().Format(time.RFC3339),
+		"data":  data,
+	})
+	if e != nil {
+		log.Println(e)
+		return
+	}
+	for _, w := range targets {
+		go deliverWebhook(w, event, body)
+	}
+}
+
+// deliverWebhook POSTs body to w, retrying with exponential backoff.
+func deliverWebhook(w webhook, event string, body []byte) {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	wait := time.Second
+	for try := 1; try <= webhookTries; try++ {
+		status := ""
+		req, e := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+		if e != nil {
+			logDelivery(w.URL, event, try, e.Error())
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "soshell/1.0 (https://"+*hostname+")")
+		req.Header.Set("X-Soshell-Event", event)
+		req.Header.Set("X-Soshell-Signature", sig)
+		res, e := httpClient.Do(req)
+		if e != nil {
+			status = e.Error()
+		} else {
+			res.Body.Close()
+			status = res.Status
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				logDelivery(w.URL, event, try, status)
+				return
+			}
+		}
+		logDelivery(w.URL, event, try, status)
+		time.Sleep(wait)
+		wait *= 4
+	}
+}
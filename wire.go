@@ -0,0 +1,35 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Wire formats. Packets go to the browser as JSON text frames unless it offers
+the soshell.msgpack websocket subprotocol, then they go as MessagePack binary
+frames, which are smaller and cheaper to decode when a page is busy with DOM
+updates. The format is picked in the handshake: the first of the browser's
+subprotocols that the server knows wins. Typed input and packets from the
+browser are text and JSON either way.
+
+The encoders are in the protocol package.
+*/
+
+//
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/jmptrader/soshell/protocol"
+)
+
+// negotiateWire returns the subprotocol to accept for r, empty if the
+// browser offered none the server knows.
+func negotiateWire(r *http.Request) string {
+	for _, proto := range websocket.Subprotocols(r) {
+		if proto == protocol.JSON || proto == protocol.Msgpack {
+			return proto
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The wizard framework runs a client through a fixed series of prompts. Each step
+shows some text, optionally restricts the answer to a set of choices (the
+first one is the default for an empty answer) and hands the answer to the
+step's Run function. Typing "skip" at any prompt ends the wizard.
+*/
+
+//
+package main
+
+import (
+	"strings"
+)
+
+// wizardStep is a single prompt of a wizard.
+type wizardStep struct {
+	Text    string
+	Choices []string
+	Run     func(c *client, answer string) error
+}
+
+// runWizard prompts c through steps. It returns false if the user skipped.
+func runWizard(c *client, steps []wizardStep) (bool, error) {
+	for _, step := range steps {
+		text := c.tr(step.Text)
+		if len(step.Choices) > 0 {
+			text += " [" + strings.Join(step.Choices, "/") + "]"
+		}
+		for {
+			answer, e := c.prompt(text + " " + c.tr("(or skip)"))
+			if e != nil {
+				return false, e
+			}
+			answer = strings.TrimSpace(answer)
+			if strings.EqualFold(answer, "skip") {
+				return false, c.appendMsg("#msg-list", "Skipped.")
+			}
+			if len(step.Choices) > 0 {
+				if answer == "" {
+					answer = step.Choices[0]
+				}
+				valid := false
+				for _, choice := range step.Choices {
+					if strings.EqualFold(answer, choice) {
+						answer, valid = choice, true
+					}
+				}
+				if !valid {
+					c.appendMsg("#msg-list", c.trf("Please answer one of: %s", strings.Join(step.Choices, ", ")))
+					continue
+				}
+			}
+			if step.Run != nil {
+				if e = step.Run(c, answer); e != nil {
+					return false, e
+				}
+			}
+			break
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,193 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Writing. send doesn't write to the websocket itself: it queues the encoded
+packet and a writer goroutine per connection writes the queue out, so
+handlers and broadcasts never wait on a slow connection. The queue holds at
+most outqMax messages. What happens to a client that can't keep up and fills
+it is set with -slow:
+
+	coalesce    packets setting state that only the latest of matters, an
+	            element's innerHTML, the command line, the theme, ..., replace
+	            earlier ones still queued for the same element; when the queue
+	            is still full, as drop
+	drop        the oldest message that can be lost without harm is dropped;
+	            important packets (see ack.go), control packets, queries and
+	            streams never are; when none can go, as disconnect
+	disconnect  the client is disconnected
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const outqMax = 256
+
+var (
+	slowPolicy = flag.String("slow", "coalesce", "what to do with clients that can't keep up with their output: coalesce, drop or disconnect")
+	errClosing = errors.New("connection closing")
+	errTooSlow = errors.New("too slow to keep up with output")
+)
+
+// coalesced are the packet types only the latest of which matters for an
+// element.
+var coalesced = map[string]bool{
+	"innerHTML":  true,
+	"inputValue": true,
+	"inputHint":  true,
+	"pager":      true,
+	"palette":    true,
+	"theme":      true,
+	"userCSS":    true,
+	"editable":   true,
+	"focus":      true,
+}
+
+// frame is a message waiting to be written.
+type frame struct {
+	typ       int
+	data      []byte
+	key       string // for coalescing, empty if it can't be
+	droppable bool
+}
+
+// writeQueue is a client's outgoing messages.
+type writeQueue struct {
+	sync.Mutex
+	frames  []frame
+	ready   chan struct{} // signalled when frames are queued
+	closing bool          // close the connection once the queue is empty
+	err     error         // why writing stopped
+}
+
+// newFrame returns the frame of message data of type typ holding v.
+func newFrame(typ int, data []byte, v interface{}) frame {
+	f := frame{typ: typ, data: data}
+	if p, ok := v.(packet); ok && p.Seq == "" && p.Id == "" && p.Chan != chanCtl {
+		f.droppable = true
+		if coalesced[p.Type] {
+			f.key = p.Type + "\x00" + p.Chan + "\x00" + p.Data["Selector"]
+		}
+	}
+	return f
+}
+
+// startWriter starts writing c's queue until done is closed or a write
+// fails.
+func (c *client) startWriter(done <-chan struct{}) {
+	c.wq.ready = make(chan struct{}, 1)
+	go c.writer(done)
+}
+
+// enqueue queues f to be written, applying -slow if the queue is full.
+func (c *client) enqueue(f frame) error {
+	q := &c.wq
+	q.Lock()
+	defer q.Unlock()
+	switch {
+	case q.err != nil:
+		return q.err
+	case q.closing:
+		return errClosing
+	}
+	if f.key != "" && *slowPolicy == "coalesce" {
+		for i := range q.frames {
+			if q.frames[i].key == f.key {
+				q.frames = append(q.frames[:i], q.frames[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(q.frames) >= outqMax && !q.drop() {
+		q.err = errTooSlow
+		q.frames = nil
+		log.Println(c.address, errTooSlow)
+		c.ws.Close()
+		return q.err
+	}
+	q.frames = append(q.frames, f)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// drop drops the oldest droppable frame, unless -slow says to disconnect,
+// and reports whether it did. Callers must hold q.
+func (q *writeQueue) drop() bool {
+	if *slowPolicy == "disconnect" {
+		return false
+	}
+	for i, f := range q.frames {
+		if f.droppable {
+			q.frames = append(q.frames[:i], q.frames[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// closeAfterWrite closes c's connection once everything queued is written.
+func (c *client) closeAfterWrite() {
+	q := &c.wq
+	q.Lock()
+	defer q.Unlock()
+	if q.ready == nil {
+		c.ws.Close()
+		return
+	}
+	q.closing = true
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// writer writes c's queue to the websocket.
+func (c *client) writer(done <-chan struct{}) {
+	q := &c.wq
+	for {
+		select {
+		case <-done:
+			return
+		case <-q.ready:
+		}
+		for {
+			q.Lock()
+			if len(q.frames) == 0 {
+				closing := q.closing
+				q.Unlock()
+				if closing {
+					c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+					c.ws.Close()
+					return
+				}
+				break
+			}
+			f := q.frames[0]
+			q.frames = q.frames[1:]
+			q.Unlock()
+			c.ws.EnableWriteCompression(c.compressMin > 0 && len(f.data) >= c.compressMin)
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if e := c.ws.WriteMessage(f.typ, f.data); e != nil {
+				q.Lock()
+				q.err, q.frames = e, nil
+				q.Unlock()
+				c.ws.Close()
+				return
+			}
+		}
+	}
+}